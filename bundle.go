@@ -0,0 +1,118 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// VersionMarker starts the migration of a version in a bundle, a single
+// stream of up migrations run with RunStream, e.g.
+//
+//	-- migrate:version 1
+//	CREATE TABLE users (id int);
+//	-- migrate:version 2
+//	ALTER TABLE users ADD COLUMN name text;
+//
+// The marker is a comment line of its own. Everything up to the next marker
+// is the migration of the version, the versions must increase.
+const VersionMarker = "migrate:version"
+
+// parseVersionMarker returns the version line marks, see VersionMarker.
+// ok is false if line isn't a marker.
+func parseVersionMarker(line string) (version uint, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "--") {
+		return 0, false, nil
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, "--"))
+	if len(fields) == 0 || fields[0] != VersionMarker {
+		return 0, false, nil
+	}
+	if len(fields) != 2 {
+		return 0, false, fmt.Errorf("invalid version marker %q", line)
+	}
+	v, err := strconv.ParseUint(fields[1], 10, 0)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid version marker %q", line)
+	}
+	return uint(v), true, nil
+}
+
+// splitBundle splits the bundle r into one up migration per version, see
+// VersionMarker. Only blank and comment lines may come before the first
+// marker.
+func splitBundle(r io.Reader) ([]*Migration, error) {
+	var (
+		migrations []*Migration
+		version    uint
+		body       bytes.Buffer
+	)
+	add := func() error {
+		migr, err := NewMigration(ioutil.NopCloser(bytes.NewReader(body.Bytes())), "", version, int(version))
+		if err != nil {
+			return err
+		}
+		migrations = append(migrations, migr)
+		body = bytes.Buffer{}
+		return nil
+	}
+
+	br := bufio.NewReader(r)
+	marked := false
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		v, ok, merr := parseVersionMarker(line)
+		switch {
+		case merr != nil:
+			return nil, fmt.Errorf("line %v: %v", lineNo, merr)
+		case ok:
+			if marked && v <= version {
+				return nil, fmt.Errorf("line %v: version %v doesn't follow %v", lineNo, v, version)
+			}
+			if marked {
+				if aerr := add(); aerr != nil {
+					return nil, aerr
+				}
+			}
+			version, marked = v, true
+		case marked:
+			body.WriteString(line)
+		default:
+			if trimmed := strings.TrimSpace(line); len(trimmed) > 0 && !strings.HasPrefix(trimmed, "--") {
+				return nil, fmt.Errorf("line %v: statement before the first version marker", lineNo)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	if marked {
+		if err := add(); err != nil {
+			return nil, err
+		}
+	}
+	return migrations, nil
+}
+
+// RunStream runs the bundle r, one up migration per version, like Run. The
+// version and, if the driver keeps one, the history are updated after each
+// migration, just like for migrations read from a source. See VersionMarker
+// for the format. The bundle is split before the first migration runs, so
+// a malformed bundle runs nothing.
+func (m *Migrate) RunStream(r io.Reader) error {
+	migrations, err := splitBundle(r)
+	if err != nil {
+		return err
+	}
+	return m.Run(migrations...)
+}
@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	dStub "github.com/golang-migrate/migrate/database/stub"
+)
+
+func TestParseVersionMarker(t *testing.T) {
+	testcases := []struct {
+		line    string
+		version uint
+		ok      bool
+		err     bool
+	}{
+		{"-- migrate:version 2\n", 2, true, false},
+		{"  --migrate:version 10", 10, true, false},
+		{"-- migrate:group tables\n", 0, false, false},
+		{"CREATE TABLE a (id int);\n", 0, false, false},
+		{"-- migrate:version\n", 0, false, true},
+		{"-- migrate:version two\n", 0, false, true},
+		{"-- migrate:version -1\n", 0, false, true},
+	}
+
+	for _, tc := range testcases {
+		version, ok, err := parseVersionMarker(tc.line)
+		if version != tc.version || ok != tc.ok || (err != nil) != tc.err {
+			t.Errorf("expected %v %v (error %v) for %q, got %v %v (%v)", tc.version, tc.ok, tc.err, tc.line, version, ok, err)
+		}
+	}
+}
+
+func TestSplitBundleInvalid(t *testing.T) {
+	bundles := []string{
+		"CREATE 1\n-- migrate:version 1\nCREATE 2\n",
+		"-- migrate:version 2\nCREATE 2\n-- migrate:version 1\nCREATE 1\n",
+		"-- migrate:version 1\nCREATE 1\n-- migrate:version 1\nCREATE 1\n",
+		"-- migrate:version x\nCREATE 1\n",
+	}
+	for _, bundle := range bundles {
+		if _, err := splitBundle(strings.NewReader(bundle)); err == nil {
+			t.Errorf("expected an error for %q", bundle)
+		}
+	}
+}
+
+func TestRunStream(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	dbDrv := &namedStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+
+	bundle := "-- built by the release tooling\n" +
+		"-- migrate:version 1\n" +
+		"CREATE 1\n" +
+		"-- migrate:version 3\n" +
+		"CREATE 3\n"
+	if err := m.RunStream(strings.NewReader(bundle)); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"CREATE 1\n", "CREATE 3\n"}; !reflect.DeepEqual(dbDrv.MigrationSequence, expected) {
+		t.Errorf("expected %q to run, got %q", expected, dbDrv.MigrationSequence)
+	}
+	if v, dirty, err := m.Version(); err != nil || v != 3 || dirty {
+		t.Errorf("expected clean version 3, got %v %v (%v)", v, dirty, err)
+	}
+	if expected := []string{"1 true ", "1 false ", "3 true ", "3 false "}; !reflect.DeepEqual(dbDrv.names, expected) {
+		t.Errorf("expected both versions to be recorded, got %q", dbDrv.names)
+	}
+
+	if err := m.RunStream(strings.NewReader("-- nothing to run\n")); err != ErrNoChange {
+		t.Errorf("expected ErrNoChange, got %v", err)
+	}
+}
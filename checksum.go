@@ -0,0 +1,111 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/golang-migrate/migrate/database"
+)
+
+// ErrChecksumsUnsupported is returned by VerifyChecksums if the database
+// driver doesn't implement database.VersionHistory and
+// database.ChecksumRecorder.
+var ErrChecksumsUnsupported = fmt.Errorf("database driver doesn't record checksums")
+
+// ErrChecksumMismatch is returned by VerifyChecksums if an up migration
+// changed after it was applied.
+type ErrChecksumMismatch struct {
+	Version uint
+
+	// Recorded is the checksum recorded when the migration was applied,
+	// Source the one of the migration in the source now.
+	Recorded string
+	Source   string
+}
+
+func (e ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("migration %v changed after it was applied: checksum %v recorded, %v in the source", e.Version, e.Recorded, e.Source)
+}
+
+// VerifyChecksums compares the checksums recorded for the applied up
+// migrations with the SHA-256 of the migrations in the source, and returns
+// ErrChecksumMismatch for the lowest version that differs, e.g. to fail CI
+// when an applied migration was edited in place. Versions recorded without
+// a checksum, by an older release, and those above the current version are
+// skipped. The database driver has to implement database.VersionHistory
+// and database.ChecksumRecorder. See VerifyChecksumsOnUp.
+func (m *Migrate) VerifyChecksums() error {
+	history, ok := m.databaseDrv.(database.VersionHistory)
+	if _, recorder := m.databaseDrv.(database.ChecksumRecorder); !ok || !recorder {
+		return ErrChecksumsUnsupported
+	}
+
+	current, _, err := m.databaseDrv.Version()
+	if err != nil {
+		return err
+	}
+
+	v, err := m.sourceDrv.First()
+	for ; err == nil && int(v) <= current; v, err = m.sourceDrv.Next(v) {
+		entry, err := history.FindVersion(int(v))
+		if err == database.ErrVersionNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(entry.Checksum) == 0 {
+			continue
+		}
+
+		checksum, err := m.sourceChecksum(v)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if checksum != entry.Checksum {
+			return ErrChecksumMismatch{Version: v, Recorded: entry.Checksum, Source: checksum}
+		}
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// sourceChecksum returns the hex encoded SHA-256 of the up migration of
+// version in the source, without a leading UTF-8 byte order mark, like
+// Migration.Checksum.
+func (m *Migrate) sourceChecksum(version uint) (string, error) {
+	r, _, err := m.sourceDrv.ReadUp(version)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	if bom, _ := br.Peek(len(utf8BOM)); bytes.Equal(bom, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, br); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordChecksum records the checksum of migr if it's an up migration with
+// a body and the database driver implements database.ChecksumRecorder.
+func (m *Migrate) recordChecksum(migr *Migration) error {
+	recorder, ok := m.databaseDrv.(database.ChecksumRecorder)
+	if !ok || migr.Checksum == nil || migr.TargetVersion != int(migr.Version) {
+		return nil
+	}
+	return recorder.RecordChecksum(migr.TargetVersion, hex.EncodeToString(migr.Checksum))
+}
@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/golang-migrate/migrate/database"
+	dStub "github.com/golang-migrate/migrate/database/stub"
+	"github.com/golang-migrate/migrate/source"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+// checksumStub adds database.ChecksumRecorder to the stub database driver.
+type checksumStub struct {
+	*dStub.Stub
+	checksums map[int]string
+}
+
+func (s *checksumStub) RecordChecksum(version int, checksum string) error {
+	if _, ok := s.History[version]; !ok {
+		s.UpsertVersion(version, false)
+	}
+	s.checksums[version] = checksum
+	return nil
+}
+
+func (s *checksumStub) FindVersion(version int) (database.HistoryEntry, error) {
+	entry, err := s.Stub.FindVersion(version)
+	entry.Checksum = s.checksums[version]
+	return entry, err
+}
+
+func checksum(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "\xef\xbb\xbfCREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "DROP 2"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	db := &checksumStub{Stub: m.databaseDrv.(*dStub.Stub), checksums: make(map[int]string)}
+	m.databaseDrv = db
+	m.VerifyChecksumsOnUp = true
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// without the byte order mark, nothing for a missing up migration
+	expected := map[int]string{1: checksum("CREATE 1"), 3: checksum("CREATE 3")}
+	if len(db.checksums) != 2 || db.checksums[1] != expected[1] || db.checksums[3] != expected[3] {
+		t.Fatalf("expected the checksums %v, got %v", expected, db.checksums)
+	}
+	if err := m.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 3 is edited in place
+	migrations = source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3 AND MORE"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "CREATE 4"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	mismatch := ErrChecksumMismatch{Version: 3, Recorded: checksum("CREATE 3"), Source: checksum("CREATE 3 AND MORE")}
+	if err := m.VerifyChecksums(); err != mismatch {
+		t.Fatalf("expected %v, got %v", mismatch, err)
+	}
+	if err := m.Up(); err != mismatch {
+		t.Fatalf("expected Up to fail with %v, got %v", mismatch, err)
+	}
+	if v, _, _ := db.Version(); v != 3 || db.IsLocked {
+		t.Errorf("expected version 3 and no lock after the failed Up, got %v (locked %v)", v, db.IsLocked)
+	}
+
+	// versions recorded without a checksum are skipped
+	delete(db.checksums, 3)
+	if err := m.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyChecksumsUnsupported(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	if err := m.VerifyChecksums(); err != ErrChecksumsUnsupported {
+		t.Fatalf("expected ErrChecksumsUnsupported, got %v", err)
+	}
+}
@@ -25,7 +25,10 @@ func main() {
 	versionPtr := flag.Bool("version", false, "")
 	verbosePtr := flag.Bool("verbose", false, "")
 	prefetchPtr := flag.Uint("prefetch", 10, "")
+	prefetchBytesPtr := flag.Uint("prefetch-bytes", 0, "")
 	lockTimeoutPtr := flag.Uint("lock-timeout", 15, "")
+	auditLogPtr := flag.String("audit-log", "", "")
+	progressPtr := flag.Uint("progress", 50, "")
 	pathPtr := flag.String("path", "", "")
 	databasePtr := flag.String("database", "", "")
 	sourcePtr := flag.String("source", "", "")
@@ -40,7 +43,12 @@ Options:
   -path            Shorthand for -source=file://path 
   -database        Run migrations against this database (driver://url)
   -prefetch N      Number of migrations to load in advance before executing (default 10)
+  -prefetch-bytes N
+                   Max bytes buffered by migrations loaded in advance (default 0, no limit)
   -lock-timeout N  Allow N seconds to acquire database lock (default 15)
+  -audit-log F     Append a JSON line per migration applied to file F
+  -progress N      Show progress instead of a line per migration when up applies
+                   more than N migrations, 0 disables it (default 50)
   -verbose         Print verbose logging
   -version         Print version
   -help            Print usage
@@ -95,8 +103,18 @@ Database drivers: `+strings.Join(database.List(), ", ")+"\n")
 	if migraterErr == nil {
 		migrater.Log = log
 		migrater.PrefetchMigrations = *prefetchPtr
+		migrater.PrefetchBytes = *prefetchBytesPtr
 		migrater.LockTimeout = time.Duration(int64(*lockTimeoutPtr)) * time.Second
 
+		if *auditLogPtr != "" {
+			audit, err := migrate.OpenAuditFile(*auditLogPtr)
+			if err != nil {
+				log.fatalErr(err)
+			}
+			defer audit.Close()
+			migrater.Audit = audit
+		}
+
 		// handle Ctrl+c
 		signals := make(chan os.Signal, 1)
 		signal.Notify(signals, syscall.SIGINT)
@@ -175,6 +193,9 @@ Database drivers: `+strings.Join(database.List(), ", ")+"\n")
 			limit = int(n)
 		}
 
+		if *progressPtr > 0 && !log.verbose {
+			showProgress(migrater, limit, int(*progressPtr))
+		}
 		upCmd(migrater, limit)
 
 		if log.verbose {
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-migrate/migrate"
+)
+
+// progressWindow is the number of migrations the ETA is averaged over.
+const progressWindow = 20
+
+// progressBarWidth is the number of characters inside the bar.
+const progressBarWidth = 30
+
+// progressEvent is sent by the tracer methods of progress when a migration
+// starts or ends, or when the run ended.
+type progressEvent struct {
+	start      bool
+	end        bool
+	version    uint
+	identifier string
+	time       time.Time
+}
+
+// progress shows the progress of a run with many migrations. On terminals
+// it redraws a bar, otherwise it prints a line every interval. It receives
+// the migrations as a migrate.Tracer and renders them from its own
+// goroutine, so it doesn't slow the run down.
+type progress struct {
+	out      io.Writer
+	tty      bool
+	total    int
+	interval time.Duration
+
+	events chan progressEvent
+	done   chan struct{}
+
+	// only used by the rendering goroutine
+	started    time.Time
+	completed  int
+	current    string
+	migrStart  time.Time
+	durations  []time.Duration
+	lastOutput time.Time
+}
+
+// newProgress returns a progress for a run applying total migrations.
+func newProgress(out io.Writer, tty bool, total int) *progress {
+	return &progress{
+		out:      out,
+		tty:      tty,
+		total:    total,
+		interval: 10 * time.Second,
+		events:   make(chan progressEvent, 64),
+		done:     make(chan struct{}),
+	}
+}
+
+// isTerminal reports whether f is a terminal, rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// StartRun implements migrate.Tracer. It starts rendering and waits for the
+// final output once the run ended.
+func (p *progress) StartRun(name string) func(err error) {
+	p.started = time.Now()
+	go p.render()
+	return func(err error) {
+		p.events <- progressEvent{end: true, time: time.Now()}
+		<-p.done
+	}
+}
+
+// StartLock implements migrate.Tracer.
+func (p *progress) StartLock() func(err error) {
+	return func(err error) {}
+}
+
+// StartMigration implements migrate.Tracer.
+func (p *progress) StartMigration(migr *migrate.Migration, statements int) func(err error) {
+	p.events <- progressEvent{start: true, version: migr.Version, identifier: migr.Identifier, time: time.Now()}
+	return func(err error) {
+		p.events <- progressEvent{time: time.Now()}
+	}
+}
+
+// render handles the events until the run ended. On terminals the bar is
+// also redrawn every second, so the elapsed time keeps going during long
+// migrations.
+func (p *progress) render() {
+	defer close(p.done)
+
+	tick := time.Second
+	if !p.tty {
+		tick = p.interval
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-p.events:
+			p.handle(e)
+			if e.end {
+				p.print(e.time, true)
+				return
+			}
+			if p.tty {
+				p.print(e.time, false)
+			}
+		case now := <-ticker.C:
+			p.print(now, false)
+		}
+	}
+}
+
+// handle updates the state of p with e.
+func (p *progress) handle(e progressEvent) {
+	switch {
+	case e.start:
+		p.current = fmt.Sprintf("%v %v", e.version, e.identifier)
+		p.migrStart = e.time
+	case e.end:
+		p.current = ""
+	default:
+		p.completed++
+		p.durations = append(p.durations, e.time.Sub(p.migrStart))
+		if len(p.durations) > progressWindow {
+			p.durations = p.durations[1:]
+		}
+		p.current = ""
+	}
+}
+
+// print writes the current state. On terminals the line replaces the
+// previous one, and the final line ends it.
+func (p *progress) print(now time.Time, final bool) {
+	line := p.line(now)
+	if p.tty {
+		// \033[K clears what's left of a longer previous line
+		fmt.Fprintf(p.out, "\r%v\033[K", line)
+		if final {
+			fmt.Fprintln(p.out)
+		}
+		return
+	}
+	if !final && now.Sub(p.lastOutput) < p.interval {
+		return
+	}
+	p.lastOutput = now
+	fmt.Fprintln(p.out, line)
+}
+
+// line formats the current state, e.g.
+//
+//	[=========>                    ] 120/900 13% 120 add_users elapsed 1m2s eta 6m40s
+func (p *progress) line(now time.Time) string {
+	parts := make([]string, 0, 6)
+	if p.tty {
+		parts = append(parts, p.bar())
+	}
+	parts = append(parts, fmt.Sprintf("%v/%v", p.completed, p.total))
+	if p.total > 0 {
+		parts = append(parts, fmt.Sprintf("%v%%", p.completed*100/p.total))
+	}
+	if p.current != "" {
+		parts = append(parts, p.current)
+	}
+	parts = append(parts, "elapsed "+now.Sub(p.started).Round(time.Second).String())
+	if eta, ok := p.eta(); ok {
+		parts = append(parts, "eta "+eta.Round(time.Second).String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// bar draws the share of completed migrations.
+func (p *progress) bar() string {
+	filled := progressBarWidth
+	if p.total > 0 && p.completed < p.total {
+		filled = p.completed * progressBarWidth / p.total
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return "[" + bar + "]"
+}
+
+// eta estimates the time the remaining migrations take from the average
+// duration of the last completed ones.
+func (p *progress) eta() (time.Duration, bool) {
+	if len(p.durations) == 0 || p.completed >= p.total {
+		return 0, false
+	}
+	var sum time.Duration
+	for _, d := range p.durations {
+		sum += d
+	}
+	return sum / time.Duration(len(p.durations)) * time.Duration(p.total-p.completed), true
+}
+
+// showProgress makes m show the progress of a run applying limit
+// migrations, all if limit is negative, if more than threshold of them are
+// pending. It replaces the log line per migration.
+func showProgress(m *migrate.Migrate, limit int, threshold int) {
+	s, err := m.Status()
+	if err != nil {
+		// the run reports the error
+		return
+	}
+	total := s.Pending
+	if limit >= 0 && limit < total {
+		total = limit
+	}
+	if total <= threshold {
+		return
+	}
+
+	m.Tracer = newProgress(os.Stderr, isTerminal(os.Stderr), total)
+	m.Log = nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate"
+)
+
+func TestProgressLine(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := newProgress(&bytes.Buffer{}, true, 900)
+	p.started = start
+	p.handle(progressEvent{start: true, version: 1, identifier: "add_users", time: start})
+	p.handle(progressEvent{time: start.Add(2 * time.Second)})
+	p.handle(progressEvent{start: true, version: 2, identifier: "add_orders", time: start.Add(2 * time.Second)})
+
+	expected := "[>                             ] 1/900 0% 2 add_orders elapsed 3s eta 29m58s"
+	if line := p.line(start.Add(3 * time.Second)); line != expected {
+		t.Errorf("expected %q, got %q", expected, line)
+	}
+
+	p.tty = false
+	expected = "1/900 0% 2 add_orders elapsed 3s eta 29m58s"
+	if line := p.line(start.Add(3 * time.Second)); line != expected {
+		t.Errorf("expected %q, got %q", expected, line)
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	testcases := []struct {
+		completed int
+		expected  string
+	}{
+		{0, "[>                             ]"},
+		{5, "[===============>              ]"},
+		{10, "[==============================]"},
+	}
+
+	for _, tc := range testcases {
+		p := newProgress(&bytes.Buffer{}, true, 10)
+		p.completed = tc.completed
+		if bar := p.bar(); bar != tc.expected {
+			t.Errorf("expected %q, got %q", tc.expected, bar)
+		}
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	p := newProgress(&bytes.Buffer{}, false, 100)
+	if _, ok := p.eta(); ok {
+		t.Error("expected no ETA before a migration completed")
+	}
+
+	// only the last progressWindow migrations are averaged
+	p.completed = 30
+	for i := 0; i < 30; i++ {
+		d := time.Second
+		if i < 10 {
+			d = time.Minute
+		}
+		p.durations = append(p.durations, d)
+		if len(p.durations) > progressWindow {
+			p.durations = p.durations[1:]
+		}
+	}
+	if eta, ok := p.eta(); !ok || eta != 70*time.Second {
+		t.Errorf("expected 70s, got %v", eta)
+	}
+}
+
+func TestProgressPlain(t *testing.T) {
+	out := &bytes.Buffer{}
+	p := newProgress(out, false, 2)
+
+	end := p.StartRun("up")
+	for v := uint(1); v <= 2; v++ {
+		endMigr := p.StartMigration(&migrate.Migration{Version: v, Identifier: "m"}, 1)
+		endMigr(nil)
+	}
+	end(nil)
+
+	// the run is shorter than the interval, so only the final line is printed
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "2/2 100% elapsed ") {
+		t.Errorf("expected a single final line, got %q", out.String())
+	}
+}
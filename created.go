@@ -0,0 +1,244 @@
+package migrate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/golang-migrate/migrate/database"
+	"github.com/golang-migrate/migrate/source"
+)
+
+// ErrTableNotCreated is returned by WhichMigrationCreated if no up migration
+// creates the table.
+var ErrTableNotCreated = fmt.Errorf("no migration creates the table")
+
+// ErrBaselineVersion is returned by AutoBaseline if the database has a
+// version already.
+var ErrBaselineVersion = fmt.Errorf("database has a version already, can't baseline it")
+
+// WhichMigrationCreated returns the version of the first up migration in
+// sourceDrv with a CREATE TABLE statement for table. Table names are
+// compared case insensitive and without quotes. If table isn't schema
+// qualified, a schema qualified name in the migration matches as well.
+// Migrations are only inspected statically, so tables created by
+// procedures or dynamic SQL are not found.
+func WhichMigrationCreated(sourceDrv source.Driver, table string) (int, error) {
+	version := database.NilVersion
+	err := createdTables(sourceDrv, func(v uint, name string) bool {
+		if tableNameMatches(name, table) {
+			version = int(v)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return database.NilVersion, err
+	}
+	if version == database.NilVersion {
+		return database.NilVersion, ErrTableNotCreated
+	}
+	return version, nil
+}
+
+// AutoBaseline marks the up migrations in sourceDrv creating tables that
+// exist already as applied, without running them, e.g. to adopt migrate on
+// a mature database. A migration counts as applied if every table it
+// creates exists. The version is set to the highest of them, so all
+// migrations below it count as applied, even those not creating tables.
+// Database drivers implementing database.VersionHistory get a row for each
+// migration marked.
+//
+// It's a heuristic reading CREATE TABLE statements like
+// WhichMigrationCreated, so review the result, e.g. with History, before
+// running Up. The database driver has to implement database.TableLister,
+// and the database must not have a version yet. ErrNoChange is returned if
+// no migration matched.
+func (m *Migrate) AutoBaseline(sourceDrv source.Driver) error {
+	lister, ok := m.databaseDrv.(database.TableLister)
+	if !ok {
+		return ErrListTablesUnsupported
+	}
+
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	version, _, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+	if version != database.NilVersion {
+		return m.unlockErr(ErrBaselineVersion)
+	}
+
+	tables, err := lister.ListTables()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	// exists is true for the versions all of whose tables exist
+	var versions []uint
+	exists := make(map[uint]bool)
+	err = createdTables(sourceDrv, func(v uint, name string) bool {
+		if _, ok := exists[v]; !ok {
+			versions = append(versions, v)
+			exists[v] = true
+		}
+		exists[v] = exists[v] && tableExists(tables, name)
+		return true
+	})
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	history, _ := m.databaseDrv.(database.VersionHistory)
+	baseline := database.NilVersion
+	for _, v := range versions {
+		if !exists[v] {
+			continue
+		}
+		m.logVerbosePrintf("Baseline %v, its tables exist\n", v)
+		if history != nil {
+			if err := history.UpsertVersion(int(v), false); err != nil {
+				return m.unlockErr(err)
+			}
+		}
+		baseline = int(v)
+	}
+	if baseline == database.NilVersion {
+		return m.unlockErr(ErrNoChange)
+	}
+
+	if err := m.databaseDrv.SetVersion(baseline, false); err != nil {
+		return m.unlockErr(err)
+	}
+	return m.unlock()
+}
+
+// createdTables calls fn with the version and the name of every table the
+// up migrations in sourceDrv create, in order, until fn returns false.
+func createdTables(sourceDrv source.Driver, fn func(version uint, table string) bool) error {
+	return upStatements(sourceDrv, database.NilVersion, func(v uint, stmt string) bool {
+		if name, ok := createdTable(stmt); ok {
+			return fn(v, name)
+		}
+		return true
+	})
+}
+
+// upStatements calls fn with the version and every statement, comments
+// stripped, of the up migrations in sourceDrv above version after, in
+// order, until fn returns false.
+func upStatements(sourceDrv source.Driver, after int, fn func(version uint, stmt string) bool) error {
+	opts := database.GenericOptions
+	opts.StripComments = true
+
+	v, err := sourceDrv.First()
+	for ; err == nil; v, err = sourceDrv.Next(v) {
+		if int(v) <= after {
+			continue
+		}
+		r, _, err := sourceDrv.ReadUp(v)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		buf, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+
+		stmts, err := database.SplitQueryOpts(buf, opts)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range stmts {
+			if !fn(v, string(stmt)) {
+				return nil
+			}
+		}
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// tableExists returns true if the table name found in a migration is one of
+// tables.
+func tableExists(tables []string, name string) bool {
+	for _, table := range tables {
+		if tableNameMatches(name, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// createdTable returns the table name if stmt is a CREATE TABLE statement.
+func createdTable(stmt string) (string, bool) {
+	words := strings.Fields(stmt)
+	if len(words) < 3 || !strings.EqualFold(words[0], "CREATE") {
+		return "", false
+	}
+
+	i := 1
+	for i < len(words) && isTableModifier(words[i]) {
+		i++
+	}
+	if i >= len(words) || !strings.EqualFold(words[i], "TABLE") {
+		return "", false
+	}
+	i++
+
+	if i+2 < len(words) && strings.EqualFold(words[i], "IF") &&
+		strings.EqualFold(words[i+1], "NOT") && strings.EqualFold(words[i+2], "EXISTS") {
+		i += 3
+	}
+	if i >= len(words) {
+		return "", false
+	}
+
+	name := words[i]
+	if idx := strings.IndexByte(name, '('); idx >= 0 {
+		name = name[:idx]
+	}
+	return name, len(name) > 0
+}
+
+func isTableModifier(word string) bool {
+	switch strings.ToUpper(word) {
+	case "TEMPORARY", "TEMP", "GLOBAL", "LOCAL", "UNLOGGED":
+		return true
+	}
+	return false
+}
+
+// tableNameMatches compares the table name found in a migration with table.
+func tableNameMatches(name, table string) bool {
+	name, table = unquoteTableName(name), unquoteTableName(table)
+	if strings.EqualFold(name, table) {
+		return true
+	}
+	if strings.Contains(table, ".") {
+		return false
+	}
+	if idx := strings.LastIndexByte(name, '.'); idx >= 0 {
+		return strings.EqualFold(name[idx+1:], table)
+	}
+	return false
+}
+
+func unquoteTableName(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = strings.Trim(p, "`\"[]")
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,110 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+
+	dStub "github.com/golang-migrate/migrate/database/stub"
+	"github.com/golang-migrate/migrate/source"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+func TestWhichMigrationCreated(t *testing.T) {
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up,
+		Identifier: "-- CREATE TABLE comments;\nCREATE TABLE `users` (id INT);"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP TABLE `users`"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "CREATE TABLE orders (id INT)"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up,
+		Identifier: "INSERT INTO users VALUES ('CREATE TABLE orders');\ncreate table if not exists public.\"Orders\"(id int);"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "CREATE TEMPORARY TABLE tmp (id INT)"})
+	migrations.Append(&source.Migration{Version: 5, Direction: source.Up, Identifier: "CREATE TABLE orders (id INT)"})
+
+	sInst, _ := sStub.WithInstance(nil, &sStub.Config{})
+	sInst.(*sStub.Stub).Migrations = migrations
+
+	testcases := []struct {
+		table   string
+		version int
+		err     error
+	}{
+		{table: "users", version: 1},
+		{table: "USERS", version: 1},
+		{table: "orders", version: 3},
+		{table: "public.orders", version: 3},
+		{table: "other.orders", version: -1, err: ErrTableNotCreated},
+		{table: "tmp", version: 4},
+		{table: "comments", version: -1, err: ErrTableNotCreated},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.table, func(t *testing.T) {
+			v, err := WhichMigrationCreated(sInst, tc.table)
+			if err != tc.err {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if v != tc.version {
+				t.Errorf("expected version %v, got %v", tc.version, v)
+			}
+		})
+	}
+}
+
+// tablesStub adds a fixed list of tables to the stub database driver.
+type tablesStub struct {
+	*dStub.Stub
+	tables []string
+}
+
+func (s *tablesStub) ListTables() ([]string, error) {
+	return s.tables, nil
+}
+
+func TestAutoBaseline(t *testing.T) {
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE TABLE users (id INT)"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "ALTER TABLE users ADD name TEXT"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up,
+		Identifier: "CREATE TABLE orders (id INT);\nCREATE TABLE order_lines (id INT)"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "CREATE TABLE `public`.`products` (id INT)"})
+	migrations.Append(&source.Migration{Version: 5, Direction: source.Up, Identifier: "CREATE TABLE invoices (id INT)"})
+	sInst, _ := sStub.WithInstance(nil, &sStub.Config{})
+	sInst.(*sStub.Stub).Migrations = migrations
+
+	newBaselineMigrate := func(tables ...string) (*Migrate, *tablesStub) {
+		m, _ := New("stub://", "stub://")
+		db := &tablesStub{Stub: m.databaseDrv.(*dStub.Stub), tables: tables}
+		m.databaseDrv = db
+		return m, db
+	}
+
+	// only some tables of 3 exist, and none of 5
+	m, db := newBaselineMigrate("orders", "products", "schema_migrations", "users")
+	if err := m.AutoBaseline(sInst); err != nil {
+		t.Fatal(err)
+	}
+	if v, dirty, _ := db.Version(); v != 4 || dirty {
+		t.Errorf("expected clean version 4, got %v %v", v, dirty)
+	}
+	expected := map[int]bool{1: false, 4: false}
+	if !reflect.DeepEqual(db.History, expected) {
+		t.Errorf("expected the history %v, got %v", expected, db.History)
+	}
+	if len(db.MigrationSequence) != 0 {
+		t.Errorf("expected no migration to run, got %q", db.MigrationSequence)
+	}
+
+	if err := m.AutoBaseline(sInst); err != ErrBaselineVersion {
+		t.Errorf("expected ErrBaselineVersion, got %v", err)
+	}
+
+	m, _ = newBaselineMigrate("schema_migrations")
+	if err := m.AutoBaseline(sInst); err != ErrNoChange {
+		t.Errorf("expected ErrNoChange, got %v", err)
+	}
+
+	m, _ = New("stub://", "stub://")
+	if err := m.AutoBaseline(sInst); err != ErrListTablesUnsupported {
+		t.Errorf("expected ErrListTablesUnsupported, got %v", err)
+	}
+}
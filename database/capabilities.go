@@ -0,0 +1,59 @@
+package database
+
+import (
+	"io"
+)
+
+// DriverCapabilities tells what a database driver supports, so that
+// tooling working with several drivers can adapt to each of them.
+type DriverCapabilities struct {
+	// SupportsLock is true if Lock keeps other processes from running
+	// migrations at the same time, not only other goroutines.
+	SupportsLock bool
+
+	// SupportsTransactionalDDL is true if schema changes inside an explicit
+	// transaction are rolled back with it.
+	SupportsTransactionalDDL bool
+
+	// SupportsHistory is true if the driver implements VersionHistory.
+	SupportsHistory bool
+
+	// SupportsOnlineDDL is true if schema changes can be made without
+	// locking the table for writes, see the driver's documentation.
+	SupportsOnlineDDL bool
+
+	// SupportsParallelRun is true if the driver implements ParallelRunner
+	// and can currently run migrations at the same time.
+	SupportsParallelRun bool
+}
+
+// ParallelRunner is an optional interface a database driver can implement
+// if it can run several migrations at the same time while Lock is held, e.g.
+// each on a session of its own. Migrate then runs the migrations of a
+// parallel group concurrently, see migrate.GroupMarker.
+type ParallelRunner interface {
+	// RunParallel is like Run, but may be called concurrently with itself
+	// and with the methods keeping the version and its history. Migrate
+	// doesn't call these methods concurrently with each other.
+	RunParallel(migration io.Reader) error
+}
+
+// CapabilityReporter is an optional interface a database driver can
+// implement to report its capabilities.
+type CapabilityReporter interface {
+	Capabilities() DriverCapabilities
+}
+
+// Capabilities returns the capabilities of d. For drivers not implementing
+// CapabilityReporter, only SupportsHistory and SupportsParallelRun are
+// derived from the interfaces the driver implements, everything else is
+// reported as unsupported.
+func Capabilities(d Driver) DriverCapabilities {
+	if r, ok := d.(CapabilityReporter); ok {
+		return r.Capabilities()
+	}
+
+	_, history := d.(VersionHistory)
+	_, parallel := d.(ParallelRunner)
+	return DriverCapabilities{SupportsHistory: history, SupportsParallelRun: parallel}
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"io"
+	"testing"
+)
+
+// nopDriver implements Driver without doing anything.
+type nopDriver struct{}
+
+func (d nopDriver) Open(url string) (Driver, error)          { return d, nil }
+func (d nopDriver) Close() error                             { return nil }
+func (d nopDriver) Lock() error                              { return nil }
+func (d nopDriver) Unlock() error                            { return nil }
+func (d nopDriver) Run(migration io.Reader) error            { return nil }
+func (d nopDriver) SetVersion(version int, dirty bool) error { return nil }
+func (d nopDriver) Version() (int, bool, error)              { return NilVersion, false, nil }
+func (d nopDriver) Drop() error                              { return nil }
+
+// historyDriver implements VersionHistory, but not CapabilityReporter.
+type historyDriver struct {
+	nopDriver
+}
+
+func (d historyDriver) FindVersion(version int) (HistoryEntry, error) {
+	return HistoryEntry{}, ErrVersionNotFound
+}
+func (d historyDriver) UpsertVersion(version int, dirty bool) error { return nil }
+func (d historyDriver) DeleteVersion(version int) error             { return nil }
+func (d historyDriver) ListVersions(offset, limit int) ([]HistoryEntry, error) {
+	return nil, nil
+}
+
+// parallelDriver implements ParallelRunner, but not CapabilityReporter.
+type parallelDriver struct {
+	nopDriver
+}
+
+func (d parallelDriver) RunParallel(migration io.Reader) error { return nil }
+
+// reportingDriver implements CapabilityReporter.
+type reportingDriver struct {
+	historyDriver
+}
+
+func (d reportingDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{SupportsLock: true, SupportsTransactionalDDL: true}
+}
+
+func TestCapabilities(t *testing.T) {
+	testcases := []struct {
+		name     string
+		driver   Driver
+		expected DriverCapabilities
+	}{
+		{name: "nothing", driver: nopDriver{}, expected: DriverCapabilities{}},
+		{name: "derived history", driver: historyDriver{}, expected: DriverCapabilities{SupportsHistory: true}},
+		{name: "derived parallel run", driver: parallelDriver{}, expected: DriverCapabilities{SupportsParallelRun: true}},
+		{name: "reported", driver: reportingDriver{},
+			expected: DriverCapabilities{SupportsLock: true, SupportsTransactionalDDL: true}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Capabilities(tc.driver); got != tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
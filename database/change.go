@@ -0,0 +1,29 @@
+package database
+
+import (
+	"fmt"
+	"io"
+)
+
+// ErrNotRollbackable is the OrigErr of Errors returned by WouldChange
+// for statements that can't be rolled back.
+var ErrNotRollbackable = fmt.Errorf("statement can't be rolled back")
+
+// ChangeDetector is an optional interface a database driver can implement
+// to tell whether running a migration would change anything.
+type ChangeDetector interface {
+	// WouldChange runs the migration inside a transaction that is always
+	// rolled back and reports whether any statement changed data or schema.
+	// Migrations with statements that can't be rolled back are rejected
+	// with an Error wrapping ErrNotRollbackable.
+	WouldChange(migration io.Reader) (bool, error)
+}
+
+// IsQuery returns true if the statement only reads data.
+func IsQuery(stmt []byte, dialect Dialect) bool {
+	switch Keyword(stmt, dialect) {
+	case "SELECT", "SHOW", "EXPLAIN", "DESCRIBE", "DESC", "VALUES", "TABLE":
+		return true
+	}
+	return false
+}
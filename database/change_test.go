@@ -0,0 +1,27 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestIsQuery(t *testing.T) {
+	testcases := []struct {
+		stmt     string
+		dialect  Dialect
+		expected bool
+	}{
+		{stmt: "SELECT 1", dialect: MySQLDialect, expected: true},
+		{stmt: "-- UPDATE\n/* DELETE */ select * from t", dialect: PostgresDialect, expected: true},
+		{stmt: "# x\nSHOW TABLES", dialect: MySQLDialect, expected: true},
+		{stmt: "UPDATE t SET a = 'SELECT'", dialect: MySQLDialect, expected: false},
+		{stmt: "", dialect: MySQLDialect, expected: false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.stmt, func(t *testing.T) {
+			if q := IsQuery([]byte(tc.stmt), tc.dialect); q != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, q)
+			}
+		})
+	}
+}
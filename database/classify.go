@@ -0,0 +1,441 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// StatementClass describes how a statement behaves inside a transaction.
+type StatementClass int
+
+const (
+	// Transactional statements are rolled back with the transaction they run in.
+	Transactional StatementClass = iota
+
+	// TransactionControl statements start or end a transaction,
+	// e.g. BEGIN, START TRANSACTION, COMMIT or ROLLBACK.
+	TransactionControl
+
+	// ImplicitCommit statements commit the open transaction before they run,
+	// like most DDL in MySQL.
+	ImplicitCommit
+
+	// NonTransactional statements can't run inside a transaction at all,
+	// like CREATE INDEX CONCURRENTLY in Postgres.
+	NonTransactional
+)
+
+func (c StatementClass) String() string {
+	switch c {
+	case Transactional:
+		return "transactional"
+	case TransactionControl:
+		return "transaction control"
+	case ImplicitCommit:
+		return "implicit commit"
+	case NonTransactional:
+		return "non-transactional"
+	}
+	return fmt.Sprintf("StatementClass(%d)", int(c))
+}
+
+// StatementKind is the kind of a statement.
+type StatementKind int
+
+const (
+	// OtherStatement is anything not covered by the other kinds,
+	// e.g. SET or GRANT.
+	OtherStatement StatementKind = iota
+
+	// DDLStatement defines the schema, e.g. CREATE, ALTER or DROP.
+	DDLStatement
+
+	// DMLStatement reads or changes data, e.g. SELECT, INSERT or DELETE.
+	DMLStatement
+
+	// TransactionControlStatement starts or ends a transaction.
+	TransactionControlStatement
+
+	// CommentOnlyStatement consists of comments and whitespace only.
+	CommentOnlyStatement
+)
+
+func (k StatementKind) String() string {
+	switch k {
+	case OtherStatement:
+		return "other"
+	case DDLStatement:
+		return "DDL"
+	case DMLStatement:
+		return "DML"
+	case TransactionControlStatement:
+		return "transaction control"
+	case CommentOnlyStatement:
+		return "comment only"
+	}
+	return fmt.Sprintf("StatementKind(%d)", int(k))
+}
+
+// StatementWarning flags dangerous patterns in a statement.
+// Multiple warnings are combined with |.
+type StatementWarning uint
+
+const (
+	// WarnDropWithoutIfExists flags DROP TABLE without IF EXISTS.
+	WarnDropWithoutIfExists StatementWarning = 1 << iota
+
+	// WarnDeleteWithoutWhere flags DELETE without a WHERE clause.
+	WarnDeleteWithoutWhere
+
+	// WarnUpdateWithoutWhere flags UPDATE without a WHERE clause.
+	WarnUpdateWithoutWhere
+)
+
+var statementWarningNames = []struct {
+	w    StatementWarning
+	name string
+}{
+	{WarnDropWithoutIfExists, "DROP TABLE without IF EXISTS"},
+	{WarnDeleteWithoutWhere, "DELETE without WHERE"},
+	{WarnUpdateWithoutWhere, "UPDATE without WHERE"},
+}
+
+func (w StatementWarning) String() string {
+	names := make([]string, 0)
+	for _, n := range statementWarningNames {
+		if w&n.w != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// NoWarnMarker suppresses all warnings of a statement if it appears
+// in a comment inside the statement, e.g.
+//
+//	DELETE FROM sessions -- migrate:nowarn
+const NoWarnMarker = "migrate:nowarn"
+
+// StatementInfo describes a single statement.
+type StatementInfo struct {
+	Kind     StatementKind
+	Class    StatementClass
+	Warnings StatementWarning
+}
+
+// String returns a short annotation for the statement,
+// e.g. "DDL, implicit commit, warning: DROP TABLE without IF EXISTS".
+func (i StatementInfo) String() string {
+	str := i.Kind.String()
+	if i.Class != Transactional {
+		str += ", " + i.Class.String()
+	}
+	if i.Warnings != 0 {
+		str += ", warning: " + i.Warnings.String()
+	}
+	return str
+}
+
+// ClassifyStatement classifies a single statement for the given dialect,
+// using lightweight token scanning rather than a full parser.
+// Keywords are matched case insensitive, comments and quoted strings
+// are ignored. Statements of the GenericDialect are always Transactional
+// unless they control the transaction. See NoWarnMarker to suppress
+// false positive warnings.
+func ClassifyStatement(stmt []byte, dialect Dialect) StatementInfo {
+	words, nowarn := scanStatement(stmt, dialect, -1)
+	if len(words) == 0 {
+		return StatementInfo{Kind: CommentOnlyStatement}
+	}
+
+	info := StatementInfo{Class: transactionClass(words, dialect)}
+	switch {
+	case info.Class == TransactionControl:
+		info.Kind = TransactionControlStatement
+	case isDDLKeyword(words[0]):
+		info.Kind = DDLStatement
+	case isDMLKeyword(words[0]):
+		info.Kind = DMLStatement
+	}
+
+	if !nowarn {
+		info.Warnings = statementWarnings(words)
+	}
+	return info
+}
+
+func isDDLKeyword(word string) bool {
+	switch word {
+	case "CREATE", "ALTER", "DROP", "RENAME", "TRUNCATE", "COMMENT":
+		return true
+	}
+	return false
+}
+
+func isDMLKeyword(word string) bool {
+	switch word {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE", "MERGE", "WITH",
+		"VALUES", "TABLE", "CALL", "COPY", "LOAD":
+		return true
+	}
+	return false
+}
+
+func statementWarnings(words []string) StatementWarning {
+	var w StatementWarning
+	switch words[0] {
+	case "DROP":
+		i := 1
+		if i < len(words) && words[i] == "TEMPORARY" {
+			i++
+		}
+		if i < len(words) && words[i] == "TABLE" && (i+1 == len(words) || words[i+1] != "IF") {
+			w |= WarnDropWithoutIfExists
+		}
+	case "DELETE":
+		if !containsWord(words, "WHERE") {
+			w |= WarnDeleteWithoutWhere
+		}
+	case "UPDATE":
+		if !containsWord(words, "WHERE") {
+			w |= WarnUpdateWithoutWhere
+		}
+	}
+	return w
+}
+
+func containsWord(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+func transactionClass(words []string, dialect Dialect) StatementClass {
+	switch words[0] {
+	case "BEGIN", "COMMIT", "ROLLBACK", "END":
+		if dialect == MySQLDialect && words[0] == "BEGIN" && len(words) > 1 && words[1] != "WORK" {
+			return Transactional // BEGIN ... END block
+		}
+		return TransactionControl
+	case "START":
+		if len(words) > 1 && words[1] == "TRANSACTION" {
+			return TransactionControl
+		}
+	}
+
+	switch dialect {
+	case MySQLDialect:
+		return classifyMySQL(words)
+	case PostgresDialect:
+		return classifyPostgres(words)
+	}
+	return Transactional
+}
+
+// https://dev.mysql.com/doc/refman/5.7/en/implicit-commit.html
+func classifyMySQL(words []string) StatementClass {
+	switch words[0] {
+	case "ALTER", "CREATE", "DROP":
+		if len(words) > 1 && words[1] == "TEMPORARY" {
+			return Transactional
+		}
+		return ImplicitCommit
+	case "RENAME", "TRUNCATE", "GRANT", "REVOKE", "LOCK", "UNLOCK",
+		"ANALYZE", "CHECK", "OPTIMIZE", "REPAIR", "CACHE", "FLUSH", "RESET",
+		"INSTALL", "UNINSTALL":
+		return ImplicitCommit
+	case "SET":
+		if len(words) > 1 && words[1] == "PASSWORD" {
+			return ImplicitCommit
+		}
+	case "LOAD":
+		if len(words) > 1 && words[1] == "INDEX" {
+			return ImplicitCommit
+		}
+	}
+	return Transactional
+}
+
+// https://www.postgresql.org/docs/current/static/sql-commands.html
+func classifyPostgres(words []string) StatementClass {
+	switch words[0] {
+	case "VACUUM":
+		return NonTransactional
+	case "CREATE", "DROP":
+		if len(words) < 2 {
+			break
+		}
+		switch words[1] {
+		case "DATABASE", "TABLESPACE", "SUBSCRIPTION":
+			return NonTransactional
+		}
+		// CREATE [UNIQUE] INDEX CONCURRENTLY, DROP INDEX CONCURRENTLY
+		i := 1
+		if words[i] == "UNIQUE" {
+			i++
+		}
+		if i+1 < len(words) && words[i] == "INDEX" && words[i+1] == "CONCURRENTLY" {
+			return NonTransactional
+		}
+	case "REINDEX":
+		// REINDEX [(options)] {INDEX|TABLE|SCHEMA|DATABASE|SYSTEM} [CONCURRENTLY] name
+		for i, w := range words[1:] {
+			switch w {
+			case "DATABASE", "SYSTEM":
+				return NonTransactional
+			case "INDEX", "TABLE", "SCHEMA":
+				if i+2 < len(words) && words[i+2] == "CONCURRENTLY" {
+					return NonTransactional
+				}
+				return Transactional
+			}
+		}
+	case "ALTER":
+		if len(words) > 1 && words[1] == "SYSTEM" {
+			return NonTransactional
+		}
+		if len(words) > 1 && words[1] == "TYPE" {
+			// ALTER TYPE name ADD VALUE can't run in a transaction before Postgres 12
+			for i, w := range words[2:] {
+				if w == "ADD" && i+3 < len(words) && words[i+3] == "VALUE" {
+					return NonTransactional
+				}
+			}
+		}
+	}
+	return Transactional
+}
+
+// ErrTransactionIssue is the OrigErr of Errors returned by drivers
+// refusing to run a migration with TransactionIssues.
+var ErrTransactionIssue = fmt.Errorf("statement breaks the atomicity of the transaction")
+
+// Keyword returns the first keyword of stmt in upper case, skipping
+// whitespace and comments.
+func Keyword(stmt []byte, dialect Dialect) string {
+	if words := statementWords(stmt, dialect, 1); len(words) > 0 {
+		return words[0]
+	}
+	return ""
+}
+
+// TransactionIssue is a statement that breaks the atomicity of the
+// transaction it runs in.
+type TransactionIssue struct {
+	// Index of the statement in the checked statements.
+	Index int
+
+	// Statement is the offending statement.
+	Statement []byte
+
+	// Class is the class of the statement.
+	Class StatementClass
+}
+
+func (i TransactionIssue) String() string {
+	switch i.Class {
+	case ImplicitCommit:
+		return fmt.Sprintf("statement %v commits the open transaction implicitly", i.Index+1)
+	case NonTransactional:
+		return fmt.Sprintf("statement %v can't run inside a transaction", i.Index+1)
+	}
+	return fmt.Sprintf("statement %v is %v", i.Index+1, i.Class)
+}
+
+// CheckTransactions returns the statements that silently break atomicity.
+// For MySQL these are statements causing an implicit commit inside an
+// explicit transaction. For Postgres these are non-transactional statements
+// inside an explicit transaction, or in a migration with more than one
+// statement, since Postgres runs those in an implicit transaction.
+func CheckTransactions(stmts [][]byte, dialect Dialect) []TransactionIssue {
+	issues := make([]TransactionIssue, 0)
+	c := TransactionChecker{Dialect: dialect, Multiple: len(stmts) > 1}
+	for _, stmt := range stmts {
+		if issue, ok := c.Check(stmt); ok {
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// TransactionChecker finds the issues CheckTransactions reports one
+// statement at a time, for migrations that are run while they are read.
+type TransactionChecker struct {
+	Dialect Dialect
+
+	// Multiple tells that the migration has more than one statement.
+	// If it isn't known in advance, non-transactional Postgres statements
+	// are only reported inside of explicit transactions.
+	Multiple bool
+
+	index int
+	inTx  bool
+}
+
+// Check returns the issue of stmt, which is the statement following the
+// statements checked before.
+func (c *TransactionChecker) Check(stmt []byte) (issue TransactionIssue, ok bool) {
+	index := c.index
+	c.index++
+
+	class := ClassifyStatement(stmt, c.Dialect).Class
+	switch class {
+	case TransactionControl:
+		words := statementWords(stmt, c.Dialect, 1)
+		c.inTx = words[0] == "BEGIN" || words[0] == "START"
+	case ImplicitCommit:
+		if c.inTx {
+			c.inTx = false
+			return TransactionIssue{Index: index, Statement: stmt, Class: class}, true
+		}
+	case NonTransactional:
+		if c.inTx || c.Multiple {
+			return TransactionIssue{Index: index, Statement: stmt, Class: class}, true
+		}
+	}
+	return TransactionIssue{}, false
+}
+
+// statementWords returns up to max leading words of stmt in upper case,
+// skipping whitespace, comments and quoted strings.
+func statementWords(stmt []byte, dialect Dialect, max int) []string {
+	words, _ := scanStatement(stmt, dialect, max)
+	return words
+}
+
+// scanStatement returns up to max words of stmt in upper case, skipping
+// whitespace, comments and quoted strings. All words are returned if max
+// is negative. nowarn is true if a comment contains NoWarnMarker.
+func scanStatement(stmt []byte, dialect Dialect, max int) (words []string, nowarn bool) {
+	s := &splitter{buf: stmt, opts: SplitOptions{Dialect: dialect, StripComments: true}, delim: defaultDelimiter}
+	words = make([]string, 0)
+	for i := 0; i < len(stmt) && (max < 0 || len(words) < max); {
+		c := stmt[i]
+		switch {
+		case isSpace(c):
+			i++
+		case s.isCommentStart(i):
+			end, _ := s.skipComment(i)
+			nowarn = nowarn || bytes.Contains(stmt[i:end], []byte(NoWarnMarker))
+			i = end
+		case c == '\'' || c == '"' || (c == '`' && dialect != PostgresDialect):
+			i, _ = s.skipQuoted(i)
+		case c == '$' && dialect == PostgresDialect && s.isDollarQuoteStart(i):
+			i, _ = s.skipDollarQuoted(i)
+		case isWordByte(c):
+			j := i
+			for j < len(stmt) && isWordByte(stmt[j]) {
+				j++
+			}
+			words = append(words, string(bytes.ToUpper(stmt[i:j])))
+			i = j
+		default:
+			i++
+		}
+	}
+	return words, nowarn
+}
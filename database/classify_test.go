@@ -0,0 +1,148 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestClassifyStatementClass(t *testing.T) {
+	testcases := []struct {
+		stmt     string
+		dialect  Dialect
+		expected StatementClass
+	}{
+		{stmt: "SELECT 1", dialect: MySQLDialect, expected: Transactional},
+		{stmt: "INSERT INTO t VALUES ('CREATE TABLE x')", dialect: MySQLDialect, expected: Transactional},
+		{stmt: "-- CREATE TABLE x\nUPDATE t SET a = 1", dialect: MySQLDialect, expected: Transactional},
+		{stmt: "/* drop */ # alter\nDELETE FROM t", dialect: MySQLDialect, expected: Transactional},
+		{stmt: "create table t (id int)", dialect: MySQLDialect, expected: ImplicitCommit},
+		{stmt: "/* x */ Alter Table t ADD c INT", dialect: MySQLDialect, expected: ImplicitCommit},
+		{stmt: "CREATE TEMPORARY TABLE t (id INT)", dialect: MySQLDialect, expected: Transactional},
+		{stmt: "TRUNCATE t", dialect: MySQLDialect, expected: ImplicitCommit},
+		{stmt: "RENAME TABLE a TO b", dialect: MySQLDialect, expected: ImplicitCommit},
+		{stmt: "SET PASSWORD = 'x'", dialect: MySQLDialect, expected: ImplicitCommit},
+		{stmt: "SET @a = 'CREATE'", dialect: MySQLDialect, expected: Transactional},
+		{stmt: "start transaction", dialect: MySQLDialect, expected: TransactionControl},
+		{stmt: "BEGIN", dialect: MySQLDialect, expected: TransactionControl},
+		{stmt: "COMMIT", dialect: MySQLDialect, expected: TransactionControl},
+		{stmt: "CREATE TABLE t (id INT)", dialect: PostgresDialect, expected: Transactional},
+		{stmt: "CREATE TABLE t (database INT)", dialect: PostgresDialect, expected: Transactional},
+		{stmt: "create unique index concurrently i ON t (a)", dialect: PostgresDialect, expected: NonTransactional},
+		{stmt: "DROP INDEX CONCURRENTLY i", dialect: PostgresDialect, expected: NonTransactional},
+		{stmt: "CREATE DATABASE d", dialect: PostgresDialect, expected: NonTransactional},
+		{stmt: "VACUUM t", dialect: PostgresDialect, expected: NonTransactional},
+		{stmt: "ALTER TYPE \"mood\" ADD VALUE 'meh'", dialect: PostgresDialect, expected: NonTransactional},
+		{stmt: "ALTER TYPE mood RENAME VALUE 'a' TO 'b'", dialect: PostgresDialect, expected: Transactional},
+		{stmt: "REINDEX TABLE CONCURRENTLY t", dialect: PostgresDialect, expected: NonTransactional},
+		{stmt: "REINDEX TABLE t", dialect: PostgresDialect, expected: Transactional},
+		{stmt: "SELECT $$ VACUUM $$", dialect: PostgresDialect, expected: Transactional},
+		{stmt: "END", dialect: PostgresDialect, expected: TransactionControl},
+		{stmt: "CREATE TABLE t (id INT)", dialect: GenericDialect, expected: Transactional},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.stmt, func(t *testing.T) {
+			if c := ClassifyStatement([]byte(tc.stmt), tc.dialect).Class; c != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, c)
+			}
+		})
+	}
+}
+
+func TestClassifyStatement(t *testing.T) {
+	testcases := []struct {
+		stmt     string
+		dialect  Dialect
+		expected StatementInfo
+	}{
+		{stmt: "CREATE TABLE t (id INT)", dialect: MySQLDialect,
+			expected: StatementInfo{Kind: DDLStatement, Class: ImplicitCommit}},
+		{stmt: "INSERT INTO t VALUES ('DROP TABLE x')", dialect: MySQLDialect,
+			expected: StatementInfo{Kind: DMLStatement}},
+		{stmt: "-- a\n/* b */", dialect: PostgresDialect,
+			expected: StatementInfo{Kind: CommentOnlyStatement}},
+		{stmt: "  ", dialect: GenericDialect,
+			expected: StatementInfo{Kind: CommentOnlyStatement}},
+		{stmt: "COMMIT", dialect: PostgresDialect,
+			expected: StatementInfo{Kind: TransactionControlStatement, Class: TransactionControl}},
+		{stmt: "SET search_path TO x", dialect: PostgresDialect,
+			expected: StatementInfo{Kind: OtherStatement}},
+		{stmt: "drop table t", dialect: PostgresDialect,
+			expected: StatementInfo{Kind: DDLStatement, Warnings: WarnDropWithoutIfExists}},
+		{stmt: "DROP TEMPORARY TABLE t", dialect: MySQLDialect,
+			expected: StatementInfo{Kind: DDLStatement, Warnings: WarnDropWithoutIfExists}},
+		{stmt: "DROP TABLE IF EXISTS t", dialect: PostgresDialect,
+			expected: StatementInfo{Kind: DDLStatement}},
+		{stmt: "DELETE FROM t", dialect: PostgresDialect,
+			expected: StatementInfo{Kind: DMLStatement, Warnings: WarnDeleteWithoutWhere}},
+		{stmt: "DELETE FROM t WHERE a = 1", dialect: PostgresDialect,
+			expected: StatementInfo{Kind: DMLStatement}},
+		{stmt: "DELETE FROM t -- WHERE a = 1", dialect: MySQLDialect,
+			expected: StatementInfo{Kind: DMLStatement, Warnings: WarnDeleteWithoutWhere}},
+		{stmt: "DELETE FROM t -- migrate:nowarn", dialect: MySQLDialect,
+			expected: StatementInfo{Kind: DMLStatement}},
+		{stmt: "/* migrate:nowarn */ UPDATE t SET a = 'WHERE'", dialect: GenericDialect,
+			expected: StatementInfo{Kind: DMLStatement}},
+		{stmt: "UPDATE t SET a = 'WHERE'", dialect: GenericDialect,
+			expected: StatementInfo{Kind: DMLStatement, Warnings: WarnUpdateWithoutWhere}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.stmt, func(t *testing.T) {
+			if info := ClassifyStatement([]byte(tc.stmt), tc.dialect); info != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, info)
+			}
+		})
+	}
+}
+
+func TestStatementInfoString(t *testing.T) {
+	info := StatementInfo{Kind: DDLStatement, Class: ImplicitCommit, Warnings: WarnDropWithoutIfExists | WarnDeleteWithoutWhere}
+	expected := "DDL, implicit commit, warning: DROP TABLE without IF EXISTS, DELETE without WHERE"
+	if info.String() != expected {
+		t.Errorf("expected %q, got %q", expected, info.String())
+	}
+}
+
+func TestCheckTransactions(t *testing.T) {
+	testcases := []struct {
+		name     string
+		query    string
+		dialect  Dialect
+		expected []int
+	}{
+		{name: "mysql ddl without transaction", query: "CREATE TABLE t (id INT); INSERT INTO t VALUES (1)",
+			dialect: MySQLDialect, expected: []int{}},
+		{name: "mysql ddl in transaction", query: "START TRANSACTION; INSERT INTO t VALUES (1); ALTER TABLE t ADD c INT; CREATE TABLE u (id INT); COMMIT",
+			dialect: MySQLDialect, expected: []int{2}},
+		{name: "mysql ddl after commit", query: "BEGIN; INSERT INTO t VALUES (1); COMMIT; ALTER TABLE t ADD c INT",
+			dialect: MySQLDialect, expected: []int{}},
+		{name: "postgres single statement", query: "CREATE INDEX CONCURRENTLY i ON t (a)",
+			dialect: PostgresDialect, expected: []int{}},
+		{name: "postgres multiple statements", query: "CREATE TABLE t (a INT); CREATE INDEX CONCURRENTLY i ON t (a)",
+			dialect: PostgresDialect, expected: []int{1}},
+		{name: "postgres ddl in transaction", query: "BEGIN; CREATE TABLE t (a INT); COMMIT",
+			dialect: PostgresDialect, expected: []int{}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			stmts, err := SplitQueryOpts([]byte(tc.query), SplitOptions{Dialect: tc.dialect})
+			if err != nil {
+				t.Fatal(err)
+			}
+			issues := CheckTransactions(stmts, tc.dialect)
+			indexes := make([]int, 0, len(issues))
+			for _, issue := range issues {
+				indexes = append(indexes, issue.Index)
+			}
+			if len(indexes) != len(tc.expected) {
+				t.Fatalf("expected issues at %v, got %v", tc.expected, indexes)
+			}
+			for i := range indexes {
+				if indexes[i] != tc.expected[i] {
+					t.Errorf("expected issues at %v, got %v", tc.expected, indexes)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package database
+
+import (
+	"context"
+	"io"
+)
+
+// DriverContext is an optional interface a database driver can implement to
+// let callers cancel its operations, most importantly a long running
+// migration. Migrate uses LockContext and RunContext with its Context, if
+// set, instead of Lock and Run.
+type DriverContext interface {
+	// LockContext is like Lock, giving up once ctx is done.
+	LockContext(ctx context.Context) error
+
+	// RunContext is like Run. Once ctx is done, the migration is aborted
+	// and an error is returned. The statement running may have been
+	// applied partially, so the version must stay dirty.
+	RunContext(ctx context.Context, migration io.Reader) error
+
+	// SetVersionContext is like SetVersion, bounded by ctx.
+	SetVersionContext(ctx context.Context, version int, dirty bool) error
+
+	// VersionContext is like Version, bounded by ctx.
+	VersionContext(ctx context.Context) (version int, dirty bool, err error)
+}
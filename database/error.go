@@ -4,6 +4,46 @@ import (
 	"fmt"
 )
 
+// ErrorCode classifies database errors independently of the database.
+// Drivers map their native error codes to an ErrorCode.
+type ErrorCode int
+
+const (
+	CodeUnknown ErrorCode = iota
+	CodeDuplicateObject
+	CodeUndefinedObject
+	CodeLockTimeout
+	CodeDeadlock
+	CodeSyntax
+)
+
+// ErrorCodes can be used as targets for errors.Is, e.g.
+//
+//	errors.Is(err, database.ErrDuplicateObject)
+var (
+	ErrDuplicateObject error = CodeDuplicateObject
+	ErrUndefinedObject error = CodeUndefinedObject
+	ErrLockTimeout     error = CodeLockTimeout
+	ErrDeadlock        error = CodeDeadlock
+	ErrSyntax          error = CodeSyntax
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	CodeUnknown:         "unknown error",
+	CodeDuplicateObject: "duplicate object",
+	CodeUndefinedObject: "undefined object",
+	CodeLockTimeout:     "lock timeout",
+	CodeDeadlock:        "deadlock",
+	CodeSyntax:          "syntax error",
+}
+
+func (c ErrorCode) Error() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("error code %d", int(c))
+}
+
 // Error should be used for errors involving queries ran against the database
 type Error struct {
 	// Optional: the line number
@@ -17,6 +57,9 @@ type Error struct {
 
 	// OrigErr is the underlying error
 	OrigErr error
+
+	// Code classifies OrigErr, see ErrorCode
+	Code ErrorCode
 }
 
 func (e Error) Error() string {
@@ -25,3 +68,14 @@ func (e Error) Error() string {
 	}
 	return fmt.Sprintf("%v in line %v: %s (details: %v)", e.Err, e.Line, e.Query, e.OrigErr)
 }
+
+// Unwrap returns the underlying error.
+func (e Error) Unwrap() error {
+	return e.OrigErr
+}
+
+// Is reports whether target is the ErrorCode of e.
+func (e Error) Is(target error) bool {
+	c, ok := target.(ErrorCode)
+	return ok && c != CodeUnknown && c == e.Code
+}
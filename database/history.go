@@ -0,0 +1,175 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrVersionNotFound is returned by VersionHistory.FindVersion if the
+// version isn't recorded.
+var ErrVersionNotFound = fmt.Errorf("version not found")
+
+// ErrBatchMismatch is returned by DeployTagger.RunBatchTagged if the
+// number of migrations and versions differ.
+var ErrBatchMismatch = fmt.Errorf("number of migrations and versions differ")
+
+// HistoryEntry is a single applied migration version.
+type HistoryEntry struct {
+	Version int
+	Dirty   bool
+
+	// Optional: when the migration was applied
+	AppliedAt time.Time
+
+	// Optional: how long running the migration took, see DurationRecorder
+	Duration time.Duration
+
+	// Optional: a note attached to the migration
+	Note string
+
+	// Optional: the deploy the migration was applied in, see DeployTagger
+	DeployID string
+
+	// Optional: the hex encoded SHA-256 of the up migration, see
+	// ChecksumRecorder
+	Checksum string
+}
+
+// VersionNamer is an optional interface a database driver can implement to
+// record the name of a migration with its version, e.g. the identifier
+// from its file name. Migrate calls SetVersionWithName instead of
+// SetVersion for up migrations, whose name it knows.
+type VersionNamer interface {
+	SetVersionWithName(version int, dirty bool, name string) error
+}
+
+// HistoryReader is an optional interface a database driver can implement
+// if it keeps a record of every applied migration, not only the current
+// version.
+type HistoryReader interface {
+	// History returns the applied migrations, oldest first.
+	History() ([]HistoryEntry, error)
+}
+
+// VersionHistory is an optional interface a database driver can implement
+// to keep a row for every version, next to the current version.
+// Drivers implementing it should pass testing.TestHistory.
+type VersionHistory interface {
+	// FindVersion returns the entry of version, or ErrVersionNotFound.
+	FindVersion(version int) (HistoryEntry, error)
+
+	// UpsertVersion records version, or updates its dirty flag if it
+	// is recorded already.
+	UpsertVersion(version int, dirty bool) error
+
+	// DeleteVersion removes version. Removing a version that isn't
+	// recorded is no error.
+	DeleteVersion(version int) error
+
+	// ListVersions returns up to limit entries ordered by version,
+	// skipping the first offset ones. A limit <= 0 returns all of them.
+	ListVersions(offset, limit int) ([]HistoryEntry, error)
+}
+
+// DeployTagger is an optional interface a database driver implementing
+// VersionHistory can implement to group the versions applied by one deploy.
+// Drivers implementing it should pass testing.TestDeployTagger.
+type DeployTagger interface {
+	// RunBatchTagged runs migrations[i] and sets versions[i] for every
+	// migration, like Run and SetVersion do, and stamps the history
+	// entries of the versions with deployID. It stops at the first
+	// error, leaving that version dirty.
+	RunBatchTagged(migrations []io.Reader, versions []int, deployID string) error
+
+	// VersionsByDeploy returns the versions stamped with deployID,
+	// ordered by version.
+	VersionsByDeploy(deployID string) ([]int, error)
+}
+
+// ChecksumRecorder is an optional interface a database driver implementing
+// VersionHistory can implement to keep the checksum of every applied up
+// migration, so that migrations edited after they were applied can be
+// found. FindVersion returns it in HistoryEntry.Checksum.
+type ChecksumRecorder interface {
+	// RecordChecksum stores checksum, the hex encoded SHA-256 of the up
+	// migration, with the history entry of version, creating a clean
+	// entry if there is none.
+	RecordChecksum(version int, checksum string) error
+}
+
+// DurationRecorder is an optional interface a database driver implementing
+// VersionHistory can implement to keep how long every applied up migration
+// took to run, e.g. for capacity planning. FindVersion and ListVersions
+// return it in HistoryEntry.Duration, zero for entries without one.
+type DurationRecorder interface {
+	// RecordDuration stores how long running the migration of version
+	// took with its history entry, creating a clean entry if there is
+	// none. It's only called once the migration succeeded, so the
+	// entries of migrations that failed keep none.
+	RecordDuration(version int, d time.Duration) error
+}
+
+// AppliedSet returns the set of versions applied to d. It lists the
+// versions of a VersionHistory or the History of a HistoryReader, for other
+// drivers it only has the current version. Dirty versions count as applied,
+// since they ran at least partially.
+func AppliedSet(d Driver) (map[int]bool, error) {
+	entries, err := appliedEntries(d)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]bool, len(entries))
+	for _, e := range entries {
+		applied[e.Version] = true
+	}
+	return applied, nil
+}
+
+// AllAppliedClean checks that all of versions are applied to d and clean,
+// e.g. for a startup check requiring a set of migrations. It reads the
+// applied versions once, like AppliedSet, and returns the versions that
+// are missing and those that are dirty, in the order given.
+func AllAppliedClean(d Driver, versions []int) (ok bool, missing []int, dirty []int, err error) {
+	entries, err := appliedEntries(d)
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	// a version recorded more than once is dirty if any entry is
+	applied := make(map[int]bool, len(entries))
+	for _, e := range entries {
+		applied[e.Version] = applied[e.Version] || e.Dirty
+	}
+	for _, v := range versions {
+		isDirty, ok := applied[v]
+		switch {
+		case !ok:
+			missing = append(missing, v)
+		case isDirty:
+			dirty = append(dirty, v)
+		}
+	}
+	return len(missing) == 0 && len(dirty) == 0, missing, dirty, nil
+}
+
+// appliedEntries returns the entries of the versions applied to d, see
+// AppliedSet.
+func appliedEntries(d Driver) ([]HistoryEntry, error) {
+	switch h := d.(type) {
+	case VersionHistory:
+		return h.ListVersions(0, 0)
+	case HistoryReader:
+		return h.History()
+	}
+
+	v, dirty, err := d.Version()
+	if err != nil {
+		return nil, err
+	}
+	if v == NilVersion {
+		return nil, nil
+	}
+	return []HistoryEntry{{Version: v, Dirty: dirty}}, nil
+}
@@ -0,0 +1,45 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+// listDriver implements VersionHistory with fixed entries.
+type listDriver struct {
+	historyDriver
+	entries []HistoryEntry
+}
+
+func (d listDriver) ListVersions(offset, limit int) ([]HistoryEntry, error) {
+	return d.entries, nil
+}
+
+func TestAllAppliedClean(t *testing.T) {
+	d := listDriver{entries: []HistoryEntry{{Version: 1}, {Version: 2}, {Version: 4, Dirty: true}, {Version: 5}}}
+
+	ok, missing, dirty, err := AllAppliedClean(d, []int{5, 3, 1, 4, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected missing and dirty versions")
+	}
+	if !reflect.DeepEqual(missing, []int{3, 6}) {
+		t.Errorf("expected 3 and 6 to be missing, got %v", missing)
+	}
+	if !reflect.DeepEqual(dirty, []int{4}) {
+		t.Errorf("expected 4 to be dirty, got %v", dirty)
+	}
+
+	ok, missing, dirty, err = AllAppliedClean(d, []int{1, 2, 5})
+	if err != nil || !ok || len(missing) != 0 || len(dirty) != 0 {
+		t.Errorf("expected all versions to be applied and clean, got %v %v %v (%v)", ok, missing, dirty, err)
+	}
+
+	// without a history only the current version is known
+	ok, missing, _, err = AllAppliedClean(nopDriver{}, []int{1})
+	if err != nil || ok || !reflect.DeepEqual(missing, []int{1}) {
+		t.Errorf("expected 1 to be missing, got %v %v (%v)", ok, missing, err)
+	}
+}
@@ -0,0 +1,22 @@
+package database
+
+import (
+	"context"
+)
+
+// ReasonLocker is an optional interface a database driver can implement if
+// it can record why the lock was taken, e.g. "deploy 4512 by CI", so that
+// others trying to acquire it can tell who holds it and why.
+type ReasonLocker interface {
+	// LockWithReason is like Lock, recording reason with the lock.
+	LockWithReason(reason string) error
+}
+
+// ReasonLockerContext is an optional interface a database driver
+// implementing ReasonLocker and DriverContext can implement, so that a lock
+// taken with a reason can be given up, too. Migrate prefers LockContext over
+// LockWithReason if the driver lacks it.
+type ReasonLockerContext interface {
+	// LockWithReasonContext is like LockWithReason, giving up once ctx is done.
+	LockWithReasonContext(ctx context.Context, reason string) error
+}
@@ -0,0 +1,8 @@
+package database
+
+// Logger receives the warnings of a database driver, e.g. about statements
+// that can't run inside a transaction. migrate.Logger and *log.Logger
+// implement it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
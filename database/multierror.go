@@ -0,0 +1,65 @@
+package database
+
+import (
+	"strings"
+)
+
+// MultiError collects multiple errors, e.g. from dropping several tables.
+type MultiError struct {
+	Errs []error
+}
+
+// Append adds errs to err and returns the resulting *MultiError, flattening
+// any *MultiError in errs and skipping nil errors. If err is a *MultiError,
+// errs are appended to it. Otherwise a new *MultiError is returned holding
+// err, unless it is nil, followed by errs. Use ErrorOrNil to get nil if
+// no errors were collected:
+//
+//	var result *database.MultiError
+//	result = database.Append(result, err)
+//	return result.ErrorOrNil()
+func Append(err error, errs ...error) *MultiError {
+	me, ok := err.(*MultiError)
+	if !ok || me == nil {
+		me = &MultiError{}
+		if !ok && err != nil {
+			me.Errs = append(me.Errs, err)
+		}
+	}
+
+	for _, e := range errs {
+		switch e := e.(type) {
+		case nil:
+		case *MultiError:
+			if e != nil {
+				me.Errs = append(me.Errs, e.Errs...)
+			}
+		default:
+			me.Errs = append(me.Errs, e)
+		}
+	}
+	return me
+}
+
+// Error implements error. Every error is written on its own line.
+func (m *MultiError) Error() string {
+	strs := make([]string, 0, len(m.Errs))
+	for _, e := range m.Errs {
+		strs = append(strs, e.Error())
+	}
+	return strings.Join(strs, "\n")
+}
+
+// Unwrap returns the collected errors, so errors.Is and errors.As
+// find any of them.
+func (m *MultiError) Unwrap() []error {
+	return m.Errs
+}
+
+// ErrorOrNil returns nil if m is nil or holds no errors, m otherwise.
+func (m *MultiError) ErrorOrNil() error {
+	if m == nil || len(m.Errs) == 0 {
+		return nil
+	}
+	return m
+}
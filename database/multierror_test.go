@@ -0,0 +1,71 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	err1 := fmt.Errorf("first")
+	err2 := fmt.Errorf("second")
+	err3 := fmt.Errorf("third")
+
+	testcases := []struct {
+		name     string
+		err      error
+		errs     []error
+		expected []error
+	}{
+		{name: "nil", err: nil, errs: nil, expected: nil},
+		{name: "nil errs", err: nil, errs: []error{nil, nil}, expected: nil},
+		{name: "plain error", err: err1, errs: []error{err2}, expected: []error{err1, err2}},
+		{name: "nil multi error", err: (*MultiError)(nil), errs: []error{err1}, expected: []error{err1}},
+		{name: "multi error", err: &MultiError{Errs: []error{err1}}, errs: []error{nil, err2}, expected: []error{err1, err2}},
+		{name: "flatten", err: err1, errs: []error{&MultiError{Errs: []error{err2, err3}}}, expected: []error{err1, err2, err3}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			me := Append(tc.err, tc.errs...)
+			if len(me.Errs) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, me.Errs)
+			}
+			for i := range me.Errs {
+				if me.Errs[i] != tc.expected[i] {
+					t.Errorf("expected %v, got %v", tc.expected, me.Errs)
+				}
+			}
+			if (me.ErrorOrNil() == nil) != (len(tc.expected) == 0) {
+				t.Errorf("unexpected ErrorOrNil %v", me.ErrorOrNil())
+			}
+		})
+	}
+}
+
+func TestMultiError(t *testing.T) {
+	var result *MultiError
+	if result.ErrorOrNil() != nil {
+		t.Fatal("expected nil")
+	}
+
+	result = Append(result, Error{OrigErr: fmt.Errorf("table exists"), Code: CodeDuplicateObject, Err: "drop failed"})
+	result = Append(result, ErrLocked)
+	err := result.ErrorOrNil()
+
+	if !errors.Is(err, ErrLocked) {
+		t.Error("expected errors.Is to find ErrLocked")
+	}
+	if !errors.Is(err, ErrDuplicateObject) {
+		t.Error("expected errors.Is to find ErrDuplicateObject")
+	}
+	var dbErr Error
+	if !errors.As(err, &dbErr) || dbErr.Err != "drop failed" {
+		t.Errorf("expected errors.As to find the database.Error, got %v", dbErr)
+	}
+
+	expected := "drop failed in line 0:  (details: table exists)\ncan't acquire lock"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
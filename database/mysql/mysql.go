@@ -3,6 +3,8 @@
 package mysql
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -10,9 +12,18 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	nurl "net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 import (
@@ -30,33 +41,500 @@ func init() {
 
 var DefaultMigrationsTable = "schema_migrations"
 
+// DefaultLockIdentifier tags the lock queries, so that they can be
+// spotted in SHOW PROCESSLIST.
+var DefaultLockIdentifier = "golang-migrate lock"
+
+// DefaultVersionTableEngine is the storage engine of the version table, so
+// that it's transactional on servers defaulting to another engine.
+var DefaultVersionTableEngine = "InnoDB"
+
+// DefaultMigrationTablesPattern is the LIKE pattern ListMigrationTables
+// matches table names against, unless Config.MigrationTablesPattern is set.
+var DefaultMigrationTablesPattern = "%migrations%"
+
+// DefaultLockTimeout is how many seconds Lock waits for the lock, unless
+// Config.LockTimeout is set.
+var DefaultLockTimeout = 10
+
+// DefaultLockRetryInterval is how long Lock sleeps between attempts to get
+// the lock, if Config.LockRetries is set and Config.LockRetryInterval isn't.
+var DefaultLockRetryInterval = time.Second
+
+// DefaultVersionQueryTimeout bounds the queries reading and writing the
+// version, unless Config.VersionQueryTimeout is set.
+var DefaultVersionQueryTimeout = 30 * time.Second
+
+// DefaultWriteTimeout bounds sending a statement to the server, unless the
+// URL sets x-write-timeout or writeTimeout.
+var DefaultWriteTimeout = 30 * time.Second
+
+// DefaultReadTimeout bounds waiting for the result of a statement, unless
+// the URL sets x-read-timeout or readTimeout. Zero means no timeout, since
+// migrations can legitimately run a single statement for hours.
+var DefaultReadTimeout time.Duration
+
 var (
-	ErrDatabaseDirty  = fmt.Errorf("database is dirty")
-	ErrNilConfig      = fmt.Errorf("no config")
-	ErrNoDatabaseName = fmt.Errorf("no database name")
-	ErrAppendPEM      = fmt.Errorf("failed to append PEM")
+	ErrDatabaseDirty         = fmt.Errorf("database is dirty")
+	ErrNilConfig             = fmt.Errorf("no config")
+	ErrNoDatabaseName        = fmt.Errorf("no database name")
+	ErrAppendPEM             = fmt.Errorf("failed to append PEM")
+	ErrStreamStrict          = fmt.Errorf("StreamStatements can't be combined with StrictTransactions")
+	ErrLockLost              = fmt.Errorf("lock lost")
+	ErrOSCStatement          = fmt.Errorf("can't parse the ALTER TABLE statement for the online schema change")
+	ErrOutsideWindow         = fmt.Errorf("outside of the allowed window for migrations")
+	ErrStreamTransactional   = fmt.Errorf("StreamStatements can't run migrations with the transactional header")
+	ErrTransactionalCommit   = fmt.Errorf("statement ends the transaction of a migration with the transactional header")
+	ErrStreamProtectDML      = fmt.Errorf("StreamStatements can't be combined with ProtectDML")
+	ErrProtectDMLTransaction = fmt.Errorf("ProtectDML can't run migrations controlling transactions themselves")
+	ErrVersionTableEngine    = fmt.Errorf("invalid storage engine for the version table")
+	ErrLockTimeoutExceeded   = fmt.Errorf("lock held longer than MaxLockDuration, migration aborted")
+	ErrNegativeLockTimeout   = fmt.Errorf("LockTimeout must not be negative, except -1 to wait forever")
+	ErrCopyTargetNotEmpty    = fmt.Errorf("table to copy the history to isn't empty")
+	ErrNegativeLockRetries   = fmt.Errorf("LockRetries must not be negative")
+	ErrStreamRunInTx         = fmt.Errorf("StreamStatements can't be combined with RunInTransaction")
+	ErrRunInTxControl        = fmt.Errorf("RunInTransaction can't run migrations controlling transactions themselves")
+	ErrSplitSendAtOnce       = fmt.Errorf("SplitStatements can't be combined with SendAtOnce")
+	ErrLockStrategyAdvisory  = fmt.Errorf("TrackLockOwner and MaxLockDuration need LockStrategyAdvisory")
+	ErrNoAppliedAtColumn     = fmt.Errorf("migrations table has no applied_at column, see UpgradeVersionTable")
+)
+
+// LockScope controls which migrations are serialized by the advisory lock.
+type LockScope int
+
+const (
+	// LockScopeDatabase locks the id earlier releases used, hashed from
+	// `database:migrations table`, so that drivers of different releases
+	// exclude each other while they are rolled out.
+	LockScopeDatabase LockScope = iota
+
+	// LockScopeTable only serializes migrations using the same migrations
+	// table, so that unrelated migration streams can run concurrently. The
+	// lock is named after the database the table is in, so qualified and
+	// unqualified names of a table share it.
+	LockScopeTable
+)
+
+// parseLockScope parses the `x-lock-scope` URL query value.
+func parseLockScope(s string) (LockScope, error) {
+	switch strings.ToLower(s) {
+	case "", "database":
+		return LockScopeDatabase, nil
+	case "table":
+		return LockScopeTable, nil
+	}
+	return 0, fmt.Errorf("unknown lock scope %q, expected database or table", s)
+}
+
+// LockStrategy controls how Lock keeps migrations from running
+// concurrently.
+type LockStrategy int
+
+const (
+	// LockStrategyAdvisory takes an advisory lock with GET_LOCK.
+	LockStrategyAdvisory LockStrategy = iota
+
+	// LockStrategyTable inserts a row into the LockTable instead, for
+	// MySQL compatible servers without GET_LOCK, like Vitess. Lock doesn't
+	// wait for the row, use LockRetries. A process that dies holding the
+	// lock leaves its row behind, delete it to release the lock.
+	LockStrategyTable
+
+	// LockStrategyNone turns Lock and Unlock into no-ops. Keeping
+	// migrations from running concurrently is up to the caller then.
+	LockStrategyNone
 )
 
+// parseLockStrategy parses the `x-lock-strategy` URL query value.
+func parseLockStrategy(s string) (LockStrategy, error) {
+	switch strings.ToLower(s) {
+	case "", "advisory":
+		return LockStrategyAdvisory, nil
+	case "table":
+		return LockStrategyTable, nil
+	case "none":
+		return LockStrategyNone, nil
+	}
+	return 0, fmt.Errorf("unknown lock strategy %q, expected advisory, table or none", s)
+}
+
+// Window is a daily time window in UTC, e.g. 22:00-06:00, see
+// Config.AllowedWindow. It wraps around midnight if End is before Start.
+type Window struct {
+	// Start and End are the time of the day.
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow parses a window like `22:00-06:00`, in UTC. Hours can be
+// given without minutes, e.g. `22-6`.
+func ParseWindow(s string) (*Window, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid window %q, expected e.g. 22:00-06:00", s)
+	}
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid window %q: %v", s, err)
+	}
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid window %q: %v", s, err)
+	}
+	return &Window{Start: start, End: end}, nil
+}
+
+// parseTimeOfDay parses `HH:MM` or `HH` into the time since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	hm := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	h, err := strconv.Atoi(hm[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid hour in %q", s)
+	}
+	var min int
+	if len(hm) == 2 {
+		min, err = strconv.Atoi(hm[1])
+		if err != nil || min < 0 || min > 59 || (h == 24 && min > 0) {
+			return 0, fmt.Errorf("invalid minute in %q", s)
+		}
+	}
+	return time.Duration(h)*time.Hour + time.Duration(min)*time.Minute, nil
+}
+
+// Contains returns true if t lies within w. Start is included, End isn't.
+func (w Window) Contains(t time.Time) bool {
+	t = t.UTC()
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	if w.Start <= w.End {
+		return d >= w.Start && d < w.End
+	}
+	return d >= w.Start || d < w.End
+}
+
 type Config struct {
 	MigrationsTable string
 	DatabaseName    string
+
+	// HistoryTable keeps the rows of the database.VersionHistory methods.
+	// It defaults to MigrationsTable with a _history suffix and is created
+	// when first used.
+	HistoryTable string
+
+	// OnlineDDL appends `ALGORITHM=INPLACE, LOCK=NONE` to ALTER TABLE
+	// statements that don't specify ALGORITHM or LOCK themselves.
+	OnlineDDL bool
+
+	// AutoIfNotExists adds IF NOT EXISTS to CREATE TABLE, CREATE INDEX and
+	// ALTER TABLE ... ADD COLUMN statements, as far as the server supports
+	// it, so that partially applied migrations can be run again.
+	AutoIfNotExists bool
+
+	// LockScope defaults to LockScopeDatabase.
+	LockScope LockScope
+
+	// LockStrategy defaults to LockStrategyAdvisory. TrackLockOwner and
+	// MaxLockDuration need the advisory lock.
+	LockStrategy LockStrategy
+
+	// LockTable keeps the lock of LockStrategyTable. It defaults to
+	// MigrationsTable with a _lock suffix and is created when first used.
+	LockTable string
+
+	// LockIdentifier is put in a comment in the lock queries, e.g.
+	// SELECT /* golang-migrate lock */ GET_LOCK(...). It defaults to
+	// DefaultLockIdentifier.
+	LockIdentifier string
+
+	// LockTimeout is how many seconds Lock waits for a lock held by
+	// another session before failing with ErrLockWaitTimeout. Zero fails
+	// right away, -1 waits forever. Nil defaults to DefaultLockTimeout.
+	LockTimeout *int
+
+	// LockRetries is how many more times Lock tries to get the lock if
+	// another session holds it, sleeping LockRetryInterval in between,
+	// e.g. for CI jobs racing each other. It defaults to no retries.
+	LockRetries int
+
+	// LockRetryInterval defaults to DefaultLockRetryInterval.
+	LockRetryInterval time.Duration
+
+	// DeferVersionCommit makes SetVersion remember the version instead of
+	// writing it. Call the closure returned by PendingVersion to write it.
+	DeferVersionCommit bool
+
+	// StrictTransactions makes Run fail instead of warning through Log if a
+	// statement commits an explicit transaction of the migration implicitly.
+	StrictTransactions bool
+
+	// StreamStatements makes Run execute a migration statement by statement
+	// while reading it, instead of reading it completely and sending it at
+	// once, so that only one statement is held in memory. Since statements
+	// run before the rest is read, it can't be combined with
+	// StrictTransactions.
+	StreamStatements bool
+
+	// OnlineSchemaChangeCmd is the command running the ALTER TABLE
+	// statements marked with OSCMarker, e.g. a wrapper around gh-ost or
+	// pt-online-schema-change. See onlineSchemaChange for the contract.
+	OnlineSchemaChangeCmd string
+
+	// VersionCacheTTL makes Version return the version it read last for
+	// this long, instead of querying it again, e.g. for frequent health
+	// checks. Writing the version through the driver drops the cached
+	// one. Zero disables the cache.
+	VersionCacheTTL time.Duration
+
+	// StoreSQL makes RunWithVersion keep the SQL of each migration in the
+	// history table, so that GetVersionSQL can show what ran even after
+	// the migration files changed. Note that migrations inserting
+	// credentials or personal data then store these, too.
+	StoreSQL bool
+
+	// MigrationTablesPattern is the LIKE pattern ListMigrationTables
+	// matches table names against. It defaults to
+	// DefaultMigrationTablesPattern.
+	MigrationTablesPattern string
+
+	// VersionQueryTimeout bounds the bookkeeping queries of Version,
+	// SetVersion, FindVersion and DeleteVersion, which can otherwise block
+	// forever, e.g. behind a metadata lock on the migrations table. It
+	// defaults to DefaultVersionQueryTimeout, a negative value disables it.
+	// Run isn't bounded by it.
+	VersionQueryTimeout time.Duration
+
+	// AllowedWindow makes Run and RunBatchTagged refuse to run migrations
+	// with ErrOutsideWindow outside of the window, e.g. during peak
+	// traffic, unless ForceWindow is set. Nil allows migrations anytime.
+	AllowedWindow *Window
+	ForceWindow   bool
+
+	// TrackLockOwner makes Lock record the host and pid of the process
+	// holding the lock, and the reason passed to LockWithReason, in
+	// LockOwnerTable. Lock then returns ErrLockedBy instead of
+	// ErrLockWaitTimeout if another tracking process holds the lock.
+	TrackLockOwner bool
+
+	// LockOwnerTable defaults to MigrationsTable with a _lock_owner suffix
+	// and is created when first used.
+	LockOwnerTable string
+
+	// VersionTableEngine is the storage engine the version table is
+	// created with. It defaults to DefaultVersionTableEngine. Existing
+	// tables aren't altered.
+	VersionTableEngine string
+
+	// UpgradeVersionTable adds the applied_at and name columns to a
+	// migrations table created before they existed, when the driver is
+	// created. Without it the table isn't altered, VersionApplied returns
+	// ErrNoAppliedAtColumn and version names aren't recorded.
+	UpgradeVersionTable bool
+
+	// WarnOnOutOfOrder makes UpsertVersion pass a warning to Log if it
+	// records a version lower than the highest one in the history table,
+	// e.g. a migration merged after newer ones were deployed.
+	WarnOnOutOfOrder bool
+
+	// ProtectDML makes Run execute a migration statement by statement, and
+	// each group of consecutive DML statements, like INSERT, UPDATE or
+	// DELETE, in a transaction of its own. If a DML statement fails, its
+	// group is rolled back and the migration fails, while the statements
+	// before the group, which MySQL commits implicitly if they're DDL, stay
+	// applied. Statements that are neither DML nor DDL, like SET, end a
+	// group and run on their own. Migrations starting or ending
+	// transactions themselves fail with ErrProtectDMLTransaction, and
+	// migrations using the online schema change aren't protected. It
+	// can't be combined with StreamStatements.
+	ProtectDML bool
+
+	// RunInTransaction makes Run execute every migration in a transaction,
+	// rolled back if a statement fails. Unlike the TransactionalHeader, it
+	// allows statements MySQL commits implicitly, like CREATE TABLE or
+	// ALTER TABLE, so a failing statement only rolls back the statements
+	// since the last of those. Migrations starting or ending transactions
+	// themselves fail with ErrRunInTxControl, and migrations using the
+	// online schema change aren't wrapped. ProtectDML doesn't apply then,
+	// and it can't be combined with StreamStatements.
+	RunInTransaction bool
+
+	// SplitStatements makes Open leave multiStatements disabled, e.g. for
+	// proxies like ProxySQL or Vitess that reject multi statement queries.
+	// Run executes migrations statement by statement anyway, unless
+	// SendAtOnce is set, so it can't be combined with that.
+	SplitStatements bool
+
+	// SendAtOnce makes Run send a migration to the server in one query,
+	// relying on multiStatements, instead of statement by statement, e.g.
+	// for a huge generated migration where a round trip per statement is
+	// too slow. The database.Error of a failing migration doesn't tell
+	// which statement failed then. StreamStatements, ProtectDML,
+	// RunInTransaction and the TransactionalHeader run statements one by
+	// one regardless.
+	SendAtOnce bool
+
+	// StrictSplit makes Run fail with a database.SplitError instead of
+	// splitting a compound statement, like a CREATE PROCEDURE without
+	// DELIMITER, on every semicolon if its BEGIN ... END nesting can't be
+	// resolved. Unterminated quotes and comments always fail.
+	StrictSplit bool
+
+	// SQLTransform, if set, rewrites every statement of a migration after
+	// it was split, and after AutoIfNotExists and OnlineDDL, right before
+	// it runs, e.g. to replace ENGINE=MyISAM with ENGINE=InnoDB. Returning
+	// an error aborts the migration, with StreamStatements after the
+	// statements before it ran. Statements run by the
+	// OnlineSchemaChangeCmd aren't transformed.
+	SQLTransform func(stmt []byte) ([]byte, error)
+
+	// MaxAllowedPacket is the size in bytes of the largest query Run sends
+	// to the server. Run fails with ErrStatementTooLarge before running a
+	// migration with a larger statement, instead of the server failing
+	// it half way. It defaults to the max_allowed_packet of the server,
+	// read when the driver is created. Set it if a proxy in between
+	// allows less.
+	MaxAllowedPacket int
+
+	// MaxLockDuration bounds how long the lock is held, so that a hung
+	// migration doesn't block all deploys. Once exceeded, the running
+	// migration is canceled, the connection holding the lock is killed if
+	// Open created the driver, which releases the lock, and Run returns
+	// ErrLockTimeoutExceeded. The driver has to be opened again after
+	// that. Zero disables it.
+	MaxLockDuration time.Duration
+
+	// Log receives the warnings of the driver. They are dropped if it's
+	// nil.
+	Log database.Logger
+}
+
+type versionState struct {
+	version int
+	dirty   bool
+	name    string
+}
+
+// dbConn is the part of *sql.Conn the driver runs its queries through.
+// *sql.DB implements it, too, so that tests can run single methods against
+// a mock database without the queries of WithInstance.
+type dbConn interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+	Close() error
 }
 
 type Mysql struct {
 	// mysql RELEASE_LOCK must be called from the same conn, so
 	// just do everything over a single conn anyway.
-	conn     *sql.Conn
+	conn     dbConn
 	isLocked bool
 
+	// db is closed with the driver, it's only set if Open created it.
+	db *sql.DB
+
+	// supportsOnlineDDL is true if the server understands the
+	// ALGORITHM and LOCK clauses of ALTER TABLE.
+	supportsOnlineDDL bool
+
+	// ifNotExists tells which statements accept IF NOT EXISTS.
+	ifNotExists ifNotExistsSupport
+
+	// maxAllowedPacket is the max_allowed_packet of the server, zero if
+	// unknown, see Config.MaxAllowedPacket.
+	maxAllowedPacket int
+
+	// pendingVersion is set by SetVersion if DeferVersionCommit is on.
+	pendingVersion *versionState
+
+	// cachedVersion is the version Version read last, valid until
+	// cachedUntil, see Config.VersionCacheTTL. cacheGeneration is
+	// increased whenever the version is written, so that a version read
+	// before a write isn't cached after it.
+	cacheMu         sync.Mutex
+	cachedVersion   *versionState
+	cachedUntil     time.Time
+	cacheGeneration uint64
+
+	// hasSQLColumn is true once the history table is known to have the
+	// sql_text column, see StoreSQL.
+	hasSQLColumn bool
+
+	// noAppliedAt and noVersionName are set if the migrations table
+	// lacks the versionColumns, see UpgradeVersionTable.
+	noAppliedAt   bool
+	noVersionName bool
+
+	// hasLockTable is true once the LockTable was created, lockToken
+	// identifies the row of this driver in it, see LockStrategyTable.
+	hasLockTable bool
+	lockToken    string
+
+	// hasHistoryColumns is true once the history table is known to exist
+	// with the historyColumns.
+	hasHistoryColumns bool
+
+	// ctxMu guards watchdog, lockCtx, lockCancel, callerCtx and canceled,
+	// which the goroutines of RunContext and RunParallel read while the
+	// caller sets them.
+	ctxMu sync.Mutex
+
+	// watchdog fires once the lock was held for MaxLockDuration. It
+	// cancels lockCtx, which the migrations run with, and sets
+	// lockExceeded.
+	watchdog     *time.Timer
+	lockCtx      context.Context
+	lockCancel   context.CancelFunc
+	lockExceeded int32
+
+	// callerCtx is the context RunContext runs the migration with, nil
+	// outside of RunContext. canceled is set once it was canceled, see
+	// Unlock.
+	callerCtx context.Context
+	canceled  bool
+
 	config *Config
 }
 
-// instance must have `multiStatements` set to true
+// instance must have `multiStatements` set to true if config.SendAtOnce
+// is set.
 func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 	if config == nil {
 		return nil, ErrNilConfig
 	}
 
+	if config.StreamStatements && config.StrictTransactions {
+		return nil, ErrStreamStrict
+	}
+
+	if config.StreamStatements && config.ProtectDML {
+		return nil, ErrStreamProtectDML
+	}
+
+	if config.StreamStatements && config.RunInTransaction {
+		return nil, ErrStreamRunInTx
+	}
+
+	if config.SplitStatements && config.SendAtOnce {
+		return nil, ErrSplitSendAtOnce
+	}
+
+	if config.LockTimeout != nil && *config.LockTimeout < -1 {
+		return nil, ErrNegativeLockTimeout
+	}
+
+	if config.LockRetries < 0 {
+		return nil, ErrNegativeLockRetries
+	}
+
+	if config.LockStrategy != LockStrategyAdvisory && (config.TrackLockOwner || config.MaxLockDuration > 0) {
+		return nil, ErrLockStrategyAdvisory
+	}
+
+	if len(config.VersionTableEngine) > 0 && !engineName.MatchString(config.VersionTableEngine) {
+		return nil, ErrVersionTableEngine
+	}
+
 	if err := instance.Ping(); err != nil {
 		return nil, err
 	}
@@ -64,7 +542,7 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 	query := `SELECT DATABASE()`
 	var databaseName sql.NullString
 	if err := instance.QueryRow(query).Scan(&databaseName); err != nil {
-		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 	}
 
 	if len(databaseName.String) == 0 {
@@ -77,6 +555,18 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		config.MigrationsTable = DefaultMigrationsTable
 	}
 
+	if len(config.HistoryTable) == 0 {
+		config.HistoryTable = config.MigrationsTable + "_history"
+	}
+
+	if len(config.LockOwnerTable) == 0 {
+		config.LockOwnerTable = config.MigrationsTable + "_lock_owner"
+	}
+
+	if len(config.LockTable) == 0 {
+		config.LockTable = config.MigrationsTable + "_lock"
+	}
+
 	conn, err := instance.Conn(context.Background())
 	if err != nil {
 		return nil, err
@@ -86,8 +576,27 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		conn:   conn,
 		config: config,
 	}
+	if config.LockStrategy == LockStrategyNone {
+		mx.warnf("locking is disabled, keeping migrations from running concurrently is up to the caller")
+	}
+
+	query = `SELECT VERSION()`
+	var version string
+	if err := conn.QueryRowContext(context.Background(), query).Scan(&version); err != nil {
+		conn.Close()
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	mx.supportsOnlineDDL = supportsOnlineDDL(version)
+	mx.ifNotExists = supportsIfNotExists(version)
+
+	query = `SELECT @@max_allowed_packet`
+	if err := conn.QueryRowContext(context.Background(), query).Scan(&mx.maxAllowedPacket); err != nil {
+		conn.Close()
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
 
 	if err := mx.ensureVersionTable(); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -113,22 +622,125 @@ func urlToMySQLConfig(u nurl.URL) (*mysql.Config, error) {
 	return c, nil
 }
 
+// setTimeouts sets the read and write timeouts of c from the
+// x-read-timeout and x-write-timeout parameters in q. Without them, the
+// defaults apply unless the DSN parameters readTimeout and writeTimeout
+// set the timeouts already.
+func setTimeouts(c *mysql.Config, q nurl.Values) error {
+	if s := q.Get("x-read-timeout"); len(s) > 0 {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		c.ReadTimeout = d
+	} else if c.ReadTimeout == 0 {
+		c.ReadTimeout = DefaultReadTimeout
+	}
+
+	if s := q.Get("x-write-timeout"); len(s) > 0 {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		c.WriteTimeout = d
+	} else if c.WriteTimeout == 0 {
+		c.WriteTimeout = DefaultWriteTimeout
+	}
+	return nil
+}
+
+// isCustomTLSConfig returns true if the value of the tls parameter names a
+// custom TLS config rather than one go-sql-driver/mysql understands itself:
+// a bool, "skip-verify" or "preferred".
+func isCustomTLSConfig(ctls string) bool {
+	if _, isBool := readBool(ctls); isBool {
+		return false
+	}
+	switch strings.ToLower(ctls) {
+	case "", "skip-verify", "preferred":
+		return false
+	}
+	return true
+}
+
+// registerTLSConfig registers the TLS config named by the tls parameter of
+// purl, built from x-tls-ca, x-tls-cert, x-tls-key and
+// x-tls-insecure-skip-verify. x-tls-cert and x-tls-key are only needed if
+// the server asks for a client certificate. Other tls values are passed to
+// go-sql-driver/mysql unchanged.
+func registerTLSConfig(purl *nurl.URL) error {
+	ctls := purl.Query().Get("tls")
+	if !isCustomTLSConfig(ctls) {
+		return nil
+	}
+
+	rootCertPool := x509.NewCertPool()
+	pem, err := ioutil.ReadFile(purl.Query().Get("x-tls-ca"))
+	if err != nil {
+		return err
+	}
+
+	if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
+		return ErrAppendPEM
+	}
+
+	insecureSkipVerify := false
+	if len(purl.Query().Get("x-tls-insecure-skip-verify")) > 0 {
+		x, err := strconv.ParseBool(purl.Query().Get("x-tls-insecure-skip-verify"))
+		if err != nil {
+			return err
+		}
+		insecureSkipVerify = x
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs:            rootCertPool,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	// the client certificate is optional
+	certFile, keyFile := purl.Query().Get("x-tls-cert"), purl.Query().Get("x-tls-key")
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		certs, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certs}
+	}
+
+	return mysql.RegisterTLSConfig(ctls, tlsConfig)
+}
+
 func (m *Mysql) Open(url string) (database.Driver, error) {
 	purl, err := nurl.Parse(url)
 	if err != nil {
 		return nil, err
 	}
 
-	q := purl.Query()
-	q.Set("multiStatements", "true")
-	purl.RawQuery = q.Encode()
+	splitStatements := false
+	if len(purl.Query().Get("x-split-statements")) > 0 {
+		splitStatements, err = strconv.ParseBool(purl.Query().Get("x-split-statements"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !splitStatements {
+		q := purl.Query()
+		q.Set("multiStatements", "true")
+		purl.RawQuery = q.Encode()
+	}
+
+	// custom TLS configs must be registered before parsing the DSN
+	if err := registerTLSConfig(purl); err != nil {
+		return nil, err
+	}
 
 	c, err := urlToMySQLConfig(*migrate.FilterCustomQuery(purl))
 	if err != nil {
 		return nil, err
 	}
-	db, err := sql.Open("mysql", c.FormatDSN())
-	if err != nil {
+	if err := setTimeouts(c, purl.Query()); err != nil {
 		return nil, err
 	}
 
@@ -137,224 +749,2565 @@ func (m *Mysql) Open(url string) (database.Driver, error) {
 		migrationsTable = DefaultMigrationsTable
 	}
 
-	// use custom TLS?
-	ctls := purl.Query().Get("tls")
-	if len(ctls) > 0 {
-		if _, isBool := readBool(ctls); !isBool && strings.ToLower(ctls) != "skip-verify" {
-			rootCertPool := x509.NewCertPool()
-			pem, err := ioutil.ReadFile(purl.Query().Get("x-tls-ca"))
-			if err != nil {
-				return nil, err
-			}
+	historyTable := purl.Query().Get("x-history-table")
 
-			if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
-				return nil, ErrAppendPEM
-			}
+	onlineDDL := false
+	if len(purl.Query().Get("x-online-ddl")) > 0 {
+		onlineDDL, err = strconv.ParseBool(purl.Query().Get("x-online-ddl"))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			certs, err := tls.LoadX509KeyPair(purl.Query().Get("x-tls-cert"), purl.Query().Get("x-tls-key"))
-			if err != nil {
-				return nil, err
-			}
+	autoIfNotExists := false
+	if len(purl.Query().Get("x-auto-if-not-exists")) > 0 {
+		autoIfNotExists, err = strconv.ParseBool(purl.Query().Get("x-auto-if-not-exists"))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			insecureSkipVerify := false
-			if len(purl.Query().Get("x-tls-insecure-skip-verify")) > 0 {
-				x, err := strconv.ParseBool(purl.Query().Get("x-tls-insecure-skip-verify"))
-				if err != nil {
-					return nil, err
-				}
-				insecureSkipVerify = x
-			}
+	deferVersionCommit := false
+	if len(purl.Query().Get("x-defer-version-commit")) > 0 {
+		deferVersionCommit, err = strconv.ParseBool(purl.Query().Get("x-defer-version-commit"))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			mysql.RegisterTLSConfig(ctls, &tls.Config{
-				RootCAs:            rootCertPool,
-				Certificates:       []tls.Certificate{certs},
-				InsecureSkipVerify: insecureSkipVerify,
-			})
+	strictTransactions := false
+	if len(purl.Query().Get("x-strict-transactions")) > 0 {
+		strictTransactions, err = strconv.ParseBool(purl.Query().Get("x-strict-transactions"))
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	mx, err := WithInstance(db, &Config{
-		DatabaseName:    purl.Path,
-		MigrationsTable: migrationsTable,
-	})
-	if err != nil {
-		return nil, err
+	streamStatements := false
+	if len(purl.Query().Get("x-stream-statements")) > 0 {
+		streamStatements, err = strconv.ParseBool(purl.Query().Get("x-stream-statements"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return mx, nil
-}
+	storeSQL := false
+	if len(purl.Query().Get("x-store-sql")) > 0 {
+		storeSQL, err = strconv.ParseBool(purl.Query().Get("x-store-sql"))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func (m *Mysql) Close() error {
-	return m.conn.Close()
-}
+	onlineSchemaChangeCmd := purl.Query().Get("x-online-schema-change-cmd")
 
-func (m *Mysql) Lock() error {
-	if m.isLocked {
-		return database.ErrLocked
+	migrationTablesPattern := purl.Query().Get("x-migration-tables-pattern")
+
+	var allowedWindow *Window
+	if len(purl.Query().Get("x-allowed-window")) > 0 {
+		allowedWindow, err = ParseWindow(purl.Query().Get("x-allowed-window"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	aid, err := database.GenerateAdvisoryLockId(
-		fmt.Sprintf("%s:%s", m.config.DatabaseName, m.config.MigrationsTable))
-	if err != nil {
-		return err
+	forceWindow := false
+	if len(purl.Query().Get("x-force-window")) > 0 {
+		forceWindow, err = strconv.ParseBool(purl.Query().Get("x-force-window"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	query := "SELECT GET_LOCK(?, 10)"
-	var success bool
-	if err := m.conn.QueryRowContext(context.Background(), query, aid).Scan(&success); err != nil {
-		return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+	var versionQueryTimeout time.Duration
+	if len(purl.Query().Get("x-version-query-timeout")) > 0 {
+		versionQueryTimeout, err = time.ParseDuration(purl.Query().Get("x-version-query-timeout"))
+		if err != nil {
+			return nil, err
+		}
+		if versionQueryTimeout == 0 {
+			// zero is the default in Config, so disable it explicitly
+			versionQueryTimeout = -1
+		}
 	}
 
-	if success {
-		m.isLocked = true
-		return nil
+	var versionCacheTTL time.Duration
+	if len(purl.Query().Get("x-version-cache-ttl")) > 0 {
+		versionCacheTTL, err = time.ParseDuration(purl.Query().Get("x-version-cache-ttl"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return database.ErrLocked
-}
+	lockIdentifier := purl.Query().Get("x-lock-identifier")
 
-func (m *Mysql) Unlock() error {
-	if !m.isLocked {
-		return nil
+	versionTableEngine := purl.Query().Get("x-version-table-engine")
+
+	warnOnOutOfOrder := false
+	if len(purl.Query().Get("x-warn-on-out-of-order")) > 0 {
+		warnOnOutOfOrder, err = strconv.ParseBool(purl.Query().Get("x-warn-on-out-of-order"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	aid, err := database.GenerateAdvisoryLockId(
-		fmt.Sprintf("%s:%s", m.config.DatabaseName, m.config.MigrationsTable))
-	if err != nil {
-		return err
+	protectDML := false
+	if len(purl.Query().Get("x-protect-dml")) > 0 {
+		protectDML, err = strconv.ParseBool(purl.Query().Get("x-protect-dml"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	query := `SELECT RELEASE_LOCK(?)`
-	if _, err := m.conn.ExecContext(context.Background(), query, aid); err != nil {
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+	runInTransaction := false
+	if len(purl.Query().Get("x-run-in-transaction")) > 0 {
+		runInTransaction, err = strconv.ParseBool(purl.Query().Get("x-run-in-transaction"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// NOTE: RELEASE_LOCK could return NULL or (or 0 if the code is changed),
-	// in which case isLocked should be true until the timeout expires -- synchronizing
-	// these states is likely not worth trying to do; reconsider the necessity of isLocked.
+	strictSplit := false
+	if len(purl.Query().Get("x-strict-split")) > 0 {
+		strictSplit, err = strconv.ParseBool(purl.Query().Get("x-strict-split"))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	m.isLocked = false
-	return nil
-}
+	sendAtOnce := false
+	if len(purl.Query().Get("x-send-at-once")) > 0 {
+		sendAtOnce, err = strconv.ParseBool(purl.Query().Get("x-send-at-once"))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func (m *Mysql) Run(migration io.Reader) error {
-	migr, err := ioutil.ReadAll(migration)
-	if err != nil {
-		return err
+	maxAllowedPacket := 0
+	if len(purl.Query().Get("x-max-allowed-packet")) > 0 {
+		maxAllowedPacket, err = strconv.Atoi(purl.Query().Get("x-max-allowed-packet"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	query := string(migr[:])
-	if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
-		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
+	var maxLockDuration time.Duration
+	if len(purl.Query().Get("x-max-lock-duration")) > 0 {
+		maxLockDuration, err = time.ParseDuration(purl.Query().Get("x-max-lock-duration"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
-}
+	upgradeVersionTable := false
+	if len(purl.Query().Get("x-upgrade-version-table")) > 0 {
+		upgradeVersionTable, err = strconv.ParseBool(purl.Query().Get("x-upgrade-version-table"))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func (m *Mysql) SetVersion(version int, dirty bool) error {
-	tx, err := m.conn.BeginTx(context.Background(), &sql.TxOptions{})
+	trackLockOwner := false
+	if len(purl.Query().Get("x-track-lock-owner")) > 0 {
+		trackLockOwner, err = strconv.ParseBool(purl.Query().Get("x-track-lock-owner"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lockScope, err := parseLockScope(purl.Query().Get("x-lock-scope"))
 	if err != nil {
-		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+		return nil, err
 	}
 
-	query := "TRUNCATE `" + m.config.MigrationsTable + "`"
-	if _, err := tx.ExecContext(context.Background(), query); err != nil {
-		tx.Rollback()
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+	lockStrategy, err := parseLockStrategy(purl.Query().Get("x-lock-strategy"))
+	if err != nil {
+		return nil, err
 	}
 
-	if version >= 0 {
-		query := "INSERT INTO `" + m.config.MigrationsTable + "` (version, dirty) VALUES (?, ?)"
-		if _, err := tx.ExecContext(context.Background(), query, version, dirty); err != nil {
-			tx.Rollback()
-			return &database.Error{OrigErr: err, Query: []byte(query)}
+	if len(purl.Query().Get("x-no-lock")) > 0 {
+		noLock, err := strconv.ParseBool(purl.Query().Get("x-no-lock"))
+		if err != nil {
+			return nil, err
+		}
+		if noLock {
+			if lockStrategy != LockStrategyAdvisory && lockStrategy != LockStrategyNone {
+				return nil, fmt.Errorf("x-no-lock can't be combined with x-lock-strategy=%v", purl.Query().Get("x-lock-strategy"))
+			}
+			lockStrategy = LockStrategyNone
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	lockTable := purl.Query().Get("x-lock-table")
+
+	var lockTimeout *int
+	if len(purl.Query().Get("x-lock-timeout")) > 0 {
+		timeout, err := strconv.Atoi(purl.Query().Get("x-lock-timeout"))
+		if err != nil {
+			return nil, err
+		}
+		lockTimeout = &timeout
 	}
 
-	return nil
-}
+	lockRetries := 0
+	if len(purl.Query().Get("x-lock-retries")) > 0 {
+		lockRetries, err = strconv.Atoi(purl.Query().Get("x-lock-retries"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var lockRetryInterval time.Duration
+	if len(purl.Query().Get("x-lock-retry-interval")) > 0 {
+		lockRetryInterval, err = time.ParseDuration(purl.Query().Get("x-lock-retry-interval"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open("mysql", c.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+
+	mx, err := WithInstance(db, &Config{
+		DatabaseName:           purl.Path,
+		MigrationsTable:        migrationsTable,
+		HistoryTable:           historyTable,
+		OnlineDDL:              onlineDDL,
+		AutoIfNotExists:        autoIfNotExists,
+		LockScope:              lockScope,
+		LockStrategy:           lockStrategy,
+		LockTable:              lockTable,
+		LockIdentifier:         lockIdentifier,
+		LockTimeout:            lockTimeout,
+		LockRetries:            lockRetries,
+		LockRetryInterval:      lockRetryInterval,
+		DeferVersionCommit:     deferVersionCommit,
+		StrictTransactions:     strictTransactions,
+		StreamStatements:       streamStatements,
+		VersionCacheTTL:        versionCacheTTL,
+		StoreSQL:               storeSQL,
+		OnlineSchemaChangeCmd:  onlineSchemaChangeCmd,
+		MigrationTablesPattern: migrationTablesPattern,
+		VersionQueryTimeout:    versionQueryTimeout,
+		AllowedWindow:          allowedWindow,
+		ForceWindow:            forceWindow,
+		TrackLockOwner:         trackLockOwner,
+		MaxLockDuration:        maxLockDuration,
+		MaxAllowedPacket:       maxAllowedPacket,
+		StrictSplit:            strictSplit,
+		ProtectDML:             protectDML,
+		RunInTransaction:       runInTransaction,
+		SplitStatements:        splitStatements,
+		SendAtOnce:             sendAtOnce,
+		WarnOnOutOfOrder:       warnOnOutOfOrder,
+		VersionTableEngine:     versionTableEngine,
+		UpgradeVersionTable:    upgradeVersionTable,
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	mx.(*Mysql).db = db
+
+	return mx, nil
+}
+
+func (m *Mysql) Close() error {
+	m.stopWatchdog()
+
+	var result *database.MultiError
+	if err := m.conn.Close(); err != nil {
+		result = database.Append(result, err)
+	}
+	if m.db != nil {
+		if err := m.db.Close(); err != nil {
+			result = database.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+func (m *Mysql) Lock() error {
+	return m.lock(context.Background(), "")
+}
+
+// LockWithReason implements database.ReasonLocker. The reason is only
+// recorded if TrackLockOwner is set.
+func (m *Mysql) LockWithReason(reason string) error {
+	return m.lock(context.Background(), reason)
+}
+
+// LockContext implements database.DriverContext. It stops waiting for the
+// lock, and retrying, once ctx is done.
+func (m *Mysql) LockContext(ctx context.Context) error {
+	return m.lock(ctx, "")
+}
+
+// LockWithReasonContext implements database.ReasonLockerContext.
+func (m *Mysql) LockWithReasonContext(ctx context.Context, reason string) error {
+	return m.lock(ctx, reason)
+}
+
+func (m *Mysql) lock(ctx context.Context, reason string) error {
+	if m.isLocked {
+		return database.ErrLocked
+	}
+
+	if m.config.LockStrategy == LockStrategyNone {
+		m.isLocked = true
+		return nil
+	}
+
+	aid, err := m.lockId()
+	if err != nil {
+		return err
+	}
+
+	acquired, err := m.getLock(ctx, aid)
+	for retry := 0; err == nil && !acquired && retry < m.config.LockRetries; retry++ {
+		interval := m.config.LockRetryInterval
+		if interval <= 0 {
+			interval = DefaultLockRetryInterval
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		acquired, err = m.getLock(ctx, aid)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !acquired {
+		if m.config.TrackLockOwner {
+			if owner, ok := m.lockOwner(aid); ok {
+				return ErrLockedBy{Owner: owner}
+			}
+		}
+		if m.config.LockStrategy == LockStrategyTable {
+			return ErrLockWaitTimeout{}
+		}
+		return ErrLockWaitTimeout{Timeout: m.lockTimeout()}
+	}
+
+	m.isLocked = true
+	if m.config.TrackLockOwner {
+		if err := m.recordLockOwner(aid, reason); err != nil {
+			return database.Append(err, m.Unlock())
+		}
+	}
+	if m.config.MaxLockDuration > 0 {
+		if err := m.startWatchdog(); err != nil {
+			return database.Append(err, m.Unlock())
+		}
+	}
+	return nil
+}
+
+// lockTimeout returns how many seconds GET_LOCK waits, see LockTimeout.
+func (m *Mysql) lockTimeout() int {
+	if m.config.LockTimeout != nil {
+		return *m.config.LockTimeout
+	}
+	return DefaultLockTimeout
+}
+
+// getLock runs GET_LOCK for aid, waiting up to LockTimeout. It returns
+// false if another session still held the lock when the wait timed out.
+func (m *Mysql) getLock(ctx context.Context, aid string) (bool, error) {
+	if m.config.LockStrategy == LockStrategyTable {
+		return m.getTableLock(ctx, aid)
+	}
+
+	query := "SELECT " + m.lockComment() + " GET_LOCK(?, " + strconv.Itoa(m.lockTimeout()) + ")"
+	var success sql.NullBool
+	if err := m.conn.QueryRowContext(ctx, query, aid).Scan(&success); err != nil {
+		return false, &database.Error{OrigErr: err, Code: errorCode(err), Err: "try lock failed", Query: []byte(query)}
+	}
+
+	if !success.Valid {
+		// GET_LOCK returns NULL instead of 0 if it failed for another
+		// reason than the timeout, e.g. the thread was killed
+		return false, &database.Error{OrigErr: database.ErrLocked, Err: "GET_LOCK returned NULL", Query: []byte(query)}
+	}
+	return success.Bool, nil
+}
+
+// getTableLock inserts the row of aid into the LockTable, unless another
+// driver's row is there already, see LockStrategyTable. It returns false
+// then.
+func (m *Mysql) getTableLock(ctx context.Context, aid string) (bool, error) {
+	if !m.hasLockTable {
+		query := "CREATE TABLE IF NOT EXISTS " + quoteTable(m.config.LockTable) + " (lock_id varchar(255) not null primary key, owner varchar(255) not null, acquired_at datetime not null)"
+		if _, err := m.conn.ExecContext(ctx, query); err != nil {
+			return false, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+		m.hasLockTable = true
+	}
+
+	if len(m.lockToken) == 0 {
+		host, _ := os.Hostname()
+		m.lockToken = fmt.Sprintf("%v:%v:%v", host, os.Getpid(), time.Now().UnixNano())
+	}
+
+	// the affected rows depend on the clientFoundRows setting, so the
+	// owner is read back instead
+	query := "INSERT INTO " + quoteTable(m.config.LockTable) + " (lock_id, owner, acquired_at) VALUES (?, ?, NOW()) ON DUPLICATE KEY UPDATE lock_id = lock_id"
+	if _, err := m.conn.ExecContext(ctx, query, aid, m.lockToken); err != nil {
+		return false, &database.Error{OrigErr: err, Code: errorCode(err), Err: "try lock failed", Query: []byte(query)}
+	}
+
+	query = "SELECT owner FROM " + quoteTable(m.config.LockTable) + " WHERE lock_id = ?"
+	var owner string
+	if err := m.conn.QueryRowContext(ctx, query, aid).Scan(&owner); err != nil {
+		return false, &database.Error{OrigErr: err, Code: errorCode(err), Err: "try lock failed", Query: []byte(query)}
+	}
+	return owner == m.lockToken, nil
+}
+
+// startWatchdog aborts the migrations once the lock was held for
+// MaxLockDuration, see Config.MaxLockDuration.
+func (m *Mysql) startWatchdog() error {
+	id, err := m.connectionID()
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&m.lockExceeded, 0)
+	lockCtx, cancel := context.WithCancel(context.Background())
+	watchdog := time.AfterFunc(m.config.MaxLockDuration, func() {
+		atomic.StoreInt32(&m.lockExceeded, 1)
+		cancel()
+		m.killLockConnection(id)
+	})
+
+	m.ctxMu.Lock()
+	m.watchdog, m.lockCtx, m.lockCancel = watchdog, lockCtx, cancel
+	m.ctxMu.Unlock()
+	return nil
+}
+
+// stopWatchdog stops the watchdog started by Lock. It returns true if the
+// lock was held for longer than MaxLockDuration.
+func (m *Mysql) stopWatchdog() bool {
+	m.ctxMu.Lock()
+	watchdog, cancel := m.watchdog, m.lockCancel
+	m.watchdog, m.lockCtx, m.lockCancel = nil, nil, nil
+	m.ctxMu.Unlock()
+
+	if watchdog == nil {
+		return false
+	}
+	watchdog.Stop()
+	cancel()
+	return atomic.LoadInt32(&m.lockExceeded) == 1
+}
+
+// connectionID returns the id of the connection the driver runs its queries
+// on.
+func (m *Mysql) connectionID() (int64, error) {
+	query := "SELECT CONNECTION_ID()"
+	var id int64
+	if err := m.conn.QueryRowContext(context.Background(), query).Scan(&id); err != nil {
+		return 0, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	return id, nil
+}
+
+// killLockConnection kills the connection holding the lock from another
+// one, so that a statement stuck on the server stops and the lock is
+// released. Without a pool of its own, the driver relies on canceling the
+// migration instead.
+func (m *Mysql) killLockConnection(id int64) {
+	if m.db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := m.db.ExecContext(ctx, fmt.Sprintf("KILL %d", id)); err != nil {
+		m.warnf("can't kill connection %v holding the lock: %v", id, err)
+	}
+}
+
+// killQuery kills the statement connection id is running from another
+// connection, since the server finishes it even if the client went away.
+// Like killLockConnection, it needs the pool of Open.
+func (m *Mysql) killQuery(id int64) {
+	if m.db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := m.db.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", id)); err != nil {
+		m.warnf("can't kill the query of connection %v: %v", id, err)
+	}
+}
+
+// runContext is the context migrations run with, canceled once the lock
+// was held for MaxLockDuration or the context passed to RunContext is done.
+func (m *Mysql) runContext() context.Context {
+	m.ctxMu.Lock()
+	defer m.ctxMu.Unlock()
+	if m.callerCtx != nil {
+		return m.callerCtx
+	}
+	if m.lockCtx != nil {
+		return m.lockCtx
+	}
+	return context.Background()
+}
+
+func (m *Mysql) Unlock() error {
+	if !m.isLocked {
+		return nil
+	}
+
+	// after MaxLockDuration, the connection holding the lock was likely
+	// killed, and with it the lock, so errors releasing it don't matter.
+	// The same goes for the connection closed by a canceled RunContext.
+	exceeded := m.stopWatchdog()
+	m.ctxMu.Lock()
+	canceled := m.canceled
+	m.canceled = false
+	m.ctxMu.Unlock()
+	if err := m.releaseLock(); err != nil && !exceeded && !canceled {
+		return err
+	}
+
+	// NOTE: RELEASE_LOCK could return NULL or (or 0 if the code is changed),
+	// in which case isLocked should be true until the timeout expires -- synchronizing
+	// these states is likely not worth trying to do; reconsider the necessity of isLocked.
+
+	m.isLocked = false
+	return nil
+}
+
+func (m *Mysql) releaseLock() error {
+	if m.config.LockStrategy == LockStrategyNone {
+		return nil
+	}
+
+	aid, err := m.lockId()
+	if err != nil {
+		return err
+	}
+
+	if m.config.LockStrategy == LockStrategyTable {
+		query := "DELETE FROM " + quoteTable(m.config.LockTable) + " WHERE lock_id = ? AND owner = ?"
+		_, err := m.conn.ExecContext(context.Background(), query, aid, m.lockToken)
+		if err != nil && m.db != nil {
+			// e.g. a canceled RunContext closed the connection, but
+			// unlike GET_LOCK the row outlives it
+			_, err = m.db.ExecContext(context.Background(), query, aid, m.lockToken)
+		}
+		if err != nil {
+			return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+		return nil
+	}
+
+	if m.config.TrackLockOwner {
+		query := "DELETE FROM " + quoteTable(m.config.LockOwnerTable) + " WHERE lock_id = ?"
+		if _, err := m.conn.ExecContext(context.Background(), query, aid); err != nil {
+			return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+	}
+
+	query := "SELECT " + m.lockComment() + " RELEASE_LOCK(?)"
+	if _, err := m.conn.ExecContext(context.Background(), query, aid); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	return nil
+}
+
+// AssertStillLocked returns ErrLockLost if the lock taken by Lock isn't held
+// anymore. All queries run on the single connection the driver keeps, so
+// the lock can't move to another connection of the pool, but it's released
+// when the lock is released on the server, e.g. by a RELEASE_ALL_LOCKS of
+// a migration. If the connection itself was killed or timed out, the query
+// fails and its error is returned. Call it between the statements of long
+// migrations to stop before running them unprotected.
+func (m *Mysql) AssertStillLocked() error {
+	if !m.isLocked {
+		return ErrLockLost
+	}
+	if m.config.LockStrategy == LockStrategyNone {
+		return nil
+	}
+
+	aid, err := m.lockId()
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT " + m.lockComment() + " COALESCE(IS_USED_LOCK(?) = CONNECTION_ID(), 0)"
+	args := []interface{}{aid}
+	if m.config.LockStrategy == LockStrategyTable {
+		query = "SELECT EXISTS (SELECT 1 FROM " + quoteTable(m.config.LockTable) + " WHERE lock_id = ? AND owner = ?)"
+		args = append(args, m.lockToken)
+	}
+	var held bool
+	if err := m.conn.QueryRowContext(context.Background(), query, args...).Scan(&held); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	if !held {
+		m.isLocked = false
+		return ErrLockLost
+	}
+	return nil
+}
+
+// LockOwner is the process holding the lock, see Config.TrackLockOwner.
+type LockOwner struct {
+	Host       string
+	PID        int
+	Reason     string
+	AcquiredAt time.Time
+}
+
+// ErrLockedBy is returned by Lock instead of ErrLockWaitTimeout if the owner
+// of the lock is known. errors.Is(err, database.ErrLocked) holds for it.
+type ErrLockedBy struct {
+	Owner LockOwner
+}
+
+func (e ErrLockedBy) Error() string {
+	msg := fmt.Sprintf("%v: held by pid %v on %v since %v", database.ErrLocked, e.Owner.PID, e.Owner.Host,
+		e.Owner.AcquiredAt.Format(time.RFC3339))
+	if len(e.Owner.Reason) > 0 {
+		msg += ": " + e.Owner.Reason
+	}
+	return msg
+}
+
+func (e ErrLockedBy) Unwrap() error {
+	return database.ErrLocked
+}
+
+// ErrLockWaitTimeout is returned by Lock if another session still held the
+// lock after waiting LockTimeout seconds, including the retries. A failing
+// GET_LOCK query is returned as a database.Error instead.
+// errors.Is(err, database.ErrLocked) holds for it.
+type ErrLockWaitTimeout struct {
+	Timeout int
+}
+
+func (e ErrLockWaitTimeout) Error() string {
+	if e.Timeout == 0 {
+		return fmt.Sprintf("%v: held by another session", database.ErrLocked)
+	}
+	return fmt.Sprintf("%v: still held by another session after waiting %v seconds", database.ErrLocked, e.Timeout)
+}
+
+func (e ErrLockWaitTimeout) Unwrap() error {
+	return database.ErrLocked
+}
+
+// recordLockOwner writes the row of this process to the lock owner table.
+// The row keeps the connection id, so that rows left behind by processes
+// that died with the lock are told apart from the current owner.
+func (m *Mysql) recordLockOwner(aid string, reason string) error {
+	query := "CREATE TABLE IF NOT EXISTS " + quoteTable(m.config.LockOwnerTable) + " (lock_id varchar(255) not null primary key, connection_id bigint not null, host varchar(255) not null, pid int not null, reason text, acquired_at datetime not null)"
+	if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	query = "REPLACE INTO " + quoteTable(m.config.LockOwnerTable) + " (lock_id, connection_id, host, pid, reason, acquired_at) VALUES (?, CONNECTION_ID(), ?, ?, ?, NOW())"
+	if _, err := m.conn.ExecContext(context.Background(), query, aid, host, os.Getpid(), reason); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	return nil
+}
+
+// lockOwner reads the row of the process holding the lock. It returns false
+// if there's none, e.g. if the holder doesn't track the owner, or if the
+// table can't be read.
+func (m *Mysql) lockOwner(aid string) (LockOwner, bool) {
+	query := "SELECT host, pid, reason, UNIX_TIMESTAMP(acquired_at) FROM " + quoteTable(m.config.LockOwnerTable) + " WHERE lock_id = ? AND connection_id = IS_USED_LOCK(?)"
+	var (
+		owner      LockOwner
+		reason     sql.NullString
+		acquiredAt int64
+	)
+	if err := m.conn.QueryRowContext(context.Background(), query, aid, aid).Scan(&owner.Host, &owner.PID, &reason, &acquiredAt); err != nil {
+		return LockOwner{}, false
+	}
+	owner.Reason = reason.String
+	owner.AcquiredAt = time.Unix(acquiredAt, 0)
+	return owner, true
+}
+
+// lockComment returns the comment tagging the lock queries.
+// A `*/` in the identifier would end the comment early, so it is removed.
+func (m *Mysql) lockComment() string {
+	id := m.config.LockIdentifier
+	if len(id) == 0 {
+		id = DefaultLockIdentifier
+	}
+	return "/* " + strings.Replace(id, "*/", "", -1) + " */"
+}
+
+// lockId returns the advisory lock id for the configured LockScope.
+func (m *Mysql) lockId() (string, error) {
+	if m.config.LockScope == LockScopeTable {
+		// name the lock after the database the table is in, so that
+		// qualified and unqualified names of a table share the lock
+		db, table := splitTableName(m.config.MigrationsTable)
+		if len(db) == 0 {
+			db = m.config.DatabaseName
+		}
+		return database.GenerateAdvisoryLockId(db, table)
+	}
+	return database.GenerateAdvisoryLockId(
+		fmt.Sprintf("%s:%s", m.config.DatabaseName, m.config.MigrationsTable))
+}
+
+func (m *Mysql) Run(migration io.Reader) error {
+	if err := m.run(migration); err != nil {
+		if atomic.LoadInt32(&m.lockExceeded) == 1 {
+			return ErrLockTimeoutExceeded
+		}
+		return err
+	}
+	return nil
+}
+
+// RunContext implements database.DriverContext. Once ctx is done, the
+// statement running is canceled and, if Open created the driver, killed
+// with KILL QUERY from another connection, since the server would finish
+// it otherwise. The error returned wraps ctx.Err(). Canceling closes the
+// connection of the driver, which releases the lock, so the driver has to
+// be opened again. The statements before the one canceled stay applied,
+// so Migrate leaves the version dirty.
+func (m *Mysql) RunContext(ctx context.Context, migration io.Reader) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.ctxMu.Lock()
+	lockCtx := m.lockCtx
+	m.ctxMu.Unlock()
+
+	// the watchdog of MaxLockDuration still applies
+	if lockCtx != nil {
+		go func() {
+			select {
+			case <-lockCtx.Done():
+				cancel()
+			case <-runCtx.Done():
+			}
+		}()
+	}
+
+	if m.db != nil {
+		id, err := m.connectionID()
+		if err != nil {
+			return err
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				m.killQuery(id)
+			case <-done:
+			}
+		}()
+	}
+
+	m.setCallerCtx(runCtx)
+	err := m.Run(migration)
+	m.setCallerCtx(nil)
+	if err != nil && ctx.Err() != nil {
+		m.ctxMu.Lock()
+		m.canceled = true
+		m.ctxMu.Unlock()
+		return &database.Error{OrigErr: ctx.Err(), Err: "migration canceled: " + err.Error()}
+	}
+	return err
+}
+
+// setCallerCtx sets the context runContext returns while RunContext runs.
+func (m *Mysql) setCallerCtx(ctx context.Context) {
+	m.ctxMu.Lock()
+	m.callerCtx = ctx
+	m.ctxMu.Unlock()
+}
+
+func (m *Mysql) run(migration io.Reader) error {
+	if atomic.LoadInt32(&m.lockExceeded) == 1 {
+		return ErrLockTimeoutExceeded
+	}
+
+	if err := m.checkWindow(); err != nil {
+		return err
+	}
+
+	if m.config.StreamStatements {
+		r := bufio.NewReaderSize(migration, transactionalHeaderSize)
+		// errors are returned again once the migration is read
+		header, _ := r.Peek(transactionalHeaderSize)
+		if transactional, err := parseTransactional(header); err != nil {
+			return err
+		} else if transactional {
+			return ErrStreamTransactional
+		}
+		return m.runStatements(r)
+	}
+
+	migr, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+
+	opts := database.MySQLOptions
+	opts.RejectUnterminated = true
+	opts.Strict = m.config.StrictSplit
+	stmts, err := database.SplitQueryOpts(migr, opts)
+	if err != nil {
+		return err
+	}
+
+	transactional, err := parseTransactional(migr)
+	if err != nil {
+		return err
+	}
+	if transactional {
+		if err := checkTransactional(stmts); err != nil {
+			return err
+		}
+	} else {
+		if m.config.RunInTransaction {
+			for _, stmt := range stmts {
+				if database.ClassifyStatement(stmt, database.MySQLDialect).Kind == database.TransactionControlStatement {
+					return database.Error{OrigErr: ErrRunInTxControl, Query: stmt}
+				}
+			}
+		}
+
+		if err := m.checkTransactions(stmts); err != nil {
+			return err
+		}
+
+		if m.usesOnlineSchemaChange(stmts) {
+			return m.runOnlineSchemaChange(stmts)
+		}
+	}
+
+	if m.rewrites() {
+		for i, stmt := range stmts {
+			if stmts[i], err = m.rewrite(stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, stmt := range stmts {
+		if err := m.checkPacketSize(stmt, false); err != nil {
+			return err
+		}
+	}
+
+	if transactional {
+		return m.runTransaction(stmts, "migration failed, rolled back")
+	}
+
+	if m.config.RunInTransaction {
+		return m.runTransaction(stmts, "migration failed, rolled back the statements since the last implicit commit")
+	}
+
+	if m.config.ProtectDML {
+		return m.runProtectedDML(stmts)
+	}
+
+	if !m.config.SendAtOnce {
+		return m.runSplit(migr, stmts)
+	}
+
+	if m.rewrites() {
+		migr = bytes.Join(stmts, []byte(";\n"))
+	} else {
+		migr = trimTrailing(migr, stmts)
+	}
+
+	// all statements are sent at once
+	if err := m.checkPacketSize(migr, true); err != nil {
+		return err
+	}
+
+	// The driver only takes the query as a string. migr and the statements
+	// pointing into it aren't used after the conversion, so that only one
+	// copy of a large migration is kept while it runs.
+	query := string(migr)
+	if _, err := m.conn.ExecContext(m.runContext(), query); err != nil {
+		return database.Error{OrigErr: err, Code: errorCode(err), Err: "migration failed", Query: []byte(query)}
+	}
+
+	return nil
+}
+
+// ErrStatementTooLarge is returned by Run if a query is larger than
+// max_allowed_packet, see Config.MaxAllowedPacket. The server would reject
+// it with a lost connection or a "packet too large" error.
+type ErrStatementTooLarge struct {
+	// Size is the size of the query in bytes, MaxAllowedPacket the limit.
+	Size             int
+	MaxAllowedPacket int
+
+	// Statement is the start of the statement, empty if the statements
+	// fit on their own, but not the whole migration sent at once.
+	Statement string
+}
+
+func (e ErrStatementTooLarge) Error() string {
+	if len(e.Statement) == 0 {
+		return fmt.Sprintf("migration of %v bytes exceeds max_allowed_packet of %v bytes, increase max_allowed_packet or unset x-send-at-once to send it statement by statement", e.Size, e.MaxAllowedPacket)
+	}
+	return fmt.Sprintf("statement of %v bytes exceeds max_allowed_packet of %v bytes, increase max_allowed_packet or split the statement: %v", e.Size, e.MaxAllowedPacket, e.Statement)
+}
+
+// statementExcerptSize is how much of a statement ErrStatementTooLarge
+// shows.
+const statementExcerptSize = 100
+
+// checkPacketSize returns ErrStatementTooLarge if query doesn't fit into
+// max_allowed_packet. whole is true if query is the whole migration.
+func (m *Mysql) checkPacketSize(query []byte, whole bool) error {
+	limit := m.config.MaxAllowedPacket
+	if limit <= 0 {
+		limit = m.maxAllowedPacket
+	}
+	// the packet holds a command byte before the query
+	if limit <= 0 || len(query)+1 <= limit {
+		return nil
+	}
+
+	err := ErrStatementTooLarge{Size: len(query), MaxAllowedPacket: limit}
+	if !whole {
+		err.Statement = string(query)
+		if len(query) > statementExcerptSize {
+			err.Statement = string(query[:statementExcerptSize]) + "..."
+		}
+	}
+	return err
+}
+
+// TransactionalHeader makes Run execute a migration in a single transaction
+// if it starts one of the comment lines at the top of the migration,
+// followed by true, e.g.
+//
+//	-- transactional: true
+//	UPDATE users SET plan = 'free' WHERE plan IS NULL;
+//	INSERT INTO plans VALUES ('free');
+//
+// Migrations run outside of a transaction by default, since most DDL
+// commits implicitly in MySQL.
+const TransactionalHeader = "transactional:"
+
+// transactionalHeaderSize is how much of a streamed migration is read to
+// find the TransactionalHeader.
+const transactionalHeaderSize = 4096
+
+// parseTransactional returns the value of a TransactionalHeader in the
+// leading comment lines of migr, false if there's none.
+func parseTransactional(migr []byte) (bool, error) {
+	for _, line := range strings.Split(string(migr), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "--"):
+			line = strings.TrimSpace(strings.TrimPrefix(line, "--"))
+		case strings.HasPrefix(line, "#"):
+			line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		default:
+			return false, nil
+		}
+		if !strings.HasPrefix(strings.ToLower(line), TransactionalHeader) {
+			continue
+		}
+		value := strings.TrimSpace(line[len(TransactionalHeader):])
+		transactional, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid %v header %q", TransactionalHeader, value)
+		}
+		return transactional, nil
+	}
+	return false, nil
+}
+
+// checkTransactional rejects the statements of a migration with the
+// TransactionalHeader that would end its transaction, before any of them
+// runs.
+func checkTransactional(stmts [][]byte) error {
+	for _, stmt := range stmts {
+		switch database.ClassifyStatement(stmt, database.MySQLDialect).Class {
+		case database.ImplicitCommit, database.TransactionControl:
+			return database.Error{OrigErr: ErrTransactionalCommit, Query: stmt}
+		}
+	}
+	return nil
+}
+
+// runProtectedDML runs stmts one by one, and each group of consecutive DML
+// statements in a transaction of its own, see ProtectDML.
+func (m *Mysql) runProtectedDML(stmts [][]byte) error {
+	isDML := make([]bool, len(stmts))
+	for i, stmt := range stmts {
+		switch database.ClassifyStatement(stmt, database.MySQLDialect).Kind {
+		case database.DMLStatement:
+			isDML[i] = true
+		case database.TransactionControlStatement:
+			return database.Error{OrigErr: ErrProtectDMLTransaction, Query: stmt}
+		}
+	}
+
+	for i := 0; i < len(stmts); {
+		if !isDML[i] {
+			if _, err := m.conn.ExecContext(m.runContext(), string(stmts[i])); err != nil {
+				return database.Error{OrigErr: err, Code: errorCode(err), Err: "migration failed", Query: stmts[i]}
+			}
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j < len(stmts) && isDML[j] {
+			j++
+		}
+		if err := m.runTransaction(stmts[i:j], "migration failed, rolled back the DML statements since the last other statement"); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// runSplit runs stmts, the statements of migr, one by one, see
+// SendAtOnce. The error of a failing statement tells its number and
+// line, and its byte offset unless it was rewritten.
+func (m *Mysql) runSplit(migr []byte, stmts [][]byte) error {
+	offset := 0
+	for i, stmt := range stmts {
+		if len(bytes.TrimSpace(stmt)) == 0 {
+			continue
+		}
+
+		// the statements appear in migr in order, unless rewritten
+		pos := -1
+		if j := bytes.Index(migr[offset:], stmt); j >= 0 {
+			pos = offset + j
+			offset = pos + len(stmt)
+		}
+
+		if _, err := m.conn.ExecContext(m.runContext(), string(stmt)); err != nil {
+			merr := database.Error{OrigErr: err, Code: errorCode(err), Query: stmt}
+			merr.Err = fmt.Sprintf("migration failed in statement %v", i+1)
+			if pos >= 0 {
+				merr.Line = uint(bytes.Count(migr[:pos], []byte("\n")) + 1)
+				merr.Err += fmt.Sprintf(" at byte %v", pos)
+			}
+			return merr
+		}
+	}
+	return nil
+}
+
+// runTransaction runs stmts in a transaction, which is rolled back if one
+// of them fails. msg describes the error then.
+func (m *Mysql) runTransaction(stmts [][]byte, msg string) error {
+	ctx := m.runContext()
+	tx, err := m.conn.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, string(stmt)); err != nil {
+			merr := database.Error{OrigErr: err, Code: errorCode(err), Err: msg, Query: stmt}
+			if rerr := tx.Rollback(); rerr != nil {
+				return database.Append(merr, rerr)
+			}
+			return merr
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+	return nil
+}
+
+// trimTrailing cuts migr, made of stmts, after its last statement. Some
+// server versions reject the empty statement a trailing delimiter, or
+// comments after it, leave in a multi statement query.
+func trimTrailing(migr []byte, stmts [][]byte) []byte {
+	if len(stmts) == 0 {
+		return migr
+	}
+	last := stmts[len(stmts)-1]
+	if i := bytes.LastIndex(migr, last); i >= 0 {
+		return migr[:i+len(last)]
+	}
+	return migr
+}
+
+// checkWindow returns ErrOutsideWindow if migrations aren't allowed now,
+// see Config.AllowedWindow.
+func (m *Mysql) checkWindow() error {
+	w := m.config.AllowedWindow
+	if w == nil || m.config.ForceWindow || w.Contains(time.Now()) {
+		return nil
+	}
+	return ErrOutsideWindow
+}
+
+// runStatements runs the migration one statement at a time while reading it.
+func (m *Mysql) runStatements(migration io.Reader) error {
+	opts := database.MySQLOptions
+	opts.RejectUnterminated = true
+	opts.Strict = m.config.StrictSplit
+	scanner := database.NewStatementScanner(migration, opts)
+	checker := database.TransactionChecker{Dialect: database.MySQLDialect}
+
+	for scanner.Scan() {
+		stmt := scanner.Statement()
+		if issue, ok := checker.Check(stmt); ok {
+			m.warnTransactionIssue(issue)
+		}
+		if m.usesOnlineSchemaChange([][]byte{stmt}) {
+			if err := m.onlineSchemaChange(stmt); err != nil {
+				return err
+			}
+			continue
+		}
+		if m.rewrites() {
+			var err error
+			if stmt, err = m.rewrite(stmt); err != nil {
+				return err
+			}
+		}
+		if err := m.checkPacketSize(stmt, false); err != nil {
+			return err
+		}
+		if _, err := m.conn.ExecContext(m.runContext(), string(stmt)); err != nil {
+			return database.Error{OrigErr: err, Code: errorCode(err), Err: "migration failed", Query: stmt}
+		}
+	}
+	return scanner.Err()
+}
+
+// OSCMarker marks an ALTER TABLE statement to be run by the
+// OnlineSchemaChangeCmd if it appears in a comment of the statement, e.g.
+//
+//	-- migrate:osc
+//	ALTER TABLE users ADD COLUMN age int;
+const OSCMarker = "migrate:osc"
+
+// usesOnlineSchemaChange returns true if OnlineSchemaChangeCmd is set and
+// one of stmts is marked for it.
+func (m *Mysql) usesOnlineSchemaChange(stmts [][]byte) bool {
+	if len(m.config.OnlineSchemaChangeCmd) == 0 {
+		return false
+	}
+	for _, stmt := range stmts {
+		if isOSCStatement(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+// runOnlineSchemaChange runs stmts one by one, passing the marked ones to
+// the OnlineSchemaChangeCmd.
+func (m *Mysql) runOnlineSchemaChange(stmts [][]byte) error {
+	for _, stmt := range stmts {
+		if isOSCStatement(stmt) {
+			if err := m.onlineSchemaChange(stmt); err != nil {
+				return err
+			}
+			continue
+		}
+		if m.rewrites() {
+			var err error
+			if stmt, err = m.rewrite(stmt); err != nil {
+				return err
+			}
+		}
+		if err := m.checkPacketSize(stmt, false); err != nil {
+			return err
+		}
+		if _, err := m.conn.ExecContext(m.runContext(), string(stmt)); err != nil {
+			return database.Error{OrigErr: err, Code: errorCode(err), Err: "migration failed", Query: stmt}
+		}
+	}
+	return nil
+}
+
+// onlineSchemaChange runs the ALTER TABLE stmt with the
+// OnlineSchemaChangeCmd. The command is split at white space and called
+// with three more arguments: the database, the table and the alter clause,
+// e.g. "ADD COLUMN age int", without comments. It must apply the change
+// completely before it exits with status 0; any other status fails the
+// migration, which then stays dirty. Its output is only shown if it fails.
+// The statement isn't rewritten for OnlineDDL or AutoIfNotExists.
+func (m *Mysql) onlineSchemaChange(stmt []byte) error {
+	db, table, alter, ok := parseOSCStatement(stmt)
+	if !ok {
+		return database.Error{OrigErr: ErrOSCStatement, Query: stmt}
+	}
+	if len(db) == 0 {
+		db = m.config.DatabaseName
+	}
+
+	args := strings.Fields(m.config.OnlineSchemaChangeCmd)
+	cmd := exec.CommandContext(m.runContext(), args[0], append(args[1:], db, table, alter)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return database.Error{OrigErr: err, Err: "online schema change failed: " + strings.TrimSpace(string(out)), Query: stmt}
+	}
+	return nil
+}
+
+// isOSCStatement returns true if stmt is an ALTER TABLE marked with
+// OSCMarker.
+func isOSCStatement(stmt []byte) bool {
+	if !alterTableRe.Match(stmt) {
+		return false
+	}
+	for _, token := range commentRe.FindAll(stmt, -1) {
+		if isComment(token) && bytes.Contains(token, []byte(OSCMarker)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOSCStatement splits an ALTER TABLE statement into the database, if
+// the table name is qualified, the table and the alter clause without
+// comments.
+func parseOSCStatement(stmt []byte) (db, table, alter string, ok bool) {
+	match := oscAlterRe.FindSubmatch(stmt)
+	if match == nil {
+		return "", "", "", false
+	}
+
+	db, table = splitTableName(string(match[1]))
+	db, table = strings.Trim(db, "`"), strings.Trim(table, "`")
+
+	clause := commentRe.ReplaceAllFunc(match[2], func(token []byte) []byte {
+		if isComment(token) {
+			return []byte(" ")
+		}
+		return token
+	})
+	alter = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(string(clause)), ";"))
+	return db, table, alter, len(alter) > 0
+}
+
+// isComment returns true if a token matched by commentRe is a comment
+// rather than a quoted string or name.
+func isComment(token []byte) bool {
+	return bytes.HasPrefix(token, []byte("--")) || bytes.HasPrefix(token, []byte("#")) || bytes.HasPrefix(token, []byte("/*"))
+}
+
+// rewrites returns true if statements are rewritten before they're run.
+func (m *Mysql) rewrites() bool {
+	return m.config.AutoIfNotExists || (m.config.OnlineDDL && m.supportsOnlineDDL) || m.config.SQLTransform != nil
+}
+
+// rewrite applies AutoIfNotExists, OnlineDDL and then SQLTransform to stmt.
+func (m *Mysql) rewrite(stmt []byte) ([]byte, error) {
+	if m.config.AutoIfNotExists {
+		stmt = autoIfNotExists(stmt, m.ifNotExists)
+	}
+	if m.config.OnlineDDL && m.supportsOnlineDDL {
+		stmt = onlineDDL(stmt)
+	}
+	if m.config.SQLTransform != nil {
+		transformed, err := m.config.SQLTransform(stmt)
+		if err != nil {
+			return nil, database.Error{OrigErr: err, Err: "sql transform failed", Query: stmt}
+		}
+		stmt = transformed
+	}
+	return stmt, nil
+}
+
+func (m *Mysql) SetVersion(version int, dirty bool) error {
+	return m.SetVersionWithName(version, dirty, "")
+}
+
+// SetVersionContext implements database.DriverContext. ctx bounds the
+// queries writing the version next to VersionQueryTimeout.
+func (m *Mysql) SetVersionContext(ctx context.Context, version int, dirty bool) error {
+	if m.config.DeferVersionCommit {
+		m.pendingVersion = &versionState{version: version, dirty: dirty}
+		return nil
+	}
+	return m.setVersion(ctx, version, dirty, "")
+}
+
+// SetVersionWithName implements database.VersionNamer. It sets the version
+// like SetVersion and records name, cut to 255 characters, in the name
+// column of the migrations table. An empty name leaves it NULL.
+func (m *Mysql) SetVersionWithName(version int, dirty bool, name string) error {
+	if utf8.RuneCountInString(name) > maxVersionName {
+		name = string([]rune(name)[:maxVersionName])
+	}
+	if m.config.DeferVersionCommit {
+		m.pendingVersion = &versionState{version: version, dirty: dirty, name: name}
+		return nil
+	}
+	return m.setVersion(context.Background(), version, dirty, name)
+}
+
+// maxVersionName is the length of the name column of the migrations table.
+const maxVersionName = 255
+
+// PendingVersion returns a closure writing the version last passed to
+// SetVersion, if DeferVersionCommit is on and it hasn't been written yet.
+// Frameworks owning the transaction a migration runs in call it after
+// committing that transaction. If the process dies in between, the
+// migration is applied but not recorded and will run again.
+func (m *Mysql) PendingVersion() (CommitVersion func() error, ok bool) {
+	pending := m.pendingVersion
+	if pending == nil {
+		return nil, false
+	}
+
+	return func() error {
+		if err := m.setVersion(context.Background(), pending.version, pending.dirty, pending.name); err != nil {
+			return err
+		}
+		if m.pendingVersion == pending {
+			m.pendingVersion = nil
+		}
+		return nil
+	}, true
+}
+
+func (m *Mysql) setVersion(parent context.Context, version int, dirty bool, name string) error {
+	defer m.invalidateVersion()
+
+	ctx, cancel := m.versionQueryContext(parent)
+	defer cancel()
+
+	tx, err := m.conn.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+
+	query := "TRUNCATE " + quoteTable(m.config.MigrationsTable)
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		tx.Rollback()
+		return m.versionQueryError(ctx, err, m.config.MigrationsTable, query)
+	}
+
+	if version >= 0 {
+		query, args := m.SetVersionSQL(version, dirty)
+		if len(name) > 0 && !m.noVersionName {
+			query = "INSERT INTO " + quoteTable(m.config.MigrationsTable) + " (version, dirty, name) VALUES (?, ?, ?)"
+			args = append(args, name)
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			tx.Rollback()
+			return m.versionQueryError(ctx, err, m.config.MigrationsTable, query)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+
+	return nil
+}
+
+// SetVersionSQL returns the statement and arguments SetVersion writes the
+// version with, without running it. SetVersion empties the migrations table
+// with TRUNCATE first, in the same transaction. For NilVersion nothing is
+// written and the query is empty.
+func (m *Mysql) SetVersionSQL(version int, dirty bool) (query string, args []interface{}) {
+	if version < 0 {
+		return "", nil
+	}
+	return "INSERT INTO " + quoteTable(m.config.MigrationsTable) + " (version, dirty) VALUES (?, ?)", []interface{}{version, dirty}
+}
+
+// VersionApplied returns when version was written to the migrations table,
+// i.e. when the migration applying it started, or ended if it's clean.
+// Only the current version is kept, database.ErrVersionNotFound is returned
+// for any other.
+func (m *Mysql) VersionApplied(version int) (time.Time, error) {
+	if m.noAppliedAt {
+		return time.Time{}, ErrNoAppliedAtColumn
+	}
+
+	ctx, cancel := m.versionQueryContext(context.Background())
+	defer cancel()
+
+	var appliedAt int64
+	query := "SELECT UNIX_TIMESTAMP(applied_at) FROM " + quoteTable(m.config.MigrationsTable) + " WHERE version = ?"
+	err := m.conn.QueryRowContext(ctx, query, version).Scan(&appliedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return time.Time{}, database.ErrVersionNotFound
+	case err != nil:
+		return time.Time{}, m.versionQueryError(ctx, err, m.config.MigrationsTable, query)
+	}
+	return time.Unix(appliedAt, 0), nil
+}
+
+func (m *Mysql) Version() (version int, dirty bool, err error) {
+	return m.VersionContext(context.Background())
+}
+
+// VersionContext implements database.DriverContext. ctx bounds the query
+// reading the version next to VersionQueryTimeout.
+func (m *Mysql) VersionContext(ctx context.Context) (version int, dirty bool, err error) {
+	if m.config.VersionCacheTTL <= 0 {
+		return m.version(ctx)
+	}
+
+	m.cacheMu.Lock()
+	if m.cachedVersion != nil && time.Now().Before(m.cachedUntil) {
+		cached := *m.cachedVersion
+		m.cacheMu.Unlock()
+		return cached.version, cached.dirty, nil
+	}
+	generation := m.cacheGeneration
+	m.cacheMu.Unlock()
+
+	version, dirty, err = m.version(ctx)
+	if err != nil {
+		return version, dirty, err
+	}
+
+	m.cacheMu.Lock()
+	if generation == m.cacheGeneration {
+		m.cachedVersion = &versionState{version: version, dirty: dirty}
+		m.cachedUntil = time.Now().Add(m.config.VersionCacheTTL)
+	}
+	m.cacheMu.Unlock()
+	return version, dirty, nil
+}
+
+// invalidateVersion drops the version cached by Version.
+func (m *Mysql) invalidateVersion() {
+	m.cacheMu.Lock()
+	m.cachedVersion = nil
+	m.cacheGeneration++
+	m.cacheMu.Unlock()
+}
+
+// version reads the version from the migrations table.
+func (m *Mysql) version(parent context.Context) (version int, dirty bool, err error) {
+	ctx, cancel := m.versionQueryContext(parent)
+	defer cancel()
+
+	query := "SELECT version, dirty FROM " + quoteTable(m.config.MigrationsTable) + " LIMIT 1"
+	err = m.conn.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	switch {
+	case err == sql.ErrNoRows:
+		return database.NilVersion, false, nil
+
+	case err != nil:
+		if e, ok := err.(*mysql.MySQLError); ok {
+			if e.Number == 0 {
+				return database.NilVersion, false, nil
+			}
+		}
+		return 0, false, m.versionQueryError(ctx, err, m.config.MigrationsTable, query)
+
+	default:
+		return version, dirty, nil
+	}
+}
+
+// versionQueryContext returns the context bounding a bookkeeping query by
+// Config.VersionQueryTimeout, derived from parent.
+func (m *Mysql) versionQueryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := m.config.VersionQueryTimeout
+	if timeout == 0 {
+		timeout = DefaultVersionQueryTimeout
+	}
+	if timeout < 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// versionQueryError returns the error of a bookkeeping query on table. If
+// the query timed out, the error says so and names the connection holding
+// a metadata lock on the table, if it can be found.
+func (m *Mysql) versionQueryError(ctx context.Context, err error, table string, query string) error {
+	if ctx.Err() != context.DeadlineExceeded {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+
+	msg := "version query blocked, e.g. by a lock on " + table
+	if holder, ok := m.metadataLockHolder(table); ok {
+		msg = "version query blocked by a metadata lock on " + table + " held by " + holder
+	}
+	return &database.Error{OrigErr: err, Code: database.CodeLockTimeout, Err: msg, Query: []byte(query)}
+}
+
+// metadataLockHolder describes a connection holding a metadata lock on
+// table, from performance_schema.metadata_locks. It needs another connection
+// than m.conn, which the driver closes when a query times out, so it's only
+// looked up if Open created the pool. The lookup fails quietly, e.g. if the
+// performance schema is disabled.
+func (m *Mysql) metadataLockHolder(table string) (string, bool) {
+	if m.db == nil {
+		return "", false
+	}
+	db, name := splitTableName(table)
+	if len(db) == 0 {
+		db = m.config.DatabaseName
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := `SELECT t.PROCESSLIST_ID, l.LOCK_TYPE, COALESCE(t.PROCESSLIST_INFO, '') ` +
+		`FROM performance_schema.metadata_locks l JOIN performance_schema.threads t ON t.THREAD_ID = l.OWNER_THREAD_ID ` +
+		`WHERE l.OBJECT_TYPE = 'TABLE' AND l.OBJECT_SCHEMA = ? AND l.OBJECT_NAME = ? AND l.LOCK_STATUS = 'GRANTED' ` +
+		`AND t.PROCESSLIST_ID IS NOT NULL ORDER BY t.PROCESSLIST_ID LIMIT 1`
+	var id int64
+	var lockType, info string
+	if err := m.db.QueryRowContext(ctx, query, db, name).Scan(&id, &lockType, &info); err != nil {
+		return "", false
+	}
+	holder := fmt.Sprintf("connection %v (%v)", id, lockType)
+	if len(info) > 0 {
+		holder += " running " + info
+	}
+	return holder, true
+}
+
+// Capabilities implements database.CapabilityReporter. MySQL commits
+// DDL statements implicitly, so they are never rolled back. Online DDL
+// depends on the server version.
+func (m *Mysql) Capabilities() database.DriverCapabilities {
+	return database.DriverCapabilities{
+		SupportsLock:             true,
+		SupportsTransactionalDDL: false,
+		SupportsHistory:          true,
+		SupportsOnlineDDL:        m.supportsOnlineDDL,
+	}
+}
+
+// RepairDuplicates implements database.DuplicateRepairer. The primary key
+// of the migrations table prevents duplicates, so only tables created
+// without it, e.g. by hand, are repaired; for others it returns 0.
+func (m *Mysql) RepairDuplicates() (int, error) {
+	query := "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = ? AND table_name = ? AND index_name = 'PRIMARY'"
+	var keys int
+	if err := m.conn.QueryRowContext(context.Background(), query, m.config.DatabaseName, m.config.MigrationsTable).Scan(&keys); err != nil {
+		return 0, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	if keys > 0 {
+		return 0, nil
+	}
+
+	defer m.invalidateVersion()
+
+	tx, err := m.conn.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return 0, &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+
+	query = "SELECT version, COUNT(*), MIN(dirty) FROM " + quoteTable(m.config.MigrationsTable) + " GROUP BY version HAVING COUNT(*) > 1"
+	duplicates, err := queryDuplicates(tx, query)
+	if err != nil {
+		tx.Rollback()
+		return 0, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+
+	removed := 0
+	for _, d := range duplicates {
+		query := "DELETE FROM " + quoteTable(m.config.MigrationsTable) + " WHERE version = ?"
+		if _, err := tx.ExecContext(context.Background(), query, d.Version); err != nil {
+			tx.Rollback()
+			return 0, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+
+		query = "INSERT INTO " + quoteTable(m.config.MigrationsTable) + " (version, dirty) VALUES (?, ?)"
+		if _, err := tx.ExecContext(context.Background(), query, d.Version, d.Dirty); err != nil {
+			tx.Rollback()
+			return 0, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+		removed += d.Count - 1
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+	return removed, nil
+}
+
+// duplicate describes rows of the migrations table with the same version.
+// dirty is true if all of them are dirty.
+type duplicate struct {
+	Version int
+	Count   int
+	Dirty   bool
+}
+
+func queryDuplicates(tx *sql.Tx, query string) ([]duplicate, error) {
+	rows, err := tx.QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	duplicates := make([]duplicate, 0)
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.Version, &d.Count, &d.Dirty); err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, d)
+	}
+	return duplicates, rows.Err()
+}
+
+func (m *Mysql) Drop() error {
+	defer m.invalidateVersion()
+
+	// select all tables
+	query := `SHOW TABLES LIKE '%'`
+	tables, err := m.conn.QueryContext(context.Background(), query)
+	if err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	defer tables.Close()
+
+	// delete one table after another
+	tableNames := make([]string, 0)
+	for tables.Next() {
+		var tableName string
+		if err := tables.Scan(&tableName); err != nil {
+			return err
+		}
+		// the row of LockStrategyTable is still needed to unlock
+		if m.config.LockStrategy == LockStrategyTable && tableName == m.config.LockTable {
+			continue
+		}
+		if len(tableName) > 0 {
+			tableNames = append(tableNames, tableName)
+		}
+	}
+	if err := tables.Err(); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	// the connection can't run the DROPs before the cursor is closed
+	if err := tables.Close(); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	// delete one by one, trying all tables even if one fails ...
+	var result *database.MultiError
+	for _, t := range tableNames {
+		query = "DROP TABLE IF EXISTS `" + t + "` CASCADE"
+		if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+			result = database.Append(result, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)})
+		}
+	}
+	// the history table is created again when it's needed
+	m.hasHistoryColumns, m.hasSQLColumn = false, false
+
+	// ... and leave an empty version table, even if there were no tables.
+	// A version table in another database isn't dropped, so empty it.
+	if err := m.ensureVersionTable(); err != nil {
+		result = database.Append(result, err)
+	} else if db, _ := splitTableName(m.config.MigrationsTable); len(db) > 0 && db != m.config.DatabaseName {
+		query = "TRUNCATE " + quoteTable(m.config.MigrationsTable)
+		if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+			result = database.Append(result, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)})
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// ListMigrationTables returns the sorted names of the tables in the
+// database that look like migration tables, e.g. to audit a database shared
+// by several migration streams. A table matches if its name is LIKE
+// Config.MigrationTablesPattern, or if it has the two columns of a version
+// table, version and dirty, and no others.
+func (m *Mysql) ListMigrationTables() ([]string, error) {
+	pattern := m.config.MigrationTablesPattern
+	if len(pattern) == 0 {
+		pattern = DefaultMigrationTablesPattern
+	}
+
+	query := `SELECT table_name FROM information_schema.tables WHERE table_schema = ? AND (table_name LIKE ? OR table_name IN (` +
+		`SELECT table_name FROM information_schema.columns WHERE table_schema = ? GROUP BY table_name ` +
+		`HAVING COUNT(*) = 2 AND SUM(column_name IN ('version', 'dirty')) = 2))`
+	rows, err := m.conn.QueryContext(context.Background(), query, m.config.DatabaseName, pattern, m.config.DatabaseName)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	// the collation of the server may sort differently
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// ListTables implements database.TableLister. It lists the base tables of
+// the database, views aren't included.
+func (m *Mysql) ListTables() ([]string, error) {
+	query := `SELECT table_name FROM information_schema.tables WHERE table_schema = ? AND table_type = 'BASE TABLE'`
+	rows, err := m.conn.QueryContext(context.Background(), query, m.config.DatabaseName)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// CheckForeignKeys looks for rows referencing rows that don't exist, which
+// migrations running with SET FOREIGN_KEY_CHECKS=0 can leave behind. It
+// checks every foreign key of the tables in the database and returns a
+// description of each one with orphaned rows, e.g.
+//
+//	orders (customer_id) references customers (id): 3 orphaned rows (fk_orders_customer)
+//
+// Like MySQL, it skips rows with a NULL in the foreign key columns.
+// Checking scans the tables, so it can take a while on large ones.
+func (m *Mysql) CheckForeignKeys() ([]string, error) {
+	keys, err := m.foreignKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	violations := make([]string, 0)
+	for _, fk := range keys {
+		query := fk.orphansQuery(m.config.DatabaseName)
+		var orphans int64
+		if err := m.conn.QueryRowContext(context.Background(), query).Scan(&orphans); err != nil {
+			return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+		if orphans > 0 {
+			violations = append(violations, fmt.Sprintf("%v: %v orphaned rows (%v)", fk, orphans, fk.name))
+		}
+	}
+	return violations, nil
+}
+
+// foreignKey is a foreign key constraint of a table in the database.
+type foreignKey struct {
+	name       string
+	table      string
+	columns    []string
+	refSchema  string
+	refTable   string
+	refColumns []string
+}
+
+func (fk foreignKey) String() string {
+	return fmt.Sprintf("%v (%v) references %v (%v)", fk.table, strings.Join(fk.columns, ", "),
+		fk.refTable, strings.Join(fk.refColumns, ", "))
+}
+
+// orphansQuery returns the query counting the rows of the table violating
+// the foreign key.
+func (fk foreignKey) orphansQuery(db string) string {
+	var on, notNull []string
+	for i, column := range fk.columns {
+		on = append(on, "p.`"+fk.refColumns[i]+"` = c.`"+column+"`")
+		notNull = append(notNull, "c.`"+column+"` IS NOT NULL")
+	}
+	ref := fk.refTable
+	if fk.refSchema != db {
+		ref = fk.refSchema + "." + fk.refTable
+	}
+	return "SELECT COUNT(*) FROM " + quoteTable(fk.table) + " c LEFT JOIN " + quoteTable(ref) + " p ON " +
+		strings.Join(on, " AND ") + " WHERE " + strings.Join(notNull, " AND ") + " AND p.`" + fk.refColumns[0] + "` IS NULL"
+}
+
+// foreignKeys returns the foreign keys of the tables in the database,
+// ordered by table and name.
+func (m *Mysql) foreignKeys() ([]foreignKey, error) {
+	query := `SELECT constraint_name, table_name, column_name, referenced_table_schema, referenced_table_name, referenced_column_name ` +
+		`FROM information_schema.key_column_usage WHERE table_schema = ? AND referenced_table_name IS NOT NULL ` +
+		`ORDER BY table_name, constraint_name, ordinal_position`
+	rows, err := m.conn.QueryContext(context.Background(), query, m.config.DatabaseName)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	var keys []foreignKey
+	for rows.Next() {
+		var fk foreignKey
+		var column, refColumn string
+		if err := rows.Scan(&fk.name, &fk.table, &column, &fk.refSchema, &fk.refTable, &refColumn); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		// the columns of a key come in a row each
+		if n := len(keys); n > 0 && keys[n-1].table == fk.table && keys[n-1].name == fk.name {
+			keys[n-1].columns = append(keys[n-1].columns, column)
+			keys[n-1].refColumns = append(keys[n-1].refColumns, refColumn)
+			continue
+		}
+		fk.columns, fk.refColumns = []string{column}, []string{refColumn}
+		keys = append(keys, fk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return keys, nil
+}
+
+func (m *Mysql) ensureVersionTable() error {
+	// check if migration table exists
+	var result string
+	db, table := splitTableName(m.config.MigrationsTable)
+	query := `SHOW TABLES LIKE "` + table + `"`
+	if len(db) > 0 {
+		query = "SHOW TABLES FROM `" + db + "` LIKE \"" + table + "\""
+	}
+	if err := m.conn.QueryRowContext(context.Background(), query).Scan(&result); err != nil {
+		if err != sql.ErrNoRows {
+			return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+	} else {
+		return m.ensureVersionColumns()
+	}
+
+	// if not, create the empty migration table
+	engine := m.config.VersionTableEngine
+	if len(engine) == 0 {
+		engine = DefaultVersionTableEngine
+	}
+	query = "CREATE TABLE " + quoteTable(m.config.MigrationsTable) + " (version bigint not null primary key, dirty boolean not null, applied_at datetime not null default current_timestamp, name varchar(255)) ENGINE=" + engine
+	if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	m.noAppliedAt, m.noVersionName = false, false
+	return nil
+}
+
+// column is a column and its definition, see addMissingColumns.
+type column struct {
+	name, definition string
+}
+
+// versionColumns are the columns added to the migrations table after it
+// was first released, with their definitions.
+var versionColumns = []column{
+	{"applied_at", "datetime not null default current_timestamp"},
+	{"name", "varchar(255)"},
+}
+
+// ensureVersionColumns checks which versionColumns a migrations table
+// created before them has. With UpgradeVersionTable the missing ones are
+// added, otherwise the table is left as is.
+func (m *Mysql) ensureVersionColumns() error {
+	if m.config.UpgradeVersionTable {
+		if err := m.addMissingColumns(m.config.MigrationsTable, versionColumns); err != nil {
+			return err
+		}
+		m.noAppliedAt, m.noVersionName = false, false
+		return nil
+	}
+
+	existing, err := m.tableColumns(m.config.MigrationsTable)
+	if err != nil {
+		return err
+	}
+	m.noAppliedAt, m.noVersionName = !existing["applied_at"], !existing["name"]
+	return nil
+}
+
+// tableColumns returns the lower case names of the columns of table.
+func (m *Mysql) tableColumns(table string) (map[string]bool, error) {
+	query := "SHOW COLUMNS FROM " + quoteTable(table)
+	rows, err := m.conn.QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var field, typ, null, key, extra string
+		var def sql.NullString
+		if err := rows.Scan(&field, &typ, &null, &key, &def, &extra); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		existing[strings.ToLower(field)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return existing, nil
+}
+
+// addMissingColumns adds the columns table lacks, in order.
+func (m *Mysql) addMissingColumns(table string, columns []column) error {
+	existing, err := m.tableColumns(table)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range columns {
+		if existing[c.name] {
+			continue
+		}
+		query := "ALTER TABLE " + quoteTable(table) + " ADD COLUMN " + c.name + " " + c.definition
+		if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+			return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+	}
+	return nil
+}
 
-func (m *Mysql) Version() (version int, dirty bool, err error) {
-	query := "SELECT version, dirty FROM `" + m.config.MigrationsTable + "` LIMIT 1"
-	err = m.conn.QueryRowContext(context.Background(), query).Scan(&version, &dirty)
+// engineName matches the names of storage engines.
+var engineName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// splitTableName splits a table name qualified with a database, like
+// migrations_db.schema_migrations, into the database and the table name.
+// The database is empty for unqualified names.
+func splitTableName(name string) (db string, table string) {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// quoteTable quotes a table name, which may be qualified with a database.
+func quoteTable(name string) string {
+	if db, table := splitTableName(name); len(db) > 0 {
+		return "`" + db + "`.`" + table + "`"
+	}
+	return "`" + name + "`"
+}
+
+// ensureHistoryTable creates the history table if it doesn't exist. It
+// only runs DDL the first time it's called, since DDL commits implicitly
+// and needs the CREATE privilege.
+func (m *Mysql) ensureHistoryTable() error {
+	if m.hasHistoryColumns {
+		return nil
+	}
+
+	query := "CREATE TABLE IF NOT EXISTS " + quoteTable(m.config.HistoryTable) + " (version bigint not null primary key, dirty boolean not null, deploy_id varchar(255), sql_text longtext, applied_at datetime(6), checksum char(64), duration_ms bigint)"
+	if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+
+	// the entries recorded before keep the added columns empty
+	if err := m.addMissingColumns(m.config.HistoryTable, historyColumns); err != nil {
+		return err
+	}
+	m.hasHistoryColumns = true
+	return nil
+}
+
+// historyColumns are the columns added to the history table after it was
+// first released, with their definitions.
+var historyColumns = []column{
+	{"applied_at", "datetime(6)"},
+	{"checksum", "char(64)"},
+	{"duration_ms", "bigint"},
+}
+
+// historyAppliedAt is the ON DUPLICATE KEY UPDATE assignment of applied_at
+// for history entries. applied_at is set when an entry is inserted and
+// again when a dirty entry is cleaned, i.e. when its migration succeeded.
+// It has to precede the assignment of dirty, which it reads.
+const historyAppliedAt = "applied_at = IF(dirty AND NOT VALUES(dirty), VALUES(applied_at), applied_at)"
+
+// appliedAtTime converts UNIX_TIMESTAMP(applied_at) to a time, zero for
+// entries without one.
+func appliedAtTime(ts sql.NullFloat64) time.Time {
+	if !ts.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(math.Round(ts.Float64*1e6))*int64(time.Microsecond))
+}
+
+// ensureSQLColumn creates the history table, and adds the sql_text column
+// to history tables created before StoreSQL existed.
+func (m *Mysql) ensureSQLColumn() error {
+	if m.hasSQLColumn {
+		return nil
+	}
+	if err := m.ensureHistoryTable(); err != nil {
+		return err
+	}
+
+	var field, typ, null, key, extra string
+	var def sql.NullString
+	query := "SHOW COLUMNS FROM " + quoteTable(m.config.HistoryTable) + " LIKE 'sql_text'"
+	err := m.conn.QueryRowContext(context.Background(), query).Scan(&field, &typ, &null, &key, &def, &extra)
+	if err == sql.ErrNoRows {
+		query = "ALTER TABLE " + quoteTable(m.config.HistoryTable) + " ADD COLUMN sql_text longtext"
+		_, err = m.conn.ExecContext(context.Background(), query)
+	}
+	if err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+
+	m.hasSQLColumn = true
+	return nil
+}
+
+// RunWithVersion runs migration like Run. With StoreSQL it then keeps the
+// SQL in the history entry of version, creating a clean entry if there
+// is none, so that GetVersionSQL returns it.
+func (m *Mysql) RunWithVersion(migration io.Reader, version int) error {
+	if !m.config.StoreSQL {
+		return m.Run(migration)
+	}
+	if err := m.ensureSQLColumn(); err != nil {
+		return err
+	}
+
+	sqlText := &bytes.Buffer{}
+	if err := m.Run(io.TeeReader(migration, sqlText)); err != nil {
+		return err
+	}
+
+	query := "INSERT INTO " + quoteTable(m.config.HistoryTable) + " (version, dirty, sql_text, applied_at) VALUES (?, false, ?, NOW(6)) ON DUPLICATE KEY UPDATE sql_text = VALUES(sql_text)"
+	if _, err := m.conn.ExecContext(context.Background(), query, version, sqlText.String()); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	return nil
+}
+
+// GetVersionSQL returns the SQL RunWithVersion stored for version. It's
+// empty if the migration ran without StoreSQL, and database.ErrVersionNotFound
+// is returned if the history has no entry for version.
+func (m *Mysql) GetVersionSQL(version int) (string, error) {
+	if err := m.ensureSQLColumn(); err != nil {
+		return "", err
+	}
+
+	var sqlText sql.NullString
+	query := "SELECT sql_text FROM " + quoteTable(m.config.HistoryTable) + " WHERE version = ?"
+	err := m.conn.QueryRowContext(context.Background(), query, version).Scan(&sqlText)
 	switch {
 	case err == sql.ErrNoRows:
-		return database.NilVersion, false, nil
+		return "", database.ErrVersionNotFound
+	case err != nil:
+		return "", &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	return sqlText.String, nil
+}
 
+// FindVersion implements database.VersionHistory.
+func (m *Mysql) FindVersion(version int) (database.HistoryEntry, error) {
+	if err := m.ensureHistoryTable(); err != nil {
+		return database.HistoryEntry{}, err
+	}
+
+	ctx, cancel := m.versionQueryContext(context.Background())
+	defer cancel()
+
+	entry := database.HistoryEntry{}
+	var deployID, checksum sql.NullString
+	var appliedAt sql.NullFloat64
+	var durationMs sql.NullInt64
+	query := "SELECT version, dirty, deploy_id, UNIX_TIMESTAMP(applied_at), duration_ms, checksum FROM " + quoteTable(m.config.HistoryTable) + " WHERE version = ?"
+	err := m.conn.QueryRowContext(ctx, query, version).Scan(&entry.Version, &entry.Dirty, &deployID, &appliedAt, &durationMs, &checksum)
+	switch {
+	case err == sql.ErrNoRows:
+		return database.HistoryEntry{}, database.ErrVersionNotFound
 	case err != nil:
-		if e, ok := err.(*mysql.MySQLError); ok {
-			if e.Number == 0 {
-				return database.NilVersion, false, nil
-			}
+		return database.HistoryEntry{}, m.versionQueryError(ctx, err, m.config.HistoryTable, query)
+	}
+	entry.DeployID = deployID.String
+	entry.AppliedAt = appliedAtTime(appliedAt)
+	entry.Duration = time.Duration(durationMs.Int64) * time.Millisecond
+	entry.Checksum = checksum.String
+	return entry, nil
+}
+
+// UpsertVersion implements database.VersionHistory.
+func (m *Mysql) UpsertVersion(version int, dirty bool) error {
+	if err := m.ensureHistoryTable(); err != nil {
+		return err
+	}
+
+	if m.config.WarnOnOutOfOrder {
+		if err := m.warnOutOfOrder(version); err != nil {
+			return err
 		}
-		return 0, false, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
 
-	default:
-		return version, dirty, nil
+	query := "INSERT INTO " + quoteTable(m.config.HistoryTable) + " (version, dirty, applied_at) VALUES (?, ?, NOW(6)) ON DUPLICATE KEY UPDATE " + historyAppliedAt + ", dirty = VALUES(dirty)"
+	if _, err := m.conn.ExecContext(context.Background(), query, version, dirty); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 	}
+	return nil
 }
 
-func (m *Mysql) Drop() error {
-	// select all tables
-	query := `SHOW TABLES LIKE '%'`
-	tables, err := m.conn.QueryContext(context.Background(), query)
+// RecordChecksum implements database.ChecksumRecorder.
+func (m *Mysql) RecordChecksum(version int, checksum string) error {
+	if err := m.ensureHistoryTable(); err != nil {
+		return err
+	}
+
+	query := "INSERT INTO " + quoteTable(m.config.HistoryTable) + " (version, dirty, applied_at, checksum) VALUES (?, false, NOW(6), ?) ON DUPLICATE KEY UPDATE checksum = VALUES(checksum)"
+	if _, err := m.conn.ExecContext(context.Background(), query, version, checksum); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	return nil
+}
+
+// RecordDuration implements database.DurationRecorder. The duration is
+// stored in milliseconds.
+func (m *Mysql) RecordDuration(version int, d time.Duration) error {
+	if err := m.ensureHistoryTable(); err != nil {
+		return err
+	}
+
+	query := "INSERT INTO " + quoteTable(m.config.HistoryTable) + " (version, dirty, applied_at, duration_ms) VALUES (?, false, NOW(6), ?) ON DUPLICATE KEY UPDATE duration_ms = VALUES(duration_ms)"
+	if _, err := m.conn.ExecContext(context.Background(), query, version, int64(d/time.Millisecond)); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	return nil
+}
+
+// warnOutOfOrder passes a warning to Config.Log if version isn't recorded yet and lower than
+// the highest version in the history table, see WarnOnOutOfOrder.
+func (m *Mysql) warnOutOfOrder(version int) error {
+	query := "SELECT MAX(version), COALESCE(SUM(version = ?), 0) FROM " + quoteTable(m.config.HistoryTable)
+	var highest sql.NullInt64
+	var recorded int
+	if err := m.conn.QueryRowContext(context.Background(), query, version).Scan(&highest, &recorded); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	if highest.Valid && int64(version) < highest.Int64 && recorded == 0 {
+		m.warnf("version %v applied out of order, %v is applied already", version, highest.Int64)
+	}
+	return nil
+}
+
+// DeleteVersion implements database.VersionHistory.
+func (m *Mysql) DeleteVersion(version int) error {
+	defer m.invalidateVersion()
+
+	if err := m.ensureHistoryTable(); err != nil {
+		return err
+	}
+
+	ctx, cancel := m.versionQueryContext(context.Background())
+	defer cancel()
+
+	query := "DELETE FROM " + quoteTable(m.config.HistoryTable) + " WHERE version = ?"
+	if _, err := m.conn.ExecContext(ctx, query, version); err != nil {
+		return m.versionQueryError(ctx, err, m.config.HistoryTable, query)
+	}
+	return nil
+}
+
+// ListVersions implements database.VersionHistory.
+func (m *Mysql) ListVersions(offset, limit int) ([]database.HistoryEntry, error) {
+	if err := m.ensureHistoryTable(); err != nil {
+		return nil, err
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	// MySQL has no OFFSET without LIMIT, so use the largest possible one
+	query := "SELECT version, dirty, deploy_id, UNIX_TIMESTAMP(applied_at), duration_ms FROM " + quoteTable(m.config.HistoryTable) + " ORDER BY version LIMIT 18446744073709551615 OFFSET ?"
+	args := []interface{}{offset}
+	if limit > 0 {
+		query = "SELECT version, dirty, deploy_id, UNIX_TIMESTAMP(applied_at), duration_ms FROM " + quoteTable(m.config.HistoryTable) + " ORDER BY version LIMIT ? OFFSET ?"
+		args = []interface{}{limit, offset}
+	}
+	rows, err := m.conn.QueryContext(context.Background(), query, args...)
 	if err != nil {
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 	}
-	defer tables.Close()
+	defer rows.Close()
 
-	// delete one table after another
-	tableNames := make([]string, 0)
-	for tables.Next() {
-		var tableName string
-		if err := tables.Scan(&tableName); err != nil {
-			return err
+	entries := make([]database.HistoryEntry, 0)
+	for rows.Next() {
+		var entry database.HistoryEntry
+		var deployID sql.NullString
+		var appliedAt sql.NullFloat64
+		var durationMs sql.NullInt64
+		if err := rows.Scan(&entry.Version, &entry.Dirty, &deployID, &appliedAt, &durationMs); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
 		}
-		if len(tableName) > 0 {
-			tableNames = append(tableNames, tableName)
+		entry.DeployID = deployID.String
+		entry.AppliedAt = appliedAtTime(appliedAt)
+		entry.Duration = time.Duration(durationMs.Int64) * time.Millisecond
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return entries, nil
+}
+
+// History implements database.HistoryReader. It returns the entries of the
+// history table ordered by version, which is the order they were applied
+// in, unless a version was applied out of order, see WarnOnOutOfOrder.
+func (m *Mysql) History() ([]database.HistoryEntry, error) {
+	return m.ListVersions(0, 0)
+}
+
+// CopyHistoryTo copies the version table to newTable and the history table
+// to newTable with a _history suffix, the history table newTable gets by
+// default, e.g. before switching MigrationsTable to newTable to use
+// LockScopeTable. Missing tables are created like the current ones,
+// existing ones have to be empty, otherwise ErrCopyTargetNotEmpty is
+// returned. The rows are copied in one transaction.
+func (m *Mysql) CopyHistoryTo(newTable string) error {
+	if err := m.ensureHistoryTable(); err != nil {
+		return err
+	}
+
+	tables := []struct{ from, to string }{
+		{m.config.MigrationsTable, newTable},
+		{m.config.HistoryTable, newTable + "_history"},
+	}
+	for _, t := range tables {
+		query := "CREATE TABLE IF NOT EXISTS " + quoteTable(t.to) + " LIKE " + quoteTable(t.from)
+		if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
+			return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 		}
 	}
 
-	if len(tableNames) > 0 {
-		// delete one by one ...
-		for _, t := range tableNames {
-			query = "DROP TABLE IF EXISTS `" + t + "` CASCADE"
-			if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
-				return &database.Error{OrigErr: err, Query: []byte(query)}
-			}
+	tx, err := m.conn.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	for _, t := range tables {
+		query := "SELECT EXISTS (SELECT 1 FROM " + quoteTable(t.to) + ")"
+		var exists bool
+		if err := tx.QueryRowContext(context.Background(), query).Scan(&exists); err != nil {
+			tx.Rollback()
+			return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+		if exists {
+			tx.Rollback()
+			return ErrCopyTargetNotEmpty
+		}
+
+		query = "INSERT INTO " + quoteTable(t.to) + " SELECT * FROM " + quoteTable(t.from)
+		if _, err := tx.ExecContext(context.Background(), query); err != nil {
+			tx.Rollback()
+			return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+	return nil
+}
+
+// RunBatchTagged implements database.DeployTagger.
+func (m *Mysql) RunBatchTagged(migrations []io.Reader, versions []int, deployID string) error {
+	if len(migrations) != len(versions) {
+		return database.ErrBatchMismatch
+	}
+	// refuse before the first version is tagged as dirty
+	if err := m.checkWindow(); err != nil {
+		return err
+	}
+	if err := m.ensureHistoryTable(); err != nil {
+		return err
+	}
+
+	for i, migration := range migrations {
+		if err := m.tagVersion(versions[i], true, deployID); err != nil {
+			return err
+		}
+		if err := m.SetVersion(versions[i], true); err != nil {
+			return err
+		}
+		if err := m.RunWithVersion(migration, versions[i]); err != nil {
+			return err
+		}
+		if err := m.SetVersion(versions[i], false); err != nil {
+			return err
 		}
-		if err := m.ensureVersionTable(); err != nil {
+		if err := m.tagVersion(versions[i], false, deployID); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
+// tagVersion upserts the history entry of version with deployID.
+func (m *Mysql) tagVersion(version int, dirty bool, deployID string) error {
+	query := "INSERT INTO " + quoteTable(m.config.HistoryTable) + " (version, dirty, deploy_id, applied_at) VALUES (?, ?, ?, NOW(6)) ON DUPLICATE KEY UPDATE " + historyAppliedAt + ", dirty = VALUES(dirty), deploy_id = VALUES(deploy_id)"
+	if _, err := m.conn.ExecContext(context.Background(), query, version, dirty, deployID); err != nil {
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
 	return nil
 }
 
-func (m *Mysql) ensureVersionTable() error {
-	// check if migration table exists
-	var result string
-	query := `SHOW TABLES LIKE "` + m.config.MigrationsTable + `"`
-	if err := m.conn.QueryRowContext(context.Background(), query).Scan(&result); err != nil {
-		if err != sql.ErrNoRows {
-			return &database.Error{OrigErr: err, Query: []byte(query)}
+// VersionsByDeploy implements database.DeployTagger.
+func (m *Mysql) VersionsByDeploy(deployID string) ([]int, error) {
+	if err := m.ensureHistoryTable(); err != nil {
+		return nil, err
+	}
+
+	query := "SELECT version FROM " + quoteTable(m.config.HistoryTable) + " WHERE deploy_id = ? ORDER BY version"
+	rows, err := m.conn.QueryContext(context.Background(), query, deployID)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	versions := make([]int, 0)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
 		}
-	} else {
-		return nil
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
 	}
+	return versions, nil
+}
 
-	// if not, create the empty migration table
-	query = "CREATE TABLE `" + m.config.MigrationsTable + "` (version bigint not null primary key, dirty boolean not null)"
-	if _, err := m.conn.ExecContext(context.Background(), query); err != nil {
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+var (
+	alterTableRe     = regexp.MustCompile(`(?is)^(\s*(--[^\n]*\n|#[^\n]*\n|/\*.*?\*/))*\s*ALTER\s+(ONLINE\s+|IGNORE\s+)?TABLE\b`)
+	onlineDDLHintRe  = regexp.MustCompile(`(?i)\b(ALGORITHM|LOCK)\s*=`)
+	partitionRe      = regexp.MustCompile(`(?i)\b(PARTITION|PARTITIONING)\b`)
+	serverVersionRe  = regexp.MustCompile(`^(\d+)\.(\d+)`)
+	lineCommentEndRe = regexp.MustCompile(`(--\s|#)[^\n]*$`)
+
+	createTableRe = regexp.MustCompile(`(?is)^((\s*(--[^\n]*\n|#[^\n]*\n|/\*.*?\*/))*\s*CREATE\s+(TEMPORARY\s+)?TABLE)(\s+IF\s+NOT\s+EXISTS\b)?`)
+	createIndexRe = regexp.MustCompile(`(?is)^((\s*(--[^\n]*\n|#[^\n]*\n|/\*.*?\*/))*\s*CREATE\s+(ONLINE\s+|OFFLINE\s+)?(UNIQUE\s+|FULLTEXT\s+|SPATIAL\s+)?INDEX)(\s+IF\s+NOT\s+EXISTS\b)?`)
+	ifNotExistsRe = regexp.MustCompile(`(?i)\bIF\s+NOT\s+EXISTS\b`)
+	// addColumnRe also matches quoted strings and comments, so that
+	// ADD COLUMN inside of them can be told apart and left alone.
+	addColumnRe = regexp.MustCompile(`(?is)'(\\.|[^'\\])*'|"(\\.|[^"\\])*"|` + "`[^`]*`" + `|--[^\n]*|#[^\n]*|/\*.*?\*/|\bADD\s+COLUMN\b(\s+IF\s+NOT\s+EXISTS\b)?`)
+
+	// commentRe matches comments, and quoted strings and names so that
+	// comment markers inside of them are skipped.
+	commentRe = regexp.MustCompile(`(?s)'(\\.|[^'\\])*'|"(\\.|[^"\\])*"|` + "`[^`]*`" + `|--[^\n]*|#[^\n]*|/\*.*?\*/`)
+	// oscAlterRe captures the table name and the alter clause of an
+	// ALTER TABLE statement.
+	oscAlterRe = regexp.MustCompile(`(?is)^(?:\s*(?:--[^\n]*\n|#[^\n]*\n|/\*.*?\*/))*\s*ALTER\s+TABLE\s+((?:` + "`[^`]+`" + `|[^\s.` + "`" + `]+)(?:\.(?:` + "`[^`]+`" + `|[^\s.` + "`" + `]+))?)\s+(.*)$`)
+)
+
+// WouldChange implements database.ChangeDetector. A statement changes
+// something if it reports affected rows. Since MySQL commits DDL implicitly,
+// migrations with DDL or transaction control statements are rejected.
+// Note that UPDATEs only count rows whose values actually changed, unless
+// the connection sets clientFoundRows.
+func (m *Mysql) WouldChange(migration io.Reader) (bool, error) {
+	migr, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return false, err
+	}
+
+	opts := database.MySQLOptions
+	opts.RejectUnterminated = true
+	opts.Strict = m.config.StrictSplit
+	stmts, err := database.SplitQueryOpts(migr, opts)
+	if err != nil {
+		return false, err
+	}
+
+	for _, stmt := range stmts {
+		if class := database.ClassifyStatement(stmt, database.MySQLDialect).Class; class != database.Transactional {
+			return false, database.Error{OrigErr: database.ErrNotRollbackable, Err: fmt.Sprintf("%v statement", class), Query: stmt}
+		}
+	}
+
+	tx, err := m.conn.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return false, &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	defer tx.Rollback()
+
+	changed := false
+	for _, stmt := range stmts {
+		res, err := tx.Exec(string(stmt))
+		if err != nil {
+			return false, database.Error{OrigErr: err, Code: errorCode(err), Err: "migration failed", Query: stmt}
+		}
+		if database.IsQuery(stmt, database.MySQLDialect) {
+			continue
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// checkTransactions warns about every statement that breaks an explicit
+// transaction, or returns an error if StrictTransactions is set.
+func (m *Mysql) checkTransactions(stmts [][]byte) error {
+	for _, issue := range database.CheckTransactions(stmts, database.MySQLDialect) {
+		if m.config.StrictTransactions {
+			return database.Error{OrigErr: database.ErrTransactionIssue, Err: issue.String(), Query: issue.Statement}
+		}
+		m.warnTransactionIssue(issue)
 	}
 	return nil
 }
 
+// warnTransactionIssue passes issue to Config.Log.
+func (m *Mysql) warnTransactionIssue(issue database.TransactionIssue) {
+	m.warnf("%v: %s", issue, issue.Statement)
+}
+
+// warnf passes a warning to Config.Log, if set.
+func (m *Mysql) warnf(format string, v ...interface{}) {
+	if m.config.Log != nil {
+		m.config.Log.Printf("migrate/mysql: warning: "+format, v...)
+	}
+}
+
+// onlineDDL appends `ALGORITHM=INPLACE, LOCK=NONE` to an ALTER TABLE
+// statement, unless the author already chose an algorithm or lock level.
+// Partitioning clauses can't be combined with other alter specifications,
+// so these statements are left untouched, too.
+func onlineDDL(stmt []byte) []byte {
+	if !alterTableRe.Match(stmt) || onlineDDLHintRe.Match(stmt) || partitionRe.Match(stmt) {
+		return stmt
+	}
+
+	// don't end up inside a trailing line comment
+	sep := " "
+	if lineCommentEndRe.Match(stmt) {
+		sep = "\n"
+	}
+
+	hinted := make([]byte, 0, len(stmt)+32)
+	hinted = append(hinted, stmt...)
+	return append(hinted, sep+", ALGORITHM=INPLACE, LOCK=NONE"...)
+}
+
+// ifNotExistsSupport tells which statements besides CREATE TABLE, which
+// always does, accept IF NOT EXISTS.
+type ifNotExistsSupport struct {
+	createIndex bool
+	addColumn   bool
+}
+
+// supportsIfNotExists returns the IF NOT EXISTS support of the server with
+// the given version. MySQL only knows CREATE TABLE IF NOT EXISTS, MariaDB
+// added ADD COLUMN IF NOT EXISTS in 10.0.2 and CREATE INDEX IF NOT EXISTS
+// in 10.1.4.
+func supportsIfNotExists(version string) ifNotExistsSupport {
+	if !strings.Contains(strings.ToLower(version), "mariadb") {
+		return ifNotExistsSupport{}
+	}
+	return ifNotExistsSupport{
+		createIndex: versionAtLeast(version, 10, 1, 4),
+		addColumn:   versionAtLeast(version, 10, 0, 2),
+	}
+}
+
+// versionAtLeast returns true if version is major.minor.patch or newer.
+func versionAtLeast(version string, major, minor, patch int) bool {
+	parts := strings.SplitN(strings.SplitN(version, "-", 2)[0], ".", 3)
+	want := []int{major, minor, patch}
+	for i, w := range want {
+		if i >= len(parts) {
+			return w == 0
+		}
+		got, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return false
+		}
+		if got != w {
+			return got > w
+		}
+	}
+	return true
+}
+
+// autoIfNotExists adds IF NOT EXISTS to CREATE TABLE statements and, if the
+// server supports it, to CREATE INDEX statements and the ADD COLUMN clauses
+// of ALTER TABLE statements. Statements that already say IF NOT EXISTS are
+// left untouched.
+func autoIfNotExists(stmt []byte, s ifNotExistsSupport) []byte {
+	if m := createTableRe.FindSubmatchIndex(stmt); m != nil {
+		return insertIfNotExists(stmt, m)
+	}
+	if m := createIndexRe.FindSubmatchIndex(stmt); m != nil {
+		if !s.createIndex {
+			return stmt
+		}
+		return insertIfNotExists(stmt, m)
+	}
+	if s.addColumn && alterTableRe.Match(stmt) {
+		return addColumnRe.ReplaceAllFunc(stmt, func(match []byte) []byte {
+			if !bytes.EqualFold(match[:3], []byte("ADD")) || ifNotExistsRe.Match(match) {
+				return match
+			}
+			return append(append([]byte{}, match...), " IF NOT EXISTS"...)
+		})
+	}
+	return stmt
+}
+
+// insertIfNotExists inserts IF NOT EXISTS after the first submatch of m,
+// unless the last one, an existing IF NOT EXISTS, matched.
+func insertIfNotExists(stmt []byte, m []int) []byte {
+	if m[len(m)-2] >= 0 {
+		return stmt
+	}
+	end := m[3]
+	rewritten := make([]byte, 0, len(stmt)+14)
+	rewritten = append(rewritten, stmt[:end]...)
+	rewritten = append(rewritten, " IF NOT EXISTS"...)
+	return append(rewritten, stmt[end:]...)
+}
+
+// supportsOnlineDDL returns true if the server with the given version
+// supports the ALGORITHM and LOCK clauses, i.e. MySQL 5.6+ or MariaDB 10.0+.
+func supportsOnlineDDL(version string) bool {
+	v := serverVersionRe.FindStringSubmatch(version)
+	if v == nil {
+		return false
+	}
+	major, _ := strconv.Atoi(v[1])
+	minor, _ := strconv.Atoi(v[2])
+	return major > 5 || major == 5 && minor >= 6
+}
+
 // Returns the bool value of the input.
 // The 2nd return value indicates if the input was a valid bool value
 // See https://github.com/go-sql-driver/mysql/blob/a059889267dc7170331388008528b3b44479bffb/utils.go#L71
@@ -369,3 +3322,33 @@ func readBool(input string) (value bool, valid bool) {
 	// Not a valid bool value
 	return
 }
+
+// errorCodes maps MySQL error numbers to database.ErrorCode, see
+// https://dev.mysql.com/doc/refman/5.7/en/server-error-reference.html
+var errorCodes = map[uint16]database.ErrorCode{
+	1007: database.CodeDuplicateObject, // ER_DB_CREATE_EXISTS
+	1050: database.CodeDuplicateObject, // ER_TABLE_EXISTS_ERROR
+	1060: database.CodeDuplicateObject, // ER_DUP_FIELDNAME
+	1061: database.CodeDuplicateObject, // ER_DUP_KEYNAME
+	1304: database.CodeDuplicateObject, // ER_SP_ALREADY_EXISTS
+	1359: database.CodeDuplicateObject, // ER_TRG_ALREADY_EXISTS
+	1049: database.CodeUndefinedObject, // ER_BAD_DB_ERROR
+	1051: database.CodeUndefinedObject, // ER_BAD_TABLE_ERROR
+	1054: database.CodeUndefinedObject, // ER_BAD_FIELD_ERROR
+	1091: database.CodeUndefinedObject, // ER_CANT_DROP_FIELD_OR_KEY
+	1146: database.CodeUndefinedObject, // ER_NO_SUCH_TABLE
+	1305: database.CodeUndefinedObject, // ER_SP_DOES_NOT_EXIST
+	1360: database.CodeUndefinedObject, // ER_TRG_DOES_NOT_EXIST
+	1205: database.CodeLockTimeout,     // ER_LOCK_WAIT_TIMEOUT
+	1213: database.CodeDeadlock,        // ER_LOCK_DEADLOCK
+	1064: database.CodeSyntax,          // ER_PARSE_ERROR
+	1149: database.CodeSyntax,          // ER_SYNTAX_ERROR
+}
+
+// errorCode classifies err if it is a MySQL error.
+func errorCode(err error) database.ErrorCode {
+	if e, ok := err.(*mysql.MySQLError); ok {
+		return errorCodes[e.Number]
+	}
+	return database.CodeUnknown
+}
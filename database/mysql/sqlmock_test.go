@@ -0,0 +1,1785 @@
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+import (
+	"github.com/golang-migrate/migrate/database"
+)
+
+// newMockMysql returns a driver running its queries against a mock
+// database, without the queries of WithInstance. Queries must match the
+// expectations exactly.
+func newMockMysql(t *testing.T, config *Config) (*Mysql, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.DatabaseName) == 0 {
+		config.DatabaseName = "public"
+	}
+	if len(config.MigrationsTable) == 0 {
+		config.MigrationsTable = DefaultMigrationsTable
+	}
+	if len(config.HistoryTable) == 0 {
+		config.HistoryTable = config.MigrationsTable + "_history"
+	}
+	if len(config.LockOwnerTable) == 0 {
+		config.LockOwnerTable = config.MigrationsTable + "_lock_owner"
+	}
+	return &Mysql{conn: db, config: config}, mock
+}
+
+// expectMet fails t if not all expected queries ran.
+func expectMet(t *testing.T, mock sqlmock.Sqlmock) {
+	t.Helper()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// errorQuery returns the query of a *database.Error or database.Error.
+func errorQuery(err error) (string, database.ErrorCode, bool) {
+	switch e := err.(type) {
+	case *database.Error:
+		return string(e.Query), e.Code, true
+	case database.Error:
+		return string(e.Query), e.Code, true
+	}
+	return "", database.CodeUnknown, false
+}
+
+// historyTable creates the history table, see expectHistoryTable.
+const historyTable = "CREATE TABLE IF NOT EXISTS `schema_migrations_history` (version bigint not null primary key, dirty boolean not null, deploy_id varchar(255), sql_text longtext, applied_at datetime(6), checksum char(64), duration_ms bigint)"
+
+// expectHistoryTable expects the history table to be created on first use,
+// with the applied_at column in place.
+func expectHistoryTable(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(historyTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SHOW COLUMNS FROM `schema_migrations_history`").
+		WillReturnRows(sqlmock.NewRows([]string{"Field", "Type", "Null", "Key", "Default", "Extra"}).
+			AddRow("version", "bigint(20)", "NO", "PRI", nil, "").
+			AddRow("applied_at", "datetime(6)", "YES", "", nil, "").
+			AddRow("checksum", "char(64)", "YES", "", nil, "").
+			AddRow("duration_ms", "bigint(20)", "YES", "", nil, ""))
+}
+
+var errNoSuchTable = &mysql.MySQLError{Number: 1146, Message: "Table doesn't exist"}
+
+func TestMockSetVersion(t *testing.T) {
+	t.Run("version", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO `schema_migrations` (version, dirty) VALUES (?, ?)").
+			WithArgs(3, true).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := m.SetVersion(3, true); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("name", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO `schema_migrations` (version, dirty, name) VALUES (?, ?, ?)").
+			WithArgs(3, false, "add_users").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO `schema_migrations` (version, dirty, name) VALUES (?, ?, ?)").
+			WithArgs(4, false, strings.Repeat("ä", 255)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		var _ database.VersionNamer = m
+		if err := m.SetVersionWithName(3, false, "add_users"); err != nil {
+			t.Fatal(err)
+		}
+		// cut to the length of the column
+		if err := m.SetVersionWithName(4, false, strings.Repeat("ä", 300)); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("nil version", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		if err := m.SetVersion(database.NilVersion, false); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("qualified table", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{MigrationsTable: "migrations_db.schema_migrations"})
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `migrations_db`.`schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO `migrations_db`.`schema_migrations` (version, dirty) VALUES (?, ?)").
+			WithArgs(1, false).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := m.SetVersion(1, false); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("truncate fails", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillReturnError(errNoSuchTable)
+		mock.ExpectRollback()
+
+		err := m.SetVersion(3, true)
+		query, code, ok := errorQuery(err)
+		if !ok || query != "TRUNCATE `schema_migrations`" || code != database.CodeUndefinedObject {
+			t.Fatalf("expected an undefined object error of the TRUNCATE, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("insert fails", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO `schema_migrations` (version, dirty) VALUES (?, ?)").
+			WithArgs(3, true).WillReturnError(&mysql.MySQLError{Number: 1213, Message: "Deadlock found"})
+		mock.ExpectRollback()
+
+		err := m.SetVersion(3, true)
+		if _, code, ok := errorQuery(err); !ok || code != database.CodeDeadlock {
+			t.Fatalf("expected a deadlock error, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("commit fails", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO `schema_migrations` (version, dirty) VALUES (?, ?)").
+			WithArgs(3, true).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit().WillReturnError(errors.New("connection lost"))
+
+		if err := m.SetVersion(3, true); err == nil {
+			t.Fatal("expected the failed commit to fail SetVersion")
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("deferred", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{DeferVersionCommit: true})
+		if err := m.SetVersion(3, false); err != nil {
+			t.Fatal(err)
+		}
+		// nothing ran yet
+		expectMet(t, mock)
+
+		commit, ok := m.PendingVersion()
+		if !ok {
+			t.Fatal("expected a pending version")
+		}
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO `schema_migrations` (version, dirty) VALUES (?, ?)").
+			WithArgs(3, false).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		if err := commit(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockVersion(t *testing.T) {
+	query := "SELECT version, dirty FROM `schema_migrations` LIMIT 1"
+
+	t.Run("version", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"version", "dirty"}).AddRow(3, true))
+
+		if version, dirty, err := m.Version(); err != nil || version != 3 || !dirty {
+			t.Fatalf("expected dirty version 3, got %v %v (%v)", version, dirty, err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("no rows", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"version", "dirty"}))
+
+		if version, dirty, err := m.Version(); err != nil || version != database.NilVersion || dirty {
+			t.Fatalf("expected NilVersion, got %v %v (%v)", version, dirty, err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(query).WillReturnError(errNoSuchTable)
+
+		_, _, err := m.Version()
+		if q, code, ok := errorQuery(err); !ok || q != query || code != database.CodeUndefinedObject {
+			t.Fatalf("expected an undefined object error, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+// versionColumnRows returns the SHOW COLUMNS rows of a migrations table, of
+// one created before the applied_at and name columns unless current is set.
+func versionColumnRows(current bool) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"Field", "Type", "Null", "Key", "Default", "Extra"}).
+		AddRow("version", "bigint(20)", "NO", "PRI", nil, "").
+		AddRow("dirty", "tinyint(1)", "NO", "", nil, "")
+	if current {
+		rows.AddRow("applied_at", "datetime", "NO", "", "CURRENT_TIMESTAMP", "").
+			AddRow("name", "varchar(255)", "YES", "", nil, "")
+	}
+	return rows
+}
+
+func TestMockEnsureVersionTable(t *testing.T) {
+	create := "CREATE TABLE `schema_migrations` (version bigint not null primary key, dirty boolean not null, applied_at datetime not null default current_timestamp, name varchar(255)) ENGINE=InnoDB"
+
+	t.Run("exists", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(`SHOW TABLES LIKE "schema_migrations"`).
+			WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("schema_migrations"))
+		mock.ExpectQuery("SHOW COLUMNS FROM `schema_migrations`").WillReturnRows(versionColumnRows(true))
+
+		if err := m.ensureVersionTable(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("old", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(`SHOW TABLES LIKE "schema_migrations"`).
+			WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("schema_migrations"))
+		mock.ExpectQuery("SHOW COLUMNS FROM `schema_migrations`").WillReturnRows(versionColumnRows(false))
+		// the name is dropped instead of altering the table
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO `schema_migrations` (version, dirty) VALUES (?, ?)").WithArgs(1, false).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := m.ensureVersionTable(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SetVersionWithName(1, false, "init"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.VersionApplied(1); err != ErrNoAppliedAtColumn {
+			t.Errorf("expected ErrNoAppliedAtColumn, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{UpgradeVersionTable: true})
+		mock.ExpectQuery(`SHOW TABLES LIKE "schema_migrations"`).
+			WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("schema_migrations"))
+		mock.ExpectQuery("SHOW COLUMNS FROM `schema_migrations`").WillReturnRows(versionColumnRows(false))
+		mock.ExpectExec("ALTER TABLE `schema_migrations` ADD COLUMN applied_at datetime not null default current_timestamp").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("ALTER TABLE `schema_migrations` ADD COLUMN name varchar(255)").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.ensureVersionTable(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(`SHOW TABLES LIKE "schema_migrations"`).WillReturnRows(sqlmock.NewRows([]string{"table"}))
+		mock.ExpectExec(create).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.ensureVersionTable(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("qualified", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{MigrationsTable: "migrations_db.schema_migrations"})
+		mock.ExpectQuery("SHOW TABLES FROM `migrations_db` LIKE \"schema_migrations\"").WillReturnRows(sqlmock.NewRows([]string{"table"}))
+		mock.ExpectExec("CREATE TABLE `migrations_db`.`schema_migrations` (version bigint not null primary key, dirty boolean not null, applied_at datetime not null default current_timestamp, name varchar(255)) ENGINE=InnoDB").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.ensureVersionTable(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("engine", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{VersionTableEngine: "RocksDB"})
+		mock.ExpectQuery(`SHOW TABLES LIKE "schema_migrations"`).WillReturnRows(sqlmock.NewRows([]string{"table"}))
+		mock.ExpectExec("CREATE TABLE `schema_migrations` (version bigint not null primary key, dirty boolean not null, applied_at datetime not null default current_timestamp, name varchar(255)) ENGINE=RocksDB").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.ensureVersionTable(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("create fails", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(`SHOW TABLES LIKE "schema_migrations"`).WillReturnRows(sqlmock.NewRows([]string{"table"}))
+		mock.ExpectExec(create).WillReturnError(&mysql.MySQLError{Number: 1050, Message: "Table already exists"})
+
+		err := m.ensureVersionTable()
+		if q, code, ok := errorQuery(err); !ok || q != create || code != database.CodeDuplicateObject {
+			t.Fatalf("expected a duplicate object error, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockVersionApplied(t *testing.T) {
+	query := "SELECT UNIX_TIMESTAMP(applied_at) FROM `schema_migrations` WHERE version = ?"
+	m, mock := newMockMysql(t, &Config{})
+	mock.ExpectQuery(query).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"applied_at"}).AddRow(1700000000))
+	mock.ExpectQuery(query).WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"applied_at"}))
+
+	appliedAt, err := m.VersionApplied(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !appliedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("expected the time of the row, got %v", appliedAt)
+	}
+	if _, err := m.VersionApplied(2); err != database.ErrVersionNotFound {
+		t.Errorf("expected ErrVersionNotFound, got %v", err)
+	}
+	expectMet(t, mock)
+}
+
+func TestMockHistory(t *testing.T) {
+	find := "SELECT version, dirty, deploy_id, UNIX_TIMESTAMP(applied_at), duration_ms, checksum FROM `schema_migrations_history` WHERE version = ?"
+
+	t.Run("upsert", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		expectHistoryTable(mock)
+		mock.ExpectExec("INSERT INTO `schema_migrations_history` (version, dirty, applied_at) VALUES (?, ?, NOW(6)) ON DUPLICATE KEY UPDATE applied_at = IF(dirty AND NOT VALUES(dirty), VALUES(applied_at), applied_at), dirty = VALUES(dirty)").
+			WithArgs(3, false).WillReturnResult(sqlmock.NewResult(0, 2))
+
+		if err := m.UpsertVersion(3, false); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("find", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		expectHistoryTable(mock)
+		mock.ExpectQuery(find).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"version", "dirty", "deploy_id", "applied_at", "duration_ms", "checksum"}).AddRow(3, false, "deploy-1", 1700000000.25, 1500, strings.Repeat("ab", 32)))
+
+		entry, err := m.FindVersion(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != (database.HistoryEntry{Version: 3, DeployID: "deploy-1", AppliedAt: time.Unix(1700000000, 250000000), Duration: 1500 * time.Millisecond, Checksum: strings.Repeat("ab", 32)}) {
+			t.Errorf("unexpected entry %+v", entry)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("find without deploy id", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		expectHistoryTable(mock)
+		mock.ExpectQuery(find).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"version", "dirty", "deploy_id", "applied_at", "duration_ms", "checksum"}).AddRow(3, true, nil, nil, nil, nil))
+
+		entry, err := m.FindVersion(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != (database.HistoryEntry{Version: 3, Dirty: true}) {
+			t.Errorf("unexpected entry %+v", entry)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		expectHistoryTable(mock)
+		mock.ExpectQuery(find).WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"version", "dirty", "deploy_id", "applied_at", "duration_ms", "checksum"}))
+
+		if _, err := m.FindVersion(4); err != database.ErrVersionNotFound {
+			t.Fatalf("expected ErrVersionNotFound, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectExec(historyTable).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SHOW COLUMNS FROM `schema_migrations_history`").
+			WillReturnRows(sqlmock.NewRows([]string{"Field", "Type", "Null", "Key", "Default", "Extra"}).
+				AddRow("version", "bigint(20)", "NO", "PRI", nil, ""))
+		mock.ExpectExec("ALTER TABLE `schema_migrations_history` ADD COLUMN applied_at datetime(6)").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("ALTER TABLE `schema_migrations_history` ADD COLUMN checksum char(64)").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("ALTER TABLE `schema_migrations_history` ADD COLUMN duration_ms bigint").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(find).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"version", "dirty", "deploy_id", "applied_at", "duration_ms", "checksum"}).AddRow(3, false, nil, nil, nil, nil))
+		// the table and columns are only checked once
+		mock.ExpectExec("DELETE FROM `schema_migrations_history` WHERE version = ?").WithArgs(3).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		entry, err := m.FindVersion(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !entry.AppliedAt.IsZero() {
+			t.Errorf("expected no applied_at for an entry recorded before the upgrade, got %v", entry.AppliedAt)
+		}
+		if err := m.DeleteVersion(3); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		expectHistoryTable(mock)
+		mock.ExpectExec("INSERT INTO `schema_migrations_history` (version, dirty, applied_at, checksum) VALUES (?, false, NOW(6), ?) ON DUPLICATE KEY UPDATE checksum = VALUES(checksum)").
+			WithArgs(3, strings.Repeat("ab", 32)).WillReturnResult(sqlmock.NewResult(0, 2))
+
+		var _ database.ChecksumRecorder = m
+		if err := m.RecordChecksum(3, strings.Repeat("ab", 32)); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("duration", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		expectHistoryTable(mock)
+		mock.ExpectExec("INSERT INTO `schema_migrations_history` (version, dirty, applied_at, duration_ms) VALUES (?, false, NOW(6), ?) ON DUPLICATE KEY UPDATE duration_ms = VALUES(duration_ms)").
+			WithArgs(3, 1500).WillReturnResult(sqlmock.NewResult(0, 2))
+
+		var _ database.DurationRecorder = m
+		if err := m.RecordDuration(3, 1500*time.Millisecond+300*time.Microsecond); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("ensure fails", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectExec(historyTable).WillReturnError(sql.ErrConnDone)
+
+		if err := m.UpsertVersion(3, false); err == nil {
+			t.Fatal("expected an error")
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockHistoryReader(t *testing.T) {
+	m, mock := newMockMysql(t, &Config{})
+	expectHistoryTable(mock)
+	mock.ExpectQuery("SELECT version, dirty, deploy_id, UNIX_TIMESTAMP(applied_at), duration_ms FROM `schema_migrations_history` ORDER BY version LIMIT 18446744073709551615 OFFSET ?").
+		WithArgs(0).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "dirty", "deploy_id", "applied_at", "duration_ms"}).
+			AddRow(1, false, nil, nil, nil).
+			AddRow(2, false, "deploy-1", 1700000000, 2500).
+			AddRow(3, true, "deploy-1", 1700000060, nil))
+
+	var _ database.HistoryReader = m
+	history, err := m.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []database.HistoryEntry{
+		{Version: 1},
+		{Version: 2, DeployID: "deploy-1", AppliedAt: time.Unix(1700000000, 0), Duration: 2500 * time.Millisecond},
+		{Version: 3, Dirty: true, DeployID: "deploy-1", AppliedAt: time.Unix(1700000060, 0)},
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("expected %+v, got %+v", expected, history)
+	}
+	expectMet(t, mock)
+}
+
+func TestMockCopyHistoryTo(t *testing.T) {
+	expectCreate := func(mock sqlmock.Sqlmock) {
+		expectHistoryTable(mock)
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS `stream_b` LIKE `schema_migrations`").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS `stream_b_history` LIKE `schema_migrations_history`").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectBegin()
+	}
+
+	t.Run("copy", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		expectCreate(mock)
+		mock.ExpectQuery("SELECT EXISTS (SELECT 1 FROM `stream_b`)").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec("INSERT INTO `stream_b` SELECT * FROM `schema_migrations`").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT EXISTS (SELECT 1 FROM `stream_b_history`)").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec("INSERT INTO `stream_b_history` SELECT * FROM `schema_migrations_history`").
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectCommit()
+
+		if err := m.CopyHistoryTo("stream_b"); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("not empty", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		expectCreate(mock)
+		mock.ExpectQuery("SELECT EXISTS (SELECT 1 FROM `stream_b`)").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectRollback()
+
+		if err := m.CopyHistoryTo("stream_b"); err != ErrCopyTargetNotEmpty {
+			t.Fatalf("expected %v, got %v", ErrCopyTargetNotEmpty, err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockWarnOnOutOfOrder(t *testing.T) {
+	highest := "SELECT MAX(version), COALESCE(SUM(version = ?), 0) FROM `schema_migrations_history`"
+	upsert := "INSERT INTO `schema_migrations_history` (version, dirty, applied_at) VALUES (?, ?, NOW(6)) ON DUPLICATE KEY UPDATE applied_at = IF(dirty AND NOT VALUES(dirty), VALUES(applied_at), applied_at), dirty = VALUES(dirty)"
+
+	buf := &bytes.Buffer{}
+	m, mock := newMockMysql(t, &Config{WarnOnOutOfOrder: true, Log: log.New(buf, "", 0)})
+	// 5 is applied, then 3, and 3 again once it succeeded
+	expectHistoryTable(mock)
+	mock.ExpectQuery(highest).WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"max", "recorded"}).AddRow(nil, 0))
+	mock.ExpectExec(upsert).WithArgs(5, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(highest).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"max", "recorded"}).AddRow(5, 0))
+	mock.ExpectExec(upsert).WithArgs(3, true).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(highest).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"max", "recorded"}).AddRow(5, 1))
+	mock.ExpectExec(upsert).WithArgs(3, false).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := m.UpsertVersion(5, false); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no warning for the first version, got %q", buf.String())
+	}
+	if err := m.UpsertVersion(3, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.UpsertVersion(3, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "warning: version 3 applied out of order, 5 is applied already"); n != 1 {
+		t.Errorf("expected a warning for 3, got %q", buf.String())
+	}
+	expectMet(t, mock)
+}
+
+func TestMockLock(t *testing.T) {
+	testcases := []struct {
+		name   string
+		config Config
+		lockId []string
+	}{
+		{name: "database scope", config: Config{},
+			lockId: []string{"public:schema_migrations"}},
+		{name: "table scope", config: Config{LockScope: LockScopeTable},
+			lockId: []string{"public", "schema_migrations"}},
+		{name: "table scope qualified", config: Config{LockScope: LockScopeTable, MigrationsTable: "migrations_db.schema_migrations"},
+			lockId: []string{"migrations_db", "schema_migrations"}},
+		{name: "identifier", config: Config{LockIdentifier: "deploy 42"},
+			lockId: []string{"public:schema_migrations"}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.config
+			m, mock := newMockMysql(t, &config)
+			aid, err := database.GenerateAdvisoryLockId(tc.lockId[0], tc.lockId[1:]...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			comment := "/* golang-migrate lock */"
+			if len(tc.config.LockIdentifier) > 0 {
+				comment = "/* " + tc.config.LockIdentifier + " */"
+			}
+
+			mock.ExpectQuery("SELECT " + comment + " GET_LOCK(?, 10)").WithArgs(aid).
+				WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(true))
+			mock.ExpectExec("SELECT " + comment + " RELEASE_LOCK(?)").WithArgs(aid).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			if err := m.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			expectMet(t, mock)
+		})
+	}
+
+	t.Run("taken", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").
+			WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(false))
+
+		err := m.Lock()
+		if err != (ErrLockWaitTimeout{Timeout: 10}) || !errors.Is(err, database.ErrLocked) {
+			t.Fatalf("expected ErrLockWaitTimeout, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("query failed", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").WillReturnError(errors.New("connection reset"))
+
+		err := m.Lock()
+		var timeout ErrLockWaitTimeout
+		if errors.As(err, &timeout) || !strings.Contains(err.Error(), "try lock failed") {
+			t.Fatalf("expected the query to fail, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("NULL", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").
+			WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(nil))
+
+		err := m.Lock()
+		if !errors.Is(err, database.ErrLocked) || !strings.Contains(err.Error(), "GET_LOCK returned NULL") {
+			t.Fatalf("expected ErrLocked noting the NULL, got %v", err)
+		}
+		if m.isLocked {
+			t.Error("expected the lock not to be held")
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		for _, timeout := range []int{0, 60} {
+			timeout := timeout
+			m, mock := newMockMysql(t, &Config{LockTimeout: &timeout})
+			mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, " + strconv.Itoa(timeout) + ")").
+				WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(false))
+
+			if err := m.Lock(); err != (ErrLockWaitTimeout{Timeout: timeout}) {
+				t.Fatalf("expected ErrLockWaitTimeout, got %v", err)
+			}
+			expectMet(t, mock)
+		}
+	})
+
+	t.Run("wait forever", func(t *testing.T) {
+		timeout := -1
+		m, mock := newMockMysql(t, &Config{LockTimeout: &timeout})
+		mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, -1)").
+			WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(true))
+
+		if err := m.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{LockRetries: 2, LockRetryInterval: time.Millisecond})
+		for _, success := range []bool{false, false, true} {
+			mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").
+				WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(success))
+		}
+
+		if err := m.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		// the lock is still only taken once per driver
+		if err := m.Lock(); err != database.ErrLocked {
+			t.Errorf("expected ErrLocked, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{LockRetries: 2, LockRetryInterval: time.Millisecond})
+		for i := 0; i < 3; i++ {
+			mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").
+				WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(false))
+		}
+
+		if err := m.Lock(); err != (ErrLockWaitTimeout{Timeout: 10}) {
+			t.Fatalf("expected ErrLockWaitTimeout, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockLockStrategy(t *testing.T) {
+	aid, err := database.GenerateAdvisoryLockId("public:schema_migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTable := "CREATE TABLE IF NOT EXISTS `schema_migrations_lock` (lock_id varchar(255) not null primary key, owner varchar(255) not null, acquired_at datetime not null)"
+	insertRow := "INSERT INTO `schema_migrations_lock` (lock_id, owner, acquired_at) VALUES (?, ?, NOW()) ON DUPLICATE KEY UPDATE lock_id = lock_id"
+	selectOwner := "SELECT owner FROM `schema_migrations_lock` WHERE lock_id = ?"
+
+	t.Run("none", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{LockStrategy: LockStrategyNone})
+
+		if err := m.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.AssertStillLocked(); err != nil {
+			t.Errorf("expected the lock to be held, got %v", err)
+		}
+		if err := m.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("table", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{LockStrategy: LockStrategyTable, LockTable: "schema_migrations_lock"})
+		m.lockToken = "me"
+		mock.ExpectExec(createTable).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(insertRow).WithArgs(aid, "me").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(selectOwner).WithArgs(aid).WillReturnRows(sqlmock.NewRows([]string{"owner"}).AddRow("me"))
+		mock.ExpectQuery("SELECT EXISTS (SELECT 1 FROM `schema_migrations_lock` WHERE lock_id = ? AND owner = ?)").
+			WithArgs(aid, "me").WillReturnRows(sqlmock.NewRows([]string{"held"}).AddRow(true))
+		mock.ExpectExec("DELETE FROM `schema_migrations_lock` WHERE lock_id = ? AND owner = ?").
+			WithArgs(aid, "me").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		if err := m.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.AssertStillLocked(); err != nil {
+			t.Errorf("expected the lock to be held, got %v", err)
+		}
+		if err := m.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("table taken", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{LockStrategy: LockStrategyTable, LockTable: "schema_migrations_lock",
+			LockRetries: 1, LockRetryInterval: time.Millisecond})
+		m.lockToken = "me"
+		mock.ExpectExec(createTable).WillReturnResult(sqlmock.NewResult(0, 0))
+		for i := 0; i < 2; i++ {
+			mock.ExpectExec(insertRow).WithArgs(aid, "me").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(selectOwner).WithArgs(aid).WillReturnRows(sqlmock.NewRows([]string{"owner"}).AddRow("other"))
+		}
+
+		if err := m.Lock(); err != (ErrLockWaitTimeout{}) {
+			t.Fatalf("expected ErrLockWaitTimeout, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockMaxLockDuration(t *testing.T) {
+	aid, err := database.GenerateAdvisoryLockId("public:schema_migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLock := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").WithArgs(aid).
+			WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(true))
+		mock.ExpectQuery("SELECT CONNECTION_ID()").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+	}
+
+	t.Run("exceeded", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{MaxLockDuration: 50 * time.Millisecond})
+		expectLock(mock)
+		mock.ExpectExec("SELECT SLEEP(10)").WillDelayFor(10 * time.Second).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("SELECT /* golang-migrate lock */ RELEASE_LOCK(?)").WithArgs(aid).
+			WillReturnError(errors.New("invalid connection"))
+
+		if err := m.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if err := m.Run(strings.NewReader("SELECT SLEEP(10);")); err != ErrLockTimeoutExceeded {
+			t.Fatalf("expected ErrLockTimeoutExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected the migration to be canceled, it ran for %v", elapsed)
+		}
+		if err := m.Run(strings.NewReader("SELECT 1;")); err != ErrLockTimeoutExceeded {
+			t.Errorf("expected no more migrations to run, got %v", err)
+		}
+		if err := m.Unlock(); err != nil {
+			t.Fatalf("expected the lost lock to be ignored, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("not exceeded", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{MaxLockDuration: time.Minute})
+		expectLock(mock)
+		mock.ExpectExec("SELECT 1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("SELECT /* golang-migrate lock */ RELEASE_LOCK(?)").WithArgs(aid).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(strings.NewReader("SELECT 1;")); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		if m.watchdog != nil {
+			t.Error("expected Unlock to stop the watchdog")
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockRunStatements(t *testing.T) {
+	migration := "INSERT INTO users VALUES ('a;b');\n;\n" +
+		"INSERT INTO users VALUES (\"c;d\");\n" +
+		"INSERT INTO missing VALUES (`g;h`);\n"
+
+	t.Run("quoted semicolons", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectExec("INSERT INTO users VALUES ('a;b')").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO users VALUES ("c;d")`).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO missing VALUES (`g;h`)").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		if err := m.Run(strings.NewReader(migration)); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("failing statement", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectExec("INSERT INTO users VALUES ('a;b')").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO users VALUES ("c;d")`).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO missing VALUES (`g;h`)").WillReturnError(errNoSuchTable)
+
+		err := m.Run(strings.NewReader(migration))
+		merr, ok := err.(database.Error)
+		if !ok {
+			t.Fatalf("expected a database.Error, got %v", err)
+		}
+		if merr.Line != 4 || merr.Err != "migration failed in statement 3 at byte 70" || merr.Code != database.CodeUndefinedObject {
+			t.Errorf("expected statement 3 in line 4 to fail, got %v", merr)
+		}
+		if string(merr.Query) != "INSERT INTO missing VALUES (`g;h`)" {
+			t.Errorf("expected the failing statement, got %q", merr.Query)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("rewritten statement", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{SQLTransform: func(stmt []byte) ([]byte, error) {
+			return bytes.Replace(stmt, []byte("missing"), []byte("gone"), 1), nil
+		}})
+		mock.ExpectExec("INSERT INTO users VALUES ('a;b')").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO users VALUES ("c;d")`).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO gone VALUES (`g;h`)").WillReturnError(errNoSuchTable)
+
+		// the statement isn't part of the migration anymore, only its
+		// number is known
+		err := m.Run(strings.NewReader(migration))
+		if merr, ok := err.(database.Error); !ok || merr.Line != 0 || merr.Err != "migration failed in statement 3" {
+			t.Errorf("expected statement 3 to fail, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("send at once", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{SendAtOnce: true})
+		mock.ExpectExec(strings.TrimSuffix(migration, ";\n")).WillReturnError(errNoSuchTable)
+
+		err := m.Run(strings.NewReader(migration))
+		if merr, ok := err.(database.Error); !ok || merr.Err != "migration failed" {
+			t.Errorf("expected the migration to fail, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockRunInTransaction(t *testing.T) {
+	t.Run("rolled back", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{RunInTransaction: true})
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO users VALUES (1)").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO missing VALUES (1)").WillReturnError(errNoSuchTable)
+		mock.ExpectRollback()
+
+		err := m.Run(strings.NewReader("INSERT INTO users VALUES (1);\nINSERT INTO missing VALUES (1);"))
+		if query, _, _ := errorQuery(err); query != "INSERT INTO missing VALUES (1)" {
+			t.Fatalf("expected the second statement to fail, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("committed", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{RunInTransaction: true})
+		mock.ExpectBegin()
+		mock.ExpectExec("CREATE TABLE users (id int)").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO users VALUES (1)").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := m.Run(strings.NewReader("CREATE TABLE users (id int);\nINSERT INTO users VALUES (1);")); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("transaction control", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{RunInTransaction: true})
+
+		err := m.Run(strings.NewReader("START TRANSACTION;\nINSERT INTO users VALUES (1);\nCOMMIT;"))
+		if !errors.Is(err, ErrRunInTxControl) {
+			t.Fatalf("expected ErrRunInTxControl, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockMaxAllowedPacket(t *testing.T) {
+	// 63 bytes and the command byte fill a packet of 64 bytes
+	fits := "SELECT '" + strings.Repeat("x", 54) + "'"
+	tooLarge := "SELECT '" + strings.Repeat("x", 55) + "'"
+
+	t.Run("statement fits", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{MaxAllowedPacket: 64})
+		mock.ExpectExec(fits).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.Run(strings.NewReader(fits + ";")); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("statement too large", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{MaxAllowedPacket: 64})
+
+		err := m.Run(strings.NewReader("SELECT 1;\n" + tooLarge + ";"))
+		expected := ErrStatementTooLarge{Size: 64, MaxAllowedPacket: 64, Statement: tooLarge}
+		if err != expected {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+		if !strings.Contains(err.Error(), "split the statement") {
+			t.Errorf("expected guidance in %q", err.Error())
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("migration too large", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{MaxAllowedPacket: 64, SendAtOnce: true})
+
+		err := m.Run(strings.NewReader(fits + ";\n" + fits + ";"))
+		if e, ok := err.(ErrStatementTooLarge); !ok || len(e.Statement) > 0 || e.Size != 128 {
+			t.Fatalf("expected ErrStatementTooLarge for the migration, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("streamed", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{MaxAllowedPacket: 64, StreamStatements: true})
+		mock.ExpectExec(fits).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(fits).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.Run(strings.NewReader(fits + ";\n" + fits + ";\n" + tooLarge + ";")); err == nil {
+			t.Fatal("expected ErrStatementTooLarge")
+		} else if _, ok := err.(ErrStatementTooLarge); !ok {
+			t.Fatalf("expected ErrStatementTooLarge, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("server limit", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		m.maxAllowedPacket = 64
+
+		if _, ok := m.Run(strings.NewReader(tooLarge + ";")).(ErrStatementTooLarge); !ok {
+			t.Fatal("expected ErrStatementTooLarge")
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockContext(t *testing.T) {
+	aid, err := database.GenerateAdvisoryLockId("public:schema_migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("run canceled", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").WithArgs(aid).
+			WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(true))
+		mock.ExpectExec("SELECT SLEEP(10)").WillDelayFor(10 * time.Second).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("SELECT /* golang-migrate lock */ RELEASE_LOCK(?)").WithArgs(aid).
+			WillReturnError(errors.New("invalid connection"))
+
+		var _ database.DriverContext = m
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := m.LockContext(ctx); err != nil {
+			t.Fatal(err)
+		}
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		if err := m.RunContext(ctx, strings.NewReader("SELECT SLEEP(10);")); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected the migration to be canceled, it ran for %v", elapsed)
+		}
+		if err := m.Unlock(); err != nil {
+			t.Fatalf("expected the lost lock to be ignored, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("run", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectExec("SELECT 1").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.RunContext(context.Background(), strings.NewReader("SELECT 1;")); err != nil {
+			t.Fatal(err)
+		}
+		if m.callerCtx != nil || m.canceled {
+			t.Error("expected the context to be dropped after the run")
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("lock retries canceled", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{LockRetries: 5, LockRetryInterval: time.Minute})
+		mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").WithArgs(aid).
+			WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(false))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := m.LockContext(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+		if m.isLocked {
+			t.Error("expected the lock not to be held")
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("version", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO `schema_migrations` (version, dirty) VALUES (?, ?)").WithArgs(3, true).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectQuery("SELECT version, dirty FROM `schema_migrations` LIMIT 1").
+			WillReturnRows(sqlmock.NewRows([]string{"version", "dirty"}).AddRow(3, true))
+
+		if err := m.SetVersionContext(context.Background(), 3, true); err != nil {
+			t.Fatal(err)
+		}
+		if version, dirty, err := m.VersionContext(context.Background()); err != nil || version != 3 || !dirty {
+			t.Fatalf("expected dirty version 3, got %v %v (%v)", version, dirty, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, _, err := m.VersionContext(ctx); err == nil {
+			t.Error("expected an error with a canceled context")
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockLockWithReason(t *testing.T) {
+	aid, err := database.GenerateAdvisoryLockId("public:schema_migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerQuery := "SELECT host, pid, reason, UNIX_TIMESTAMP(acquired_at) FROM `schema_migrations_lock_owner` WHERE lock_id = ? AND connection_id = IS_USED_LOCK(?)"
+
+	t.Run("recorded", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{TrackLockOwner: true})
+		var _ database.ReasonLockerContext = m
+		mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").WithArgs(aid).
+			WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(true))
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS `schema_migrations_lock_owner` (lock_id varchar(255) not null primary key, connection_id bigint not null, host varchar(255) not null, pid int not null, reason text, acquired_at datetime not null)").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("REPLACE INTO `schema_migrations_lock_owner` (lock_id, connection_id, host, pid, reason, acquired_at) VALUES (?, CONNECTION_ID(), ?, ?, ?, NOW())").
+			WithArgs(aid, host, os.Getpid(), "deploy 4512 by CI").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM `schema_migrations_lock_owner` WHERE lock_id = ?").WithArgs(aid).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("SELECT /* golang-migrate lock */ RELEASE_LOCK(?)").WithArgs(aid).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.LockWithReasonContext(context.Background(), "deploy 4512 by CI"); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("surfaced", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{TrackLockOwner: true})
+		mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").WithArgs(aid).
+			WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(false))
+		mock.ExpectQuery(ownerQuery).WithArgs(aid, aid).
+			WillReturnRows(sqlmock.NewRows([]string{"host", "pid", "reason", "acquired_at"}).
+				AddRow("deploy-7", 4242, "deploy 4512 by CI", 1527890651))
+
+		err := m.Lock()
+		lerr, ok := err.(ErrLockedBy)
+		if !ok {
+			t.Fatalf("expected ErrLockedBy, got %v", err)
+		}
+		expected := LockOwner{Host: "deploy-7", PID: 4242, Reason: "deploy 4512 by CI", AcquiredAt: time.Unix(1527890651, 0)}
+		if lerr.Owner != expected {
+			t.Errorf("expected the owner %+v, got %+v", expected, lerr.Owner)
+		}
+		if !errors.Is(err, database.ErrLocked) {
+			t.Errorf("expected the error to be ErrLocked, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "pid 4242 on deploy-7") || !strings.HasSuffix(err.Error(), ": deploy 4512 by CI") {
+			t.Errorf("expected the error to name the owner, got %q", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("owner unknown", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{TrackLockOwner: true})
+		mock.ExpectQuery("SELECT /* golang-migrate lock */ GET_LOCK(?, 10)").WithArgs(aid).
+			WillReturnRows(sqlmock.NewRows([]string{"success"}).AddRow(false))
+		mock.ExpectQuery(ownerQuery).WithArgs(aid, aid).
+			WillReturnRows(sqlmock.NewRows([]string{"host", "pid", "reason", "acquired_at"}))
+
+		if err := m.Lock(); err != (ErrLockWaitTimeout{Timeout: 10}) {
+			t.Fatalf("expected ErrLockWaitTimeout, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockDrop(t *testing.T) {
+	t.Run("tables", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery("SHOW TABLES LIKE '%'").
+			WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("users").AddRow("schema_migrations").AddRow(""))
+		mock.ExpectExec("DROP TABLE IF EXISTS `users` CASCADE").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DROP TABLE IF EXISTS `schema_migrations` CASCADE").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(`SHOW TABLES LIKE "schema_migrations"`).WillReturnRows(sqlmock.NewRows([]string{"table"}))
+		mock.ExpectExec("CREATE TABLE `schema_migrations` (version bigint not null primary key, dirty boolean not null, applied_at datetime not null default current_timestamp, name varchar(255)) ENGINE=InnoDB").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.Drop(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("lock table", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{LockStrategy: LockStrategyTable, LockTable: "schema_migrations_lock"})
+		mock.ExpectQuery("SHOW TABLES LIKE '%'").
+			WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("schema_migrations").AddRow("schema_migrations_lock"))
+		mock.ExpectExec("DROP TABLE IF EXISTS `schema_migrations` CASCADE").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(`SHOW TABLES LIKE "schema_migrations"`).WillReturnRows(sqlmock.NewRows([]string{"table"}))
+		mock.ExpectExec("CREATE TABLE `schema_migrations` (version bigint not null primary key, dirty boolean not null, applied_at datetime not null default current_timestamp, name varchar(255)) ENGINE=InnoDB").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.Drop(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("drop fails", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery("SHOW TABLES LIKE '%'").
+			WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("orders").AddRow("users"))
+		mock.ExpectExec("DROP TABLE IF EXISTS `orders` CASCADE").
+			WillReturnError(&mysql.MySQLError{Number: 3730, Message: "Cannot drop table referenced by a foreign key"})
+		// the remaining tables are still dropped
+		mock.ExpectExec("DROP TABLE IF EXISTS `users` CASCADE").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(`SHOW TABLES LIKE "schema_migrations"`).WillReturnRows(sqlmock.NewRows([]string{"table"}))
+		mock.ExpectExec("CREATE TABLE `schema_migrations` (version bigint not null primary key, dirty boolean not null, applied_at datetime not null default current_timestamp, name varchar(255)) ENGINE=InnoDB").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		err := m.Drop()
+		multi, ok := err.(*database.MultiError)
+		if !ok || len(multi.Errs) != 1 {
+			t.Fatalf("expected a single error, got %v", err)
+		}
+		if q, _, _ := errorQuery(multi.Errs[0]); q != "DROP TABLE IF EXISTS `orders` CASCADE" {
+			t.Errorf("expected the error of the orders table, got %v", multi.Errs[0])
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("version table in other database", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{MigrationsTable: "migrations_db.schema_migrations"})
+		mock.ExpectQuery("SHOW TABLES LIKE '%'").WillReturnRows(sqlmock.NewRows([]string{"table"}))
+		mock.ExpectQuery("SHOW TABLES FROM `migrations_db` LIKE \"schema_migrations\"").
+			WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("schema_migrations"))
+		mock.ExpectQuery("SHOW COLUMNS FROM `migrations_db`.`schema_migrations`").WillReturnRows(versionColumnRows(true))
+		mock.ExpectExec("TRUNCATE `migrations_db`.`schema_migrations`").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.Drop(); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("listing fails", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery("SHOW TABLES LIKE '%'").WillReturnError(&mysql.MySQLError{Number: 1049, Message: "Unknown database"})
+
+		err := m.Drop()
+		if _, code, ok := errorQuery(err); !ok || code != database.CodeUndefinedObject {
+			t.Fatalf("expected an undefined object error, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockListTables(t *testing.T) {
+	m, mock := newMockMysql(t, &Config{})
+	mock.ExpectQuery("SELECT table_name FROM information_schema.tables WHERE table_schema = ? AND table_type = 'BASE TABLE'").
+		WithArgs("public").
+		WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("users").AddRow("orders").AddRow("schema_migrations"))
+
+	tables, err := m.ListTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"orders", "schema_migrations", "users"}
+	if !reflect.DeepEqual(tables, expected) {
+		t.Errorf("expected %v, got %v", expected, tables)
+	}
+	expectMet(t, mock)
+}
+
+func TestMockCheckForeignKeys(t *testing.T) {
+	m, mock := newMockMysql(t, &Config{})
+	mock.ExpectQuery("SELECT constraint_name, table_name, column_name, referenced_table_schema, referenced_table_name, referenced_column_name " +
+		"FROM information_schema.key_column_usage WHERE table_schema = ? AND referenced_table_name IS NOT NULL " +
+		"ORDER BY table_name, constraint_name, ordinal_position").WithArgs("public").
+		WillReturnRows(sqlmock.NewRows([]string{"constraint_name", "table_name", "column_name", "referenced_table_schema", "referenced_table_name", "referenced_column_name"}).
+			AddRow("fk_lines_order", "order_lines", "order_id", "public", "orders", "id").
+			AddRow("fk_lines_product", "order_lines", "shop_id", "catalog", "products", "shop_id").
+			AddRow("fk_lines_product", "order_lines", "product_id", "catalog", "products", "id").
+			AddRow("fk_orders_customer", "orders", "customer_id", "public", "customers", "id"))
+	mock.ExpectQuery("SELECT COUNT(*) FROM `order_lines` c LEFT JOIN `orders` p ON p.`id` = c.`order_id` " +
+		"WHERE c.`order_id` IS NOT NULL AND p.`id` IS NULL").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("SELECT COUNT(*) FROM `order_lines` c LEFT JOIN `catalog`.`products` p ON p.`shop_id` = c.`shop_id` AND p.`id` = c.`product_id` " +
+		"WHERE c.`shop_id` IS NOT NULL AND c.`product_id` IS NOT NULL AND p.`shop_id` IS NULL").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery("SELECT COUNT(*) FROM `orders` c LEFT JOIN `customers` p ON p.`id` = c.`customer_id` " +
+		"WHERE c.`customer_id` IS NOT NULL AND p.`id` IS NULL").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	violations, err := m.CheckForeignKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"order_lines (shop_id, product_id) references products (shop_id, id): 2 orphaned rows (fk_lines_product)",
+		"orders (customer_id) references customers (id): 1 orphaned rows (fk_orders_customer)",
+	}
+	if !reflect.DeepEqual(violations, expected) {
+		t.Errorf("expected %q, got %q", expected, violations)
+	}
+	expectMet(t, mock)
+}
+
+func TestMockListMigrationTables(t *testing.T) {
+	query := "SELECT table_name FROM information_schema.tables WHERE table_schema = ? AND (table_name LIKE ? OR table_name IN (" +
+		"SELECT table_name FROM information_schema.columns WHERE table_schema = ? GROUP BY table_name " +
+		"HAVING COUNT(*) = 2 AND SUM(column_name IN ('version', 'dirty')) = 2))"
+
+	t.Run("default pattern", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(query).WithArgs("public", "%migrations%", "public").
+			WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("schema_migrations").AddRow("billing_versions").AddRow("Schema_migrations_history"))
+
+		tables, err := m.ListMigrationTables()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"Schema_migrations_history", "billing_versions", "schema_migrations"}
+		if !reflect.DeepEqual(tables, expected) {
+			t.Errorf("expected %v, got %v", expected, tables)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("pattern", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{MigrationTablesPattern: "%\\_schema"})
+		mock.ExpectQuery(query).WithArgs("public", "%\\_schema", "public").
+			WillReturnRows(sqlmock.NewRows([]string{"table_name"}))
+
+		tables, err := m.ListMigrationTables()
+		if err != nil || len(tables) != 0 {
+			t.Errorf("expected no tables, got %v (%v)", tables, err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(query).WillReturnError(&mysql.MySQLError{Number: 1049, Message: "Unknown database"})
+
+		_, err := m.ListMigrationTables()
+		if q, code, _ := errorQuery(err); q != query || code != database.CodeUndefinedObject {
+			t.Errorf("expected an undefined object error of the query, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockVersionQueryTimeout(t *testing.T) {
+	versionQuery := "SELECT version, dirty FROM `schema_migrations` LIMIT 1"
+	lockQuery := "SELECT t.PROCESSLIST_ID, l.LOCK_TYPE, COALESCE(t.PROCESSLIST_INFO, '') " +
+		"FROM performance_schema.metadata_locks l JOIN performance_schema.threads t ON t.THREAD_ID = l.OWNER_THREAD_ID " +
+		"WHERE l.OBJECT_TYPE = 'TABLE' AND l.OBJECT_SCHEMA = ? AND l.OBJECT_NAME = ? AND l.LOCK_STATUS = 'GRANTED' " +
+		"AND t.PROCESSLIST_ID IS NOT NULL ORDER BY t.PROCESSLIST_ID LIMIT 1"
+
+	t.Run("lock holder", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{VersionQueryTimeout: 50 * time.Millisecond})
+		mock.ExpectQuery(versionQuery).WillDelayFor(time.Second).
+			WillReturnRows(sqlmock.NewRows([]string{"version", "dirty"}))
+
+		// the lock holder is looked up on another connection of the pool
+		db, poolMock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		m.db = db
+		poolMock.ExpectQuery(lockQuery).WithArgs("public", "schema_migrations").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "type", "info"}).AddRow(12, "SHARED_UPGRADABLE", "ALTER TABLE schema_migrations ADD COLUMN c int"))
+
+		_, _, err = m.Version()
+		if !errors.Is(err, database.ErrLockTimeout) {
+			t.Fatalf("expected a lock timeout, got %v", err)
+		}
+		expected := "version query blocked by a metadata lock on schema_migrations held by connection 12 (SHARED_UPGRADABLE) running ALTER TABLE schema_migrations ADD COLUMN c int"
+		if e, ok := err.(*database.Error); !ok || e.Err != expected {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+		expectMet(t, mock)
+		expectMet(t, poolMock)
+	})
+
+	t.Run("set version", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{VersionQueryTimeout: 50 * time.Millisecond})
+		mock.ExpectBegin()
+		mock.ExpectExec("TRUNCATE `schema_migrations`").WillDelayFor(time.Second).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		err := m.SetVersion(3, false)
+		if !errors.Is(err, database.ErrLockTimeout) {
+			t.Fatalf("expected a lock timeout, got %v", err)
+		}
+		if q, _, _ := errorQuery(err); q != "TRUNCATE `schema_migrations`" {
+			t.Errorf("expected the TRUNCATE in the error, got %v", err)
+		}
+	})
+
+	t.Run("history", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{VersionQueryTimeout: 50 * time.Millisecond})
+		expectHistoryTable(mock)
+		mock.ExpectExec("DELETE FROM `schema_migrations_history` WHERE version = ?").WithArgs(3).
+			WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		err := m.DeleteVersion(3)
+		if e, ok := err.(*database.Error); !ok || e.Code != database.CodeLockTimeout || e.Err != "version query blocked, e.g. by a lock on schema_migrations_history" {
+			t.Errorf("expected a lock timeout without the holder, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{VersionQueryTimeout: -1})
+		mock.ExpectQuery(versionQuery).WillDelayFor(100 * time.Millisecond).
+			WillReturnRows(sqlmock.NewRows([]string{"version", "dirty"}).AddRow(2, false))
+
+		if v, _, err := m.Version(); err != nil || v != 2 {
+			t.Errorf("expected version 2, got %v (%v)", v, err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockAllowedWindow(t *testing.T) {
+	// a window of an hour starting in an hour excludes now
+	now := time.Now().UTC()
+	start := time.Duration(now.Hour()+1) * time.Hour
+	closed := &Window{Start: start % (24 * time.Hour), End: (start + time.Hour) % (24 * time.Hour)}
+
+	t.Run("refused", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{AllowedWindow: closed})
+		if err := m.Run(strings.NewReader("CREATE TABLE t (id int)")); err != ErrOutsideWindow {
+			t.Errorf("expected ErrOutsideWindow, got %v", err)
+		}
+		// nothing is tagged before the batch is refused
+		if err := m.RunBatchTagged([]io.Reader{strings.NewReader("SELECT 1")}, []int{1}, "deploy"); err != ErrOutsideWindow {
+			t.Errorf("expected ErrOutsideWindow, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("forced", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{AllowedWindow: closed, ForceWindow: true})
+		mock.ExpectExec("CREATE TABLE t (id int)").WillReturnResult(sqlmock.NewResult(0, 0))
+		if err := m.Run(strings.NewReader("CREATE TABLE t (id int)")); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("open", func(t *testing.T) {
+		open := &Window{Start: closed.End, End: closed.Start}
+		m, mock := newMockMysql(t, &Config{AllowedWindow: open})
+		mock.ExpectExec("CREATE TABLE t (id int)").WillReturnResult(sqlmock.NewResult(0, 0))
+		if err := m.Run(strings.NewReader("CREATE TABLE t (id int)")); err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockRunTrailingSemicolon(t *testing.T) {
+	m, mock := newMockMysql(t, &Config{SendAtOnce: true})
+	mock.ExpectExec("CREATE TABLE t (id int);\nINSERT INTO t VALUES (1)").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := m.Run(strings.NewReader("CREATE TABLE t (id int);\nINSERT INTO t VALUES (1);\n")); err != nil {
+		t.Fatal(err)
+	}
+	expectMet(t, mock)
+}
+
+func TestMockStrictSplit(t *testing.T) {
+	testcases := []struct {
+		name      string
+		config    Config
+		migration string
+		expected  database.SplitError
+	}{
+		{name: "unterminated string", config: Config{},
+			migration: "INSERT INTO t VALUES (1, 'a');\nINSERT INTO t VALUES (2, 'b);\n",
+			expected:  database.SplitError{Line: 2, Offset: 56, Err: "unterminated quoted string"}},
+		{name: "unterminated string streamed", config: Config{StreamStatements: true},
+			migration: "INSERT INTO t VALUES (1, 'a');\nINSERT INTO t VALUES (2, 'b);\n",
+			expected:  database.SplitError{Line: 2, Offset: 56, Err: "unterminated quoted string"}},
+		{name: "unterminated BEGIN", config: Config{StrictSplit: true},
+			migration: "CREATE PROCEDURE p()\nBEGIN\nSELECT 1;",
+			expected:  database.SplitError{Line: 2, Offset: 21, Err: "unterminated BEGIN in compound statement, use DELIMITER"}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.config
+			m, mock := newMockMysql(t, &config)
+			if tc.config.StreamStatements {
+				mock.ExpectExec("INSERT INTO t VALUES (1, 'a')").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			if err := m.Run(strings.NewReader(tc.migration)); err != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+			expectMet(t, mock)
+		})
+	}
+}
+
+func TestMockProtectDML(t *testing.T) {
+	t.Run("groups", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{ProtectDML: true})
+		mock.ExpectExec("CREATE TABLE t (id int primary key)").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO t VALUES (1)").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE t SET id = 2").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectExec("SET @x = 3").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO t VALUES (@x)").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		err := m.Run(strings.NewReader("CREATE TABLE t (id int primary key);\n" +
+			"INSERT INTO t VALUES (1);\nUPDATE t SET id = 2;\nSET @x = 3;\nINSERT INTO t VALUES (@x);\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("failing DML", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{ProtectDML: true})
+		mock.ExpectExec("CREATE TABLE t (id int primary key)").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO t VALUES (1)").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO t VALUES (1)").
+			WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'PRIMARY'"})
+		mock.ExpectRollback()
+
+		err := m.Run(strings.NewReader("CREATE TABLE t (id int primary key);\n" +
+			"INSERT INTO t VALUES (1);\nINSERT INTO t VALUES (1);\nCREATE INDEX i ON t (id);\n"))
+		if q, _, ok := errorQuery(err); !ok || q != "INSERT INTO t VALUES (1)" {
+			t.Fatalf("expected the error of the second INSERT, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "rolled back") {
+			t.Errorf("expected the error to tell the DML was rolled back, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("transaction control", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{ProtectDML: true})
+
+		err := m.Run(strings.NewReader("START TRANSACTION;\nINSERT INTO t VALUES (1);\nCOMMIT;"))
+		if !errors.Is(err, ErrProtectDMLTransaction) {
+			t.Fatalf("expected ErrProtectDMLTransaction, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestParseTransactional(t *testing.T) {
+	testcases := []struct {
+		migration string
+		expected  bool
+	}{
+		{"-- transactional: true\nUPDATE t SET id = 1;", true},
+		{"\n-- backfill t\n--Transactional:TRUE\nUPDATE t SET id = 1;", true},
+		{"# transactional: 1\nUPDATE t SET id = 1;", true},
+		{"-- transactional: false\nUPDATE t SET id = 1;", false},
+		{"UPDATE t SET id = 1;\n-- transactional: true\n", false},
+		{"/* transactional: true */\nUPDATE t SET id = 1;", false},
+		{"", false},
+	}
+
+	for _, tc := range testcases {
+		transactional, err := parseTransactional([]byte(tc.migration))
+		if err != nil || transactional != tc.expected {
+			t.Errorf("expected %v for %q, got %v (%v)", tc.expected, tc.migration, transactional, err)
+		}
+	}
+
+	if _, err := parseTransactional([]byte("-- transactional: yes\n")); err == nil {
+		t.Error("expected an error for an invalid value")
+	}
+}
+
+func TestMockTransactionalHeader(t *testing.T) {
+	t.Run("commit", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectBegin()
+		mock.ExpectExec("-- transactional: true\nUPDATE t SET id = 2").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO t VALUES (1)").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		err := m.Run(strings.NewReader("-- transactional: true\nUPDATE t SET id = 2;\nINSERT INTO t VALUES (1);\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectBegin()
+		mock.ExpectExec("-- transactional: true\nINSERT INTO t VALUES (1)").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO t VALUES (1)").
+			WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'PRIMARY'"})
+		mock.ExpectRollback()
+
+		err := m.Run(strings.NewReader("-- transactional: true\nINSERT INTO t VALUES (1);\nINSERT INTO t VALUES (1);\n"))
+		if q, _, ok := errorQuery(err); !ok || q != "INSERT INTO t VALUES (1)" {
+			t.Fatalf("expected the error of the second INSERT, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "rolled back") {
+			t.Errorf("expected the error to tell the migration was rolled back, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("implicit commit", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+
+		err := m.Run(strings.NewReader("-- transactional: true\nINSERT INTO t VALUES (1);\nCREATE INDEX i ON t (id);\n"))
+		if !errors.Is(err, ErrTransactionalCommit) {
+			t.Fatalf("expected ErrTransactionalCommit, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectExec("-- transactional: false\nINSERT INTO t VALUES (1)").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("CREATE INDEX i ON t (id)").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		err := m.Run(strings.NewReader("-- transactional: false\nINSERT INTO t VALUES (1);\nCREATE INDEX i ON t (id);\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{StreamStatements: true})
+
+		err := m.Run(strings.NewReader("-- transactional: true\nINSERT INTO t VALUES (1);\n"))
+		if err != ErrStreamTransactional {
+			t.Fatalf("expected ErrStreamTransactional, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockSQLTransform(t *testing.T) {
+	engine := regexp.MustCompile(`(?i)ENGINE\s*=\s*MyISAM`)
+	var seen []string
+	transform := func(stmt []byte) ([]byte, error) {
+		seen = append(seen, string(stmt))
+		if bytes.Contains(stmt, []byte("MEMORY")) {
+			return nil, errors.New("MEMORY tables aren't allowed")
+		}
+		return engine.ReplaceAll(stmt, []byte("ENGINE=InnoDB")), nil
+	}
+	migration := "CREATE TABLE a (id int) ENGINE=MyISAM;\nCREATE TABLE b (id int) engine = MyISAM;\n"
+
+	t.Run("statements", func(t *testing.T) {
+		seen = nil
+		m, mock := newMockMysql(t, &Config{SQLTransform: transform})
+		mock.ExpectExec("CREATE TABLE a (id int) ENGINE=InnoDB").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE b (id int) ENGINE=InnoDB").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.Run(strings.NewReader(migration)); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"CREATE TABLE a (id int) ENGINE=MyISAM", "CREATE TABLE b (id int) engine = MyISAM"}
+		if !reflect.DeepEqual(seen, expected) {
+			t.Errorf("expected the transform to see the split statements %q, got %q", expected, seen)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("stream statements", func(t *testing.T) {
+		seen = nil
+		m, mock := newMockMysql(t, &Config{SQLTransform: transform, StreamStatements: true})
+		mock.ExpectExec("CREATE TABLE a (id int) ENGINE=InnoDB").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE b (id int) ENGINE=InnoDB").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := m.Run(strings.NewReader(migration)); err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != 2 {
+			t.Errorf("expected the transform to see 2 statements, got %q", seen)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{SQLTransform: transform})
+
+		err := m.Run(strings.NewReader(migration + "CREATE TABLE c (id int) ENGINE=MEMORY;\n"))
+		if err == nil || !strings.Contains(err.Error(), "MEMORY tables aren't allowed") {
+			t.Fatalf("expected the transform to abort the migration, got %v", err)
+		}
+		expectMet(t, mock)
+	})
+}
+
+func TestMockRepairDuplicates(t *testing.T) {
+	keyQuery := "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = ? AND table_name = ? AND index_name = 'PRIMARY'"
+
+	t.Run("primary key", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(keyQuery).WithArgs("public", DefaultMigrationsTable).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+		removed, err := m.RepairDuplicates()
+		if err != nil || removed != 0 {
+			t.Errorf("expected nothing to repair, got %v, %v", removed, err)
+		}
+		expectMet(t, mock)
+	})
+
+	t.Run("no primary key", func(t *testing.T) {
+		m, mock := newMockMysql(t, &Config{})
+		mock.ExpectQuery(keyQuery).WithArgs("public", DefaultMigrationsTable).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT version, COUNT(*), MIN(dirty) FROM `schema_migrations` GROUP BY version HAVING COUNT(*) > 1").
+			WillReturnRows(sqlmock.NewRows([]string{"version", "count", "dirty"}).AddRow(3, 3, false))
+		mock.ExpectExec("DELETE FROM `schema_migrations` WHERE version = ?").WithArgs(3).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec("INSERT INTO `schema_migrations` (version, dirty) VALUES (?, ?)").WithArgs(3, false).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		removed, err := m.RepairDuplicates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != 2 {
+			t.Errorf("expected 2 removed rows, got %v", removed)
+		}
+		expectMet(t, mock)
+	})
+}
@@ -35,6 +35,23 @@ var (
 type Config struct {
 	MigrationsTable string
 	DatabaseName    string
+	SchemaName      string
+
+	// StrictTransactions makes Run fail instead of warning through Log if a
+	// statement that can't run inside a transaction is part of a migration
+	// with more than one statement.
+	StrictTransactions bool
+
+	// Log receives the warnings of the driver. They are dropped if it's
+	// nil.
+	Log database.Logger
+
+	// LockPerSchema locks a 64-bit key of the database and schema name, so
+	// that migrations of different schemas don't wait for each other. By
+	// default the key is derived from the database name only, like in
+	// earlier releases. The keys don't exclude each other, so switch all
+	// migrators of a database at once.
+	LockPerSchema bool
 }
 
 type Postgres struct {
@@ -58,7 +75,7 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 	query := `SELECT CURRENT_DATABASE()`
 	var databaseName string
 	if err := instance.QueryRow(query).Scan(&databaseName); err != nil {
-		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 	}
 
 	if len(databaseName) == 0 {
@@ -67,6 +84,19 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 
 	config.DatabaseName = databaseName
 
+	query = `SELECT CURRENT_SCHEMA()`
+	// NULL if no schema of the search_path exists
+	var schemaName sql.NullString
+	if err := instance.QueryRow(query).Scan(&schemaName); err != nil {
+		return nil, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+
+	if !schemaName.Valid || len(schemaName.String) == 0 {
+		return nil, ErrNoSchema
+	}
+
+	config.SchemaName = schemaName.String
+
 	if len(config.MigrationsTable) == 0 {
 		config.MigrationsTable = DefaultMigrationsTable
 	}
@@ -105,9 +135,27 @@ func (p *Postgres) Open(url string) (database.Driver, error) {
 		migrationsTable = DefaultMigrationsTable
 	}
 
+	strictTransactions := false
+	if len(purl.Query().Get("x-strict-transactions")) > 0 {
+		strictTransactions, err = strconv.ParseBool(purl.Query().Get("x-strict-transactions"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lockPerSchema := false
+	if len(purl.Query().Get("x-lock-per-schema")) > 0 {
+		lockPerSchema, err = strconv.ParseBool(purl.Query().Get("x-lock-per-schema"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	px, err := WithInstance(db, &Config{
-		DatabaseName:    purl.Path,
-		MigrationsTable: migrationsTable,
+		DatabaseName:       purl.Path,
+		MigrationsTable:    migrationsTable,
+		StrictTransactions: strictTransactions,
+		LockPerSchema:      lockPerSchema,
 	})
 	if err != nil {
 		return nil, err
@@ -126,7 +174,7 @@ func (p *Postgres) Lock() error {
 		return database.ErrLocked
 	}
 
-	aid, err := database.GenerateAdvisoryLockId(p.config.DatabaseName)
+	aid, err := p.lockKey()
 	if err != nil {
 		return err
 	}
@@ -135,7 +183,7 @@ func (p *Postgres) Lock() error {
 	// or return false if the lock cannot be acquired immediately.
 	query := `SELECT pg_advisory_lock($1)`
 	if _, err := p.conn.ExecContext(context.Background(), query, aid); err != nil {
-		return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+		return &database.Error{OrigErr: err, Code: errorCode(err), Err: "try lock failed", Query: []byte(query)}
 	}
 
 	p.isLocked = true
@@ -147,27 +195,45 @@ func (p *Postgres) Unlock() error {
 		return nil
 	}
 
-	aid, err := database.GenerateAdvisoryLockId(p.config.DatabaseName)
+	aid, err := p.lockKey()
 	if err != nil {
 		return err
 	}
 
 	query := `SELECT pg_advisory_unlock($1)`
 	if _, err := p.conn.ExecContext(context.Background(), query, aid); err != nil {
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 	}
 	p.isLocked = false
 	return nil
 }
 
+// lockKey returns the advisory lock key, see Config.LockPerSchema.
+func (p *Postgres) lockKey() (interface{}, error) {
+	if p.config.LockPerSchema {
+		return database.GenerateAdvisoryLockId64(p.config.DatabaseName, p.config.SchemaName)
+	}
+	return database.GenerateAdvisoryLockId(p.config.DatabaseName)
+}
+
 func (p *Postgres) Run(migration io.Reader) error {
 	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
 	}
 
-	// run migration
-	query := string(migr[:])
+	opts := database.PostgresOptions
+	opts.RejectUnterminated = true
+	stmts, err := database.SplitQueryOpts(migr, opts)
+	if err != nil {
+		return err
+	}
+	if err := p.checkTransactions(stmts); err != nil {
+		return err
+	}
+
+	// run migration, the query is the only copy of it kept from here on
+	query := string(migr)
 	if _, err := p.conn.ExecContext(context.Background(), query); err != nil {
 		if pgErr, ok := err.(*pq.Error); ok {
 			var line uint
@@ -185,14 +251,111 @@ func (p *Postgres) Run(migration io.Reader) error {
 			if pgErr.Detail != "" {
 				message = fmt.Sprintf("%s, %s", message, pgErr.Detail)
 			}
-			return database.Error{OrigErr: err, Err: message, Query: migr, Line: line}
+			return database.Error{OrigErr: err, Code: errorCode(err), Err: message, Query: []byte(query), Line: line}
 		}
-		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
+		return database.Error{OrigErr: err, Code: errorCode(err), Err: "migration failed", Query: []byte(query)}
 	}
 
 	return nil
 }
 
+// schemaFingerprintQuery hashes the definitions of relations, columns,
+// constraints, functions, enum values and triggers outside of the system
+// schemas, so that schema changes made by a transaction can be detected.
+const schemaFingerprintQuery = `SELECT md5(COALESCE(string_agg(def, ',' ORDER BY def), '')) FROM (
+	SELECT 'r' || c.oid || c.relname || c.relkind || n.nspname AS def
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'
+	UNION ALL
+	SELECT 'a' || a.attrelid || a.attname || a.atttypid || a.attnotnull || a.attisdropped || a.atthasdef
+		FROM pg_attribute a JOIN pg_class c ON c.oid = a.attrelid JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE a.attnum > 0 AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'
+	UNION ALL
+	SELECT 'c' || co.oid || co.conname FROM pg_constraint co JOIN pg_namespace n ON n.oid = co.connamespace
+		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')
+	UNION ALL
+	SELECT 'p' || p.oid || p.proname || md5(p.prosrc) FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')
+	UNION ALL
+	SELECT 'e' || e.enumtypid || e.enumlabel FROM pg_enum e
+	UNION ALL
+	SELECT 't' || t.oid || t.tgname || t.tgenabled FROM pg_trigger t WHERE NOT t.tgisinternal
+) defs`
+
+// WouldChange implements database.ChangeDetector. A statement changes
+// something if it reports affected rows or changes the schema. Schema changes
+// are detected by comparing a fingerprint of the system catalogs, which
+// doesn't cover every kind of object, e.g. grants, comments or sequence
+// values. Migrations with statements that can't run inside a transaction
+// or transaction control statements are rejected.
+func (p *Postgres) WouldChange(migration io.Reader) (bool, error) {
+	migr, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return false, err
+	}
+
+	opts := database.PostgresOptions
+	opts.RejectUnterminated = true
+	stmts, err := database.SplitQueryOpts(migr, opts)
+	if err != nil {
+		return false, err
+	}
+
+	for _, stmt := range stmts {
+		if class := database.ClassifyStatement(stmt, database.PostgresDialect).Class; class != database.Transactional {
+			return false, database.Error{OrigErr: database.ErrNotRollbackable, Err: fmt.Sprintf("%v statement", class), Query: stmt}
+		}
+	}
+
+	tx, err := p.conn.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return false, &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	defer tx.Rollback()
+
+	var before, after string
+	if err := tx.QueryRow(schemaFingerprintQuery).Scan(&before); err != nil {
+		return false, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(schemaFingerprintQuery)}
+	}
+
+	changed := false
+	for _, stmt := range stmts {
+		res, err := tx.Exec(string(stmt))
+		if err != nil {
+			return false, database.Error{OrigErr: err, Code: errorCode(err), Err: "migration failed", Query: stmt}
+		}
+		if database.IsQuery(stmt, database.PostgresDialect) {
+			continue
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			changed = true
+		}
+	}
+
+	if !changed {
+		if err := tx.QueryRow(schemaFingerprintQuery).Scan(&after); err != nil {
+			return false, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(schemaFingerprintQuery)}
+		}
+		changed = before != after
+	}
+	return changed, nil
+}
+
+// checkTransactions warns about every statement that can't run
+// inside the migration's transaction, or returns an error if
+// StrictTransactions is set.
+func (p *Postgres) checkTransactions(stmts [][]byte) error {
+	for _, issue := range database.CheckTransactions(stmts, database.PostgresDialect) {
+		if p.config.StrictTransactions {
+			return database.Error{OrigErr: database.ErrTransactionIssue, Err: issue.String(), Query: issue.Statement}
+		}
+		if p.config.Log != nil {
+			p.config.Log.Printf("migrate/postgres: warning: %v: %s", issue, issue.Statement)
+		}
+	}
+	return nil
+}
+
 func computeLineFromPos(s string, pos int) (line uint, col uint, ok bool) {
 	// replace crlf with lf
 	s = strings.Replace(s, "\r\n", "\n", -1)
@@ -237,14 +400,14 @@ func (p *Postgres) SetVersion(version int, dirty bool) error {
 	query := `TRUNCATE "` + p.config.MigrationsTable + `"`
 	if _, err := tx.Exec(query); err != nil {
 		tx.Rollback()
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 	}
 
 	if version >= 0 {
-		query = `INSERT INTO "` + p.config.MigrationsTable + `" (version, dirty) VALUES ($1, $2)`
-		if _, err := tx.Exec(query, version, dirty); err != nil {
+		query, args := p.SetVersionSQL(version, dirty)
+		if _, err := tx.Exec(query, args...); err != nil {
 			tx.Rollback()
-			return &database.Error{OrigErr: err, Query: []byte(query)}
+			return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 		}
 	}
 
@@ -255,6 +418,17 @@ func (p *Postgres) SetVersion(version int, dirty bool) error {
 	return nil
 }
 
+// SetVersionSQL returns the statement and arguments SetVersion writes the
+// version with, without running it. SetVersion empties the migrations table
+// with TRUNCATE first, in the same transaction. For NilVersion nothing is
+// written and the query is empty.
+func (p *Postgres) SetVersionSQL(version int, dirty bool) (query string, args []interface{}) {
+	if version < 0 {
+		return "", nil
+	}
+	return `INSERT INTO "` + p.config.MigrationsTable + `" (version, dirty) VALUES ($1, $2)`, []interface{}{version, dirty}
+}
+
 func (p *Postgres) Version() (version int, dirty bool, err error) {
 	query := `SELECT version, dirty FROM "` + p.config.MigrationsTable + `" LIMIT 1`
 	err = p.conn.QueryRowContext(context.Background(), query).Scan(&version, &dirty)
@@ -268,19 +442,89 @@ func (p *Postgres) Version() (version int, dirty bool, err error) {
 				return database.NilVersion, false, nil
 			}
 		}
-		return 0, false, &database.Error{OrigErr: err, Query: []byte(query)}
+		return 0, false, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 
 	default:
 		return version, dirty, nil
 	}
 }
 
+// Capabilities implements database.CapabilityReporter.
+func (p *Postgres) Capabilities() database.DriverCapabilities {
+	return database.DriverCapabilities{
+		SupportsLock:             true,
+		SupportsTransactionalDDL: true,
+	}
+}
+
+// RepairDuplicates implements database.DuplicateRepairer.
+func (p *Postgres) RepairDuplicates() (int, error) {
+	tx, err := p.conn.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return 0, &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+
+	query := `SELECT version, COUNT(*), bool_and(dirty) FROM "` + p.config.MigrationsTable + `" GROUP BY version HAVING COUNT(*) > 1`
+	duplicates, err := queryDuplicates(tx, query)
+	if err != nil {
+		tx.Rollback()
+		return 0, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+	}
+
+	removed := 0
+	for _, d := range duplicates {
+		query := `DELETE FROM "` + p.config.MigrationsTable + `" WHERE version = $1`
+		if _, err := tx.ExecContext(context.Background(), query, d.Version); err != nil {
+			tx.Rollback()
+			return 0, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+
+		query = `INSERT INTO "` + p.config.MigrationsTable + `" (version, dirty) VALUES ($1, $2)`
+		if _, err := tx.ExecContext(context.Background(), query, d.Version, d.Dirty); err != nil {
+			tx.Rollback()
+			return 0, &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
+		}
+		removed += d.Count - 1
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+	return removed, nil
+}
+
+// duplicate describes rows of the migrations table with the same version.
+// dirty is true if all of them are dirty.
+type duplicate struct {
+	Version int
+	Count   int
+	Dirty   bool
+}
+
+func queryDuplicates(tx *sql.Tx, query string) ([]duplicate, error) {
+	rows, err := tx.QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	duplicates := make([]duplicate, 0)
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.Version, &d.Count, &d.Dirty); err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, d)
+	}
+	return duplicates, rows.Err()
+}
+
 func (p *Postgres) Drop() error {
 	// select all tables in current schema
 	query := `SELECT table_name FROM information_schema.tables WHERE table_schema=(SELECT current_schema())`
 	tables, err := p.conn.QueryContext(context.Background(), query)
 	if err != nil {
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 	}
 	defer tables.Close()
 
@@ -296,20 +540,16 @@ func (p *Postgres) Drop() error {
 		}
 	}
 
-	if len(tableNames) > 0 {
-		// delete one by one ...
-		for _, t := range tableNames {
-			query = `DROP TABLE IF EXISTS ` + t + ` CASCADE`
-			if _, err := p.conn.ExecContext(context.Background(), query); err != nil {
-				return &database.Error{OrigErr: err, Query: []byte(query)}
-			}
-		}
-		if err := p.ensureVersionTable(); err != nil {
-			return err
+	// delete one by one ...
+	for _, t := range tableNames {
+		query = `DROP TABLE IF EXISTS ` + t + ` CASCADE`
+		if _, err := p.conn.ExecContext(context.Background(), query); err != nil {
+			return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 		}
 	}
 
-	return nil
+	// ... and leave an empty version table, even if there were no tables
+	return p.ensureVersionTable()
 }
 
 func (p *Postgres) ensureVersionTable() error {
@@ -317,7 +557,7 @@ func (p *Postgres) ensureVersionTable() error {
 	var count int
 	query := `SELECT COUNT(1) FROM information_schema.tables WHERE table_name = $1 AND table_schema = (SELECT current_schema()) LIMIT 1`
 	if err := p.conn.QueryRowContext(context.Background(), query, p.config.MigrationsTable).Scan(&count); err != nil {
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 	}
 	if count == 1 {
 		return nil
@@ -326,7 +566,35 @@ func (p *Postgres) ensureVersionTable() error {
 	// if not, create the empty migration table
 	query = `CREATE TABLE "` + p.config.MigrationsTable + `" (version bigint not null primary key, dirty boolean not null)`
 	if _, err := p.conn.ExecContext(context.Background(), query); err != nil {
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+		return &database.Error{OrigErr: err, Code: errorCode(err), Query: []byte(query)}
 	}
 	return nil
 }
+
+// errorCodes maps Postgres SQLSTATE codes to database.ErrorCode, see
+// https://www.postgresql.org/docs/current/static/errcodes-appendix.html
+var errorCodes = map[pq.ErrorCode]database.ErrorCode{
+	"42P04": database.CodeDuplicateObject, // duplicate_database
+	"42P06": database.CodeDuplicateObject, // duplicate_schema
+	"42P07": database.CodeDuplicateObject, // duplicate_table
+	"42701": database.CodeDuplicateObject, // duplicate_column
+	"42710": database.CodeDuplicateObject, // duplicate_object
+	"42723": database.CodeDuplicateObject, // duplicate_function
+	"3D000": database.CodeUndefinedObject, // invalid_catalog_name
+	"3F000": database.CodeUndefinedObject, // invalid_schema_name
+	"42P01": database.CodeUndefinedObject, // undefined_table
+	"42703": database.CodeUndefinedObject, // undefined_column
+	"42704": database.CodeUndefinedObject, // undefined_object
+	"42883": database.CodeUndefinedObject, // undefined_function
+	"55P03": database.CodeLockTimeout,     // lock_not_available
+	"40P01": database.CodeDeadlock,        // deadlock_detected
+	"42601": database.CodeSyntax,          // syntax_error
+}
+
+// errorCode classifies err if it is a Postgres error.
+func errorCode(err error) database.ErrorCode {
+	if e, ok := err.(*pq.Error); ok {
+		return errorCodes[e.Code]
+	}
+	return database.CodeUnknown
+}
@@ -7,14 +7,20 @@ import (
 	"context"
 	"database/sql"
 	sqldriver "database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-migrate/migrate/database"
 	dt "github.com/golang-migrate/migrate/database/testing"
 	mt "github.com/golang-migrate/migrate/testing"
+	"github.com/lib/pq"
 )
 
 var versions = []mt.Version{
@@ -62,6 +68,37 @@ func Test(t *testing.T) {
 		})
 }
 
+func TestDropEmpty(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			p := &Postgres{}
+			addr := pgConnectionString(i.Host(), i.Port())
+			d, err := p.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			defer d.Close()
+			ps := d.(*Postgres)
+
+			// leave the database without any table
+			if _, err := ps.conn.ExecContext(context.Background(), `DROP TABLE "`+DefaultMigrationsTable+`"`); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := d.Drop(); err != nil {
+				t.Fatal(err)
+			}
+
+			var exists bool
+			if err := ps.conn.QueryRowContext(context.Background(), "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = $1 AND table_schema = (SELECT current_schema()))", DefaultMigrationsTable).Scan(&exists); err != nil {
+				t.Fatal(err)
+			}
+			if !exists {
+				t.Fatal("expected the version table to exist after Drop")
+			}
+		})
+}
+
 func TestMultiStatement(t *testing.T) {
 	mt.ParallelTest(t, versions, isReady,
 		func(t *testing.T, i mt.Instance) {
@@ -182,6 +219,50 @@ func TestWithInstance(t *testing.T) {
 
 }
 
+func TestWithInstanceNoSchema(t *testing.T) {
+	for _, schema := range []interface{}{nil, ""} {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectQuery("SELECT CURRENT_DATABASE()").
+			WillReturnRows(sqlmock.NewRows([]string{"current_database"}).AddRow("postgres"))
+		mock.ExpectQuery("SELECT CURRENT_SCHEMA()").
+			WillReturnRows(sqlmock.NewRows([]string{"current_schema"}).AddRow(schema))
+
+		if _, err := WithInstance(db, &Config{}); err != ErrNoSchema {
+			t.Errorf("expected ErrNoSchema for %#v, got %v", schema, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	lockKey := func(schema string, perSchema bool) interface{} {
+		p := &Postgres{config: &Config{DatabaseName: "postgres", SchemaName: schema, LockPerSchema: perSchema}}
+		key, err := p.lockKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	// the lock key of earlier releases
+	legacy, err := database.GenerateAdvisoryLockId("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockKey("a", false) != legacy || lockKey("b", false) != legacy {
+		t.Error("expected the lock key of earlier releases by default")
+	}
+	if lockKey("a", true) == lockKey("b", true) {
+		t.Error("expected schemas to get different lock keys with LockPerSchema")
+	}
+}
+
 func TestPostgres_Lock(t *testing.T) {
 	mt.ParallelTest(t, versions, isReady,
 		func(t *testing.T, i mt.Instance) {
@@ -298,3 +379,139 @@ func Test_computeLineFromPos(t *testing.T) {
 	}
 
 }
+
+func TestErrorCode(t *testing.T) {
+	testcases := []struct {
+		err      error
+		expected database.ErrorCode
+	}{
+		{err: &pq.Error{Code: "42P07"}, expected: database.CodeDuplicateObject},
+		{err: &pq.Error{Code: "42701"}, expected: database.CodeDuplicateObject},
+		{err: &pq.Error{Code: "42710"}, expected: database.CodeDuplicateObject},
+		{err: &pq.Error{Code: "42P01"}, expected: database.CodeUndefinedObject},
+		{err: &pq.Error{Code: "55P03"}, expected: database.CodeLockTimeout},
+		{err: &pq.Error{Code: "40P01"}, expected: database.CodeDeadlock},
+		{err: &pq.Error{Code: "42601"}, expected: database.CodeSyntax},
+		{err: &pq.Error{Code: "23505"}, expected: database.CodeUnknown},
+		{err: fmt.Errorf("42P07"), expected: database.CodeUnknown},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			if code := errorCode(tc.err); code != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, code)
+			}
+		})
+	}
+
+	err := error(&database.Error{OrigErr: &pq.Error{Code: "42601"}, Code: errorCode(&pq.Error{Code: "42601"})})
+	if !errors.Is(err, database.ErrSyntax) {
+		t.Error("expected err to be database.ErrSyntax")
+	}
+	if errors.Is(err, database.ErrDuplicateObject) {
+		t.Error("expected err not to be database.ErrDuplicateObject")
+	}
+}
+
+func TestCheckTransactions(t *testing.T) {
+	stmts, err := database.SplitQueryOpts([]byte("CREATE TABLE t (a INT); CREATE INDEX CONCURRENTLY i ON t (a)"), database.PostgresOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	p := &Postgres{config: &Config{Log: log.New(buf, "", 0)}}
+	if err := p.checkTransactions(stmts); err != nil {
+		t.Errorf("expected only a warning, got %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "migrate/postgres: warning: ") {
+		t.Errorf("expected a warning, got %q", buf.String())
+	}
+
+	p.config.StrictTransactions = true
+	if err := p.checkTransactions(stmts); !errors.Is(err, database.ErrTransactionIssue) {
+		t.Errorf("expected ErrTransactionIssue, got %v", err)
+	}
+}
+
+func TestWouldChangeRejectsNonTransactional(t *testing.T) {
+	p := &Postgres{config: &Config{}}
+	for _, query := range []string{"CREATE INDEX CONCURRENTLY i ON t (a)", "BEGIN; UPDATE t SET a = 1; COMMIT"} {
+		if _, err := p.WouldChange(bytes.NewBufferString(query)); !errors.Is(err, database.ErrNotRollbackable) {
+			t.Errorf("expected ErrNotRollbackable for %q, got %v", query, err)
+		}
+	}
+}
+
+func TestRepairDuplicates(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			p := &Postgres{}
+			addr := pgConnectionString(i.Host(), i.Port())
+			d, err := p.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			defer d.Close()
+
+			// the primary key prevents duplicates, tables edited by hand might lack it
+			if err := d.Run(bytes.NewReader([]byte("ALTER TABLE schema_migrations DROP CONSTRAINT schema_migrations_pkey"))); err != nil {
+				t.Fatal(err)
+			}
+			seed := "INSERT INTO schema_migrations (version, dirty) VALUES (3, true), (3, false), (3, true), (2, true)"
+			if err := d.Run(bytes.NewReader([]byte(seed))); err != nil {
+				t.Fatal(err)
+			}
+
+			removed, err := d.(*Postgres).RepairDuplicates()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != 2 {
+				t.Errorf("expected 2 removed rows, got %v", removed)
+			}
+
+			// one clean row is left for version 3
+			var count int
+			var dirty bool
+			query := "SELECT COUNT(*), bool_or(dirty) FROM schema_migrations WHERE version = 3"
+			if err := d.(*Postgres).conn.QueryRowContext(context.Background(), query).Scan(&count, &dirty); err != nil {
+				t.Fatal(err)
+			}
+			if count != 1 || dirty {
+				t.Errorf("expected a single clean row, got %v rows (dirty %v)", count, dirty)
+			}
+
+			removed, err = d.(*Postgres).RepairDuplicates()
+			if err != nil || removed != 0 {
+				t.Errorf("expected nothing left to repair, got %v, %v", removed, err)
+			}
+		})
+}
+
+func TestSetVersionSQL(t *testing.T) {
+	m := &Postgres{config: &Config{MigrationsTable: "schema_migrations"}}
+
+	testcases := []struct {
+		version      int
+		dirty        bool
+		expectedSQL  string
+		expectedArgs []interface{}
+	}{
+		{version: 1, dirty: true, expectedSQL: `INSERT INTO "schema_migrations" (version, dirty) VALUES ($1, $2)`, expectedArgs: []interface{}{1, true}},
+		{version: 0, dirty: false, expectedSQL: `INSERT INTO "schema_migrations" (version, dirty) VALUES ($1, $2)`, expectedArgs: []interface{}{0, false}},
+		{version: -1, dirty: false, expectedSQL: "", expectedArgs: nil},
+	}
+
+	for _, tc := range testcases {
+		t.Run(strconv.Itoa(tc.version), func(t *testing.T) {
+			query, args := m.SetVersionSQL(tc.version, tc.dirty)
+			if query != tc.expectedSQL {
+				t.Errorf("expected %q, got %q", tc.expectedSQL, query)
+			}
+			if !reflect.DeepEqual(args, tc.expectedArgs) {
+				t.Errorf("expected %v, got %v", tc.expectedArgs, args)
+			}
+		})
+	}
+}
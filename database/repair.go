@@ -0,0 +1,11 @@
+package database
+
+// DuplicateRepairer is an optional interface a database driver can
+// implement to repair a migrations table with several rows of the same
+// version, e.g. after manual edits. Version picks one of them arbitrarily.
+type DuplicateRepairer interface {
+	// RepairDuplicates collapses rows with the same version into one,
+	// which is clean if any of them was, and returns the number of
+	// rows it removed.
+	RepairDuplicates() (removed int, err error)
+}
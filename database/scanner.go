@@ -0,0 +1,122 @@
+package database
+
+import (
+	"bytes"
+	"io"
+)
+
+// scanChunkSize is the minimum number of bytes a StatementScanner reads at once.
+var scanChunkSize = 64 * 1024
+
+// StatementScanner splits a migration into its statements like
+// SplitQueryOpts does, while reading it. Only the statement being split is
+// kept in memory, so drivers can run migrations of any size one statement
+// at a time.
+//
+//	scanner := database.NewStatementScanner(migration, database.MySQLOptions)
+//	for scanner.Scan() {
+//		// run scanner.Statement()
+//	}
+//	if err := scanner.Err(); err != nil {
+//		// ...
+//	}
+type StatementScanner struct {
+	r    io.Reader
+	s    splitter
+	stmt []byte
+	err  error
+
+	// start is the offset of the next statement in s.buf.
+	start int
+	eof   bool
+
+	// bomChecked is true once a leading byte order mark was looked for.
+	bomChecked bool
+}
+
+// NewStatementScanner returns a StatementScanner reading from r.
+func NewStatementScanner(r io.Reader, opts SplitOptions) *StatementScanner {
+	sc := &StatementScanner{r: r, s: splitter{opts: opts}}
+	sc.s.setDelimiter(defaultDelimiter)
+	return sc
+}
+
+// Scan advances to the next statement, which is then available through
+// Statement. It returns false at the end of the migration or after an error.
+func (sc *StatementScanner) Scan() bool {
+	sc.stmt = nil
+	for sc.err == nil {
+		if sc.bomChecked && sc.start < len(sc.s.buf) {
+			st, ok, err := sc.s.next(sc.start, sc.eof)
+			if err != nil {
+				sc.err = err
+				return false
+			}
+			if ok {
+				sc.start = st.next
+				if stmt := sc.s.bytes(st); len(stmt) > 0 {
+					sc.stmt = stmt
+					return true
+				}
+				continue
+			}
+		}
+		if sc.eof {
+			return false
+		}
+		sc.fill()
+	}
+	return false
+}
+
+// Statement returns the statement found by the last call to Scan.
+// The underlying array may be overwritten by the next call to Scan.
+func (sc *StatementScanner) Statement() []byte {
+	return sc.stmt
+}
+
+// Err returns the first error reading or splitting the migration.
+func (sc *StatementScanner) Err() error {
+	return sc.err
+}
+
+// fill drops the statements already returned from the buffer and reads
+// more of the migration. It reads at least as much as the buffer holds,
+// so that splitting a long statement over and over stays linear.
+func (sc *StatementScanner) fill() {
+	// keep the byte in front of the next statement, the splitter looks
+	// behind quotes and dollar signs
+	if drop := sc.start - 1; drop > 0 {
+		sc.s.lines += countLines(sc.s.buf[:drop])
+		sc.s.offset += drop
+		n := copy(sc.s.buf, sc.s.buf[drop:])
+		sc.s.buf = sc.s.buf[:n]
+		sc.start -= drop
+	}
+
+	size := len(sc.s.buf) - sc.start
+	if size < scanChunkSize {
+		size = scanChunkSize
+	}
+	if cap(sc.s.buf)-len(sc.s.buf) < size {
+		buf := make([]byte, len(sc.s.buf), len(sc.s.buf)+size)
+		copy(buf, sc.s.buf)
+		sc.s.buf = buf
+	}
+
+	n, err := io.ReadFull(sc.r, sc.s.buf[len(sc.s.buf):len(sc.s.buf)+size])
+	sc.s.buf = sc.s.buf[:len(sc.s.buf)+n]
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		sc.eof = true
+	case err != nil:
+		sc.err = err
+	}
+
+	if !sc.bomChecked && (len(sc.s.buf) >= len(utf8BOM) || sc.eof) {
+		sc.bomChecked = true
+		if bytes.HasPrefix(sc.s.buf, utf8BOM) {
+			sc.start = len(utf8BOM)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestStatementScanner(t *testing.T) {
+	strict := MySQLOptions
+	strict.Strict = true
+	unterminated := PostgresOptions
+	unterminated.RejectUnterminated = true
+	strictUnterminated := MySQLOptions
+	strictUnterminated.RejectUnterminated = true
+	stripped := MySQLOptions
+	stripped.StripComments = true
+
+	testcases := []struct {
+		name  string
+		query string
+		opts  SplitOptions
+	}{
+		{name: "empty", query: "", opts: GenericOptions},
+		{name: "multiple", query: ";;SELECT 1; SELECT 2;\r\nSELECT 3", opts: GenericOptions},
+		{name: "quotes", query: "SELECT 'a;b', \"c;d\", `e;f`; SELECT 'it''s;'", opts: GenericOptions},
+		{name: "byte order mark", query: "\xef\xbb\xbfSELECT 1;\nSELECT 2;\n", opts: GenericOptions},
+		{name: "comments", query: "-- a;\nSELECT 1; # b;\n/* c; */ SELECT 2 -- d\n;", opts: stripped},
+		{name: "delimiter", query: "DELIMITER $$\nCREATE PROCEDURE p() BEGIN SELECT 1; END$$\nDELIMITER ;\nSELECT 2;", opts: MySQLOptions},
+		{name: "repeated delimiters", query: "DELIMITER $$\nCREATE PROCEDURE p() BEGIN SELECT 1; END$$\nDELIMITER ;\nSELECT 2;\n" +
+			"DELIMITER //\nCREATE PROCEDURE q() BEGIN SELECT 3; END//\nDELIMITER ;\nSELECT 4; SELECT 5", opts: MySQLOptions},
+		{name: "compound", query: "CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW BEGIN IF 1 THEN SELECT 1; END IF; END; SELECT 2", opts: MySQLOptions},
+		{name: "unbalanced", query: "SELECT 1;\nCREATE PROCEDURE p() BEGIN SELECT 1; END; END; SELECT 2", opts: strict},
+		{name: "dollar quotes", query: "CREATE FUNCTION f() AS $x$ SELECT 1; $x$;\nSELECT E'\\';'", opts: PostgresOptions},
+		{name: "unterminated", query: "SELECT 1;\n\nSELECT 'a;\n", opts: unterminated},
+		{name: "crlf", query: "SELECT 1;\r\n\r\nSELECT 'a;\r\n", opts: unterminated},
+		{name: "crlf delimiter", query: "DELIMITER $$\r\nSELECT 1$$\r\nDELIMITER ;\r\nSELECT 2;\r\nSELECT 'a;", opts: strictUnterminated},
+	}
+
+	for _, tc := range testcases {
+		expected, expectedErr := SplitQueryOpts([]byte(tc.query), tc.opts)
+
+		for _, chunkSize := range []int{1, 2, 3, 7, 64 * 1024} {
+			t.Run(fmt.Sprintf("%v/%v", tc.name, chunkSize), func(t *testing.T) {
+				defer func(size int) { scanChunkSize = size }(scanChunkSize)
+				scanChunkSize = chunkSize
+
+				scanner := NewStatementScanner(iotest.OneByteReader(strings.NewReader(tc.query)), tc.opts)
+				stmts := make([]string, 0)
+				for scanner.Scan() {
+					stmts = append(stmts, string(scanner.Statement()))
+				}
+
+				if !reflect.DeepEqual(scanner.Err(), expectedErr) {
+					t.Fatalf("expected error %v, got %v", expectedErr, scanner.Err())
+				}
+				if expectedErr == nil && !reflect.DeepEqual(stmts, toStrings(expected)) {
+					t.Errorf("expected %q, got %q", toStrings(expected), stmts)
+				}
+			})
+		}
+	}
+}
+
+func TestStatementScannerReadError(t *testing.T) {
+	r := iotest.TimeoutReader(bytes.NewReader(bytes.Repeat([]byte("SELECT 1;"), scanChunkSize)))
+	scanner := NewStatementScanner(r, GenericOptions)
+
+	n := 0
+	for scanner.Scan() {
+		n++
+	}
+	if scanner.Err() != iotest.ErrTimeout {
+		t.Fatalf("expected %v, got %v", iotest.ErrTimeout, scanner.Err())
+	}
+	if n == 0 {
+		t.Fatal("expected the statements read before the error")
+	}
+}
@@ -0,0 +1,681 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// utf8BOM is the byte order mark some editors put in front of UTF-8 files.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+var defaultDelimiter = []byte(";")
+
+// SplitError is returned when a migration can't be split into statements.
+type SplitError struct {
+	// Line is the line number the offending construct started in.
+	Line uint
+
+	// Offset is the byte offset the offending construct started at,
+	// counted from the start of the migration.
+	Offset int
+
+	// Err is a useful/helping error message for humans
+	Err string
+}
+
+func (e SplitError) Error() string {
+	return fmt.Sprintf("%v in line %v (byte %v)", e.Err, e.Line, e.Offset)
+}
+
+// Dialect selects the SQL dialect specific rules used to split a migration.
+type Dialect int
+
+const (
+	// GenericDialect knows about single quotes, double quotes, backticks
+	// and `--` and `/* */` comments. `#` isn't a comment, since Postgres
+	// uses it in operators like `#>>`.
+	GenericDialect Dialect = iota
+
+	// MySQLDialect adds backslash escapes in strings and
+	// `-- `, `#` and `/* */` comments.
+	MySQLDialect
+
+	// PostgresDialect adds dollar quotes, escape string constants (E'...')
+	// and `--` and `/* */` comments. Backticks are not quotes.
+	PostgresDialect
+)
+
+// SplitOptions configures how SplitQueryOpts splits a migration.
+type SplitOptions struct {
+	Dialect Dialect
+
+	// AnsiQuotes treats double quotes as identifier quotes, like MySQL's
+	// ANSI_QUOTES SQL mode does, so backslashes don't escape inside them.
+	AnsiQuotes bool
+
+	// StripComments removes comments from the statements. MySQL's executable
+	// comments (/*! ... */) and optimizer hints (/*+ ... */) are kept.
+	StripComments bool
+
+	// AttachLeadingComments keeps the comments preceding a statement as part
+	// of that statement when comments are stripped, so annotations like
+	// "-- this will lock the table" show up in logs and error output.
+	// Comments after the last statement are still dropped.
+	AttachLeadingComments bool
+
+	// CustomDelimiters honors the `DELIMITER` directive of the MySQL client,
+	// which changes the statement delimiter from `;` to something else.
+	// A migration may switch it any number of times, each directive holds
+	// until the next one, and BEGIN ... END bodies are only recognized
+	// while the delimiter is `;`. The directives are not part of the
+	// returned statements.
+	CustomDelimiters bool
+
+	// CompoundStatements recognizes CREATE TRIGGER, PROCEDURE, FUNCTION and
+	// EVENT statements with a BEGIN ... END body that weren't wrapped in a
+	// DELIMITER directive, so that semicolons inside the body don't split it.
+	// This is a heuristic: if the BEGIN/END nesting can't be resolved, the
+	// statement is split on every semicolon instead.
+	CompoundStatements bool
+
+	// Strict returns a SplitError instead of falling back to a best effort
+	// split when the migration can't be split reliably.
+	Strict bool
+
+	// RejectUnterminated returns a SplitError naming the line a quoted
+	// string, quoted identifier, block comment or dollar quote was opened
+	// in if the migration ends before it is closed. Otherwise the rest of
+	// the migration is treated as part of it.
+	RejectUnterminated bool
+}
+
+var (
+	// GenericOptions are used by SplitQuery. They honor DELIMITER
+	// directives, since no statement starts with DELIMITER in any dialect.
+	GenericOptions = SplitOptions{Dialect: GenericDialect, CustomDelimiters: true}
+
+	// MySQLOptions split migrations the way the mysql command line client would.
+	MySQLOptions = SplitOptions{Dialect: MySQLDialect, CustomDelimiters: true, CompoundStatements: true}
+
+	// PostgresOptions split migrations the way psql would.
+	PostgresOptions = SplitOptions{Dialect: PostgresDialect}
+)
+
+// SplitQuery splits a migration into its statements. Statements are
+// separated by semicolons, semicolons inside quoted strings, identifiers
+// and comments are ignored. A `DELIMITER x` line of the MySQL client, e.g. DELIMITER $$
+// or DELIMITER //, makes x the separator until the next directive, so that
+// stored procedures and triggers aren't split inside their body. The
+// directives aren't returned. Leading and trailing whitespace is removed
+// and empty statements are skipped. A leading UTF-8 byte order mark is dropped.
+// SplitQuery uses GenericOptions, see SplitQueryOpts for dialect support.
+func SplitQuery(buf []byte) [][]byte {
+	stmts, _ := SplitQueryOpts(buf, GenericOptions)
+	return stmts
+}
+
+// SplitQueryOpts splits a migration into its statements like SplitQuery,
+// applying the given options. Statements consisting of comments only are
+// skipped. An error is only returned if opts.Strict or
+// opts.RejectUnterminated is set.
+func SplitQueryOpts(buf []byte, opts SplitOptions) ([][]byte, error) {
+	return (&splitter{buf: buf, opts: opts}).split()
+}
+
+// SplitQueryStrict splits a migration like SplitQuery, but returns a
+// SplitError with the line and byte offset of a quoted string, quoted
+// identifier or comment that isn't closed, instead of treating the rest of
+// the migration as part of it. See SplitOptions.RejectUnterminated.
+func SplitQueryStrict(buf []byte) ([][]byte, error) {
+	opts := GenericOptions
+	opts.Strict = true
+	opts.RejectUnterminated = true
+	return SplitQueryOpts(buf, opts)
+}
+
+// SplitMySQLQuery splits a migration using MySQLOptions.
+// If strict is true, a SplitError is returned if the nesting of a
+// compound statement can't be resolved.
+func SplitMySQLQuery(buf []byte, strict bool) ([][]byte, error) {
+	opts := MySQLOptions
+	opts.Strict = strict
+	return SplitQueryOpts(buf, opts)
+}
+
+type splitter struct {
+	buf   []byte
+	opts  SplitOptions
+	delim []byte
+
+	// lines and offset are the number of lines and bytes in front of buf,
+	// if a StatementScanner dropped them.
+	lines  uint
+	offset int
+
+	// class classifies bytes for the active delimiter, see setDelimiter.
+	class [256]byteClass
+}
+
+// byteClass lets the splitter skip most bytes with a table lookup.
+type byteClass uint8
+
+const (
+	// classOther is punctuation and any other byte without a meaning.
+	classOther byteClass = iota
+	classSpace
+	classWord
+
+	// classSpecial bytes may start a delimiter, a quote or a comment.
+	// They are looked at closely.
+	classSpecial
+)
+
+// setDelimiter makes delim the active delimiter and updates s.class.
+func (s *splitter) setDelimiter(delim []byte) {
+	s.delim = delim
+	for c := 0; c < len(s.class); c++ {
+		switch b := byte(c); {
+		case b == delim[0], b == '\'', b == '"', b == '`', b == '$', b == '#', b == '-', b == '/':
+			s.class[c] = classSpecial
+		case isWordByte(b):
+			s.class[c] = classWord
+		case isSpace(b):
+			s.class[c] = classSpace
+		default:
+			s.class[c] = classOther
+		}
+	}
+}
+
+// span is a statement found by the splitter.
+type span struct {
+	// start and end of the statement, end is the offset of the delimiter.
+	start, end int
+
+	// next is the offset right after the delimiter.
+	next int
+
+	// content is true if the statement consists of more than whitespace and comments.
+	content bool
+
+	// comments holds the start and end offsets of the comments in the statement.
+	// Only collected if comments are stripped.
+	comments [][2]int
+}
+
+func (s *splitter) split() ([][]byte, error) {
+	// delimiters in quotes and comments are counted, too, but the
+	// estimate saves growing the slice over and over for large migrations
+	stmts := make([][]byte, 0, bytes.Count(s.buf, defaultDelimiter)+1)
+	s.setDelimiter(defaultDelimiter)
+
+	start := 0
+	if bytes.HasPrefix(s.buf, utf8BOM) {
+		start = len(utf8BOM)
+	}
+
+	for start < len(s.buf) {
+		st, _, err := s.next(start, true)
+		if err != nil {
+			return nil, err
+		}
+		if stmt := s.bytes(st); len(stmt) > 0 {
+			stmts = append(stmts, stmt)
+		}
+		start = st.next
+	}
+	return stmts, nil
+}
+
+// next returns the statement or DELIMITER directive starting at offset
+// start. Directives are returned as spans without content. If final is
+// false, more input may follow buf, and ok is false if the statement might
+// continue past the end of buf.
+func (s *splitter) next(start int, final bool) (st span, ok bool, err error) {
+	if s.opts.CustomDelimiters {
+		delim := s.delim
+		if end, found := s.delimiterDirective(start); found {
+			if end == len(s.buf) && !final {
+				// the rest of the line might be missing
+				s.setDelimiter(delim)
+				return span{}, false, nil
+			}
+			return span{start: start, end: end, next: end}, true, nil
+		}
+	}
+
+	compound := s.opts.CompoundStatements && bytes.Equal(s.delim, defaultDelimiter)
+	st, err = s.statement(start, compound)
+	if !final && (err != nil || st.next == len(s.buf)) {
+		return span{}, false, nil
+	}
+	if err != nil {
+		if s.opts.Strict {
+			return st, true, err
+		}
+		if st, err = s.statement(start, false); err != nil {
+			return st, true, err
+		}
+	}
+	return st, true, nil
+}
+
+// bytes returns the statement's bytes, without surrounding whitespace.
+func (s *splitter) bytes(st span) []byte {
+	if !st.content {
+		return nil
+	}
+	if !s.opts.StripComments || len(st.comments) == 0 {
+		return bytes.TrimSpace(s.buf[st.start:st.end])
+	}
+
+	stmt := make([]byte, 0, st.end-st.start)
+	i := st.start
+	for _, c := range st.comments {
+		stmt = append(stmt, s.buf[i:c[0]]...)
+		if s.buf[c[1]-1] == '\n' || s.buf[c[1]-1] == '\r' {
+			// keep the line break terminating a line comment
+			stmt = append(stmt, s.buf[c[1]-1])
+		} else {
+			stmt = append(stmt, ' ')
+		}
+		i = c[1]
+	}
+	stmt = append(stmt, s.buf[i:st.end]...)
+	return bytes.TrimSpace(stmt)
+}
+
+// delimiterDirective checks for a `DELIMITER x` line at the start of the
+// statement starting at offset start. If found, it changes the active
+// delimiter and returns the offset right after the directive.
+func (s *splitter) delimiterDirective(start int) (int, bool) {
+	word, i := s.nextWord(start)
+	if !bytes.EqualFold(word, []byte("DELIMITER")) || i == len(s.buf) || (s.buf[i] != ' ' && s.buf[i] != '\t') {
+		return 0, false
+	}
+
+	end := len(s.buf)
+	if eol := bytes.IndexAny(s.buf[i:], "\r\n"); eol >= 0 {
+		end = i + eol
+	}
+
+	delim := bytes.TrimSpace(s.buf[i:end])
+	if len(delim) == 0 {
+		return 0, false
+	}
+	// copied, a StatementScanner reuses buf
+	s.setDelimiter(append([]byte(nil), delim...))
+	return end, true
+}
+
+// statement returns the statement starting at offset start.
+// If compound is true, delimiters inside BEGIN ... END blocks of compound
+// statements don't terminate the statement.
+func (s *splitter) statement(start int, compound bool) (span, error) {
+	st := span{start: start}
+	detect := compound // still looking for CREATE ... TRIGGER|PROCEDURE|FUNCTION|EVENT
+	isCompound := false
+	depth := 0
+	opened := start // offset of the outermost BEGIN
+	words := 0
+	var prev byte // last significant byte that isn't part of a word
+
+	for i := start; i < len(s.buf); {
+		c := s.buf[i]
+
+		// fast path for bytes that can't start anything
+		switch s.class[c] {
+		case classSpace:
+			i++
+			continue
+		case classOther:
+			prev = c
+			i++
+			st.content = true
+			continue
+		case classWord:
+			if !detect && !isCompound {
+				// the words don't matter, skip them in one go
+				for i++; i < len(s.buf) && s.class[s.buf[i]] == classWord; i++ {
+				}
+				prev = 0
+				words++
+				st.content = true
+				continue
+			}
+		}
+
+		switch {
+		case s.atDelimiter(i) && depth == 0:
+			st.end = i
+			st.next = i + len(s.delim)
+			return st, nil
+
+		case c == '\'' || c == '"' || (c == '`' && s.opts.Dialect != PostgresDialect):
+			end, ok := s.skipQuoted(i)
+			if !ok && s.opts.RejectUnterminated {
+				return st, s.unterminated(i)
+			}
+			i = end
+			prev = c
+			st.content = true
+
+		case c == '$' && s.opts.Dialect == PostgresDialect && s.isDollarQuoteStart(i):
+			end, ok := s.skipDollarQuoted(i)
+			if !ok && s.opts.RejectUnterminated {
+				return st, s.unterminated(i)
+			}
+			i = end
+			prev = c
+			st.content = true
+
+		case s.isCommentStart(i):
+			end, ok := s.skipComment(i)
+			if !ok && s.opts.RejectUnterminated {
+				return st, s.unterminated(i)
+			}
+			if s.isExecutableComment(i) {
+				st.content = true
+			} else if s.opts.StripComments && (st.content || !s.opts.AttachLeadingComments) {
+				st.comments = append(st.comments, [2]int{i, end})
+			}
+			i = end
+
+		case isWordByte(c):
+			j := s.wordEnd(i)
+			words++
+			st.content = true
+
+			// only compound statements need to look at the words
+			var word []byte
+			if isCompound || (detect && words > 1) {
+				word = bytes.ToUpper(s.buf[i:j])
+			}
+
+			switch {
+			case detect:
+				// CREATE [DEFINER = user] [OR REPLACE] [AGGREGATE] TRIGGER|PROCEDURE|FUNCTION|EVENT
+				switch {
+				case words == 1:
+					detect = bytes.EqualFold(s.buf[i:j], []byte("CREATE"))
+				case prev == '=' || prev == '@':
+					// value of DEFINER
+				case isCompoundKind(word):
+					detect = false
+					isCompound = true
+				case !isCompoundModifier(word):
+					detect = false
+				}
+
+			case isCompound && prev != '.':
+				switch string(word) {
+				case "BEGIN", "CASE":
+					if depth == 0 {
+						opened = i
+					}
+					depth++
+				case "END":
+					next, k := s.nextWord(j)
+					switch string(bytes.ToUpper(next)) {
+					case "IF", "LOOP", "WHILE", "REPEAT":
+						// closes a block that doesn't count towards depth
+						j = k
+					case "CASE":
+						depth--
+						j = k
+					default:
+						depth--
+					}
+					if depth < 0 {
+						return st, s.errorAt(i, "unbalanced END in compound statement, use DELIMITER")
+					}
+				}
+			}
+
+			prev = 0
+			i = j
+
+		case isSpace(c):
+			i++
+
+		default:
+			prev = c
+			i++
+			st.content = true
+		}
+	}
+
+	if depth > 0 {
+		return st, s.errorAt(opened, "unterminated BEGIN in compound statement, use DELIMITER")
+	}
+	st.end = len(s.buf)
+	st.next = len(s.buf)
+	return st, nil
+}
+
+// atDelimiter returns true if the active delimiter starts at offset i.
+func (s *splitter) atDelimiter(i int) bool {
+	return s.buf[i] == s.delim[0] && bytes.HasPrefix(s.buf[i:], s.delim)
+}
+
+// unterminated returns the SplitError for the unterminated construct
+// starting at offset i.
+func (s *splitter) unterminated(i int) SplitError {
+	var what string
+	switch c := s.buf[i]; {
+	case c == '\'':
+		what = "unterminated quoted string"
+	case c == '"' && (s.opts.Dialect == PostgresDialect || s.opts.AnsiQuotes):
+		what = "unterminated quoted identifier"
+	case c == '"':
+		what = "unterminated double quoted string"
+	case c == '`':
+		what = "unterminated quoted identifier"
+	case c == '$':
+		tag, _ := s.dollarQuoteTag(i)
+		what = fmt.Sprintf("unterminated dollar quoted string %s", tag)
+	default:
+		what = "unterminated comment"
+	}
+	return s.errorAt(i, what)
+}
+
+// errorAt returns a SplitError for the construct starting at offset i.
+func (s *splitter) errorAt(i int, msg string) SplitError {
+	return SplitError{Line: s.line(i), Offset: s.offset + i, Err: msg}
+}
+
+// skipQuoted returns the offset right after the quoted string or identifier
+// starting at offset i. ok is false if the migration ends before the quote
+// is closed.
+func (s *splitter) skipQuoted(i int) (end int, ok bool) {
+	start := i
+	q := s.buf[i]
+	escapes := false
+	switch s.opts.Dialect {
+	case MySQLDialect:
+		escapes = q == '\'' || (q == '"' && !s.opts.AnsiQuotes)
+	case PostgresDialect:
+		// E'...' escape string constant
+		escapes = q == '\'' && i > 0 && (s.buf[i-1] == 'E' || s.buf[i-1] == 'e') && (i < 2 || !isWordByte(s.buf[i-2]))
+	}
+
+	// most strings are short, look at the first bytes one by one
+	for i++; i < len(s.buf) && i < start+32; i++ {
+		switch s.buf[i] {
+		case '\\':
+			if escapes {
+				i++
+			}
+		case q:
+			return i + 1, true
+		}
+	}
+
+	for i < len(s.buf) {
+		end := bytes.IndexByte(s.buf[i:], q)
+		if end < 0 {
+			break
+		}
+		if escapes {
+			if esc := bytes.IndexByte(s.buf[i:i+end], '\\'); esc >= 0 {
+				// skip the escaped byte and look again
+				i += esc + 2
+				continue
+			}
+		}
+		return i + end + 1, true
+	}
+	return len(s.buf), false
+}
+
+// isDollarQuoteStart returns true if a dollar quote ($$ or $tag$) starts at offset i.
+func (s *splitter) isDollarQuoteStart(i int) bool {
+	if i > 0 && isWordByte(s.buf[i-1]) {
+		return false
+	}
+	_, ok := s.dollarQuoteTag(i)
+	return ok
+}
+
+// dollarQuoteTag returns the dollar quote tag starting at offset i,
+// including both dollar signs.
+func (s *splitter) dollarQuoteTag(i int) ([]byte, bool) {
+	for j := i + 1; j < len(s.buf); j++ {
+		c := s.buf[j]
+		switch {
+		case c == '$':
+			return s.buf[i : j+1], true
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= 0x80:
+		case c >= '0' && c <= '9' && j > i+1:
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// skipDollarQuoted returns the offset right after the dollar quoted string
+// starting at offset i. ok is false if the migration ends before the
+// closing tag.
+func (s *splitter) skipDollarQuoted(i int) (end int, ok bool) {
+	tag, _ := s.dollarQuoteTag(i)
+	if end := bytes.Index(s.buf[i+len(tag):], tag); end >= 0 {
+		return i + len(tag) + end + len(tag), true
+	}
+	return len(s.buf), false
+}
+
+func (s *splitter) isCommentStart(i int) bool {
+	switch s.buf[i] {
+	case '#':
+		return s.opts.Dialect == MySQLDialect
+	case '-':
+		if i+1 == len(s.buf) || s.buf[i+1] != '-' {
+			return false
+		}
+		switch s.opts.Dialect {
+		case MySQLDialect:
+			// MySQL requires whitespace after the second dash
+			return i+2 == len(s.buf) || isSpace(s.buf[i+2])
+		}
+		return true
+	case '/':
+		return i+1 < len(s.buf) && s.buf[i+1] == '*'
+	}
+	return false
+}
+
+// isExecutableComment returns true for MySQL's /*! ... */ and /*+ ... */
+// comments, which are executed by the server.
+func (s *splitter) isExecutableComment(i int) bool {
+	return s.opts.Dialect == MySQLDialect && s.buf[i] == '/' &&
+		i+2 < len(s.buf) && (s.buf[i+2] == '!' || s.buf[i+2] == '+')
+}
+
+// skipComment returns the offset right after the comment starting at offset i.
+// ok is false if the migration ends inside a block comment.
+func (s *splitter) skipComment(i int) (end int, ok bool) {
+	if s.buf[i] == '/' {
+		if end := bytes.Index(s.buf[i+2:], []byte("*/")); end >= 0 {
+			return i + 2 + end + 2, true
+		}
+		return len(s.buf), false
+	}
+	if end := bytes.IndexAny(s.buf[i:], "\r\n"); end >= 0 {
+		return i + end + 1, true
+	}
+	return len(s.buf), true
+}
+
+// wordEnd returns the offset right after the word starting at offset i.
+// A delimiter ends the word.
+func (s *splitter) wordEnd(i int) int {
+	for ; i < len(s.buf); i++ {
+		switch s.class[s.buf[i]] {
+		case classWord:
+		case classSpecial:
+			if !isWordByte(s.buf[i]) || s.atDelimiter(i) {
+				return i
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// nextWord returns the next word after offset i and the offset right after it.
+// Only whitespace and comments may precede the word, which is returned as is.
+func (s *splitter) nextWord(i int) ([]byte, int) {
+	for i < len(s.buf) {
+		c := s.buf[i]
+		switch {
+		case isSpace(c):
+			i++
+		case s.isCommentStart(i):
+			i, _ = s.skipComment(i)
+		case isWordByte(c):
+			j := s.wordEnd(i)
+			return s.buf[i:j], j
+		default:
+			return nil, i
+		}
+	}
+	return nil, i
+}
+
+// line returns the line number of offset i.
+// Lines may end in \n, \r\n or \r.
+func (s *splitter) line(i int) uint {
+	return s.lines + countLines(s.buf[:i]) + 1
+}
+
+// countLines returns the number of line breaks in b.
+func countLines(b []byte) uint {
+	return uint(bytes.Count(b, []byte("\n")) + bytes.Count(b, []byte("\r")) - bytes.Count(b, []byte("\r\n")))
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$' || c >= 0x80
+}
+
+func isCompoundKind(word []byte) bool {
+	switch string(word) {
+	case "TRIGGER", "PROCEDURE", "FUNCTION", "EVENT":
+		return true
+	}
+	return false
+}
+
+func isCompoundModifier(word []byte) bool {
+	switch string(word) {
+	case "DEFINER", "OR", "REPLACE", "AGGREGATE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,407 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSplitQuery(t *testing.T) {
+	testcases := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{name: "empty", query: "", expected: []string{}},
+		{name: "single", query: "SELECT 1", expected: []string{"SELECT 1"}},
+		{name: "trailing semicolon", query: "SELECT 1;\n", expected: []string{"SELECT 1"}},
+		{name: "multiple", query: "SELECT 1; SELECT 2;\nSELECT 3",
+			expected: []string{"SELECT 1", "SELECT 2", "SELECT 3"}},
+		{name: "empty statements", query: ";;SELECT 1;; ;", expected: []string{"SELECT 1"}},
+		{name: "single quotes", query: "INSERT INTO t VALUES ('a;b'); SELECT 1",
+			expected: []string{"INSERT INTO t VALUES ('a;b')", "SELECT 1"}},
+		{name: "double quotes", query: `SELECT "a;b"; SELECT 1`,
+			expected: []string{`SELECT "a;b"`, "SELECT 1"}},
+		{name: "backticks", query: "SELECT `a;b` FROM t; SELECT 1",
+			expected: []string{"SELECT `a;b` FROM t", "SELECT 1"}},
+		{name: "doubled quotes", query: "SELECT 'it''s;'; SELECT 1",
+			expected: []string{"SELECT 'it''s;'", "SELECT 1"}},
+		{name: "byte order mark", query: "\xef\xbb\xbfSELECT 1;\nSELECT 2;\n",
+			expected: []string{"SELECT 1", "SELECT 2"}},
+		{name: "crlf", query: "SELECT 1;\r\n\r\n;\r\nSELECT 2;\r\n",
+			expected: []string{"SELECT 1", "SELECT 2"}},
+		{name: "mixed line endings", query: "\xef\xbb\xbfSELECT 1;\r\nSELECT\r2;\nSELECT 3;\r",
+			expected: []string{"SELECT 1", "SELECT\r2", "SELECT 3"}},
+		{name: "carriage return before semicolon", query: "SELECT 1\r\n;\r\nSELECT 2 \r;\r",
+			expected: []string{"SELECT 1", "SELECT 2"}},
+		{name: "line comment", query: "-- drop; table\nSELECT 1; SELECT 2 -- a;b\n",
+			expected: []string{"-- drop; table\nSELECT 1", "SELECT 2 -- a;b"}},
+		{name: "hash operator", query: "SELECT data #>> '{a}' FROM t;\nUPDATE t SET x = 1;",
+			expected: []string{"SELECT data #>> '{a}' FROM t", "UPDATE t SET x = 1"}},
+		{name: "block comment", query: "SELECT /* a;\nb */ 1; /* c; 'd */ SELECT 2",
+			expected: []string{"SELECT /* a;\nb */ 1", "/* c; 'd */ SELECT 2"}},
+		{name: "comment only statement", query: "SELECT 1;\n-- e;f\n",
+			expected: []string{"SELECT 1"}},
+		{name: "comment markers in quotes", query: "SELECT '--', \"/*\"; SELECT '#'",
+			expected: []string{"SELECT '--', \"/*\"", "SELECT '#'"}},
+		{name: "procedure with $$ delimiter",
+			query:    "DELIMITER $$\nCREATE PROCEDURE p()\nBEGIN\n  INSERT INTO t VALUES ('a$$b');\n  SELECT 1;\nEND$$\nDELIMITER ;\nSELECT 2;",
+			expected: []string{"CREATE PROCEDURE p()\nBEGIN\n  INSERT INTO t VALUES ('a$$b');\n  SELECT 1;\nEND", "SELECT 2"}},
+		{name: "procedure with // delimiter",
+			query:    "SELECT 1;\ndelimiter //\nCREATE PROCEDURE p()\nBEGIN\n  SELECT 'http://x';\n  SELECT 2;\nEND //\nDELIMITER ;\nSELECT 3;",
+			expected: []string{"SELECT 1", "CREATE PROCEDURE p()\nBEGIN\n  SELECT 'http://x';\n  SELECT 2;\nEND", "SELECT 3"}},
+		{name: "delimiter not restored", query: "DELIMITER $$\nCREATE PROCEDURE p() BEGIN SELECT 1; END$$\nSELECT 2; SELECT 3$$",
+			expected: []string{"CREATE PROCEDURE p() BEGIN SELECT 1; END", "SELECT 2; SELECT 3"}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if stmts := SplitQuery([]byte(tc.query)); !reflect.DeepEqual(toStrings(stmts), tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, toStrings(stmts))
+			}
+		})
+	}
+}
+
+func TestSplitMySQLQuery(t *testing.T) {
+	trigger := "CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW\nBEGIN\n" +
+		"  IF NEW.a < 0 THEN\n    SET NEW.a = 0;\n  END IF;\n" +
+		"  SET NEW.b = CASE WHEN NEW.a > 10 THEN 'big;' ELSE 'small' END;\nEND"
+
+	procedure := "CREATE DEFINER=`root`@`localhost` PROCEDURE p()\nBEGIN\n" +
+		"  DECLARE i INT DEFAULT 0;\n  WHILE i < 10 DO\n    BEGIN\n      SET i = i + 1;\n    END;\n  END WHILE;\n" +
+		"  CASE i\n    WHEN 10 THEN SELECT 1;\n    ELSE SELECT 2;\n  END CASE;\nEND"
+
+	testcases := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{name: "plain", query: "SELECT 1; SELECT 2", expected: []string{"SELECT 1", "SELECT 2"}},
+		{name: "comments", query: "SELECT 1; -- a;b\n# c;d\nSELECT /* e;f */ 2",
+			expected: []string{"SELECT 1", "-- a;b\n# c;d\nSELECT /* e;f */ 2"}},
+		{name: "backslash escape", query: `SELECT 'a\';b'; SELECT 1`,
+			expected: []string{`SELECT 'a\';b'`, "SELECT 1"}},
+		{name: "transaction", query: "BEGIN; SELECT 1; COMMIT",
+			expected: []string{"BEGIN", "SELECT 1", "COMMIT"}},
+		{name: "trigger", query: "SELECT 1;\n" + trigger + ";\nSELECT 2;",
+			expected: []string{"SELECT 1", trigger, "SELECT 2"}},
+		{name: "procedure", query: procedure + ";\nSELECT 2",
+			expected: []string{procedure, "SELECT 2"}},
+		{name: "trigger without body", query: "CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW SET NEW.a = 1; SELECT 1",
+			expected: []string{"CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW SET NEW.a = 1", "SELECT 1"}},
+		{name: "not a compound statement", query: "CREATE TABLE t (begin INT); SELECT 1",
+			expected: []string{"CREATE TABLE t (begin INT)", "SELECT 1"}},
+		{name: "crlf comments", query: "-- a;b\r\nSELECT 1;\r-- c;d\rSELECT 2;\r\n",
+			expected: []string{"-- a;b\r\nSELECT 1", "-- c;d\rSELECT 2"}},
+		{name: "unresolved falls back", query: "CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2",
+			expected: []string{"CREATE PROCEDURE p() BEGIN SELECT 1", "SELECT 2"}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			stmts, err := SplitMySQLQuery([]byte(tc.query), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(toStrings(stmts), tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, toStrings(stmts))
+			}
+		})
+	}
+}
+
+func TestSplitMySQLQueryStrict(t *testing.T) {
+	testcases := []struct {
+		name  string
+		query string
+		line  uint
+	}{
+		{name: "unterminated BEGIN", query: "SELECT 1;\nCREATE PROCEDURE p()\nBEGIN\nSELECT 1;", line: 3},
+		{name: "unbalanced END", query: "CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW\nSET NEW.a = 1 END;", line: 2},
+		{name: "crlf", query: "SELECT 1;\r\nCREATE PROCEDURE p()\r\nBEGIN\r\nSELECT 1;", line: 3},
+		{name: "mixed line endings", query: "\xef\xbb\xbfSELECT 1;\rSELECT 2;\r\nCREATE PROCEDURE p()\nBEGIN\nSELECT 1;", line: 4},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := SplitMySQLQuery([]byte(tc.query), true)
+			e, ok := err.(SplitError)
+			if !ok {
+				t.Fatalf("expected SplitError, got %v", err)
+			}
+			if e.Line != tc.line {
+				t.Errorf("expected line %v, got %v", tc.line, e.Line)
+			}
+		})
+	}
+}
+
+func TestSplitQueryOpts(t *testing.T) {
+	ansiQuotes := MySQLOptions
+	ansiQuotes.AnsiQuotes = true
+
+	stripComments := MySQLOptions
+	stripComments.StripComments = true
+
+	genericStripComments := GenericOptions
+	genericStripComments.StripComments = true
+
+	attachComments := stripComments
+	attachComments.AttachLeadingComments = true
+
+	procedure := "CREATE PROCEDURE p()\nBEGIN\n  SELECT 1;\n  SELECT 2;\nEND"
+
+	testcases := []struct {
+		name     string
+		opts     SplitOptions
+		query    string
+		expected []string
+	}{
+		{name: "generic comments", opts: GenericOptions, query: "-- a;b\nSELECT 1; /* e;f */ SELECT 2; -- g;h\n",
+			expected: []string{"-- a;b\nSELECT 1", "/* e;f */ SELECT 2"}},
+		{name: "generic strip comments", opts: genericStripComments, query: "-- a;b\nSELECT /* c;d */ 1; -- e\n",
+			expected: []string{"SELECT   1"}},
+		{name: "comment only statements", opts: MySQLOptions, query: "SELECT 1; -- a\n/* b */;\n# c",
+			expected: []string{"SELECT 1"}},
+		{name: "ansi quotes", opts: ansiQuotes, query: `SELECT "a\"; SELECT 1`,
+			expected: []string{`SELECT "a\"`, "SELECT 1"}},
+		{name: "mysql double quote escapes", opts: MySQLOptions, query: `SELECT "a\"; b"; SELECT 1`,
+			expected: []string{`SELECT "a\"; b"`, "SELECT 1"}},
+		{name: "strip comments", opts: stripComments, query: "-- a\nSELECT 1 # b\nFROM t /* c */ WHERE 1; /* d */",
+			expected: []string{"SELECT 1 \nFROM t   WHERE 1"}},
+		{name: "keep executable comments", opts: stripComments, query: "/*!40101 SET NAMES utf8 */; SELECT /*+ NO_ICP(t) */ 1",
+			expected: []string{"/*!40101 SET NAMES utf8 */", "SELECT /*+ NO_ICP(t) */ 1"}},
+		{name: "attach leading comments", opts: attachComments,
+			query:    "-- this will lock the table\n-- for a while\nALTER TABLE t /* x */ ADD c INT; # one\n/* two */ SELECT 1;\n-- trailing\n",
+			expected: []string{"-- this will lock the table\n-- for a while\nALTER TABLE t   ADD c INT", "# one\n/* two */ SELECT 1"}},
+		{name: "attach leading comments trailing", opts: attachComments, query: "SELECT 1; -- a;b\n# c",
+			expected: []string{"SELECT 1"}},
+		{name: "delimiter", opts: MySQLOptions, query: "DELIMITER $$\n" + procedure + "$$\nDELIMITER ;\nSELECT 3;",
+			expected: []string{procedure, "SELECT 3"}},
+		{name: "repeated delimiter blocks", opts: MySQLOptions,
+			query: "DELIMITER $$\n" + procedure + "$$\nDELIMITER ;\nSELECT 3;\n" +
+				"DELIMITER //\nCREATE PROCEDURE q()\nBEGIN\n  SELECT 4;\nEND //\nDELIMITER ;\n" +
+				"DELIMITER $$\nCREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW SET NEW.a = 1$$\nDELIMITER ;\nSELECT 5; SELECT 6",
+			expected: []string{procedure, "SELECT 3", "CREATE PROCEDURE q()\nBEGIN\n  SELECT 4;\nEND",
+				"CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW SET NEW.a = 1", "SELECT 5", "SELECT 6"}},
+		{name: "delimiter glued to word", opts: MySQLOptions, query: "delimiter //\nSELECT 1//SELECT 2 //\nDELIMITER ;\nSELECT 3",
+			expected: []string{"SELECT 1", "SELECT 2", "SELECT 3"}},
+		{name: "crlf delimiter", opts: MySQLOptions,
+			query:    "DELIMITER $$\r\nCREATE PROCEDURE p()\r\nBEGIN\r\n  SELECT 1;\r\nEND $$\r\n\r\nDELIMITER ;\r\nSELECT 2;\r\n",
+			expected: []string{"CREATE PROCEDURE p()\r\nBEGIN\r\n  SELECT 1;\r\nEND", "SELECT 2"}},
+		{name: "cr delimiter", opts: MySQLOptions, query: "DELIMITER //\rSELECT 1 //\rDELIMITER ;\rSELECT 2;\r",
+			expected: []string{"SELECT 1", "SELECT 2"}},
+		{name: "crlf compound statement", opts: MySQLOptions, query: "CREATE PROCEDURE p()\r\nBEGIN\r\n  SELECT 1;\r\nEND;\r\nSELECT 2;\r\n",
+			expected: []string{"CREATE PROCEDURE p()\r\nBEGIN\r\n  SELECT 1;\r\nEND", "SELECT 2"}},
+		{name: "postgres dollar quotes", opts: PostgresOptions,
+			query:    "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql; SELECT $tag$ ; $$ ; $tag$; SELECT $1",
+			expected: []string{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", "SELECT $tag$ ; $$ ; $tag$", "SELECT $1"}},
+		{name: "postgres escape strings", opts: PostgresOptions, query: `SELECT E'a\';b'; SELECT 'c\'; SELECT 1`,
+			expected: []string{`SELECT E'a\';b'`, `SELECT 'c\'`, "SELECT 1"}},
+		{name: "postgres backticks", opts: PostgresOptions, query: "SELECT '`'; SELECT 1",
+			expected: []string{"SELECT '`'", "SELECT 1"}},
+		{name: "postgres comments", opts: PostgresOptions, query: "--a;b\nSELECT 1; /* c; */ SELECT 2",
+			expected: []string{"--a;b\nSELECT 1", "/* c; */ SELECT 2"}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			stmts, err := SplitQueryOpts([]byte(tc.query), tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(toStrings(stmts), tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, toStrings(stmts))
+			}
+		})
+	}
+}
+
+func TestSplitQueryUnterminated(t *testing.T) {
+	testcases := []struct {
+		name    string
+		opts    SplitOptions
+		query   string
+		line    uint
+		offset  int
+		message string
+	}{
+		{name: "single quote", opts: GenericOptions, query: "SELECT 1;\nSELECT 'a;\nSELECT 2;",
+			line: 2, offset: 17, message: "unterminated quoted string"},
+		{name: "escaped quote", opts: MySQLOptions, query: "SELECT 1;\r\nSELECT 'a\\';\r\nSELECT 2;",
+			line: 2, offset: 18, message: "unterminated quoted string"},
+		{name: "double quote", opts: MySQLOptions, query: "SELECT \"a;",
+			line: 1, offset: 7, message: "unterminated double quoted string"},
+		{name: "postgres identifier", opts: PostgresOptions, query: "SELECT 1;\nSELECT \"a;",
+			line: 2, offset: 17, message: "unterminated quoted identifier"},
+		{name: "backtick", opts: MySQLOptions, query: "SELECT `a;",
+			line: 1, offset: 7, message: "unterminated quoted identifier"},
+		{name: "block comment", opts: PostgresOptions, query: "SELECT 1;\n\n/* a;\nSELECT 2;",
+			line: 3, offset: 11, message: "unterminated comment"},
+		{name: "dollar quote", opts: PostgresOptions, query: "CREATE FUNCTION f() AS $body$\nSELECT 1; $$;",
+			line: 1, offset: 23, message: "unterminated dollar quoted string $body$"},
+		{name: "compound statement", opts: MySQLOptions, query: "CREATE PROCEDURE p()\nBEGIN\nSELECT 'a;\nEND;",
+			line: 3, offset: 34, message: "unterminated quoted string"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := SplitQueryOpts([]byte(tc.query), tc.opts); err != nil {
+				t.Fatalf("expected no error without RejectUnterminated, got %v", err)
+			}
+
+			tc.opts.RejectUnterminated = true
+			_, err := SplitQueryOpts([]byte(tc.query), tc.opts)
+			e, ok := err.(SplitError)
+			if !ok {
+				t.Fatalf("expected SplitError, got %v", err)
+			}
+			if e.Line != tc.line || e.Offset != tc.offset || e.Err != tc.message {
+				t.Errorf("expected %q in line %v at byte %v, got %q in line %v at byte %v",
+					tc.message, tc.line, tc.offset, e.Err, e.Line, e.Offset)
+			}
+		})
+	}
+}
+
+func TestSplitQueryStrict(t *testing.T) {
+	query := "INSERT INTO users VALUES (1, 'bob');\nINSERT INTO users VALUES (2, 'alice);\nSELECT 1;"
+	if stmts := SplitQuery([]byte(query)); len(stmts) != 2 {
+		t.Fatalf("expected the rest of the migration to be quoted, got %q", toStrings(stmts))
+	}
+
+	_, err := SplitQueryStrict([]byte(query))
+	e, ok := err.(SplitError)
+	if !ok {
+		t.Fatalf("expected SplitError, got %v", err)
+	}
+	if e.Line != 2 || e.Offset != 66 || e.Err != "unterminated quoted string" {
+		t.Errorf("expected an unterminated quoted string in line 2 at byte 66, got %v", e)
+	}
+	if e.Error() != "unterminated quoted string in line 2 (byte 66)" {
+		t.Errorf("unexpected message %q", e.Error())
+	}
+
+	stmts, err := SplitQueryStrict([]byte("SELECT 'a;b'; SELECT 2"))
+	if err != nil || len(stmts) != 2 {
+		t.Errorf("expected 2 statements, got %q (%v)", toStrings(stmts), err)
+	}
+}
+
+func TestSplitQueryTerminated(t *testing.T) {
+	opts := MySQLOptions
+	opts.RejectUnterminated = true
+	stmts, err := SplitQueryOpts([]byte("SELECT 'a'; -- don't\nSELECT `b`; /* c */"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != 2 {
+		t.Errorf("expected 2 statements, got %q", toStrings(stmts))
+	}
+}
+
+func FuzzSplitQueryOpts(f *testing.F) {
+	f.Add([]byte("SELECT 1; SELECT 'a;b'"), uint8(0))
+	f.Add([]byte("DELIMITER $$\nCREATE PROCEDURE p() BEGIN SELECT 1; END$$\nDELIMITER ;"), uint8(1))
+	f.Add([]byte("CREATE FUNCTION f() AS $x$ SELECT 1; $x$; SELECT E'\\''"), uint8(2))
+	f.Add([]byte("\xef\xbb\xbf-- a\r/* b */ # c\n`d"), uint8(0xff))
+	f.Add([]byte("DELIMITER \nDELIMITER ;;\nSELECT 1;;;"), uint8(0x31))
+
+	f.Fuzz(func(t *testing.T, buf []byte, flags uint8) {
+		opts := SplitOptions{
+			Dialect:               Dialect(flags % 3),
+			AnsiQuotes:            flags&0x04 != 0,
+			StripComments:         flags&0x08 != 0,
+			CustomDelimiters:      flags&0x10 != 0,
+			CompoundStatements:    flags&0x20 != 0,
+			Strict:                flags&0x40 != 0,
+			RejectUnterminated:    flags&0x80 != 0,
+			AttachLeadingComments: flags&0x02 != 0,
+		}
+
+		stmts, err := SplitQueryOpts(buf, opts)
+		if err != nil {
+			if _, ok := err.(SplitError); !ok {
+				t.Fatalf("expected SplitError, got %T", err)
+			}
+			return
+		}
+		for _, stmt := range stmts {
+			if len(stmt) == 0 {
+				t.Fatal("expected no empty statements")
+			}
+			ClassifyStatement(stmt, opts.Dialect)
+		}
+	})
+}
+
+func toStrings(stmts [][]byte) []string {
+	strs := make([]string, 0, len(stmts))
+	for _, s := range stmts {
+		strs = append(strs, string(s))
+	}
+	return strs
+}
+
+// benchmarkMigration generates a migration of about size bytes with
+// statements of about stmtSize bytes. Quoted strings contain semicolons
+// and every tenth statement has a comment.
+func benchmarkMigration(size, stmtSize int) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, size+stmtSize))
+	for n := 0; buf.Len() < size; n++ {
+		if n%10 == 0 {
+			fmt.Fprintf(buf, "-- statement %d\n", n)
+		}
+		fmt.Fprintf(buf, "INSERT INTO users (id, name, note) VALUES (%d, 'user %d', 'a; b')", n, n)
+		for rowStart := buf.Len(); buf.Len()-rowStart < stmtSize; n++ {
+			fmt.Fprintf(buf, ", (%d, \"user %d\", /* note */ 'it''s; here')", n, n)
+		}
+		buf.WriteString(";\n")
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkSplitQuery(b *testing.B) {
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{name: "1MB", size: 1 << 20},
+		{name: "10MB", size: 10 << 20},
+		{name: "100MB", size: 100 << 20},
+	}
+	stmtSizes := []struct {
+		name string
+		size int
+	}{
+		{name: "100B", size: 100},
+		{name: "10KB", size: 10 << 10},
+	}
+	dialects := []struct {
+		name string
+		opts SplitOptions
+	}{
+		{name: "generic", opts: GenericOptions},
+		{name: "mysql", opts: MySQLOptions},
+	}
+
+	for _, size := range sizes {
+		for _, stmtSize := range stmtSizes {
+			migr := benchmarkMigration(size.size, stmtSize.size)
+			for _, dialect := range dialects {
+				b.Run(size.name+"/"+stmtSize.name+"/"+dialect.name, func(b *testing.B) {
+					b.SetBytes(int64(len(migr)))
+					b.ReportAllocs()
+					b.ResetTimer()
+					for n := 0; n < b.N; n++ {
+						if _, err := SplitQueryOpts(migr, dialect.opts); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"io"
 	"io/ioutil"
 	"reflect"
+	"sort"
+	"sync"
 
 	"github.com/golang-migrate/migrate/database"
 )
@@ -20,8 +22,15 @@ type Stub struct {
 	LastRunMigration  []byte // todo: make []string
 	IsDirty           bool
 	IsLocked          bool
+	History           map[int]bool   // version -> dirty
+	DeployIDs         map[int]string // version -> deploy id
 
 	Config *Config
+
+	// mu guards the version, lock state and history, so that they can be
+	// read while migrations run, and parallel migrations can record their
+	// versions.
+	mu sync.Mutex
 }
 
 func (s *Stub) Open(url string) (database.Driver, error) {
@@ -49,6 +58,8 @@ func (s *Stub) Close() error {
 }
 
 func (s *Stub) Lock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.IsLocked {
 		return database.ErrLocked
 	}
@@ -57,6 +68,8 @@ func (s *Stub) Lock() error {
 }
 
 func (s *Stub) Unlock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.IsLocked = false
 	return nil
 }
@@ -72,24 +85,120 @@ func (s *Stub) Run(migration io.Reader) error {
 }
 
 func (s *Stub) SetVersion(version int, state bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.CurrentVersion = version
 	s.IsDirty = state
 	return nil
 }
 
 func (s *Stub) Version() (version int, dirty bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.CurrentVersion, s.IsDirty, nil
 }
 
 const DROP = "DROP"
 
 func (s *Stub) Drop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.CurrentVersion = -1
 	s.LastRunMigration = nil
+	s.History = nil
+	s.DeployIDs = nil
 	s.MigrationSequence = append(s.MigrationSequence, DROP)
 	return nil
 }
 
+func (s *Stub) FindVersion(version int) (database.HistoryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dirty, ok := s.History[version]
+	if !ok {
+		return database.HistoryEntry{}, database.ErrVersionNotFound
+	}
+	return database.HistoryEntry{Version: version, Dirty: dirty, DeployID: s.DeployIDs[version]}, nil
+}
+
+func (s *Stub) UpsertVersion(version int, dirty bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.History == nil {
+		s.History = make(map[int]bool)
+	}
+	s.History[version] = dirty
+	return nil
+}
+
+func (s *Stub) DeleteVersion(version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.History, version)
+	delete(s.DeployIDs, version)
+	return nil
+}
+
+func (s *Stub) ListVersions(offset, limit int) ([]database.HistoryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := make([]int, 0, len(s.History))
+	for v := range s.History {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(versions) {
+		offset = len(versions)
+	}
+	versions = versions[offset:]
+	if limit > 0 && limit < len(versions) {
+		versions = versions[:limit]
+	}
+
+	entries := make([]database.HistoryEntry, 0, len(versions))
+	for _, v := range versions {
+		entries = append(entries, database.HistoryEntry{Version: v, Dirty: s.History[v], DeployID: s.DeployIDs[v]})
+	}
+	return entries, nil
+}
+
+func (s *Stub) RunBatchTagged(migrations []io.Reader, versions []int, deployID string) error {
+	if len(migrations) != len(versions) {
+		return database.ErrBatchMismatch
+	}
+	for i, migration := range migrations {
+		s.UpsertVersion(versions[i], true)
+		s.mu.Lock()
+		if s.DeployIDs == nil {
+			s.DeployIDs = make(map[int]string)
+		}
+		s.DeployIDs[versions[i]] = deployID
+		s.mu.Unlock()
+		s.SetVersion(versions[i], true)
+		if err := s.Run(migration); err != nil {
+			return err
+		}
+		s.SetVersion(versions[i], false)
+		s.UpsertVersion(versions[i], false)
+	}
+	return nil
+}
+
+func (s *Stub) VersionsByDeploy(deployID string) ([]int, error) {
+	versions := make([]int, 0)
+	for v, id := range s.DeployIDs {
+		if id == deployID {
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
 func (s *Stub) EqualSequence(seq []string) bool {
 	return reflect.DeepEqual(seq, s.MigrationSequence)
 }
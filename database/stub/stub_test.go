@@ -13,4 +13,6 @@ func Test(t *testing.T) {
 		t.Fatal(err)
 	}
 	dt.Test(t, d, []byte("/* foobar migration */"))
+	dt.TestHistory(t, d)
+	dt.TestDeployTagger(t, d, []byte("/* foobar migration */"))
 }
@@ -0,0 +1,8 @@
+package database
+
+// TableLister is an optional interface a database driver can implement to
+// list the tables of the database, e.g. for migrate.AutoBaseline.
+type TableLister interface {
+	// ListTables returns the names of the tables in the database, sorted.
+	ListTables() ([]string, error)
+}
@@ -0,0 +1,87 @@
+package testing
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/golang-migrate/migrate/database"
+)
+
+// hugeMigration has 1000 statements of about 1KB each.
+var hugeMigration = []byte(strings.Repeat("SELECT '"+strings.Repeat("x", 1000)+"';\n", 1000))
+
+// Benchmark runs the standard benchmarks against d, so that drivers and
+// their options report comparable numbers. Each benchmark starts from an
+// unlocked driver and reports allocations. The migrations are plain SELECT
+// statements, so they don't depend on the schema and the numbers show the
+// overhead of the driver rather than the work of the server. For numbers
+// stable enough to track in CI, run them against a server of its own with
+// -count and compare them with benchstat.
+func Benchmark(b *testing.B, d database.Driver) {
+	b.Run("TinyMigration", func(b *testing.B) { BenchmarkTinyMigration(b, d) })
+	b.Run("HugeMigration", func(b *testing.B) { BenchmarkHugeMigration(b, d) })
+	b.Run("VersionRoundTrip", func(b *testing.B) { BenchmarkVersionRoundTrip(b, d) })
+	b.Run("LockAndUnlock", func(b *testing.B) { BenchmarkLockAndUnlock(b, d) })
+}
+
+// BenchmarkTinyMigration applies a migration of a single statement per
+// operation, with the version bookkeeping migrate does around it, so that
+// ns/op is the overhead of a migration.
+func BenchmarkTinyMigration(b *testing.B, d database.Driver) {
+	migration := []byte("SELECT 1")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.SetVersion(i+1, true); err != nil {
+			b.Fatal(err)
+		}
+		if err := d.Run(bytes.NewReader(migration)); err != nil {
+			b.Fatal(err)
+		}
+		if err := d.SetVersion(i+1, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkHugeMigration runs a migration of 1000 statements and about 1MB
+// per operation, e.g. to compare the ways a driver splits and sends them.
+func BenchmarkHugeMigration(b *testing.B, d database.Driver) {
+	b.SetBytes(int64(len(hugeMigration)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.Run(bytes.NewReader(hugeMigration)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkVersionRoundTrip writes and reads the version per operation.
+func BenchmarkVersionRoundTrip(b *testing.B, d database.Driver) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.SetVersion(i+1, false); err != nil {
+			b.Fatal(err)
+		}
+		if v, _, err := d.Version(); err != nil || v != i+1 {
+			b.Fatalf("expected version %v, got %v (%v)", i+1, v, err)
+		}
+	}
+}
+
+// BenchmarkLockAndUnlock acquires and releases the lock per operation.
+func BenchmarkLockAndUnlock(b *testing.B, d database.Driver) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.Lock(); err != nil {
+			b.Fatal(err)
+		}
+		if err := d.Unlock(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package testing
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/golang-migrate/migrate/database"
+)
+
+// TestHistory runs tests against drivers implementing
+// database.VersionHistory. Drivers opt in by calling it from their tests,
+// like Test, with a driver whose history is empty:
+//
+//	dt.Test(t, d, []byte("SELECT 1"))
+//	dt.TestHistory(t, d)
+//
+// The history is dropped afterwards.
+func TestHistory(t *testing.T, d database.Driver) {
+	h, ok := d.(database.VersionHistory)
+	if !ok {
+		t.Fatalf("%T doesn't implement database.VersionHistory", d)
+	}
+
+	testFindVersionEmpty(t, h)
+	testUpsertVersion(t, h)
+	testDeleteVersion(t, h)
+	testListVersions(t, h)
+	testHistoryAfterDrop(t, d, h)
+}
+
+func testFindVersionEmpty(t *testing.T, h database.VersionHistory) {
+	if _, err := h.FindVersion(1); err != database.ErrVersionNotFound {
+		t.Fatalf("FindVersion: expected ErrVersionNotFound, got %v", err)
+	}
+
+	entries, err := h.ListVersions(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("ListVersions: expected no entries, got %v", entries)
+	}
+}
+
+func testUpsertVersion(t *testing.T, h database.VersionHistory) {
+	// upserting twice is the same as once
+	for i := 0; i < 2; i++ {
+		if err := h.UpsertVersion(1, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectEntry(t, h, 1, true)
+
+	entries, err := h.ListVersions(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("ListVersions: expected 1 entry after upserting twice, got %v", entries)
+	}
+
+	// dirty -> clean -> dirty
+	if err := h.UpsertVersion(1, false); err != nil {
+		t.Fatal(err)
+	}
+	expectEntry(t, h, 1, false)
+
+	if err := h.UpsertVersion(1, true); err != nil {
+		t.Fatal(err)
+	}
+	expectEntry(t, h, 1, true)
+}
+
+func testDeleteVersion(t *testing.T, h database.VersionHistory) {
+	if err := h.DeleteVersion(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.FindVersion(1); err != database.ErrVersionNotFound {
+		t.Fatalf("FindVersion: expected ErrVersionNotFound after delete, got %v", err)
+	}
+
+	// deleting again is no error
+	if err := h.DeleteVersion(1); err != nil {
+		t.Fatalf("DeleteVersion: expected no error for a missing version, got %v", err)
+	}
+}
+
+func testListVersions(t *testing.T, h database.VersionHistory) {
+	// insert out of order, ListVersions sorts
+	for _, v := range []int{3, 1, 5, 2, 4} {
+		if err := h.UpsertVersion(v, v == 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testcases := []struct {
+		offset   int
+		limit    int
+		expected []int
+	}{
+		{offset: 0, limit: 0, expected: []int{1, 2, 3, 4, 5}},
+		{offset: 0, limit: 2, expected: []int{1, 2}},
+		{offset: 2, limit: 2, expected: []int{3, 4}},
+		{offset: 4, limit: 2, expected: []int{5}},
+		{offset: 5, limit: 2, expected: []int{}},
+		{offset: 3, limit: 0, expected: []int{4, 5}},
+	}
+
+	for _, tc := range testcases {
+		entries, err := h.ListVersions(tc.offset, tc.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions := make([]int, 0, len(entries))
+		for _, e := range entries {
+			versions = append(versions, e.Version)
+			if e.Dirty != (e.Version == 5) {
+				t.Errorf("ListVersions: unexpected dirty flag %v for version %v", e.Dirty, e.Version)
+			}
+		}
+		if !equalVersions(versions, tc.expected) {
+			t.Errorf("ListVersions(%v, %v): expected %v, got %v", tc.offset, tc.limit, tc.expected, versions)
+		}
+	}
+}
+
+func testHistoryAfterDrop(t *testing.T, d database.Driver, h database.VersionHistory) {
+	if err := d.Drop(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := h.ListVersions(0, 0)
+	if err != nil {
+		t.Fatalf("ListVersions: expected no error after Drop, got %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("ListVersions: expected no entries after Drop, got %v", entries)
+	}
+	if _, err := h.FindVersion(5); err != database.ErrVersionNotFound {
+		t.Fatalf("FindVersion: expected ErrVersionNotFound after Drop, got %v", err)
+	}
+}
+
+// TestDeployTagger runs tests against drivers implementing
+// database.DeployTagger, with a driver whose history is empty. The
+// migration is run once for every version. The history is dropped
+// afterwards.
+func TestDeployTagger(t *testing.T, d database.Driver, migration []byte) {
+	dtg, ok := d.(database.DeployTagger)
+	if !ok {
+		t.Fatalf("%T doesn't implement database.DeployTagger", d)
+	}
+	h, ok := d.(database.VersionHistory)
+	if !ok {
+		t.Fatalf("%T doesn't implement database.VersionHistory", d)
+	}
+
+	migrations := func(n int) []io.Reader {
+		readers := make([]io.Reader, n)
+		for i := range readers {
+			readers[i] = bytes.NewReader(migration)
+		}
+		return readers
+	}
+
+	if err := dtg.RunBatchTagged(migrations(2), []int{1}, "mismatch"); err != database.ErrBatchMismatch {
+		t.Fatalf("RunBatchTagged: expected ErrBatchMismatch, got %v", err)
+	}
+
+	if err := dtg.RunBatchTagged(migrations(3), []int{10, 11, 12}, "deploy-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dtg.RunBatchTagged(migrations(2), []int{13, 14}, "deploy-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	version, dirty, err := d.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 14 || dirty {
+		t.Fatalf("Version: expected version 14 (dirty false), got %v (dirty %v)", version, dirty)
+	}
+
+	testcases := []struct {
+		deployID string
+		expected []int
+	}{
+		{deployID: "deploy-1", expected: []int{10, 11, 12}},
+		{deployID: "deploy-2", expected: []int{13, 14}},
+		{deployID: "unknown", expected: []int{}},
+	}
+	for _, tc := range testcases {
+		versions, err := dtg.VersionsByDeploy(tc.deployID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalVersions(versions, tc.expected) {
+			t.Errorf("VersionsByDeploy(%q): expected %v, got %v", tc.deployID, tc.expected, versions)
+		}
+	}
+
+	e, err := h.FindVersion(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Dirty || e.DeployID != "deploy-1" {
+		t.Errorf("FindVersion: expected version 11 of deploy-1 (dirty false), got %+v", e)
+	}
+
+	if err := d.Drop(); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := dtg.VersionsByDeploy("deploy-1")
+	if err != nil {
+		t.Fatalf("VersionsByDeploy: expected no error after Drop, got %v", err)
+	}
+	if len(versions) != 0 {
+		t.Fatalf("VersionsByDeploy: expected no versions after Drop, got %v", versions)
+	}
+}
+
+func expectEntry(t *testing.T, h database.VersionHistory, version int, dirty bool) {
+	e, err := h.FindVersion(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Version != version || e.Dirty != dirty {
+		t.Fatalf("FindVersion: expected version %v (dirty %v), got %v (dirty %v)", version, dirty, e.Version, e.Dirty)
+	}
+}
+
+func equalVersions(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
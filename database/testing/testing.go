@@ -1,5 +1,8 @@
 // Package testing has the database tests.
 // All database drivers must pass the Test function.
+// Drivers implementing database.VersionHistory must pass TestHistory, too,
+// drivers implementing database.DeployTagger TestDeployTagger.
+// Benchmark reports comparable numbers for any driver.
 // This lives in it's own package so it stays a test dependency.
 package testing
 
@@ -1,15 +1,58 @@
 package database
 
 import (
+	"bytes"
 	"fmt"
 	"hash/crc32"
+	"hash/fnv"
+	"strconv"
 )
 
 const advisoryLockIdSalt uint = 1486364155
 
 // GenerateAdvisoryLockId inspired by rails migrations, see https://goo.gl/8o9bCT
-func GenerateAdvisoryLockId(databaseName string) (string, error) {
-	sum := crc32.ChecksumIEEE([]byte(databaseName))
+// Use additionalNames to derive the lock id from further components, like the
+// schema or the migrations table name, instead of concatenating them yourself.
+// Each component is length-prefixed, so ("ab", "c") and ("a", "bc") can't be
+// confused. Without additionalNames the id only depends on databaseName.
+//
+// The id is a 32-bit value, formatted as a decimal string. Since multiplying
+// with the (odd) salt is a bijection modulo 2^32, ids collide exactly when the
+// CRC-32 checksums of the names do, which becomes likely (50%) at around 77,000
+// distinct names. Prefer GenerateAdvisoryLockId64 for new drivers; this
+// function is kept as is, so that existing drivers keep locking the same id.
+func GenerateAdvisoryLockId(databaseName string, additionalNames ...string) (string, error) {
+	sum := crc32.ChecksumIEEE(lockName(append([]string{databaseName}, additionalNames...)))
 	sum = sum * uint32(advisoryLockIdSalt)
 	return fmt.Sprintf("%v", sum), nil
 }
+
+// GenerateAdvisoryLockId64 returns a 64-bit advisory lock id for names,
+// suitable for databases taking a bigint lock key, like Postgres.
+// Names are length-prefixed like in GenerateAdvisoryLockId and hashed with
+// FNV-1a, which makes a collision likely (50%) only at around 5 billion
+// distinct names. At least one name must be given.
+func GenerateAdvisoryLockId64(names ...string) (int64, error) {
+	if len(names) == 0 {
+		return 0, fmt.Errorf("advisory lock id: no names given")
+	}
+
+	h := fnv.New64a()
+	h.Write(lockName(names))
+	return int64(h.Sum64() * uint64(advisoryLockIdSalt)), nil
+}
+
+// lockName encodes names unambiguously. A single name is used as is.
+func lockName(names []string) []byte {
+	if len(names) == 1 {
+		return []byte(names[0])
+	}
+
+	var b bytes.Buffer
+	for _, n := range names {
+		b.WriteString(strconv.Itoa(len(n)))
+		b.WriteByte(':')
+		b.WriteString(n)
+	}
+	return b.Bytes()
+}
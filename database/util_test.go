@@ -1,20 +1,24 @@
 package database
 
 import (
+	"fmt"
 	"testing"
+	"testing/quick"
 )
 
 func TestGenerateAdvisoryLockId(t *testing.T) {
 	testcases := []struct {
-		dbname     string
-		expectedID string // empty string signifies that an error is expected
+		dbname          string
+		additionalNames []string
+		expectedID      string // empty string signifies that an error is expected
 	}{
 		{dbname: "database_name", expectedID: "1764327054"},
+		{dbname: "database_name", additionalNames: []string{"schema_name"}, expectedID: "166173730"},
 	}
 
 	for _, tc := range testcases {
 		t.Run(tc.dbname, func(t *testing.T) {
-			if id, err := GenerateAdvisoryLockId("database_name"); err == nil {
+			if id, err := GenerateAdvisoryLockId(tc.dbname, tc.additionalNames...); err == nil {
 				if id != tc.expectedID {
 					t.Error("Generated incorrect ID:", id, "!=", tc.expectedID)
 				}
@@ -26,3 +30,108 @@ func TestGenerateAdvisoryLockId(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateAdvisoryLockIdComponents(t *testing.T) {
+	id := func(names ...string) string {
+		s, err := GenerateAdvisoryLockId(names[0], names[1:]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if id("ab", "c") == id("a", "bc") {
+		t.Error(`("ab", "c") and ("a", "bc") generated the same ID`)
+	}
+	if id("a:b") == id("a", "b") {
+		t.Error(`("a:b") and ("a", "b") generated the same ID`)
+	}
+	if id("a", "b", "") == id("a", "b") {
+		t.Error(`("a", "b", "") and ("a", "b") generated the same ID`)
+	}
+
+	// splitting the same string at different positions never yields the same ID
+	differentSplits := func(s string, i, j uint8) bool {
+		if len(s) == 0 {
+			return true
+		}
+		a, b := int(i)%(len(s)+1), int(j)%(len(s)+1)
+		if a == b {
+			return true
+		}
+		return id(s[:a], s[a:]) != id(s[:b], s[b:])
+	}
+	if err := quick.Check(differentSplits, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGenerateAdvisoryLockId64(t *testing.T) {
+	id := func(names ...string) int64 {
+		aid, err := GenerateAdvisoryLockId64(names...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return aid
+	}
+
+	if id("database_name") != id("database_name") {
+		t.Error("expected the ID to be stable")
+	}
+	if id("database_name") == id("database_name", "schema_name") {
+		t.Error("expected additional names to change the ID")
+	}
+	if id("ab", "c") == id("a", "bc") {
+		t.Error(`("ab", "c") and ("a", "bc") generated the same ID`)
+	}
+
+	if _, err := GenerateAdvisoryLockId64(); err == nil {
+		t.Error("expected error without names")
+	}
+
+	// splitting the same string at different positions never yields the same ID
+	differentSplits := func(s string, i, j uint8) bool {
+		if len(s) == 0 {
+			return true
+		}
+		a, b := int(i)%(len(s)+1), int(j)%(len(s)+1)
+		if a == b {
+			return true
+		}
+		return id(s[:a], s[a:]) != id(s[:b], s[b:])
+	}
+	if err := quick.Check(differentSplits, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGenerateAdvisoryLockId64Collisions(t *testing.T) {
+	// the 64-bit ids are expected to stay collision free,
+	// the 32-bit collisions are logged for comparison.
+	const n = 200000
+	seen32 := make(map[string]bool, n)
+	seen64 := make(map[int64]bool, n)
+	collisions32 := 0
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("database_%d", i)
+
+		aid, err := GenerateAdvisoryLockId(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen32[aid] {
+			collisions32++
+		}
+		seen32[aid] = true
+
+		aid64, err := GenerateAdvisoryLockId64(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen64[aid64] {
+			t.Fatalf("unexpected 64-bit collision for %v", name)
+		}
+		seen64[aid64] = true
+	}
+	t.Logf("%v 32-bit collisions in %v names", collisions32, n)
+}
@@ -0,0 +1,144 @@
+package migrate
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// expvarMu guards expvarStates, which maps the prefixes passed to
+// PublishExpvar to the state their variables report.
+var (
+	expvarMu     sync.Mutex
+	expvarStates = make(map[string]*expvarState)
+)
+
+// expvarState is the migration state published by PublishExpvar.
+type expvarState struct {
+	mu              sync.Mutex
+	version         int
+	dirty           bool
+	appliedLastRun  int
+	lastRunDuration time.Duration
+	lastError       string
+}
+
+// PublishExpvar publishes the state of m as expvar variables, so that it's
+// served on /debug/vars. The variables are, prefixed with prefix:
+//
+//	version                    active migration version, -1 if none
+//	dirty                      whether the database is dirty
+//	applied_last_run           migrations applied by the last run
+//	last_run_duration_seconds  duration of the last run
+//	last_error                 error of the last run, empty if it succeeded
+//
+// They're updated after every run through m.Metrics; a collector set before
+// keeps receiving all events. Instances in one process need distinct
+// prefixes. Publishing again with the same prefix makes the variables report
+// the new instance.
+func PublishExpvar(m *Migrate, prefix string) {
+	state := &expvarState{version: -1}
+	if version, dirty, err := m.databaseDrv.Version(); err == nil {
+		state.version = version
+		state.dirty = dirty
+	}
+	m.Metrics = &expvarCollector{m: m, state: state, next: m.Metrics}
+
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if _, ok := expvarStates[prefix]; !ok {
+		publishExpvarVars(prefix)
+	}
+	expvarStates[prefix] = state
+}
+
+// publishExpvarVars publishes the variables reading the state of prefix.
+// expvar panics on duplicate names, so it must be called once per prefix.
+func publishExpvarVars(prefix string) {
+	read := func(f func(s *expvarState) interface{}) expvar.Func {
+		return func() interface{} {
+			expvarMu.Lock()
+			s := expvarStates[prefix]
+			expvarMu.Unlock()
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return f(s)
+		}
+	}
+
+	expvar.Publish(prefix+"version", read(func(s *expvarState) interface{} { return s.version }))
+	expvar.Publish(prefix+"dirty", read(func(s *expvarState) interface{} { return s.dirty }))
+	expvar.Publish(prefix+"applied_last_run", read(func(s *expvarState) interface{} { return s.appliedLastRun }))
+	expvar.Publish(prefix+"last_run_duration_seconds", read(func(s *expvarState) interface{} { return s.lastRunDuration.Seconds() }))
+	expvar.Publish(prefix+"last_error", read(func(s *expvarState) interface{} { return s.lastError }))
+}
+
+// expvarCollector updates an expvarState and passes all events on to next.
+type expvarCollector struct {
+	m     *Migrate
+	state *expvarState
+	next  MetricsCollector
+}
+
+// RunStarted implements MetricsCollector.
+func (c *expvarCollector) RunStarted() {
+	c.state.mu.Lock()
+	c.state.appliedLastRun = 0
+	c.state.mu.Unlock()
+
+	if c.next != nil {
+		c.next.RunStarted()
+	}
+}
+
+// RunFinished implements MetricsCollector.
+func (c *expvarCollector) RunFinished(version int, duration time.Duration) {
+	c.state.mu.Lock()
+	c.state.version = version
+	c.state.dirty = false
+	c.state.lastRunDuration = duration
+	c.state.lastError = ""
+	c.state.mu.Unlock()
+
+	if c.next != nil {
+		c.next.RunFinished(version, duration)
+	}
+}
+
+// RunFailed implements MetricsCollector.
+func (c *expvarCollector) RunFailed(err error, duration time.Duration) {
+	// the failed migration might have left the database dirty
+	version, dirty, verr := c.m.databaseDrv.Version()
+
+	c.state.mu.Lock()
+	if verr == nil {
+		c.state.version = version
+		c.state.dirty = dirty
+	}
+	c.state.lastRunDuration = duration
+	c.state.lastError = err.Error()
+	c.state.mu.Unlock()
+
+	if c.next != nil {
+		c.next.RunFailed(err, duration)
+	}
+}
+
+// LockAcquired implements MetricsCollector.
+func (c *expvarCollector) LockAcquired(wait time.Duration) {
+	if c.next != nil {
+		c.next.LockAcquired(wait)
+	}
+}
+
+// MigrationApplied implements MetricsCollector.
+func (c *expvarCollector) MigrationApplied(migr *Migration, duration time.Duration) {
+	c.state.mu.Lock()
+	c.state.appliedLastRun++
+	c.state.mu.Unlock()
+
+	if c.next != nil {
+		c.next.MigrationApplied(migr, duration)
+	}
+}
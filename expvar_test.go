@@ -0,0 +1,69 @@
+package migrate
+
+import (
+	"encoding/json"
+	"expvar"
+	"reflect"
+	"testing"
+
+	dStub "github.com/golang-migrate/migrate/database/stub"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+// expvarValues returns the values of the variables published with prefix.
+func expvarValues(t *testing.T, prefix string) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, name := range []string{"version", "dirty", "applied_last_run", "last_error"} {
+		v := expvar.Get(prefix + name)
+		if v == nil {
+			t.Fatalf("expected %v to be published", prefix+name)
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(v.String()), &value); err != nil {
+			t.Fatal(err)
+		}
+		values[name] = value
+	}
+	return values
+}
+
+func TestPublishExpvar(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	c := &recordingCollector{}
+	m.Metrics = c
+	PublishExpvar(m, "test_expvar.")
+
+	expected := map[string]interface{}{"version": -1.0, "dirty": false, "applied_last_run": 0.0, "last_error": ""}
+	if values := expvarValues(t, "test_expvar."); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+
+	if err := m.Steps(2); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{"version": 3.0, "dirty": false, "applied_last_run": 2.0, "last_error": ""}
+	if values := expvarValues(t, "test_expvar."); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+	if len(c.events) == 0 {
+		t.Error("expected the previous collector to receive events")
+	}
+
+	m.databaseDrv = &slowStub{Stub: m.databaseDrv.(*dStub.Stub), failures: 1}
+	if err := m.Steps(1); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	expected = map[string]interface{}{"version": 4.0, "dirty": true, "applied_last_run": 0.0, "last_error": "run failed"}
+	if values := expvarValues(t, "test_expvar."); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+
+	// publishing again replaces the instance
+	m2, _ := New("stub://", "stub://")
+	PublishExpvar(m2, "test_expvar.")
+	expected = map[string]interface{}{"version": -1.0, "dirty": false, "applied_last_run": 0.0, "last_error": ""}
+	if values := expvarValues(t, "test_expvar."); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+}
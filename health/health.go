@@ -0,0 +1,61 @@
+// Package health provides an HTTP handler reporting the migration state,
+// for readiness probes of services that migrate at startup.
+//
+//	http.Handle("/ready", health.Handler(m))
+//
+// The handler responds with a JSON object like
+//
+//	{"version": 7, "dirty": false, "pending": 0, "running": false, "last_error": ""}
+//
+// and status 200 once all migrations are applied cleanly, or 503 while
+// migrations run, are pending, failed or left the database dirty.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang-migrate/migrate"
+)
+
+// Response is the JSON body written by the handler.
+type Response struct {
+	// Version is the active migration version, -1 if there is none.
+	Version   int    `json:"version"`
+	Dirty     bool   `json:"dirty"`
+	Pending   int    `json:"pending"`
+	Running   bool   `json:"running"`
+	LastError string `json:"last_error"`
+}
+
+// Handler returns a handler reporting the state of m, see migrate.Status.
+// It doesn't take the migration lock.
+func Handler(m *migrate.Migrate) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := m.Status()
+
+		resp := Response{
+			Version: s.Version,
+			Dirty:   s.Dirty,
+			Pending: s.Pending,
+			Running: s.Running,
+		}
+		if s.LastError != nil {
+			resp.LastError = s.LastError.Error()
+		}
+		// the state can't be read, e.g. the database is unreachable
+		if err != nil {
+			resp.LastError = err.Error()
+		}
+
+		status := http.StatusOK
+		if err != nil || s.Dirty || s.Running || s.Pending > 0 || s.LastError != nil {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	})
+}
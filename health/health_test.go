@@ -0,0 +1,61 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-migrate/migrate"
+	dStub "github.com/golang-migrate/migrate/database/stub"
+	"github.com/golang-migrate/migrate/source"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+func TestHandler(t *testing.T) {
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+
+	sInst, _ := sStub.WithInstance(nil, &sStub.Config{})
+	sInst.(*sStub.Stub).Migrations = migrations
+	dbInst, _ := dStub.WithInstance(nil, &dStub.Config{})
+
+	m, err := migrate.NewWithInstance("stub", sInst, "stub", dbInst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(m)
+
+	check := func(expectedStatus int, expected Response) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+
+		if rec.Code != expectedStatus {
+			t.Errorf("expected status %v, got %v", expectedStatus, rec.Code)
+		}
+		var resp Response
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp != expected {
+			t.Errorf("expected %+v, got %+v", expected, resp)
+		}
+	}
+
+	check(http.StatusServiceUnavailable, Response{Version: -1, Pending: 2})
+
+	if err := m.Steps(1); err != nil {
+		t.Fatal(err)
+	}
+	check(http.StatusServiceUnavailable, Response{Version: 1, Pending: 1})
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	check(http.StatusOK, Response{Version: 2})
+
+	dbInst.(*dStub.Stub).IsDirty = true
+	check(http.StatusServiceUnavailable, Response{Version: 2, Dirty: true})
+}
@@ -0,0 +1,206 @@
+package migrate
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang-migrate/migrate/database"
+	"github.com/golang-migrate/migrate/source"
+)
+
+// History returns the applied migrations, oldest first. If the database
+// driver doesn't implement database.HistoryReader, only the current version
+// is returned. History is empty if no migration has been applied, yet.
+func (m *Migrate) History() ([]database.HistoryEntry, error) {
+	if hr, ok := m.databaseDrv.(database.HistoryReader); ok {
+		return hr.History()
+	}
+
+	v, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+	if v == database.NilVersion {
+		return []database.HistoryEntry{}, nil
+	}
+	return []database.HistoryEntry{{Version: v, Dirty: dirty}}, nil
+}
+
+// ErrNoAppliedAt is returned by TimeSinceLastMigration if the history
+// doesn't record when migrations were applied.
+var ErrNoAppliedAt = fmt.Errorf("history doesn't record when migrations were applied")
+
+// TimeSinceLastMigration returns how long ago the last migration was
+// applied, e.g. for a "last migrated 3 days ago" on a deploy dashboard. It
+// takes the latest AppliedAt of the History, so the database driver has to
+// implement database.HistoryReader and record it, ErrNoAppliedAt is returned
+// otherwise. ErrNilVersion is returned if no migration has been applied.
+func (m *Migrate) TimeSinceLastMigration() (time.Duration, error) {
+	history, err := m.History()
+	if err != nil {
+		return 0, err
+	}
+	if len(history) == 0 {
+		return 0, ErrNilVersion
+	}
+
+	var last time.Time
+	for _, e := range history {
+		if e.AppliedAt.After(last) {
+			last = e.AppliedAt
+		}
+	}
+	if last.IsZero() {
+		return 0, ErrNoAppliedAt
+	}
+	return time.Since(last), nil
+}
+
+// HistoryBetween returns the entries of the versions from from to to, both
+// included, ordered by version, e.g. for the release notes of a deploy. It
+// reads the History, or the versions of a database.VersionHistory if the
+// database driver doesn't implement database.HistoryReader. Entries only
+// carry the metadata the driver keeps. HistoryBetween is empty if no
+// version in the range has been applied.
+func (m *Migrate) HistoryBetween(from, to int) ([]database.HistoryEntry, error) {
+	var entries []database.HistoryEntry
+	var err error
+	_, reader := m.databaseDrv.(database.HistoryReader)
+	if vh, ok := m.databaseDrv.(database.VersionHistory); ok && !reader {
+		entries, err = vh.ListVersions(0, 0)
+	} else {
+		entries, err = m.History()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	between := make([]database.HistoryEntry, 0)
+	for _, e := range entries {
+		if e.Version >= from && e.Version <= to {
+			between = append(between, e)
+		}
+	}
+	sort.SliceStable(between, func(i, j int) bool { return between[i].Version < between[j].Version })
+	return between, nil
+}
+
+// DiffHistory compares the versions applied to a and b, e.g. staging and
+// production, see database.AppliedSet. It returns the versions only applied
+// to a and those only applied to b, both sorted.
+func DiffHistory(a, b database.Driver) (onlyA, onlyB []int, err error) {
+	appliedA, err := database.AppliedSet(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	appliedB, err := database.AppliedSet(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return missingFrom(appliedA, appliedB), missingFrom(appliedB, appliedA), nil
+}
+
+// recordDuration records how long running migr took if it's an up migration
+// with a body and the database driver implements database.DurationRecorder.
+func (m *Migrate) recordDuration(migr *Migration, d time.Duration) error {
+	recorder, ok := m.databaseDrv.(database.DurationRecorder)
+	if !ok || migr.Body == nil || migr.TargetVersion != int(migr.Version) {
+		return nil
+	}
+	return recorder.RecordDuration(migr.TargetVersion, d)
+}
+
+// AppliedWithoutSource returns the versions applied to the database that
+// sourceDrv has no migration for, sorted, e.g. after migrations were
+// squashed or their files deleted. These can't be migrated down, and the
+// schema likely drifted from the source. The applied versions are read like
+// database.AppliedSet.
+func (m *Migrate) AppliedWithoutSource(sourceDrv source.Driver) ([]int, error) {
+	applied, err := database.AppliedSet(m.databaseDrv)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[int]bool)
+	v, err := sourceDrv.First()
+	for ; err == nil; v, err = sourceDrv.Next(v) {
+		versions[int(v)] = true
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return missingFrom(applied, versions), nil
+}
+
+// missingFrom returns the sorted versions of set that other lacks.
+func missingFrom(set, other map[int]bool) []int {
+	missing := make([]int, 0)
+	for v := range set {
+		if !other[v] {
+			missing = append(missing, v)
+		}
+	}
+	sort.Ints(missing)
+	return missing
+}
+
+// ExportHistoryCSV writes the History as CSV to w, starting with a header row.
+// The columns are version and dirty, followed by applied_at, duration and
+// note if any entry has a value for them. applied_at uses RFC 3339.
+func (m *Migrate) ExportHistoryCSV(w io.Writer) error {
+	history, err := m.History()
+	if err != nil {
+		return err
+	}
+
+	var appliedAt, duration, note bool
+	for _, e := range history {
+		appliedAt = appliedAt || !e.AppliedAt.IsZero()
+		duration = duration || e.Duration != 0
+		note = note || len(e.Note) > 0
+	}
+
+	header := []string{"version", "dirty"}
+	if appliedAt {
+		header = append(header, "applied_at")
+	}
+	if duration {
+		header = append(header, "duration")
+	}
+	if note {
+		header = append(header, "note")
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, e := range history {
+		record := []string{strconv.Itoa(e.Version), strconv.FormatBool(e.Dirty)}
+		if appliedAt {
+			if e.AppliedAt.IsZero() {
+				record = append(record, "")
+			} else {
+				record = append(record, e.AppliedAt.UTC().Format(time.RFC3339))
+			}
+		}
+		if duration {
+			record = append(record, e.Duration.String())
+		}
+		if note {
+			record = append(record, e.Note)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
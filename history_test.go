@@ -0,0 +1,323 @@
+package migrate
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate/database"
+	dStub "github.com/golang-migrate/migrate/database/stub"
+	"github.com/golang-migrate/migrate/source"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+// historyStub adds a fixed history to the stub database driver.
+type historyStub struct {
+	*dStub.Stub
+	history []database.HistoryEntry
+}
+
+func (s *historyStub) History() ([]database.HistoryEntry, error) {
+	return s.history, nil
+}
+
+func TestExportHistoryCSV(t *testing.T) {
+	appliedAt := time.Date(2018, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	testcases := []struct {
+		name     string
+		history  []database.HistoryEntry
+		expected string
+	}{
+		{name: "empty", history: []database.HistoryEntry{}, expected: "version,dirty\n"},
+		{name: "version and dirty", history: []database.HistoryEntry{{Version: 1}, {Version: 3, Dirty: true}},
+			expected: "version,dirty\n1,false\n3,true\n"},
+		{name: "all columns", history: []database.HistoryEntry{
+			{Version: 1, AppliedAt: appliedAt, Duration: 1500 * time.Millisecond, Note: "create users, orders"},
+			{Version: 3, AppliedAt: appliedAt.Add(time.Hour), Duration: time.Second},
+		}, expected: "version,dirty,applied_at,duration,note\n" +
+			"1,false,2018-03-01T12:30:00Z,1.5s,\"create users, orders\"\n" +
+			"3,false,2018-03-01T13:30:00Z,1s,\n"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, _ := New("stub://", "stub://")
+			m.databaseDrv = &historyStub{Stub: m.databaseDrv.(*dStub.Stub), history: tc.history}
+
+			buf := &bytes.Buffer{}
+			if err := m.ExportHistoryCSV(buf); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tc.expected {
+				t.Errorf("expected\n%q\ngot\n%q", tc.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestExportHistoryCSVWithoutHistory(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	buf := &bytes.Buffer{}
+	if err := m.ExportHistoryCSV(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "version,dirty\n" {
+		t.Errorf("expected header only, got %q", buf.String())
+	}
+
+	if err := m.Steps(2); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := m.ExportHistoryCSV(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "version,dirty\n3,false\n" {
+		t.Errorf("expected current version only, got %q", buf.String())
+	}
+}
+
+// versionOnlyStub hides the history of the stub database driver.
+func TestTimeSinceLastMigration(t *testing.T) {
+	last := time.Now().Add(-3 * time.Hour)
+	m, _ := New("stub://", "stub://")
+	db := &historyStub{Stub: m.databaseDrv.(*dStub.Stub), history: []database.HistoryEntry{
+		{Version: 1, AppliedAt: last.Add(-24 * time.Hour)},
+		{Version: 3, AppliedAt: last},
+		{Version: 2, AppliedAt: last.Add(-time.Hour)},
+	}}
+	m.databaseDrv = db
+
+	since, err := m.TimeSinceLastMigration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since < 3*time.Hour || since > 3*time.Hour+time.Minute {
+		t.Errorf("expected about 3h, got %v", since)
+	}
+
+	db.history = []database.HistoryEntry{{Version: 1}}
+	if _, err := m.TimeSinceLastMigration(); err != ErrNoAppliedAt {
+		t.Errorf("expected ErrNoAppliedAt, got %v", err)
+	}
+
+	db.history = []database.HistoryEntry{}
+	if _, err := m.TimeSinceLastMigration(); err != ErrNilVersion {
+		t.Errorf("expected ErrNilVersion, got %v", err)
+	}
+
+	// without a HistoryReader, only the current version is known
+	m, _ = New("stub://", "stub://")
+	m.databaseDrv.SetVersion(1, false)
+	if _, err := m.TimeSinceLastMigration(); err != ErrNoAppliedAt {
+		t.Errorf("expected ErrNoAppliedAt, got %v", err)
+	}
+}
+
+func TestHistoryBetween(t *testing.T) {
+	appliedAt := time.Date(2018, 3, 1, 12, 30, 0, 0, time.UTC)
+	history := []database.HistoryEntry{
+		{Version: 1, AppliedAt: appliedAt},
+		{Version: 4, AppliedAt: appliedAt.Add(3 * time.Hour), Note: "add orders.total"},
+		{Version: 2, AppliedAt: appliedAt.Add(time.Hour), Note: "create orders"},
+		{Version: 3, AppliedAt: appliedAt.Add(2 * time.Hour), Dirty: true},
+		{Version: 6, AppliedAt: appliedAt.Add(4 * time.Hour)},
+	}
+	m, _ := New("stub://", "stub://")
+	m.databaseDrv = &historyStub{Stub: m.databaseDrv.(*dStub.Stub), history: history}
+
+	entries, err := m.HistoryBetween(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []database.HistoryEntry{history[2], history[3], history[1]}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %+v, got %+v", expected, entries)
+	}
+
+	entries, err = m.HistoryBetween(7, 9)
+	if err != nil || entries == nil || len(entries) != 0 {
+		t.Errorf("expected an empty slice, got %v (%v)", entries, err)
+	}
+
+	// the versions of a driver without a HistoryReader
+	db := &dStub.Stub{}
+	for _, v := range []int{1, 2, 3, 5} {
+		db.UpsertVersion(v, v == 5)
+	}
+	m.databaseDrv = db
+	entries, err = m.HistoryBetween(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []database.HistoryEntry{{Version: 2}, {Version: 3}, {Version: 5, Dirty: true}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %+v, got %+v", expected, entries)
+	}
+}
+
+type versionOnlyStub struct {
+	database.Driver
+}
+
+func TestDiffHistory(t *testing.T) {
+	staging := &dStub.Stub{}
+	prod := &dStub.Stub{}
+	for _, v := range []int{1, 2, 3, 5} {
+		staging.UpsertVersion(v, false)
+	}
+	for _, v := range []int{1, 3, 4, 6} {
+		prod.UpsertVersion(v, v == 6)
+	}
+
+	onlyStaging, onlyProd, err := DiffHistory(staging, prod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(onlyStaging, []int{2, 5}) {
+		t.Errorf("expected 2 and 5 only in staging, got %v", onlyStaging)
+	}
+	// the dirty version 6 counts as applied
+	if !reflect.DeepEqual(onlyProd, []int{4, 6}) {
+		t.Errorf("expected 4 and 6 only in prod, got %v", onlyProd)
+	}
+
+	onlyA, onlyB, err := DiffHistory(staging, staging)
+	if err != nil || len(onlyA) != 0 || len(onlyB) != 0 {
+		t.Errorf("expected no difference, got %v %v (%v)", onlyA, onlyB, err)
+	}
+
+	// without a history only the current version is known
+	current := &dStub.Stub{CurrentVersion: 3}
+	onlyA, onlyB, err = DiffHistory(versionOnlyStub{current}, prod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onlyA) != 0 || !reflect.DeepEqual(onlyB, []int{1, 4, 6}) {
+		t.Errorf("expected 1, 4 and 6 only in prod, got %v %v", onlyA, onlyB)
+	}
+}
+
+func TestAppliedWithoutSource(t *testing.T) {
+	migrations := source.NewMigrations()
+	for _, v := range []uint{1, 3, 5} {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: "CREATE"})
+	}
+	// 4 only has a down migration, which still counts
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Down, Identifier: "DROP"})
+	sInst, _ := sStub.WithInstance(nil, &sStub.Config{})
+	sInst.(*sStub.Stub).Migrations = migrations
+
+	m, _ := New("stub://", "stub://")
+	db := m.databaseDrv.(*dStub.Stub)
+	for _, v := range []int{6, 1, 2, 3, 4} {
+		db.UpsertVersion(v, v == 6)
+	}
+
+	missing, err := m.AppliedWithoutSource(sInst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(missing, []int{2, 6}) {
+		t.Errorf("expected 2 and 6 without a migration, got %v", missing)
+	}
+
+	empty, _ := sStub.WithInstance(nil, &sStub.Config{})
+	missing, err = m.AppliedWithoutSource(empty)
+	if err != nil || len(missing) != 5 {
+		t.Errorf("expected all versions without a migration in an empty source, got %v (%v)", missing, err)
+	}
+}
+
+func TestHistoryKept(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	db := &slowStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = db
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := database.AppliedSet(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(applied, map[int]bool{1: true, 3: true}) {
+		t.Errorf("expected 1 and 3 to be applied, got %v", applied)
+	}
+
+	// a failed migration leaves a dirty row
+	db.failures = 1
+	if err := m.Up(); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	_, missing, dirty, err := database.AllAppliedClean(db, []int{1, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 || !reflect.DeepEqual(dirty, []int{4}) {
+		t.Errorf("expected 4 to be dirty, got missing %v and dirty %v", missing, dirty)
+	}
+}
+
+// durationStub adds database.DurationRecorder to the stub database driver.
+// Migrations containing SLOW take 20ms to run.
+type durationStub struct {
+	*dStub.Stub
+	durations map[int]time.Duration
+}
+
+func (s *durationStub) Run(migration io.Reader) error {
+	b, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(b), "SLOW") {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return s.Stub.Run(bytes.NewReader(b))
+}
+
+func (s *durationStub) RecordDuration(version int, d time.Duration) error {
+	s.durations[version] = d
+	return nil
+}
+
+func TestRecordDuration(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "SLOW 1"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "SLOW DROP 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Down, Identifier: "DROP 3"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	db := &durationStub{Stub: m.databaseDrv.(*dStub.Stub), durations: make(map[int]time.Duration)}
+	m.databaseDrv = db
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// nothing for 3, which has no up migration
+	if len(db.durations) != 2 || db.durations[1] < 20*time.Millisecond || db.durations[2] >= 20*time.Millisecond {
+		t.Fatalf("expected the durations of 1 and 2, got %v", db.durations)
+	}
+
+	// down migrations don't record one
+	recorded := db.durations[1]
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.durations) != 2 || db.durations[1] != recorded {
+		t.Errorf("expected no durations for down migrations, got %v", db.durations)
+	}
+}
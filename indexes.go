@@ -0,0 +1,186 @@
+package migrate
+
+import (
+	"strings"
+
+	"github.com/golang-migrate/migrate/source"
+)
+
+// IndexChange is an index created by a pending up migration, see
+// PendingIndexes.
+type IndexChange struct {
+	Version uint
+	Table   string
+
+	// Index is empty for indexes created without a name.
+	Index string
+}
+
+// PendingIndexes returns the indexes the up migrations in sourceDrv above
+// currentVersion create with CREATE INDEX or ALTER TABLE ... ADD INDEX, in
+// order, e.g. to review the index churn of a deploy. Pass
+// database.NilVersion for a database without a version. Like
+// WhichMigrationCreated, migrations are only inspected statically.
+func PendingIndexes(sourceDrv source.Driver, currentVersion int) ([]IndexChange, error) {
+	changes := []IndexChange{}
+	err := upStatements(sourceDrv, currentVersion, func(v uint, stmt string) bool {
+		for _, c := range createdIndexes(stmt) {
+			c.Version = v
+			changes = append(changes, c)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// createdIndexes returns the indexes stmt creates, without their version.
+func createdIndexes(stmt string) []IndexChange {
+	words := strings.Fields(stmt)
+	if len(words) < 3 {
+		return nil
+	}
+	switch {
+	case strings.EqualFold(words[0], "CREATE"):
+		if c, ok := createIndex(words[1:]); ok {
+			return []IndexChange{c}
+		}
+	case strings.EqualFold(words[0], "ALTER") && strings.EqualFold(words[1], "TABLE"):
+		return alterTableIndexes(stmt)
+	}
+	return nil
+}
+
+// createIndex parses the words of a CREATE INDEX statement following CREATE.
+func createIndex(words []string) (IndexChange, bool) {
+	i := 0
+	for i < len(words) && isIndexModifier(words[i]) {
+		i++
+	}
+	if i >= len(words) || !strings.EqualFold(words[i], "INDEX") {
+		return IndexChange{}, false
+	}
+	i++
+	if i < len(words) && strings.EqualFold(words[i], "CONCURRENTLY") {
+		i++
+	}
+	i = skipIfNotExists(words, i)
+
+	var c IndexChange
+	if i < len(words) && !strings.EqualFold(words[i], "ON") {
+		c.Index = unquoteTableName(words[i])
+		i++
+	}
+	// MySQL allows the index type before ON
+	if i+1 < len(words) && strings.EqualFold(words[i], "USING") {
+		i += 2
+	}
+	if i >= len(words) || !strings.EqualFold(words[i], "ON") {
+		return IndexChange{}, false
+	}
+	i++
+	if i < len(words) && strings.EqualFold(words[i], "ONLY") {
+		i++
+	}
+	if i >= len(words) {
+		return IndexChange{}, false
+	}
+	c.Table = unquoteTableName(beforeParen(words[i]))
+	return c, len(c.Table) > 0
+}
+
+// alterTableIndexes returns the indexes the ADD INDEX clauses of an ALTER
+// TABLE statement create.
+func alterTableIndexes(stmt string) []IndexChange {
+	clauses := splitClauses(stmt)
+	words := strings.Fields(clauses[0])
+	i := 2
+	if i+1 < len(words) && strings.EqualFold(words[i], "IF") && strings.EqualFold(words[i+1], "EXISTS") {
+		i += 2
+	}
+	if i < len(words) && strings.EqualFold(words[i], "ONLY") {
+		i++
+	}
+	if i >= len(words) {
+		return nil
+	}
+	table := unquoteTableName(words[i])
+	clauses[0] = strings.Join(words[i+1:], " ")
+
+	var changes []IndexChange
+	for _, clause := range clauses {
+		if index, ok := addIndex(strings.Fields(clause)); ok {
+			changes = append(changes, IndexChange{Table: table, Index: index})
+		}
+	}
+	return changes
+}
+
+// addIndex parses the words of an ADD INDEX clause of ALTER TABLE and
+// returns the index name.
+func addIndex(words []string) (string, bool) {
+	if len(words) < 2 || !strings.EqualFold(words[0], "ADD") {
+		return "", false
+	}
+	i := 1
+	for i < len(words) && isIndexModifier(words[i]) {
+		i++
+	}
+	// UNIQUE and the others create an index without saying so
+	if i < len(words) && (strings.EqualFold(words[i], "INDEX") || strings.EqualFold(words[i], "KEY")) {
+		i++
+	} else if i == 1 {
+		return "", false
+	}
+	i = skipIfNotExists(words, i)
+	if i >= len(words) || strings.EqualFold(words[i], "USING") {
+		return "", true
+	}
+	return unquoteTableName(beforeParen(words[i])), true
+}
+
+// splitClauses splits stmt at the commas outside of parentheses.
+func splitClauses(stmt string) []string {
+	var clauses []string
+	depth, start := 0, 0
+	for i, c := range stmt {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				clauses = append(clauses, stmt[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(clauses, stmt[start:])
+}
+
+func isIndexModifier(word string) bool {
+	switch strings.ToUpper(word) {
+	case "UNIQUE", "FULLTEXT", "SPATIAL":
+		return true
+	}
+	return false
+}
+
+func skipIfNotExists(words []string, i int) int {
+	if i+2 < len(words) && strings.EqualFold(words[i], "IF") &&
+		strings.EqualFold(words[i+1], "NOT") && strings.EqualFold(words[i+2], "EXISTS") {
+		return i + 3
+	}
+	return i
+}
+
+// beforeParen cuts word at an opening parenthesis, e.g. of users(id).
+func beforeParen(word string) string {
+	if idx := strings.IndexByte(word, '('); idx >= 0 {
+		return word[:idx]
+	}
+	return word
+}
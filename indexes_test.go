@@ -0,0 +1,59 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang-migrate/migrate/database"
+	"github.com/golang-migrate/migrate/source"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+func TestPendingIndexes(t *testing.T) {
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up,
+		Identifier: "CREATE TABLE users (id int, email text);\nCREATE INDEX users_id ON users (id);"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up,
+		Identifier: "-- CREATE INDEX comments ON users (id);\n" +
+			"CREATE UNIQUE INDEX IF NOT EXISTS `users_email` ON `users`(email);\n" +
+			"CREATE INDEX CONCURRENTLY ON public.orders (user_id);"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "CREATE INDEX down ON users (id)"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up,
+		Identifier: "INSERT INTO users VALUES (1, 'CREATE INDEX x ON y (z)');\n" +
+			"ALTER TABLE orders ADD COLUMN total int, ADD INDEX orders_total (total, created_at), ADD UNIQUE KEY orders_ref(ref);\n" +
+			"ALTER TABLE IF EXISTS users ADD FULLTEXT (email), DROP INDEX users_id;\n" +
+			"CREATE INDEX users_email_hash USING HASH ON users (email);"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "ALTER TABLE users ADD PRIMARY KEY (id)"})
+
+	sInst, _ := sStub.WithInstance(nil, &sStub.Config{})
+	sInst.(*sStub.Stub).Migrations = migrations
+
+	changes, err := PendingIndexes(sInst, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []IndexChange{
+		{Version: 2, Table: "users", Index: "users_email"},
+		{Version: 2, Table: "public.orders"},
+		{Version: 3, Table: "orders", Index: "orders_total"},
+		{Version: 3, Table: "orders", Index: "orders_ref"},
+		{Version: 3, Table: "users"},
+		{Version: 3, Table: "users", Index: "users_email_hash"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %+v, got %+v", expected, changes)
+	}
+
+	changes, err = PendingIndexes(sInst, database.NilVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 7 || changes[0] != (IndexChange{Version: 1, Table: "users", Index: "users_id"}) {
+		t.Errorf("expected the indexes of all migrations, got %+v", changes)
+	}
+
+	changes, err = PendingIndexes(sInst, 4)
+	if err != nil || changes == nil || len(changes) != 0 {
+		t.Errorf("expected no indexes, got %+v (%v)", changes, err)
+	}
+}
@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/golang-migrate/migrate/database"
+)
+
+// MetricsCollector receives instrumentation events from a Migrate instance,
+// see Migrate.Metrics. A run is a single call of Migrate, Steps, Up, Down
+// or Run. The methods are called synchronously, so they should return quickly.
+type MetricsCollector interface {
+	// RunStarted is called before the first migration of a run.
+	RunStarted()
+
+	// RunFinished is called after a run succeeded. version is the
+	// active migration version afterwards, -1 if there is none.
+	RunFinished(version int, duration time.Duration)
+
+	// RunFailed is called after a run failed.
+	RunFailed(err error, duration time.Duration)
+
+	// LockAcquired is called after acquiring the database lock took wait.
+	LockAcquired(wait time.Duration)
+
+	// MigrationApplied is called after a single migration was applied.
+	MigrationApplied(migr *Migration, duration time.Duration)
+}
+
+// WriteMetrics writes the currently active migration version, the number of
+// applied migrations and the dirty state to w, using the Prometheus text
+// exposition format. Serve it from a sidecar to expose the migration state.
+// The version is -1 if no migration has been applied, yet.
+func (m *Migrate) WriteMetrics(w io.Writer) error {
+	version, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return err
+	}
+
+	applied, err := m.countApplied(version)
+	if err != nil {
+		return err
+	}
+
+	dirtyValue := 0
+	if dirty {
+		dirtyValue = 1
+	}
+
+	_, err = fmt.Fprintf(w, "# HELP migrate_version Currently active migration version.\n"+
+		"# TYPE migrate_version gauge\n"+
+		"migrate_version %d\n"+
+		"# HELP migrate_applied_migrations Number of applied migrations.\n"+
+		"# TYPE migrate_applied_migrations gauge\n"+
+		"migrate_applied_migrations %d\n"+
+		"# HELP migrate_dirty Whether the database is dirty (1) or not (0).\n"+
+		"# TYPE migrate_dirty gauge\n"+
+		"migrate_dirty %d\n",
+		version, applied, dirtyValue)
+	return err
+}
+
+// countApplied returns the number of migrations in the source
+// up to and including version.
+func (m *Migrate) countApplied(version int) (int, error) {
+	if version == database.NilVersion {
+		return 0, nil
+	}
+
+	v, err := m.sourceDrv.First()
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for int(v) <= version {
+		count++
+		v, err = m.sourceDrv.Next(v)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,113 @@
+// Package prometheus provides a migrate.MetricsCollector exposing
+// Prometheus metrics.
+//
+//	c, err := prometheus.New(prom.DefaultRegisterer)
+//	m.Metrics = c
+package prometheus
+
+import (
+	"time"
+
+	"github.com/golang-migrate/migrate"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements migrate.MetricsCollector.
+type Collector struct {
+	applied         prom.Counter
+	failures        prom.Counter
+	duration        prom.Histogram
+	runDuration     prom.Histogram
+	lockWait        prom.Histogram
+	schemaVersion   prom.Gauge
+	lastRunFinished prom.Gauge
+}
+
+// New returns a Collector with its metrics registered with reg:
+//
+//	migrate_applied_total              counter   applied migrations
+//	migrate_failures_total             counter   failed runs
+//	migrate_duration_seconds           histogram duration of single migrations
+//	migrate_run_duration_seconds       histogram duration of runs
+//	migrate_lock_wait_seconds          histogram time spent acquiring the lock
+//	migrate_schema_version             gauge     active migration version, -1 if none
+//	migrate_last_run_timestamp_seconds gauge     end of the last successful run
+func New(reg prom.Registerer) (*Collector, error) {
+	c := &Collector{
+		applied: prom.NewCounter(prom.CounterOpts{
+			Namespace: "migrate",
+			Name:      "applied_total",
+			Help:      "Number of applied migrations.",
+		}),
+		failures: prom.NewCounter(prom.CounterOpts{
+			Namespace: "migrate",
+			Name:      "failures_total",
+			Help:      "Number of failed migration runs.",
+		}),
+		duration: prom.NewHistogram(prom.HistogramOpts{
+			Namespace: "migrate",
+			Name:      "duration_seconds",
+			Help:      "Duration of single migrations.",
+			Buckets:   prom.ExponentialBuckets(0.01, 4, 10),
+		}),
+		runDuration: prom.NewHistogram(prom.HistogramOpts{
+			Namespace: "migrate",
+			Name:      "run_duration_seconds",
+			Help:      "Duration of migration runs.",
+			Buckets:   prom.ExponentialBuckets(0.01, 4, 10),
+		}),
+		lockWait: prom.NewHistogram(prom.HistogramOpts{
+			Namespace: "migrate",
+			Name:      "lock_wait_seconds",
+			Help:      "Time spent acquiring the database lock.",
+			Buckets:   prom.DefBuckets,
+		}),
+		schemaVersion: prom.NewGauge(prom.GaugeOpts{
+			Namespace: "migrate",
+			Name:      "schema_version",
+			Help:      "Active migration version, -1 if no migration has been applied.",
+		}),
+		lastRunFinished: prom.NewGauge(prom.GaugeOpts{
+			Namespace: "migrate",
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Unix time the last successful migration run finished.",
+		}),
+	}
+
+	collectors := []prom.Collector{c.applied, c.failures, c.duration, c.runDuration,
+		c.lockWait, c.schemaVersion, c.lastRunFinished}
+	for _, col := range collectors {
+		if err := reg.Register(col); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// RunStarted implements migrate.MetricsCollector.
+func (c *Collector) RunStarted() {}
+
+// RunFinished implements migrate.MetricsCollector.
+func (c *Collector) RunFinished(version int, duration time.Duration) {
+	c.runDuration.Observe(duration.Seconds())
+	c.schemaVersion.Set(float64(version))
+	c.lastRunFinished.Set(float64(time.Now().Unix()))
+}
+
+// RunFailed implements migrate.MetricsCollector.
+func (c *Collector) RunFailed(err error, duration time.Duration) {
+	c.failures.Inc()
+	c.runDuration.Observe(duration.Seconds())
+}
+
+// LockAcquired implements migrate.MetricsCollector.
+func (c *Collector) LockAcquired(wait time.Duration) {
+	c.lockWait.Observe(wait.Seconds())
+}
+
+// MigrationApplied implements migrate.MetricsCollector.
+func (c *Collector) MigrationApplied(migr *migrate.Migration, duration time.Duration) {
+	c.applied.Inc()
+	c.duration.Observe(duration.Seconds())
+	c.schemaVersion.Set(float64(migr.TargetVersion))
+}
@@ -0,0 +1,51 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/golang-migrate/migrate"
+	_ "github.com/golang-migrate/migrate/database/stub"
+	"github.com/golang-migrate/migrate/source"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	reg := prom.NewRegistry()
+	c, err := New(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+
+	sInst, _ := sStub.WithInstance(nil, &sStub.Config{})
+	sInst.(*sStub.Stub).Migrations = migrations
+
+	m, err := migrate.NewWithSourceInstance("stub", sInst, "stub://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Metrics = c
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := testutil.ToFloat64(c.applied); v != 2 {
+		t.Errorf("expected 2 applied migrations, got %v", v)
+	}
+	if v := testutil.ToFloat64(c.schemaVersion); v != 2 {
+		t.Errorf("expected schema version 2, got %v", v)
+	}
+	if v := testutil.ToFloat64(c.failures); v != 0 {
+		t.Errorf("expected no failures, got %v", v)
+	}
+
+	if _, err := New(reg); err == nil {
+		t.Error("expected error registering the metrics twice")
+	}
+}
@@ -0,0 +1,247 @@
+// Package statsd provides a migrate.MetricsCollector sending metrics to a
+// statsd or DogStatsD agent over UDP.
+//
+//	c, err := statsd.Open("statsd://localhost:8125?x-statsd-service=api")
+//	defer c.Close()
+//	m.Metrics = c
+//
+// The metrics are, with the default prefix:
+//
+//	migrate.applied         counter applied migrations, tagged with direction
+//	migrate.failures        counter failed runs
+//	migrate.duration        timer   duration of single migrations, tagged with direction
+//	migrate.run_duration    timer   duration of runs
+//	migrate.lock_wait       timer   time spent acquiring the lock
+//	migrate.schema_version  gauge   active migration version, -1 if none
+//
+// DogStatsD tags are added for the service, the database and the direction.
+// statsd doesn't know tags, so with the plain format their values are
+// appended to the metric name instead, e.g. migrate.applied.api.users.up.
+package statsd
+
+import (
+	"fmt"
+	"net"
+	nurl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-migrate/migrate"
+)
+
+// DefaultAddr is the address of a local agent.
+var DefaultAddr = "127.0.0.1:8125"
+
+// DefaultPrefix is put in front of every metric name.
+var DefaultPrefix = "migrate."
+
+// maxPacketSize keeps packets below the usual MTU of 1500 bytes.
+const maxPacketSize = 1432
+
+// Format is the line format metrics are sent in.
+type Format int
+
+const (
+	// DogStatsD appends tags like |#service:api to every line.
+	DogStatsD Format = iota
+
+	// Plain appends the tag values to the metric name.
+	Plain
+)
+
+// parseFormat parses the value of the x-statsd-format URL parameter.
+func parseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "", "dogstatsd":
+		return DogStatsD, nil
+	case "plain":
+		return Plain, nil
+	}
+	return 0, fmt.Errorf("unknown statsd format %q, expected dogstatsd or plain", s)
+}
+
+type Config struct {
+	// Addr of the agent, defaults to DefaultAddr.
+	Addr string
+
+	// Prefix defaults to DefaultPrefix.
+	Prefix string
+
+	// Service and Database are added as tags if not empty.
+	Service  string
+	Database string
+
+	Format Format
+}
+
+// Collector implements migrate.MetricsCollector. Metrics are buffered and
+// sent once a packet is full, at the end of a run and on Close. Errors
+// sending them are ignored, like statsd clients usually do.
+type Collector struct {
+	conn   net.Conn
+	config *Config
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// New returns a Collector sending metrics to config.Addr.
+func New(config *Config) (*Collector, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if len(config.Addr) == 0 {
+		config.Addr = DefaultAddr
+	}
+	if len(config.Prefix) == 0 {
+		config.Prefix = DefaultPrefix
+	}
+
+	conn, err := net.Dial("udp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Collector{
+		conn:   conn,
+		config: config,
+	}, nil
+}
+
+// Open returns a Collector configured by a URL like
+// statsd://host:port?x-statsd-prefix=migrate.&x-statsd-service=api&x-statsd-database=users&x-statsd-format=plain
+func Open(url string) (*Collector, error) {
+	purl, err := nurl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := parseFormat(purl.Query().Get("x-statsd-format"))
+	if err != nil {
+		return nil, err
+	}
+
+	return New(&Config{
+		Addr:     purl.Host,
+		Prefix:   purl.Query().Get("x-statsd-prefix"),
+		Service:  purl.Query().Get("x-statsd-service"),
+		Database: purl.Query().Get("x-statsd-database"),
+		Format:   format,
+	})
+}
+
+// Close sends the buffered metrics and closes the connection.
+func (c *Collector) Close() error {
+	c.Flush()
+	return c.conn.Close()
+}
+
+// Flush sends the buffered metrics.
+func (c *Collector) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+}
+
+func (c *Collector) flush() {
+	if len(c.buf) == 0 {
+		return
+	}
+	c.conn.Write(c.buf)
+	c.buf = c.buf[:0]
+}
+
+// RunStarted implements migrate.MetricsCollector.
+func (c *Collector) RunStarted() {}
+
+// RunFinished implements migrate.MetricsCollector.
+func (c *Collector) RunFinished(version int, duration time.Duration) {
+	c.send("run_duration", millis(duration), "ms", "")
+	c.send("schema_version", strconv.Itoa(version), "g", "")
+	c.Flush()
+}
+
+// RunFailed implements migrate.MetricsCollector.
+func (c *Collector) RunFailed(err error, duration time.Duration) {
+	c.send("failures", "1", "c", "")
+	c.send("run_duration", millis(duration), "ms", "")
+	c.Flush()
+}
+
+// LockAcquired implements migrate.MetricsCollector.
+func (c *Collector) LockAcquired(wait time.Duration) {
+	c.send("lock_wait", millis(wait), "ms", "")
+}
+
+// MigrationApplied implements migrate.MetricsCollector.
+func (c *Collector) MigrationApplied(migr *migrate.Migration, duration time.Duration) {
+	direction := "up"
+	if migr.TargetVersion < int(migr.Version) {
+		direction = "down"
+	}
+	c.send("applied", "1", "c", direction)
+	c.send("duration", millis(duration), "ms", direction)
+	c.send("schema_version", strconv.Itoa(migr.TargetVersion), "g", "")
+}
+
+// send buffers a metric, flushing the buffer first if the line doesn't fit.
+func (c *Collector) send(name, value, kind, direction string) {
+	line := c.line(name, value, kind, direction)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.buf) > 0 && len(c.buf)+1+len(line) > maxPacketSize {
+		c.flush()
+	}
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line...)
+}
+
+// line formats a metric in the configured format.
+func (c *Collector) line(name, value, kind, direction string) string {
+	tags := [][2]string{
+		{"service", c.config.Service},
+		{"database", c.config.Database},
+		{"direction", direction},
+	}
+
+	if c.config.Format == Plain {
+		name = c.config.Prefix + name
+		for _, tag := range tags {
+			if len(tag[1]) > 0 {
+				name += "." + sanitize(tag[1], ".")
+			}
+		}
+		return name + ":" + value + "|" + kind
+	}
+
+	line := c.config.Prefix + name + ":" + value + "|" + kind
+	sep := "|#"
+	for _, tag := range tags {
+		if len(tag[1]) > 0 {
+			line += sep + tag[0] + ":" + sanitize(tag[1], "")
+			sep = ","
+		}
+	}
+	return line
+}
+
+// sanitize replaces characters with a meaning in the line format.
+func sanitize(s, extra string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(":|@#,\n"+extra, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// millis formats d in milliseconds, the unit of statsd timers.
+func millis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)
+}
@@ -0,0 +1,122 @@
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate"
+	_ "github.com/golang-migrate/migrate/database/stub"
+	"github.com/golang-migrate/migrate/source"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+func TestCollector(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	c, err := Open("statsd://" + agent.LocalAddr().String() + "?x-statsd-service=api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+
+	sInst, _ := sStub.WithInstance(nil, &sStub.Config{})
+	sInst.(*sStub.Stub).Migrations = migrations
+
+	m, err := migrate.NewWithSourceInstance("stub", sInst, "stub://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Metrics = c
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxPacketSize)
+	n, _, err := agent.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(buf[:n]), "\n")
+	applied := 0
+	for _, line := range lines {
+		if line == "migrate.applied:1|c|#service:api,direction:up" {
+			applied++
+		}
+	}
+	if applied != 2 {
+		t.Errorf("expected 2 applied migrations, got %v in %q", applied, lines)
+	}
+	if last := lines[len(lines)-1]; last != "migrate.schema_version:2|g|#service:api" {
+		t.Errorf("expected schema version 2, got %q", last)
+	}
+}
+
+func TestLine(t *testing.T) {
+	testcases := []struct {
+		name      string
+		config    Config
+		direction string
+		expected  string
+	}{
+		{name: "no tags", config: Config{Prefix: "migrate."},
+			expected: "migrate.applied:1|c"},
+		{name: "dogstatsd", config: Config{Prefix: "migrate.", Service: "api", Database: "users"}, direction: "up",
+			expected: "migrate.applied:1|c|#service:api,database:users,direction:up"},
+		{name: "dogstatsd sanitized", config: Config{Prefix: "migrate.", Service: "a|b:c"},
+			expected: "migrate.applied:1|c|#service:a_b_c"},
+		{name: "plain", config: Config{Prefix: "migrate.", Service: "api", Database: "users", Format: Plain}, direction: "down",
+			expected: "migrate.applied.api.users.down:1|c"},
+		{name: "plain sanitized", config: Config{Prefix: "deploy.", Database: "db.users", Format: Plain},
+			expected: "deploy.applied.db_users:1|c"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Collector{config: &tc.config}
+			if got := c.line("applied", "1", "c", tc.direction); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	testcases := []struct {
+		format    string
+		expected  Format
+		expectErr bool
+	}{
+		{format: "", expected: DogStatsD},
+		{format: "dogstatsd", expected: DogStatsD},
+		{format: "plain", expected: Plain},
+		{format: "PLAIN", expected: Plain},
+		{format: "graphite", expectErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.format, func(t *testing.T) {
+			format, err := parseFormat(tc.format)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if format != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, format)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dStub "github.com/golang-migrate/migrate/database/stub"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	testcases := []struct {
+		version  int
+		dirty    bool
+		expected []string
+	}{
+		{version: -1, expected: []string{"migrate_version -1\n", "migrate_applied_migrations 0\n", "migrate_dirty 0\n"}},
+		{version: 4, dirty: true, expected: []string{"migrate_version 4\n", "migrate_applied_migrations 3\n", "migrate_dirty 1\n"}},
+		{version: 7, expected: []string{"migrate_version 7\n", "migrate_applied_migrations 5\n", "migrate_dirty 0\n"}},
+	}
+
+	for _, tc := range testcases {
+		if err := dbDrv.SetVersion(tc.version, tc.dirty); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := m.WriteMetrics(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, line := range tc.expected {
+			if !strings.Contains(buf.String(), line) {
+				t.Errorf("expected metrics to contain %q, got:\n%v", line, buf.String())
+			}
+		}
+		if !strings.Contains(buf.String(), "# TYPE migrate_version gauge\n") {
+			t.Errorf("expected metrics to contain type information, got:\n%v", buf.String())
+		}
+	}
+}
+
+// recordingCollector records the events it receives.
+type recordingCollector struct {
+	events   []string
+	versions []int
+}
+
+func (c *recordingCollector) RunStarted() {
+	c.events = append(c.events, "started")
+}
+
+func (c *recordingCollector) RunFinished(version int, duration time.Duration) {
+	c.events = append(c.events, "finished")
+	c.versions = append(c.versions, version)
+}
+
+func (c *recordingCollector) RunFailed(err error, duration time.Duration) {
+	c.events = append(c.events, "failed")
+}
+
+func (c *recordingCollector) LockAcquired(wait time.Duration) {
+	c.events = append(c.events, "locked")
+}
+
+func (c *recordingCollector) MigrationApplied(migr *Migration, duration time.Duration) {
+	c.events = append(c.events, fmt.Sprintf("applied %v", migr.TargetVersion))
+}
+
+func TestMetricsCollector(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	// nil collector
+	if err := m.Steps(1); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &recordingCollector{}
+	m.Metrics = c
+	if err := m.Steps(2); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"locked", "started", "applied 3", "applied 4", "finished"}
+	if !reflect.DeepEqual(c.events, expected) {
+		t.Errorf("expected events %v, got %v", expected, c.events)
+	}
+	if !reflect.DeepEqual(c.versions, []int{4}) {
+		t.Errorf("expected version 4, got %v", c.versions)
+	}
+
+	c.events = nil
+	db := &slowStub{Stub: m.databaseDrv.(*dStub.Stub), failures: 1}
+	m.databaseDrv = db
+	if err := m.Steps(-1); err == nil {
+		t.Fatal("expected error")
+	}
+	expected = []string{"locked", "started", "failed"}
+	if !reflect.DeepEqual(c.events, expected) {
+		t.Errorf("expected events %v, got %v", expected, c.events)
+	}
+}
@@ -5,9 +5,14 @@
 package migrate
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-migrate/migrate/database"
@@ -18,7 +23,8 @@ import (
 // from the source. This is helpful if the source is remote, but has little
 // effect for a local source (i.e. file system).
 // Please note that this setting has a major impact on the memory usage,
-// since each pre-read migration is buffered in memory. See DefaultBufferSize.
+// since each pre-read migration is buffered in memory. See DefaultBufferSize
+// and DefaultPrefetchBytes.
 var DefaultPrefetchMigrations = uint(10)
 
 // DefaultLockTimeout sets the max time a database driver has to acquire a lock.
@@ -29,6 +35,12 @@ var (
 	ErrNilVersion  = fmt.Errorf("no migration")
 	ErrLocked      = fmt.Errorf("database locked")
 	ErrLockTimeout = fmt.Errorf("timeout: can't acquire database lock")
+	ErrRunTimeout  = fmt.Errorf("timeout: migration did not finish in time")
+
+	ErrWouldChangeUnsupported = fmt.Errorf("database driver can't tell whether a migration would change anything")
+	ErrRepairUnsupported      = fmt.Errorf("database driver can't repair duplicate versions")
+	ErrListTablesUnsupported  = fmt.Errorf("database driver can't list tables")
+	ErrTimeoutUnsupported     = fmt.Errorf("database driver can't stop a migration after its timeout")
 )
 
 // ErrShortLimit is an error returned when not enough migrations
@@ -50,31 +62,131 @@ func (e ErrDirty) Error() string {
 	return fmt.Sprintf("Dirty database version %v. Fix and force version.", e.Version)
 }
 
+// FailureMode controls what happens to the version of a migration
+// that fails to run.
+type FailureMode int
+
+const (
+	// MarkDirty leaves the version of the failed migration in place,
+	// marked dirty. The version has to be forced before migrating again.
+	MarkDirty FailureMode = iota
+
+	// DeleteRow removes the version of the failed migration, restoring
+	// the version from before the migration, so running it again simply
+	// retries it. Use this only if failed migrations are rolled back
+	// completely, e.g. by running them in a transaction.
+	DeleteRow
+)
+
 type Migrate struct {
 	sourceName   string
 	sourceDrv    source.Driver
 	databaseName string
 	databaseDrv  database.Driver
 
-	// Log accepts a Logger interface
-	Log Logger
+	// databaseURL is the database URL without the password if known,
+	// the database name otherwise.
+	databaseURL string
+
+	// Log accepts a Logger interface. Set it before running migrations,
+	// use SetLogger to replace it while migrations run.
+	Log   Logger
+	logMu *sync.RWMutex
 
 	// GracefulStop accepts `true` and will stop executing migrations
 	// as soon as possible at a safe break point, so that the database
-	// is not corrupted.
-	GracefulStop   chan bool
-	isGracefulStop bool
+	// is not corrupted. Only send on it, it's received from by the
+	// goroutines running migrations.
+	GracefulStop chan bool
+
+	// isGracefulStop is set to 1 once a stop signal was received,
+	// it's read and written atomically.
+	isGracefulStop int32
 
 	isLockedMu *sync.Mutex
 	isLocked   bool
 
+	// running counts the runs in progress, it's read and written
+	// atomically. lastRunErr is the error of the last run that ended,
+	// guarded by lastRunMu. See Status.
+	running    int32
+	lastRunErr error
+	lastRunMu  *sync.Mutex
+
 	// PrefetchMigrations defaults to DefaultPrefetchMigrations,
 	// but can be set per Migrate instance.
 	PrefetchMigrations uint
 
+	// PrefetchBytes defaults to DefaultPrefetchBytes,
+	// but can be set per Migrate instance.
+	PrefetchBytes uint
+
+	// prefetch counts the bytes buffered by the current run, see newRun.
+	// It's guarded by prefetchMu, since the goroutine reading the
+	// migrations of a failed run may still be buffering.
+	prefetch   *prefetchLimiter
+	prefetchMu *sync.Mutex
+
+	// SpillSize defaults to DefaultSpillSize,
+	// but can be set per Migrate instance.
+	SpillSize uint
+
 	// LockTimeout defaults to DefaultLockTimeout,
 	// but can be set per Migrate instance.
 	LockTimeout time.Duration
+
+	// LockReason is recorded with the lock if not empty and the database
+	// driver implements database.ReasonLocker, e.g. "deploy 4512 by CI".
+	// With Context set, the driver must implement
+	// database.ReasonLockerContext, too.
+	LockReason string
+
+	// Metrics receives instrumentation events if not nil.
+	Metrics MetricsCollector
+
+	// Tracer is told about runs, lock acquisitions and migrations if not nil.
+	Tracer Tracer
+
+	// OnFailure defaults to MarkDirty, see FailureMode.
+	// Migrations that time out are always marked dirty, since they
+	// might still be running.
+	OnFailure FailureMode
+
+	// Audit records every migration applied or failed if not nil.
+	// Failing to write to it doesn't fail the migration.
+	Audit *AuditWriter
+
+	// BetweenMigrations is called before each migration of a run with the
+	// version the migration leads to, -1 for NilVersion. Returning an error
+	// ends the run with that error before the migration starts, leaving
+	// the migrations run so far applied and the database unlocked. Use it
+	// to ask for confirmation or wait for an approval.
+	BetweenMigrations func(nextVersion int) error
+
+	// AfterAllMigrations is called once all migrations of a run succeeded,
+	// with the version the run ended at, -1 for NilVersion, while the
+	// database is still locked. It isn't called if no migration ran or the
+	// run was stopped gracefully. Returning an error fails the run, the
+	// migrations stay applied. Use it for post-deploy tasks, e.g. to warm
+	// caches or ANALYZE the tables changed.
+	AfterAllMigrations func(finalVersion int) error
+
+	// VerifyChecksumsOnUp makes Up call VerifyChecksums once the database
+	// is locked, and fail without running a migration if an applied
+	// migration changed.
+	VerifyChecksumsOnUp bool
+
+	// Context, if not nil, is passed to database drivers implementing
+	// database.DriverContext when locking and running migrations, so that
+	// canceling it aborts the migration running. The canceled migration
+	// isn't retried and its version stays dirty, regardless of OnFailure.
+	Context context.Context
+
+	// MaxParallel is the number of migrations of a parallel group that
+	// run at the same time, see GroupMarker. With values below 2, or if
+	// the database driver can't run migrations in parallel, the migrations
+	// of a group run one by one like any other.
+	MaxParallel int
 }
 
 // New returns a new Migrate instance from a source URL and a database URL.
@@ -93,6 +205,7 @@ func New(sourceUrl, databaseUrl string) (*Migrate, error) {
 		return nil, err
 	}
 	m.databaseName = databaseName
+	m.databaseURL = redactURL(databaseUrl)
 
 	sourceDrv, err := source.Open(sourceUrl)
 	if err != nil {
@@ -123,6 +236,7 @@ func NewWithDatabaseInstance(sourceUrl string, databaseName string, databaseInst
 	m.sourceName = sourceName
 
 	m.databaseName = databaseName
+	m.databaseURL = databaseName
 
 	sourceDrv, err := source.Open(sourceUrl)
 	if err != nil {
@@ -147,6 +261,7 @@ func NewWithSourceInstance(sourceName string, sourceInstance source.Driver, data
 		return nil, err
 	}
 	m.databaseName = databaseName
+	m.databaseURL = redactURL(databaseUrl)
 
 	m.sourceName = sourceName
 
@@ -170,6 +285,7 @@ func NewWithInstance(sourceName string, sourceInstance source.Driver, databaseNa
 
 	m.sourceName = sourceName
 	m.databaseName = databaseName
+	m.databaseURL = databaseName
 
 	m.sourceDrv = sourceInstance
 	m.databaseDrv = databaseInstance
@@ -181,8 +297,14 @@ func newCommon() *Migrate {
 	return &Migrate{
 		GracefulStop:       make(chan bool, 1),
 		PrefetchMigrations: DefaultPrefetchMigrations,
+		PrefetchBytes:      DefaultPrefetchBytes,
+		prefetch:           newPrefetchLimiter(0),
+		prefetchMu:         &sync.Mutex{},
+		SpillSize:          DefaultSpillSize,
 		LockTimeout:        DefaultLockTimeout,
 		isLockedMu:         &sync.Mutex{},
+		logMu:              &sync.RWMutex{},
+		lastRunMu:          &sync.Mutex{},
 	}
 }
 
@@ -206,7 +328,9 @@ func (m *Migrate) Close() (source error, database error) {
 
 // Migrate looks at the currently active migration version,
 // then migrates either up or down to the specified version.
-func (m *Migrate) Migrate(version uint) error {
+func (m *Migrate) Migrate(version uint) (err error) {
+	defer m.startRun("migrate")(&err)
+
 	if err := m.lock(); err != nil {
 		return err
 	}
@@ -220,7 +344,7 @@ func (m *Migrate) Migrate(version uint) error {
 		return m.unlockErr(ErrDirty{curVersion})
 	}
 
-	ret := make(chan interface{}, m.PrefetchMigrations)
+	ret := m.newRun()
 	go m.read(curVersion, int(version), ret)
 
 	return m.unlockErr(m.runMigrations(ret))
@@ -228,7 +352,9 @@ func (m *Migrate) Migrate(version uint) error {
 
 // Steps looks at the currently active migration version.
 // It will migrate up if n > 0, and down if n < 0.
-func (m *Migrate) Steps(n int) error {
+func (m *Migrate) Steps(n int) (err error) {
+	defer m.startRun("steps")(&err)
+
 	if n == 0 {
 		return ErrNoChange
 	}
@@ -246,7 +372,7 @@ func (m *Migrate) Steps(n int) error {
 		return m.unlockErr(ErrDirty{curVersion})
 	}
 
-	ret := make(chan interface{}, m.PrefetchMigrations)
+	ret := m.newRun()
 
 	if n > 0 {
 		go m.readUp(curVersion, n, ret)
@@ -259,7 +385,9 @@ func (m *Migrate) Steps(n int) error {
 
 // Up looks at the currently active migration version
 // and will migrate all the way up (applying all up migrations).
-func (m *Migrate) Up() error {
+func (m *Migrate) Up() (err error) {
+	defer m.startRun("up")(&err)
+
 	if err := m.lock(); err != nil {
 		return err
 	}
@@ -273,7 +401,13 @@ func (m *Migrate) Up() error {
 		return m.unlockErr(ErrDirty{curVersion})
 	}
 
-	ret := make(chan interface{}, m.PrefetchMigrations)
+	if m.VerifyChecksumsOnUp {
+		if err := m.VerifyChecksums(); err != nil {
+			return m.unlockErr(err)
+		}
+	}
+
+	ret := m.newRun()
 
 	go m.readUp(curVersion, -1, ret)
 	return m.unlockErr(m.runMigrations(ret))
@@ -281,7 +415,9 @@ func (m *Migrate) Up() error {
 
 // Down looks at the currently active migration version
 // and will migrate all the way down (applying all down migrations).
-func (m *Migrate) Down() error {
+func (m *Migrate) Down() (err error) {
+	defer m.startRun("down")(&err)
+
 	if err := m.lock(); err != nil {
 		return err
 	}
@@ -295,7 +431,7 @@ func (m *Migrate) Down() error {
 		return m.unlockErr(ErrDirty{curVersion})
 	}
 
-	ret := make(chan interface{}, m.PrefetchMigrations)
+	ret := m.newRun()
 	go m.readDown(curVersion, -1, ret)
 	return m.unlockErr(m.runMigrations(ret))
 }
@@ -315,7 +451,9 @@ func (m *Migrate) Drop() error {
 // It does not check any currently active version in database.
 // Usually you don't need this function at all. Use Migrate,
 // Steps, Up or Down instead.
-func (m *Migrate) Run(migration ...*Migration) error {
+func (m *Migrate) Run(migration ...*Migration) (err error) {
+	defer m.startRun("run")(&err)
+
 	if len(migration) == 0 {
 		return ErrNoChange
 	}
@@ -333,7 +471,7 @@ func (m *Migrate) Run(migration ...*Migration) error {
 		return m.unlockErr(ErrDirty{curVersion})
 	}
 
-	ret := make(chan interface{}, m.PrefetchMigrations)
+	ret := m.newRun()
 
 	go func() {
 		defer close(ret)
@@ -345,13 +483,81 @@ func (m *Migrate) Run(migration ...*Migration) error {
 			}
 
 			ret <- migr
-			go migr.Buffer()
+			m.buffer(migr)
 		}
 	}()
 
 	return m.unlockErr(m.runMigrations(ret))
 }
 
+// RunString runs sql against the database, without changing the
+// migration version. It fails if the database is dirty.
+func (m *Migrate) RunString(sql string) error {
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if dirty {
+		return m.unlockErr(ErrDirty{curVersion})
+	}
+
+	return m.unlockErr(m.databaseDrv.Run(strings.NewReader(sql)))
+}
+
+// RunStringWithVersion runs sql as the up migration of version, like Run.
+func (m *Migrate) RunStringWithVersion(sql string, version int) error {
+	if version < 0 {
+		return fmt.Errorf("invalid version %v", version)
+	}
+
+	migr, err := NewMigration(ioutil.NopCloser(strings.NewReader(sql)), "", uint(version), version)
+	if err != nil {
+		return err
+	}
+	return m.Run(migr)
+}
+
+// WouldChange reports whether running migration would change anything
+// in the database, see database.ChangeDetector. The migration is run in a
+// transaction that is rolled back. Statements that can't be rolled back,
+// like DDL in MySQL, are rejected rather than run.
+func (m *Migrate) WouldChange(migration io.Reader) (bool, error) {
+	cd, ok := m.databaseDrv.(database.ChangeDetector)
+	if !ok {
+		return false, ErrWouldChangeUnsupported
+	}
+
+	if err := m.lock(); err != nil {
+		return false, err
+	}
+
+	changed, err := cd.WouldChange(migration)
+	return changed, m.unlockErr(err)
+}
+
+// RepairDuplicates collapses rows of the migrations table with the same
+// version into one, preferring a clean row over dirty ones, and returns the
+// number of rows removed, see database.DuplicateRepairer. Use it if Version
+// reports the wrong dirty state after manual edits of the table.
+func (m *Migrate) RepairDuplicates() (removed int, err error) {
+	dr, ok := m.databaseDrv.(database.DuplicateRepairer)
+	if !ok {
+		return 0, ErrRepairUnsupported
+	}
+
+	if err := m.lock(); err != nil {
+		return 0, err
+	}
+
+	removed, err = dr.RepairDuplicates()
+	return removed, m.unlockErr(err)
+}
+
 // Force sets a migration version.
 // It does not check any currently active version in database.
 // It resets the dirty state to false.
@@ -373,6 +579,8 @@ func (m *Migrate) Force(version int) error {
 
 // Version returns the currently active migration version.
 // If no migration has been applied, yet, it will return ErrNilVersion.
+// It can be called while migrations run, if the database driver is safe
+// for concurrent use, like the drivers backed by database/sql.
 func (m *Migrate) Version() (version uint, dirty bool, err error) {
 	v, d, err := m.databaseDrv.Version()
 	if err != nil {
@@ -432,7 +640,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 			}
 
 			ret <- migr
-			go migr.Buffer()
+			m.buffer(migr)
 			from = int(firstVersion)
 		}
 
@@ -455,7 +663,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 			}
 
 			ret <- migr
-			go migr.Buffer()
+			m.buffer(migr)
 			from = int(next)
 		}
 
@@ -476,7 +684,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 					return
 				}
 				ret <- migr
-				go migr.Buffer()
+				m.buffer(migr)
 				return
 
 			} else if err != nil {
@@ -491,7 +699,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 			}
 
 			ret <- migr
-			go migr.Buffer()
+			m.buffer(migr)
 			from = int(prev)
 		}
 	}
@@ -539,7 +747,7 @@ func (m *Migrate) readUp(from int, limit int, ret chan<- interface{}) {
 			}
 
 			ret <- migr
-			go migr.Buffer()
+			m.buffer(migr)
 			from = int(firstVersion)
 			count++
 			continue
@@ -583,7 +791,7 @@ func (m *Migrate) readUp(from int, limit int, ret chan<- interface{}) {
 		}
 
 		ret <- migr
-		go migr.Buffer()
+		m.buffer(migr)
 		from = int(next)
 		count++
 	}
@@ -644,7 +852,7 @@ func (m *Migrate) readDown(from int, limit int, ret chan<- interface{}) {
 					return
 				}
 				ret <- migr
-				go migr.Buffer()
+				m.buffer(migr)
 				count++
 			}
 
@@ -665,7 +873,7 @@ func (m *Migrate) readDown(from int, limit int, ret chan<- interface{}) {
 		}
 
 		ret <- migr
-		go migr.Buffer()
+		m.buffer(migr)
 		from = int(prev)
 		count++
 	}
@@ -677,10 +885,39 @@ func (m *Migrate) readDown(from int, limit int, ret chan<- interface{}) {
 // Before running a newly received migration it will check if it's supposed
 // to stop execution because it might have received a stop signal on the
 // GracefulStop channel.
-func (m *Migrate) runMigrations(ret <-chan interface{}) error {
-	for r := range ret {
+func (m *Migrate) runMigrations(ret <-chan interface{}) (err error) {
+	if m.Metrics != nil {
+		m.Metrics.RunStarted()
+		defer m.reportRun(time.Now(), &err)
+	}
+
+	// the migrations that aren't run must not keep buffering
+	defer func() { go discard(ret) }()
+
+	// next is the value a parallel group read from ret, but didn't run
+	var next interface{}
+	defer func() {
+		if migr, ok := next.(*Migration); ok {
+			migr.discardBuffer()
+		}
+	}()
+
+	applied := false
+	for {
+		r := next
+		next = nil
+		if r == nil {
+			var ok bool
+			if r, ok = <-ret; !ok {
+				if applied && m.AfterAllMigrations != nil {
+					return m.afterAllMigrations()
+				}
+				return nil
+			}
+		}
 
 		if m.stop() {
+			next = r
 			return nil
 		}
 
@@ -690,44 +927,272 @@ func (m *Migrate) runMigrations(ret <-chan interface{}) error {
 
 		case *Migration:
 			migr := r.(*Migration)
-
-			// set version with dirty state
-			if err := m.databaseDrv.SetVersion(migr.TargetVersion, true); err != nil {
-				return err
+			if group := m.parallelGroup(migr); len(group) > 0 {
+				var err error
+				if next, err = m.applyGroup(group, migr, ret); err != nil {
+					return err
+				}
+				applied = true
+				continue
 			}
-
-			if migr.Body != nil {
-				m.logVerbosePrintf("Read and execute %v\n", migr.LogString())
-				if err := m.databaseDrv.Run(migr.BufferedBody); err != nil {
+			if m.BetweenMigrations != nil {
+				if err := m.BetweenMigrations(migr.TargetVersion); err != nil {
+					migr.discardBuffer()
 					return err
 				}
 			}
-
-			// set clean state
-			if err := m.databaseDrv.SetVersion(migr.TargetVersion, false); err != nil {
+			if err := m.applyMigration(migr); err != nil {
+				migr.discardBuffer()
 				return err
 			}
+			applied = true
 
-			endTime := time.Now()
-			readTime := migr.FinishedReading.Sub(migr.StartedBuffering)
-			runTime := endTime.Sub(migr.FinishedReading)
+		default:
+			panic("unknown type")
+		}
+	}
+}
 
-			// log either verbose or normal
-			if m.Log != nil {
-				if m.Log.Verbose() {
-					m.logPrintf("Finished %v (read %v, ran %v)\n", migr.LogString(), readTime, runTime)
-				} else {
-					m.logPrintf("%v (%v)\n", migr.LogString(), readTime+runTime)
+// afterAllMigrations calls AfterAllMigrations with the current version.
+func (m *Migrate) afterAllMigrations() error {
+	version, _, err := m.databaseDrv.Version()
+	if err != nil {
+		return err
+	}
+	m.logVerbosePrintf("Run AfterAllMigrations for version %v\n", version)
+	return m.AfterAllMigrations(version)
+}
+
+// applyMigration runs a single migration against the database and
+// updates the version accordingly.
+func (m *Migrate) applyMigration(migr *Migration) (err error) {
+	if m.Audit != nil {
+		defer func(startTime time.Time) { m.audit(migr, startTime, err) }(time.Now())
+	}
+
+	runFn, err := m.runFunc(migr)
+	if err != nil {
+		return err
+	}
+
+	body, err := m.bufferBody(migr)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		defer body.Close()
+	}
+
+	if m.Tracer != nil {
+		statements, cerr := countStatements(body)
+		if cerr != nil {
+			return cerr
+		}
+		end := m.Tracer.StartMigration(migr, statements)
+		defer func() { end(err) }()
+	}
+
+	startTime := time.Now()
+
+	prevVersion := database.NilVersion
+	if m.OnFailure == DeleteRow {
+		v, _, err := m.databaseDrv.Version()
+		if err != nil {
+			return err
+		}
+		prevVersion = v
+	}
+
+	// set version with dirty state
+	if err := m.setVersion(migr, true); err != nil {
+		return err
+	}
+	if err := m.recordHistory(migr, true); err != nil {
+		return err
+	}
+
+	var runTime time.Duration
+	if migr.Body != nil {
+		m.logVerbosePrintf("Read and execute %v\n", migr.LogString())
+		runStart := time.Now()
+		if err := m.run(migr, body, runFn); err != nil {
+			if m.OnFailure == DeleteRow && err != ErrRunTimeout && !m.canceled() {
+				if verr := m.databaseDrv.SetVersion(prevVersion, false); verr != nil {
+					return database.Append(err, verr)
+				}
+				if verr := m.revertHistory(migr); verr != nil {
+					return database.Append(err, verr)
 				}
 			}
-
-		default:
-			panic("unknown type")
+			return err
 		}
+		runTime = time.Since(runStart)
 	}
+
+	// set clean state
+	if err := m.setVersion(migr, false); err != nil {
+		return err
+	}
+	if err := m.recordHistory(migr, false); err != nil {
+		return err
+	}
+	if err := m.recordChecksum(migr); err != nil {
+		return err
+	}
+	if err := m.recordDuration(migr, runTime); err != nil {
+		return err
+	}
+
+	m.migrationApplied(migr, startTime)
 	return nil
 }
 
+// recordHistory keeps the row of migr in the history of a database driver
+// implementing database.VersionHistory. Up migrations upsert their version,
+// dirty while they run. Down migrations mark the version they undo dirty
+// while they run and delete it once they succeeded.
+func (m *Migrate) recordHistory(migr *Migration, dirty bool) error {
+	history, ok := m.databaseDrv.(database.VersionHistory)
+	if !ok {
+		return nil
+	}
+	if migr.TargetVersion == int(migr.Version) {
+		return history.UpsertVersion(migr.TargetVersion, dirty)
+	}
+	if dirty {
+		return history.UpsertVersion(int(migr.Version), true)
+	}
+	return history.DeleteVersion(int(migr.Version))
+}
+
+// revertHistory restores the history row of migr after it failed and was
+// rolled back, see DeleteRow.
+func (m *Migrate) revertHistory(migr *Migration) error {
+	history, ok := m.databaseDrv.(database.VersionHistory)
+	if !ok {
+		return nil
+	}
+	if migr.TargetVersion == int(migr.Version) {
+		return history.DeleteVersion(migr.TargetVersion)
+	}
+	return history.UpsertVersion(int(migr.Version), false)
+}
+
+// setVersion sets the version migr leads to. Up migrations pass their
+// identifier along if the database driver implements
+// database.VersionNamer, down migrations don't know the name of the
+// version they lead to, and migrations without a body have none.
+func (m *Migrate) setVersion(migr *Migration, dirty bool) error {
+	namer, ok := m.databaseDrv.(database.VersionNamer)
+	if ok && migr.Body != nil && migr.TargetVersion == int(migr.Version) {
+		return namer.SetVersionWithName(migr.TargetVersion, dirty, migr.Identifier)
+	}
+	return m.databaseDrv.SetVersion(migr.TargetVersion, dirty)
+}
+
+// bufferBody buffers the body of migr completely if it's read more than
+// once, because of Retries or for the Tracer. It returns nil otherwise.
+func (m *Migrate) bufferBody(migr *Migration) (*bodyBuffer, error) {
+	if migr.Body == nil || (m.Tracer == nil && migr.Retries == 0) {
+		return nil, nil
+	}
+	return newBodyBuffer(migr.BufferedBody, m.SpillSize)
+}
+
+// migrationApplied reports and logs migr, which started at startTime.
+func (m *Migrate) migrationApplied(migr *Migration, startTime time.Time) {
+	endTime := time.Now()
+	if m.Metrics != nil {
+		m.Metrics.MigrationApplied(migr, endTime.Sub(startTime))
+	}
+	readTime := migr.FinishedReading.Sub(migr.StartedBuffering)
+	runTime := endTime.Sub(migr.FinishedReading)
+
+	// log either verbose or normal
+	if l := m.logger(); l != nil {
+		if l.Verbose() {
+			l.Printf("Finished %v (read %v, ran %v)\n", migr.LogString(), readTime, runTime)
+		} else {
+			l.Printf("%v (%v)\n", migr.LogString(), readTime+runTime)
+		}
+	}
+}
+
+// reportRun reports the outcome of a run started at startTime to m.Metrics.
+func (m *Migrate) reportRun(startTime time.Time, err *error) {
+	duration := time.Now().Sub(startTime)
+	if *err != nil {
+		m.Metrics.RunFailed(*err, duration)
+		return
+	}
+
+	version, _, verr := m.databaseDrv.Version()
+	if verr != nil {
+		m.Metrics.RunFailed(verr, duration)
+		return
+	}
+	m.Metrics.RunFinished(version, duration)
+}
+
+// run proxies the migration body to runFn, Run or RunParallel of the
+// database driver, enforcing the migration's Retries. A
+// migration with retries must be buffered in body, so it can be run again
+// from the start. If body is nil, the driver reads the migration straight
+// from the source.
+func (m *Migrate) run(migr *Migration, body *bodyBuffer, runFn func(io.Reader) error) error {
+	if body == nil {
+		return runFn(migr.BufferedBody)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := runFn(body.Reader())
+		// don't retry after a timeout, canceling closes the driver's connection
+		if err == nil || err == ErrRunTimeout || m.canceled() || attempt >= migr.Retries {
+			return err
+		}
+		m.logPrintf("Retrying %v after error: %v\n", migr.LogString(), err)
+	}
+}
+
+// runFunc returns the function running migr against the database,
+// RunContext with m.Context if the driver implements database.DriverContext.
+// The migration's Timeout cancels the context, and the function returns
+// ErrRunTimeout then. Drivers without DriverContext can't stop a running
+// migration, so ErrTimeoutUnsupported is returned for a migration with a
+// Timeout.
+func (m *Migrate) runFunc(migr *Migration) (func(io.Reader) error, error) {
+	dc, ok := m.databaseDrv.(database.DriverContext)
+	if migr.Timeout <= 0 {
+		if ok && m.Context != nil {
+			return func(r io.Reader) error { return dc.RunContext(m.Context, r) }, nil
+		}
+		return m.databaseDrv.Run, nil
+	}
+	if !ok {
+		return nil, ErrTimeoutUnsupported
+	}
+
+	return func(r io.Reader) error {
+		parent := m.Context
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, cancel := context.WithTimeout(parent, migr.Timeout)
+		defer cancel()
+
+		err := dc.RunContext(ctx, r)
+		if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			return ErrRunTimeout
+		}
+		return err
+	}, nil
+}
+
+// canceled returns true if m.Context is done.
+func (m *Migrate) canceled() bool {
+	return m.Context != nil && m.Context.Err() != nil
+}
+
 // versionExists checks the source if either the up or down migration for
 // the specified migration version exists.
 func (m *Migrate) versionExists(version uint) error {
@@ -760,13 +1225,13 @@ func (m *Migrate) versionExists(version uint) error {
 // because a stop signal was received on the GracefulStop channel.
 // Calls are cheap and this function is not blocking.
 func (m *Migrate) stop() bool {
-	if m.isGracefulStop {
+	if atomic.LoadInt32(&m.isGracefulStop) == 1 {
 		return true
 	}
 
 	select {
 	case <-m.GracefulStop:
-		m.isGracefulStop = true
+		atomic.StoreInt32(&m.isGracefulStop, 1)
 		return true
 
 	default:
@@ -820,6 +1285,18 @@ func (m *Migrate) newMigration(version uint, targetVersion int) (*Migration, err
 		}
 	}
 
+	if mr, ok := m.sourceDrv.(source.MetadataReader); ok {
+		md, err := mr.Metadata(version)
+		if err != nil && !os.IsNotExist(err) {
+			if migr.Body != nil {
+				migr.Body.Close()
+			}
+			return nil, err
+		}
+		migr.Timeout = md.Timeout
+		migr.Retries = md.Retries
+	}
+
 	if m.PrefetchMigrations > 0 && migr.Body != nil {
 		m.logVerbosePrintf("Start buffering %v\n", migr.LogString())
 	} else {
@@ -831,10 +1308,15 @@ func (m *Migrate) newMigration(version uint, targetVersion int) (*Migration, err
 
 // lock is a thread safe helper function to lock the database.
 // It should be called as late as possible when running migrations.
-func (m *Migrate) lock() error {
+func (m *Migrate) lock() (err error) {
 	m.isLockedMu.Lock()
 	defer m.isLockedMu.Unlock()
 
+	if m.Tracer != nil {
+		end := m.Tracer.StartLock()
+		defer func() { end(err) }()
+	}
+
 	if m.isLocked {
 		return ErrLocked
 	}
@@ -847,6 +1329,7 @@ func (m *Migrate) lock() error {
 
 	// use errchan to signal error back to this context
 	errchan := make(chan error, 2)
+	startTime := time.Now()
 
 	// start timeout goroutine
 	timeout := time.After(m.LockTimeout)
@@ -864,7 +1347,18 @@ func (m *Migrate) lock() error {
 
 	// now try to acquire the lock
 	go func() {
-		if err := m.databaseDrv.Lock(); err != nil {
+		// giving up on the lock once m.Context is done beats recording the reason
+		lock := m.databaseDrv.Lock
+		if locker, ok := m.databaseDrv.(database.ReasonLocker); ok && len(m.LockReason) > 0 {
+			lock = func() error { return locker.LockWithReason(m.LockReason) }
+		}
+		if dc, ok := m.databaseDrv.(database.DriverContext); ok && m.Context != nil {
+			lock = func() error { return dc.LockContext(m.Context) }
+		}
+		if locker, ok := m.databaseDrv.(database.ReasonLockerContext); ok && len(m.LockReason) > 0 && m.Context != nil {
+			lock = func() error { return locker.LockWithReasonContext(m.Context, m.LockReason) }
+		}
+		if err := lock(); err != nil {
 			errchan <- err
 		} else {
 			errchan <- nil
@@ -873,9 +1367,12 @@ func (m *Migrate) lock() error {
 	}()
 
 	// wait until we either recieve ErrLockTimeout or error from Lock operation
-	err := <-errchan
+	err = <-errchan
 	if err == nil {
 		m.isLocked = true
+		if m.Metrics != nil {
+			m.Metrics.LockAcquired(time.Now().Sub(startTime))
+		}
 	}
 	return err
 }
@@ -905,16 +1402,31 @@ func (m *Migrate) unlockErr(prevErr error) error {
 	return prevErr
 }
 
+// SetLogger replaces m.Log. Unlike setting m.Log directly,
+// it's safe to call while migrations run.
+func (m *Migrate) SetLogger(l Logger) {
+	m.logMu.Lock()
+	m.Log = l
+	m.logMu.Unlock()
+}
+
+// logger returns m.Log.
+func (m *Migrate) logger() Logger {
+	m.logMu.RLock()
+	defer m.logMu.RUnlock()
+	return m.Log
+}
+
 // logPrintf writes to m.Log if not nil
 func (m *Migrate) logPrintf(format string, v ...interface{}) {
-	if m.Log != nil {
-		m.Log.Printf(format, v...)
+	if l := m.logger(); l != nil {
+		l.Printf(format, v...)
 	}
 }
 
 // logVerbosePrintf writes to m.Log if not nil. Use for verbose logging output.
 func (m *Migrate) logVerbosePrintf(format string, v ...interface{}) {
-	if m.Log != nil && m.Log.Verbose() {
-		m.Log.Printf(format, v...)
+	if l := m.logger(); l != nil && l.Verbose() {
+		l.Printf(format, v...)
 	}
 }
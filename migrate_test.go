@@ -2,14 +2,23 @@ package migrate
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/golang-migrate/migrate/database"
 	dStub "github.com/golang-migrate/migrate/database/stub"
 	"github.com/golang-migrate/migrate/source"
+	"github.com/golang-migrate/migrate/source/sidecar"
 	sStub "github.com/golang-migrate/migrate/source/stub"
 )
 
@@ -955,6 +964,88 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunString(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.RunString("CREATE 1"); err != nil {
+		t.Fatal(err)
+	}
+	if string(dbDrv.LastRunMigration) != "CREATE 1" {
+		t.Errorf("expected CREATE 1 to run, got %q", dbDrv.LastRunMigration)
+	}
+	if _, _, err := m.Version(); err != ErrNilVersion {
+		t.Errorf("expected ErrNilVersion, got %v", err)
+	}
+
+	if err := m.RunStringWithVersion("CREATE 2", 2); err != nil {
+		t.Fatal(err)
+	}
+	if string(dbDrv.LastRunMigration) != "CREATE 2" {
+		t.Errorf("expected CREATE 2 to run, got %q", dbDrv.LastRunMigration)
+	}
+	v, dirty, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 || dirty {
+		t.Errorf("expected version 2, got %v (dirty %v)", v, dirty)
+	}
+
+	if err := m.RunStringWithVersion("CREATE 3", -1); err == nil {
+		t.Error("expected error for negative version")
+	}
+
+	dbDrv.IsDirty = true
+	if err := m.RunString("CREATE 4"); err == nil {
+		t.Error("expected ErrDirty")
+	}
+}
+
+// changeStub reports a change for migrations other than "NOOP".
+type changeStub struct {
+	*dStub.Stub
+}
+
+func (s *changeStub) WouldChange(migration io.Reader) (bool, error) {
+	m, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return false, err
+	}
+	return string(m) != "NOOP", nil
+}
+
+func TestWouldChange(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	if _, err := m.WouldChange(bytes.NewBufferString("CREATE 1")); err != ErrWouldChangeUnsupported {
+		t.Fatalf("expected ErrWouldChangeUnsupported, got %v", err)
+	}
+
+	dbDrv := &changeStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+
+	testcases := []struct {
+		migration string
+		expected  bool
+	}{
+		{migration: "CREATE 1", expected: true},
+		{migration: "NOOP", expected: false},
+	}
+
+	for _, tc := range testcases {
+		changed, err := m.WouldChange(bytes.NewBufferString(tc.migration))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != tc.expected {
+			t.Errorf("expected %v for %v, got %v", tc.expected, tc.migration, changed)
+		}
+	}
+	if dbDrv.IsLocked {
+		t.Error("expected database to be unlocked")
+	}
+}
+
 func TestRunDirty(t *testing.T) {
 	m, _ := New("stub://", "stub://")
 	dbDrv := m.databaseDrv.(*dStub.Stub)
@@ -1307,6 +1398,620 @@ func TestLock(t *testing.T) {
 	}
 }
 
+// reasonStub records the reason it was locked with.
+type reasonStub struct {
+	*dStub.Stub
+	reason string
+}
+
+func (s *reasonStub) LockWithReason(reason string) error {
+	s.reason = reason
+	return s.Stub.Lock()
+}
+
+func TestLockWithReason(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	db := &reasonStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = db
+
+	m.LockReason = "deploy 4512 by CI"
+	if err := m.lock(); err != nil {
+		t.Fatal(err)
+	}
+	if db.reason != "deploy 4512 by CI" {
+		t.Errorf("expected the lock reason to be passed, got %q", db.reason)
+	}
+}
+
+// reasonContextStub records the reason and context it was locked with.
+type reasonContextStub struct {
+	*contextStub
+	reason string
+	ctx    context.Context
+}
+
+func (s *reasonContextStub) LockWithReason(reason string) error {
+	s.reason = reason
+	return s.Stub.Lock()
+}
+
+func (s *reasonContextStub) LockWithReasonContext(ctx context.Context, reason string) error {
+	s.ctx, s.reason = ctx, reason
+	return s.Stub.Lock()
+}
+
+func TestLockWithReasonContext(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	db := &reasonContextStub{contextStub: &contextStub{Stub: m.databaseDrv.(*dStub.Stub)}}
+	m.databaseDrv = db
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Context = ctx
+	m.LockReason = "deploy 4512 by CI"
+	if err := m.lock(); err != nil {
+		t.Fatal(err)
+	}
+	if db.ctx != ctx || db.reason != "deploy 4512 by CI" {
+		t.Errorf("expected the context and lock reason to be passed, got %v and %q", db.ctx, db.reason)
+	}
+	if err := m.unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// without ReasonLockerContext, the lock can still be given up
+	m.databaseDrv = db.contextStub
+	if err := m.lock(); err != nil {
+		t.Fatal(err)
+	}
+	if db.locks != 1 {
+		t.Errorf("expected LockContext to be used, got %v calls", db.locks)
+	}
+}
+
+// slowStub delays Run and lets the first failures calls to Run fail.
+type slowStub struct {
+	*dStub.Stub
+	delay    time.Duration
+	failures int
+}
+
+func (s *slowStub) Run(migration io.Reader) error {
+	if s.failures > 0 {
+		s.failures--
+		return fmt.Errorf("run failed")
+	}
+	time.Sleep(s.delay)
+	return s.Stub.Run(migration)
+}
+
+func newSidecarMigrate(t *testing.T, sidecarFile, content string, dbInst database.Driver) *Migrate {
+	dir, err := ioutil.TempDir("", "migrate-sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, sidecarFile), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sInst, err := sStub.WithInstance(nil, &sStub.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sInst.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	sc, err := sidecar.WithInstance(sInst, &sidecar.Config{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewWithInstance("sidecar", sc, "stub", dbInst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSidecarTimeout(t *testing.T) {
+	dbInst, _ := dStub.WithInstance(nil, &dStub.Config{})
+	db := &contextStub{Stub: dbInst.(*dStub.Stub), hang: "CREATE 1"}
+	m := newSidecarMigrate(t, "0001_create.json", `{"timeout": "10ms"}`, db)
+
+	if err := m.Steps(1); err != ErrRunTimeout {
+		t.Fatalf("expected ErrRunTimeout, got %v", err)
+	}
+	if db.canceled != context.DeadlineExceeded {
+		t.Errorf("expected the migration to be canceled by the deadline, got %v", db.canceled)
+	}
+
+	v, dirty, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 || !dirty {
+		t.Errorf("expected version 1 (dirty), got %v (dirty %v)", v, dirty)
+	}
+}
+
+func TestSidecarTimeoutUnsupported(t *testing.T) {
+	dbInst, _ := dStub.WithInstance(nil, &dStub.Config{})
+	m := newSidecarMigrate(t, "0001_create.json", `{"timeout": "10ms"}`, dbInst)
+
+	if err := m.Steps(1); err != ErrTimeoutUnsupported {
+		t.Fatalf("expected ErrTimeoutUnsupported, got %v", err)
+	}
+	if v, _, _ := dbInst.Version(); v != database.NilVersion {
+		t.Errorf("expected no version, got %v", v)
+	}
+}
+
+func TestSidecarRetries(t *testing.T) {
+	dbInst, _ := dStub.WithInstance(nil, &dStub.Config{})
+	db := &slowStub{Stub: dbInst.(*dStub.Stub), failures: 2}
+	m := newSidecarMigrate(t, "1_create.json", `{"retries": 2}`, db)
+
+	if err := m.Steps(1); err != nil {
+		t.Fatal(err)
+	}
+	equalDbSeq(t, 0, newMigSeq(M(1)), db.Stub)
+
+	db.failures = 2
+	m = newSidecarMigrate(t, "3_create.json", `{"retries": 1}`, db)
+	if err := m.Steps(1); err == nil {
+		t.Fatal("expected error after exhausting retries")
+	}
+}
+
+func TestSidecarRetriesSpilled(t *testing.T) {
+	dbInst, _ := dStub.WithInstance(nil, &dStub.Config{})
+	db := &slowStub{Stub: dbInst.(*dStub.Stub), failures: 2}
+	m := newSidecarMigrate(t, "1_create.json", `{"retries": 2}`, db)
+	// the migration is read from a temporary file for every attempt
+	m.SpillSize = 1
+
+	if err := m.Steps(1); err != nil {
+		t.Fatal(err)
+	}
+	equalDbSeq(t, 0, newMigSeq(M(1)), db.Stub)
+}
+
+func TestPrefetchBytes(t *testing.T) {
+	testcases := []struct {
+		name          string
+		prefetchBytes uint
+		expectedPeak  uint
+	}{
+		{name: "no limit", prefetchBytes: 0, expectedPeak: 4 * DefaultBufferSize},
+		{name: "two migrations", prefetchBytes: 2 * DefaultBufferSize, expectedPeak: 2 * DefaultBufferSize},
+		{name: "less than one migration", prefetchBytes: 1, expectedPeak: 1},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, _ := New("stub://", "stub://")
+			m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+			// the source is fast, so migrations are buffered as far
+			// ahead as allowed while the first one runs
+			db := &slowStub{Stub: m.databaseDrv.(*dStub.Stub), delay: 50 * time.Millisecond}
+			m.databaseDrv = db
+			m.PrefetchBytes = tc.prefetchBytes
+
+			if err := m.Up(); err != nil {
+				t.Fatal(err)
+			}
+			equalDbSeq(t, 0, newMigSeq(M(1), M(3), M(4), M(7)), db.Stub)
+
+			if m.prefetch.peak != tc.expectedPeak {
+				t.Errorf("expected up to %v bytes to be buffered at once, got %v", tc.expectedPeak, m.prefetch.peak)
+			}
+		})
+	}
+}
+
+// nopLogger discards everything logged.
+type nopLogger struct{ verbose bool }
+
+func (l nopLogger) Printf(format string, v ...interface{}) {}
+func (l nopLogger) Verbose() bool                          { return l.verbose }
+
+// TestInspectWhileRunning is meant to be run with -race.
+func TestInspectWhileRunning(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	db := &slowStub{Stub: m.databaseDrv.(*dStub.Stub), delay: 10 * time.Millisecond}
+	m.databaseDrv = db
+	m.Log = nopLogger{verbose: true}
+
+	done := make(chan error, 1)
+	go func() { done <- m.Up() }()
+
+	for polls := 0; ; polls++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if polls == 0 {
+				t.Fatal("expected to inspect the instance while migrating")
+			}
+			equalDbSeq(t, 0, newMigSeq(M(1), M(3), M(4), M(7)), db.Stub)
+			return
+		default:
+		}
+
+		if _, _, err := m.Version(); err != nil && err != ErrNilVersion {
+			t.Fatal(err)
+		}
+		m.SetLogger(nopLogger{verbose: polls%2 == 0})
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGracefulStopWhileRunning(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	db := &slowStub{Stub: m.databaseDrv.(*dStub.Stub), delay: 50 * time.Millisecond}
+	m.databaseDrv = db
+
+	done := make(chan error, 1)
+	go func() { done <- m.Up() }()
+
+	// stop while the first migration runs
+	for {
+		if v, _, err := m.Version(); err == nil && v == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m.GracefulStop <- true
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	v, dirty, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 || dirty {
+		t.Errorf("expected version 1 (clean), got %v (dirty %v)", v, dirty)
+	}
+	equalDbSeq(t, 0, newMigSeq(M(1)), db.Stub)
+}
+
+func TestBetweenMigrations(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbInst := m.databaseDrv.(*dStub.Stub)
+
+	errAbort := fmt.Errorf("not approved")
+	asked := make([]int, 0)
+	m.BetweenMigrations = func(nextVersion int) error {
+		asked = append(asked, nextVersion)
+		if nextVersion == 4 {
+			return errAbort
+		}
+		return nil
+	}
+
+	if err := m.Up(); err != errAbort {
+		t.Fatalf("expected %v, got %v", errAbort, err)
+	}
+	if !reflect.DeepEqual(asked, []int{1, 3, 4}) {
+		t.Errorf("expected to be asked for versions [1 3 4], got %v", asked)
+	}
+	equalDbSeq(t, 0, newMigSeq(M(1), M(3)), dbInst)
+
+	// the versions before are applied and the lock is released
+	v, dirty, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 3 || dirty {
+		t.Errorf("expected version 3 (clean), got %v (dirty %v)", v, dirty)
+	}
+	if dbInst.IsLocked {
+		t.Error("expected the database to be unlocked")
+	}
+
+	// down migrations are announced with the version they lead to
+	asked = asked[:0]
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(asked, []int{1, -1}) {
+		t.Errorf("expected to be asked for versions [1 -1], got %v", asked)
+	}
+}
+
+func TestAfterAllMigrations(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbInst := m.databaseDrv.(*dStub.Stub)
+
+	var called []int
+	var locked []bool
+	errHook := fmt.Errorf("cache warm failed")
+	hookErr := error(nil)
+	m.AfterAllMigrations = func(finalVersion int) error {
+		called = append(called, finalVersion)
+		locked = append(locked, dbInst.IsLocked)
+		return hookErr
+	}
+
+	// once for all the migrations of a run, while locked
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(called, []int{7}) || !locked[0] {
+		t.Errorf("expected one call for version 7 while locked, got %v (locked %v)", called, locked)
+	}
+
+	// not without a pending migration
+	if err := m.Up(); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	if len(called) != 1 {
+		t.Errorf("expected no call without pending migrations, got %v", called)
+	}
+
+	// an error fails the run, the migrations stay applied
+	hookErr = errHook
+	if err := m.Down(); err != errHook {
+		t.Fatalf("expected %v, got %v", errHook, err)
+	}
+	if !reflect.DeepEqual(called, []int{7, -1}) {
+		t.Errorf("expected a call for NilVersion, got %v", called)
+	}
+	if v, _, err := dbInst.Version(); err != nil || v != database.NilVersion {
+		t.Errorf("expected NilVersion, got %v (%v)", v, err)
+	}
+	if dbInst.IsLocked {
+		t.Error("expected the database to be unlocked")
+	}
+}
+
+// namedStub records the names passed to SetVersionWithName.
+type namedStub struct {
+	*dStub.Stub
+	names []string
+}
+
+func (s *namedStub) SetVersionWithName(version int, dirty bool, name string) error {
+	s.names = append(s.names, fmt.Sprintf("%v %v %v", version, dirty, name))
+	return s.Stub.SetVersion(version, dirty)
+}
+
+func TestSetVersionWithName(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbInst := &namedStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbInst
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"1 true 1.up.stub", "1 false 1.up.stub", "3 true 3.up.stub", "3 false 3.up.stub", "4 true 4.up.stub", "4 false 4.up.stub"}
+	if !reflect.DeepEqual(dbInst.names, expected) {
+		t.Errorf("expected the up migrations to be named %q, got %q", expected, dbInst.names)
+	}
+
+	// down migrations don't know the name of the version they lead to
+	dbInst.names = nil
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+	if len(dbInst.names) != 0 {
+		t.Errorf("expected no names for down migrations, got %q", dbInst.names)
+	}
+	if v, dirty, _ := dbInst.Version(); v != 3 || dirty {
+		t.Errorf("expected clean version 3, got %v %v", v, dirty)
+	}
+}
+
+// contextStub adds database.DriverContext to the stub database driver.
+// RunContext blocks until ctx is done for the migration hang.
+type contextStub struct {
+	*dStub.Stub
+	hang     string
+	locks    int
+	runs     int
+	canceled error
+}
+
+func (s *contextStub) LockContext(ctx context.Context) error {
+	s.locks++
+	return s.Stub.Lock()
+}
+
+func (s *contextStub) RunContext(ctx context.Context, migration io.Reader) error {
+	s.runs++
+	b, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	if string(b) == s.hang {
+		<-ctx.Done()
+		s.canceled = ctx.Err()
+		return s.canceled
+	}
+	return s.Stub.Run(bytes.NewReader(b))
+}
+
+func (s *contextStub) SetVersionContext(ctx context.Context, version int, dirty bool) error {
+	return s.Stub.SetVersion(version, dirty)
+}
+
+func (s *contextStub) VersionContext(ctx context.Context) (int, bool, error) {
+	return s.Stub.Version()
+}
+
+func TestContext(t *testing.T) {
+	dbInst, _ := dStub.WithInstance(nil, &dStub.Config{})
+	db := &contextStub{Stub: dbInst.(*dStub.Stub), hang: "CREATE 3"}
+	m := newSidecarMigrate(t, "3_create.json", `{"retries": 2}`, db)
+	m.OnFailure = DeleteRow
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.Context = ctx
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := m.Migrate(3); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if db.locks != 1 || db.runs != 2 {
+		t.Errorf("expected 1 lock and 2 runs, without retries, got %v and %v", db.locks, db.runs)
+	}
+	// the canceled migration may be applied partially
+	if v, dirty, _ := db.Version(); v != 3 || !dirty {
+		t.Errorf("expected dirty version 3, got %v %v", v, dirty)
+	}
+}
+
+// countingSource counts the migration bodies it opens and the calls to
+// their Close methods. Metadata fails for failMetadata.
+type countingSource struct {
+	source.Driver
+	failMetadata uint
+
+	opened, closed int32
+}
+
+func (s *countingSource) ReadUp(version uint) (io.ReadCloser, string, error) {
+	r, identifier, err := s.Driver.ReadUp(version)
+	return s.count(r), identifier, err
+}
+
+func (s *countingSource) ReadDown(version uint) (io.ReadCloser, string, error) {
+	r, identifier, err := s.Driver.ReadDown(version)
+	return s.count(r), identifier, err
+}
+
+func (s *countingSource) Metadata(version uint) (source.Metadata, error) {
+	if version == s.failMetadata {
+		return source.Metadata{}, fmt.Errorf("metadata of %v unreadable", version)
+	}
+	return source.Metadata{}, os.ErrNotExist
+}
+
+func (s *countingSource) count(r io.ReadCloser) io.ReadCloser {
+	if r == nil {
+		return nil
+	}
+	atomic.AddInt32(&s.opened, 1)
+	return &countingBody{ReadCloser: r, closed: &s.closed}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	closed *int32
+}
+
+func (b *countingBody) Close() error {
+	atomic.AddInt32(b.closed, 1)
+	return b.ReadCloser.Close()
+}
+
+func TestBodiesClosed(t *testing.T) {
+	errAbort := fmt.Errorf("not approved")
+
+	testcases := []struct {
+		name         string
+		failMetadata uint
+		failures     int
+		abortAt      int
+		expectedErr  bool
+	}{
+		{name: "success"},
+		{name: "migration fails", failures: 1, expectedErr: true},
+		{name: "run aborted", abortAt: 4, expectedErr: true},
+		{name: "metadata fails", failMetadata: 4, expectedErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			sInst, _ := sStub.WithInstance(nil, &sStub.Config{})
+			sInst.(*sStub.Stub).Migrations = sourceStubMigrations
+			src := &countingSource{Driver: sInst, failMetadata: tc.failMetadata}
+
+			dbInst, _ := dStub.WithInstance(nil, &dStub.Config{})
+			db := &slowStub{Stub: dbInst.(*dStub.Stub), failures: tc.failures}
+
+			m, _ := NewWithInstance("stub", src, "stub", db)
+			m.BetweenMigrations = func(nextVersion int) error {
+				if nextVersion == tc.abortAt {
+					return errAbort
+				}
+				return nil
+			}
+
+			if err := m.Up(); (err != nil) != tc.expectedErr {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+
+			// bodies left over are closed by the goroutines buffering them
+			deadline := time.Now().Add(time.Second)
+			for atomic.LoadInt32(&src.closed) != atomic.LoadInt32(&src.opened) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if opened, closed := atomic.LoadInt32(&src.opened), atomic.LoadInt32(&src.closed); opened == 0 || closed != opened {
+				t.Errorf("expected all %v bodies opened to be closed once, got %v calls to Close", opened, closed)
+			}
+		})
+	}
+}
+
+func TestOnFailure(t *testing.T) {
+	testcases := []struct {
+		name      string
+		onFailure FailureMode
+		steps     int
+		version   uint
+		dirty     bool
+		nilVer    bool
+	}{
+		{name: "mark dirty", onFailure: MarkDirty, steps: 0, version: 1, dirty: true},
+		{name: "delete row", onFailure: DeleteRow, steps: 0, nilVer: true},
+		{name: "mark dirty after first", onFailure: MarkDirty, steps: 1, version: 3, dirty: true},
+		{name: "delete row after first", onFailure: DeleteRow, steps: 1, version: 1, dirty: false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, _ := New("stub://", "stub://")
+			m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+			db := &slowStub{Stub: m.databaseDrv.(*dStub.Stub)}
+			m.databaseDrv = db
+			m.OnFailure = tc.onFailure
+
+			if tc.steps > 0 {
+				if err := m.Steps(tc.steps); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db.failures = 1
+			if err := m.Steps(1); err == nil {
+				t.Fatal("expected error")
+			}
+
+			v, dirty, err := m.Version()
+			if tc.nilVer {
+				if err != ErrNilVersion {
+					t.Fatalf("expected ErrNilVersion, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != tc.version || dirty != tc.dirty {
+				t.Errorf("expected version %v (dirty %v), got %v (dirty %v)", tc.version, tc.dirty, v, dirty)
+			}
+		})
+	}
+}
+
 func migrationsFromChannel(ret chan interface{}) ([]*Migration, error) {
 	slice := make([]*Migration, 0)
 	for r := range ret {
@@ -1402,3 +2107,40 @@ func equalDbSeq(t *testing.T, i int, expected migrationSequence, got *dStub.Stub
 		t.Fatalf("\nexpected sequence %v,\ngot               %v, in %v", bs, got.MigrationSequence, i)
 	}
 }
+
+// repairStub removes a fixed number of duplicate version rows.
+type repairStub struct {
+	*dStub.Stub
+	duplicates int
+}
+
+func (s *repairStub) RepairDuplicates() (int, error) {
+	removed := s.duplicates
+	s.duplicates = 0
+	return removed, nil
+}
+
+func TestRepairDuplicates(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	if _, err := m.RepairDuplicates(); err != ErrRepairUnsupported {
+		t.Fatalf("expected ErrRepairUnsupported, got %v", err)
+	}
+
+	dbDrv := &repairStub{Stub: m.databaseDrv.(*dStub.Stub), duplicates: 2}
+	m.databaseDrv = dbDrv
+
+	removed, err := m.RepairDuplicates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("expected 2 removed rows, got %v", removed)
+	}
+	if dbDrv.IsLocked {
+		t.Error("expected the lock to be released")
+	}
+
+	if removed, err := m.RepairDuplicates(); err != nil || removed != 0 {
+		t.Errorf("expected nothing to repair, got %v, %v", removed, err)
+	}
+}
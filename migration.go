@@ -2,8 +2,12 @@ package migrate
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"time"
 )
 
@@ -11,6 +15,14 @@ import (
 // pre-read migration (see DefaultPrefetchMigrations).
 var DefaultBufferSize = uint(100000)
 
+// DefaultSpillSize sets how many bytes of a migration that is read more than
+// once, because it has Retries or Migrate.Tracer is set, are kept in memory.
+// Larger migrations are written to a temporary file.
+var DefaultSpillSize = uint(32 * 1024 * 1024)
+
+// utf8BOM is the byte order mark some editors put in front of UTF-8 files.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
 // Migration holds information about a migration.
 // It is initially created from data coming from the source and then
 // used when run against the database.
@@ -36,6 +48,13 @@ type Migration struct {
 	// BufferSize defaults to DefaultBufferSize
 	BufferSize uint
 
+	// Timeout limits how long running this migration may take.
+	// Zero means no limit.
+	Timeout time.Duration
+
+	// Retries is how often this migration is run again if it fails.
+	Retries int
+
 	// bufferWriter holds an io.WriteCloser and pipes to BufferBody.
 	// It's an *Closer for flow control.
 	bufferWriter io.WriteCloser
@@ -52,8 +71,13 @@ type Migration struct {
 	// FinishedReading is the time when the migration source is fully read.
 	FinishedReading time.Time
 
-	// BytesRead holds the number of Bytes read from the migration source.
+	// BytesRead holds the number of Bytes read from the migration source,
+	// not counting a leading UTF-8 byte order mark.
 	BytesRead int64
+
+	// Checksum holds the SHA-256 of the bytes read from BufferedBody. It's
+	// computed while buffering and set before BufferedBody reports io.EOF.
+	Checksum []byte
 }
 
 // NewMigration returns a new Migration and sets the body, identifier,
@@ -129,19 +153,27 @@ func (m *Migration) Buffer() error {
 
 	// start reading from body, peek won't move the read pointer though
 	// poor man's solution?
-	b.Peek(int(m.BufferSize))
+	buf, _ := b.Peek(int(m.BufferSize))
+
+	// databases reject a byte order mark in front of the first statement
+	if bytes.HasPrefix(buf, utf8BOM) {
+		b.Discard(len(utf8BOM))
+	}
 
 	m.FinishedBuffering = time.Now()
 
 	// write to bufferWriter, this will block until
 	// something starts reading from m.Buffer
-	n, err := b.WriteTo(m.bufferWriter)
+	h := sha256.New()
+	n, err := io.Copy(m.bufferWriter, io.TeeReader(b, h))
 	if err != nil {
+		m.Body.Close()
 		return err
 	}
 
 	m.FinishedReading = time.Now()
 	m.BytesRead = n
+	m.Checksum = h.Sum(nil)
 
 	// close bufferWriter so Buffer knows that there is no
 	// more data coming
@@ -152,3 +184,67 @@ func (m *Migration) Buffer() error {
 
 	return nil
 }
+
+// discardBuffer closes BufferedBody of a migration that won't be read to
+// the end. Buffer then fails, closes Body and frees the bytes it holds.
+func (m *Migration) discardBuffer() {
+	if m.Body == nil {
+		return
+	}
+	if c, ok := m.BufferedBody.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// bodyBuffer holds a migration body, so that it can be read more than once.
+type bodyBuffer struct {
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+// newBodyBuffer reads r completely. Up to max bytes are kept in memory,
+// larger bodies are written to a temporary file.
+func newBodyBuffer(r io.Reader, max uint) (*bodyBuffer, error) {
+	buf := &bytes.Buffer{}
+	n, err := io.CopyN(buf, r, int64(max)+1)
+	if err == io.EOF {
+		return &bodyBuffer{mem: buf.Bytes(), size: n}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "migrate")
+	if err != nil {
+		return nil, err
+	}
+	b := &bodyBuffer{file: f}
+	if _, err := buf.WriteTo(f); err != nil {
+		b.Close()
+		return nil, err
+	}
+	rest, err := io.Copy(f, r)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	b.size = n + rest
+	return b, nil
+}
+
+// Reader returns a new reader of the whole body.
+func (b *bodyBuffer) Reader() io.Reader {
+	if b.file == nil {
+		return bytes.NewReader(b.mem)
+	}
+	return io.NewSectionReader(b.file, 0, b.size)
+}
+
+// Close removes the temporary file, if any.
+func (b *bodyBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
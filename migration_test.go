@@ -1,10 +1,14 @@
 package migrate
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"strings"
+	"testing"
 )
 
 func ExampleNewMigration() {
@@ -54,3 +58,121 @@ func ExampleNewMigration_nilVersion() {
 	// Output:
 	// 1486686016/d drop_users_table
 }
+
+func TestBufferByteOrderMark(t *testing.T) {
+	testcases := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "without byte order mark", body: "SELECT 1;\r\n", expected: "SELECT 1;\r\n"},
+		{name: "with byte order mark", body: "\xef\xbb\xbfSELECT 1;\r\n", expected: "SELECT 1;\r\n"},
+		{name: "only byte order mark", body: "\xef\xbb\xbf", expected: ""},
+		{name: "byte order mark not leading", body: "SELECT '\xef\xbb\xbf';", expected: "SELECT '\xef\xbb\xbf';"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			migr, err := NewMigration(ioutil.NopCloser(strings.NewReader(tc.body)), "", 1, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go migr.Buffer()
+
+			got, err := ioutil.ReadAll(migr.BufferedBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestBufferChecksum(t *testing.T) {
+	testcases := []struct {
+		name string
+		body string
+		max  uint
+	}{
+		{name: "in memory", body: "SELECT 1;", max: 64},
+		{name: "spilled", body: "SELECT 1;", max: 4},
+		{name: "with byte order mark", body: "\xef\xbb\xbfSELECT 1;", max: 4},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			migr, err := NewMigration(ioutil.NopCloser(strings.NewReader(tc.body)), "", 1, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go migr.Buffer()
+
+			b, err := newBodyBuffer(migr.BufferedBody, tc.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			got, err := ioutil.ReadAll(b.Reader())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the checksum covers the bytes delivered, without the byte order mark
+			expected := sha256.Sum256(got)
+			if !bytes.Equal(migr.Checksum, expected[:]) {
+				t.Errorf("expected checksum %x, got %x", expected, migr.Checksum)
+			}
+			if string(got) != strings.TrimPrefix(tc.body, "\xef\xbb\xbf") {
+				t.Errorf("expected %q, got %q", tc.body, got)
+			}
+		})
+	}
+}
+
+func TestBodyBuffer(t *testing.T) {
+	testcases := []struct {
+		name    string
+		body    string
+		max     uint
+		spilled bool
+	}{
+		{name: "empty", body: "", max: 4},
+		{name: "in memory", body: "SELECT 1;", max: 9},
+		{name: "spilled", body: "SELECT 1;", max: 8, spilled: true},
+		{name: "nothing in memory", body: "SELECT 1;", max: 0, spilled: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := newBodyBuffer(strings.NewReader(tc.body), tc.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spilled := b.file != nil; spilled != tc.spilled {
+				t.Fatalf("expected spilled to be %v, got %v", tc.spilled, spilled)
+			}
+
+			// the body can be read more than once
+			for i := 0; i < 2; i++ {
+				got, err := ioutil.ReadAll(b.Reader())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != tc.body {
+					t.Fatalf("expected %q, got %q", tc.body, got)
+				}
+			}
+
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if b.file != nil {
+				if _, err := os.Stat(b.file.Name()); !os.IsNotExist(err) {
+					t.Errorf("expected the temporary file to be removed, got %v", err)
+				}
+			}
+		})
+	}
+}
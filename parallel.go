@@ -0,0 +1,284 @@
+package migrate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-migrate/migrate/database"
+)
+
+// GroupMarker makes an up migration a member of a parallel group if it
+// starts one of the comment lines at the top of the migration, e.g.
+//
+//	-- migrate:group bootstrap-tables
+//	CREATE TABLE users (id int);
+//
+// Contiguous pending migrations of the same group don't depend on each
+// other, so Migrate runs up to MaxParallel of them at the same time, if the
+// database driver implements database.ParallelRunner. Use it for
+// migrations like the CREATE TABLEs bootstrapping a new database.
+const GroupMarker = "migrate:group"
+
+// groupHeaderSize is how much of a migration is read to find its group.
+const groupHeaderSize = 4096
+
+// ErrGroupFailed is returned if migrations of a parallel group failed. The
+// migrations of the group that weren't started yet when the first one
+// failed aren't run.
+type ErrGroupFailed struct {
+	Group string
+
+	// Succeeded are the versions applied, ordered.
+	Succeeded []uint
+
+	// Failed are the errors of the versions that failed.
+	Failed map[uint]error
+}
+
+func (e ErrGroupFailed) Error() string {
+	failed := make([]string, 0, len(e.Failed))
+	for _, v := range e.failedVersions() {
+		failed = append(failed, fmt.Sprintf("%v: %v", v, e.Failed[v]))
+	}
+	return fmt.Sprintf("parallel group %v failed: %v (applied %v)", e.Group, strings.Join(failed, "; "), e.Succeeded)
+}
+
+// failedVersions returns the failed versions, ordered.
+func (e ErrGroupFailed) failedVersions() []uint {
+	versions := make([]uint, 0, len(e.Failed))
+	for v := range e.Failed {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// parseGroup returns the group a GroupMarker in the leading comment lines of
+// header names, if any.
+func parseGroup(header []byte) string {
+	for _, line := range strings.Split(string(header), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			return ""
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "--"))
+		if len(fields) == 2 && fields[0] == GroupMarker {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// peekReader lets the start of a migration body be read without consuming
+// it. It closes the reader it wraps, so that discardBuffer still works.
+type peekReader struct {
+	*bufio.Reader
+	body io.Reader
+}
+
+func (r *peekReader) Close() error {
+	if c, ok := r.body.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// group returns the parallel group of the migration, see GroupMarker.
+func (m *Migration) group() string {
+	if m.BufferedBody == nil {
+		return ""
+	}
+	r, ok := m.BufferedBody.(*peekReader)
+	if !ok {
+		r = &peekReader{Reader: bufio.NewReaderSize(m.BufferedBody, groupHeaderSize), body: m.BufferedBody}
+		m.BufferedBody = r
+	}
+	// errors are returned again once the migration is read
+	header, _ := r.Peek(groupHeaderSize)
+	return parseGroup(header)
+}
+
+// parallelGroup returns the parallel group of migr if it's run in parallel.
+// Migrations with a Timeout are run on their own, RunParallel can't be
+// canceled.
+func (m *Migrate) parallelGroup(migr *Migration) string {
+	if m.MaxParallel < 2 || migr.Body == nil || migr.Timeout > 0 || migr.TargetVersion < int(migr.Version) {
+		return ""
+	}
+	if _, ok := m.databaseDrv.(database.ParallelRunner); !ok || !database.Capabilities(m.databaseDrv).SupportsParallelRun {
+		return ""
+	}
+	return migr.group()
+}
+
+// applyGroup runs first and the migrations following it in ret that belong
+// to the same parallel group, up to MaxParallel at a time. It returns the
+// first value it read from ret that doesn't belong to the group, if any.
+//
+// The version is set to the first migration, dirty, while the group runs,
+// and to the last one once all succeeded. A driver implementing
+// database.VersionHistory gets a row for every migration, dirty until it
+// succeeded. If a migration fails, no more migrations of the group are
+// started, the version is set to the lowest failed one, dirty, and
+// ErrGroupFailed is returned once the running ones ended. OnFailure doesn't
+// apply to groups.
+func (m *Migrate) applyGroup(group string, first *Migration, ret <-chan interface{}) (next interface{}, err error) {
+	m.logVerbosePrintf("Start parallel group %v\n", group)
+
+	// mu serializes the bookkeeping of the workers and guards the results
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		succeeded []uint
+		failed    = make(map[uint]error)
+	)
+	failing := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(failed) > 0
+	}
+
+	jobs := make(chan *Migration)
+	for i := 0; i < m.MaxParallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for migr := range jobs {
+				if failing() {
+					migr.discardBuffer()
+					continue
+				}
+				err := m.applyParallel(migr, &mu)
+				mu.Lock()
+				if err != nil {
+					failed[migr.Version] = err
+				} else {
+					succeeded = append(succeeded, migr.Version)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var last *Migration
+	migr := first
+	for {
+		if failing() {
+			migr.discardBuffer()
+			break
+		}
+		if m.BetweenMigrations != nil {
+			if err = m.BetweenMigrations(migr.TargetVersion); err != nil {
+				migr.discardBuffer()
+				break
+			}
+		}
+		if last == nil {
+			if err = m.setVersion(first, true); err != nil {
+				migr.discardBuffer()
+				break
+			}
+		}
+		jobs <- migr
+		last = migr
+
+		r, ok := <-ret
+		if !ok {
+			break
+		}
+		nextMigr, isMigr := r.(*Migration)
+		if !isMigr || m.stop() || m.parallelGroup(nextMigr) != group {
+			next = r
+			break
+		}
+		migr = nextMigr
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Slice(succeeded, func(i, j int) bool { return succeeded[i] < succeeded[j] })
+		gerr := ErrGroupFailed{Group: group, Succeeded: succeeded, Failed: failed}
+		if verr := m.databaseDrv.SetVersion(int(gerr.failedVersions()[0]), true); verr != nil {
+			return next, database.Append(gerr, verr)
+		}
+		return next, gerr
+	}
+
+	// all migrations started succeeded, the last one is the highest
+	if last != nil {
+		if verr := m.setVersion(last, false); verr != nil {
+			return next, verr
+		}
+	}
+	return next, err
+}
+
+// applyParallel runs migr of a parallel group with RunParallel. mu
+// serializes the bookkeeping with the other migrations of the group.
+func (m *Migrate) applyParallel(migr *Migration, mu *sync.Mutex) (err error) {
+	if m.Audit != nil {
+		defer func(startTime time.Time) { m.audit(migr, startTime, err) }(time.Now())
+	}
+
+	body, err := m.bufferBody(migr)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		defer body.Close()
+	}
+
+	if m.Tracer != nil {
+		statements, cerr := countStatements(body)
+		if cerr != nil {
+			return cerr
+		}
+		mu.Lock()
+		end := m.Tracer.StartMigration(migr, statements)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			end(err)
+			mu.Unlock()
+		}()
+	}
+
+	startTime := time.Now()
+	mu.Lock()
+	err = m.recordHistory(migr, true)
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.logVerbosePrintf("Read and execute %v in parallel\n", migr.LogString())
+	runner := m.databaseDrv.(database.ParallelRunner)
+	runStart := time.Now()
+	if err := m.run(migr, body, runner.RunParallel); err != nil {
+		return err
+	}
+	runTime := time.Since(runStart)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err := m.recordHistory(migr, false); err != nil {
+		return err
+	}
+	if err := m.recordChecksum(migr); err != nil {
+		return err
+	}
+	if err := m.recordDuration(migr, runTime); err != nil {
+		return err
+	}
+	m.migrationApplied(migr, startTime)
+	return nil
+}
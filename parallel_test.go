@@ -0,0 +1,199 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dStub "github.com/golang-migrate/migrate/database/stub"
+	"github.com/golang-migrate/migrate/source"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+// parallelStub runs migrations in parallel and records the highest number
+// running at once. Migrations containing FAIL fail right away.
+type parallelStub struct {
+	*dStub.Stub
+	delay time.Duration
+
+	mu      sync.Mutex
+	running int
+	peak    int
+	ran     []string
+}
+
+func (s *parallelStub) RunParallel(migration io.Reader) error {
+	b, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+
+	if strings.Contains(string(b), "FAIL") {
+		return fmt.Errorf("migration failed")
+	}
+
+	s.mu.Lock()
+	s.running++
+	if s.running > s.peak {
+		s.peak = s.running
+	}
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.ran = append(s.ran, string(b))
+	return nil
+}
+
+// newParallelMigrate returns a Migrate running bodies[i] as version i+1.
+func newParallelMigrate(t *testing.T, bodies ...string) (*Migrate, *parallelStub) {
+	m, err := New("stub://", "stub://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations := source.NewMigrations()
+	for i, body := range bodies {
+		migrations.Append(&source.Migration{Version: uint(i + 1), Direction: source.Up, Identifier: body})
+	}
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+
+	db := &parallelStub{Stub: m.databaseDrv.(*dStub.Stub), delay: 50 * time.Millisecond}
+	m.databaseDrv = db
+	m.MaxParallel = 3
+	return m, db
+}
+
+func TestParseGroup(t *testing.T) {
+	testcases := []struct {
+		header   string
+		expected string
+	}{
+		{"-- migrate:group tables\nCREATE TABLE a (id int);", "tables"},
+		{"\n-- create a\n--migrate:group tables\nCREATE TABLE a (id int);", "tables"},
+		{"CREATE TABLE a (id int);\n-- migrate:group tables\n", ""},
+		{"-- migrate:group\nCREATE TABLE a (id int);", ""},
+		{"-- migrate:group tables and more\n", ""},
+		{"", ""},
+	}
+
+	for _, tc := range testcases {
+		if group := parseGroup([]byte(tc.header)); group != tc.expected {
+			t.Errorf("expected %q for %q, got %q", tc.expected, tc.header, group)
+		}
+	}
+}
+
+func TestUpParallelGroup(t *testing.T) {
+	m, db := newParallelMigrate(t,
+		"CREATE 1",
+		"-- migrate:group tables\nCREATE 2",
+		"-- migrate:group tables\nCREATE 3",
+		"-- migrate:group tables\nCREATE 4",
+		"-- migrate:group tables\nCREATE 5",
+		"-- migrate:group tables\nCREATE 6",
+		"-- migrate:group other\nCREATE 7",
+		"CREATE 8",
+	)
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the groups ran in parallel, 7 in a group of its own, the others
+	// one by one
+	if db.peak != 3 {
+		t.Errorf("expected 3 migrations to run at once, got %v", db.peak)
+	}
+	sort.Strings(db.ran)
+	if len(db.ran) != 6 || !strings.HasSuffix(db.ran[0], "CREATE 7") || !strings.HasSuffix(db.ran[5], "CREATE 6") {
+		t.Errorf("expected 2 to 7 to run in parallel, got %q", db.ran)
+	}
+	if !reflect.DeepEqual(db.MigrationSequence, []string{"CREATE 1", "CREATE 8"}) {
+		t.Errorf("expected 1 and 8 to run one by one, got %q", db.MigrationSequence)
+	}
+	if v, dirty, _ := db.Version(); v != 8 || dirty {
+		t.Errorf("expected clean version 8, got %v %v", v, dirty)
+	}
+	for v := 2; v <= 7; v++ {
+		if dirty, ok := db.History[v]; !ok || dirty {
+			t.Errorf("expected a clean history row for %v, got %v %v", v, dirty, ok)
+		}
+	}
+}
+
+func TestUpParallelGroupFailure(t *testing.T) {
+	m, db := newParallelMigrate(t,
+		"-- migrate:group tables\nCREATE 1",
+		"-- migrate:group tables\nFAIL 2",
+		"-- migrate:group tables\nCREATE 3",
+		"-- migrate:group tables\nCREATE 4",
+		"-- migrate:group tables\nCREATE 5",
+		"CREATE 6",
+	)
+	m.MaxParallel = 2
+
+	err := m.Up()
+	gerr, ok := err.(ErrGroupFailed)
+	if !ok {
+		t.Fatalf("expected ErrGroupFailed, got %v", err)
+	}
+	if gerr.Group != "tables" || len(gerr.Failed) != 1 || gerr.Failed[2] == nil {
+		t.Errorf("expected 2 to fail, got %v", gerr)
+	}
+	// 1 still ran when 2 failed, nothing started after that
+	if !reflect.DeepEqual(gerr.Succeeded, []uint{1}) {
+		t.Errorf("expected 1 to succeed, got %v", gerr.Succeeded)
+	}
+
+	if v, dirty, _ := db.Version(); v != 2 || !dirty {
+		t.Errorf("expected dirty version 2, got %v %v", v, dirty)
+	}
+	expected := map[int]bool{1: false, 2: true}
+	if !reflect.DeepEqual(db.History, expected) {
+		t.Errorf("expected the history %v, got %v", expected, db.History)
+	}
+	if len(db.MigrationSequence) != 0 {
+		t.Errorf("expected no migration after the group, got %q", db.MigrationSequence)
+	}
+}
+
+func TestUpParallelGroupSequential(t *testing.T) {
+	bodies := []string{"-- migrate:group tables\nCREATE 1", "-- migrate:group tables\nCREATE 2"}
+
+	// without MaxParallel ...
+	m, db := newParallelMigrate(t, bodies...)
+	m.MaxParallel = 0
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if db.peak != 0 || len(db.MigrationSequence) != 2 {
+		t.Errorf("expected the group to run one by one, got %q", db.MigrationSequence)
+	}
+
+	// ... and with a driver that can't run migrations in parallel
+	m, err := New("stub://", "stub://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations := source.NewMigrations()
+	for i, body := range bodies {
+		migrations.Append(&source.Migration{Version: uint(i + 1), Direction: source.Up, Identifier: body})
+	}
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	m.MaxParallel = 3
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := m.databaseDrv.(*dStub.Stub).MigrationSequence; !reflect.DeepEqual(seq, bodies) {
+		t.Errorf("expected the group to run one by one, got %q", seq)
+	}
+}
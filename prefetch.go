@@ -0,0 +1,98 @@
+package migrate
+
+import (
+	"sync"
+)
+
+// DefaultPrefetchBytes sets the number of bytes pre-read migrations may
+// buffer in memory together. Zero means no limit, only
+// DefaultPrefetchMigrations applies.
+var DefaultPrefetchBytes = uint(0)
+
+// prefetchLimiter bounds the bytes buffered by the pre-read migrations of a run.
+type prefetchLimiter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// limit is the number of bytes that may be buffered, 0 means no limit.
+	limit uint
+	used  uint
+
+	// peak is the most bytes ever buffered at once.
+	peak uint
+}
+
+func newPrefetchLimiter(limit uint) *prefetchLimiter {
+	l := &prefetchLimiter{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until n more bytes can be buffered and returns the number
+// of bytes acquired. A migration buffering more than the limit on its own
+// acquires the whole limit, so that it can still be buffered alone.
+func (l *prefetchLimiter) acquire(n uint) uint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit > 0 && n > l.limit {
+		n = l.limit
+	}
+	for l.limit > 0 && l.used+n > l.limit {
+		l.cond.Wait()
+	}
+
+	l.used += n
+	if l.used > l.peak {
+		l.peak = l.used
+	}
+	return n
+}
+
+// release returns n acquired bytes.
+func (l *prefetchLimiter) release(n uint) {
+	l.mu.Lock()
+	l.used -= n
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// newRun returns the channel the migrations of a run are sent through,
+// holding up to PrefetchMigrations migrations, and starts counting the
+// bytes buffered by the run against PrefetchBytes.
+func (m *Migrate) newRun() chan interface{} {
+	m.prefetchMu.Lock()
+	m.prefetch = newPrefetchLimiter(m.PrefetchBytes)
+	m.prefetchMu.Unlock()
+	return make(chan interface{}, m.PrefetchMigrations)
+}
+
+// buffer starts buffering migr in the background. Migrations are buffered
+// in the order this is called, it blocks until the migrations buffered
+// before leave enough room under PrefetchBytes.
+func (m *Migrate) buffer(migr *Migration) {
+	if migr.Body == nil {
+		go migr.Buffer()
+		return
+	}
+
+	m.prefetchMu.Lock()
+	l := m.prefetch
+	m.prefetchMu.Unlock()
+
+	n := l.acquire(migr.BufferSize)
+	go func() {
+		defer l.release(n)
+		migr.Buffer()
+	}()
+}
+
+// discard receives the migrations left in ret after a run ended early,
+// until the goroutine reading them closes ret, and discards their buffers.
+func discard(ret <-chan interface{}) {
+	for r := range ret {
+		if migr, ok := r.(*Migration); ok {
+			migr.discardBuffer()
+		}
+	}
+}
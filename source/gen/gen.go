@@ -0,0 +1,184 @@
+// Package gen generates synthetic migrations for load and soak tests, e.g.
+// of the lock, prefetching or the growth of the history table.
+//
+//	gen.Generate("testdata/soak", 5000, gen.GenOptions{Seed: 1})
+//
+// writes 5000 pairs of up and down migrations, while
+//
+//	m, err := migrate.NewWithSourceInstance("gen", gen.NewSource(5000, gen.GenOptions{Seed: 1}), dbURL)
+//
+// serves the same migrations from memory. Migration n creates the table
+// gen_n, fills it with the remaining statements and the down migration drops
+// it. The statements are generated from the seed when read, so memory
+// doesn't grow with the number of migrations.
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang-migrate/migrate/source"
+)
+
+// GenOptions configures the generated migrations.
+type GenOptions struct {
+	// Seed makes the generated statements reproducible.
+	Seed int64
+
+	// Statements is the number of statements per up migration, at least 1,
+	// the CREATE TABLE.
+	Statements int
+
+	// StatementSize pads the INSERT statements with random data to about
+	// this many bytes.
+	StatementSize int
+
+	// SleepEvery adds a statement sleeping for Sleep to every SleepEvery'th
+	// up migration. Zero adds none.
+	SleepEvery int
+	Sleep      time.Duration
+
+	// SleepStatement returns the statement sleeping for d, MySQLSleep if nil.
+	SleepStatement func(d time.Duration) string
+}
+
+// MySQLSleep returns a MySQL statement sleeping for d.
+func MySQLSleep(d time.Duration) string {
+	return fmt.Sprintf("SELECT SLEEP(%v);", d.Seconds())
+}
+
+// PostgresSleep returns a PostgreSQL statement sleeping for d.
+func PostgresSleep(d time.Duration) string {
+	return fmt.Sprintf("SELECT pg_sleep(%v);", d.Seconds())
+}
+
+// Generate writes n pairs of up and down migrations, versions 1 to n, to dir.
+func Generate(dir string, n int, opts GenOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for v := uint(1); v <= uint(n); v++ {
+		up := filepath.Join(dir, fmt.Sprintf("%v_%v.up.sql", v, identifier(v)))
+		if err := ioutil.WriteFile(up, opts.up(v), 0644); err != nil {
+			return err
+		}
+		down := filepath.Join(dir, fmt.Sprintf("%v_%v.down.sql", v, identifier(v)))
+		if err := ioutil.WriteFile(down, opts.down(v), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// identifier returns the name of migration v.
+func identifier(v uint) string {
+	return fmt.Sprintf("gen_%v", v)
+}
+
+// letters are used for the random data, so it never needs quoting.
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// up returns the up migration of version v.
+func (o GenOptions) up(v uint) []byte {
+	// every migration has its own generator, so it can be read on its own
+	r := rand.New(rand.NewSource(o.Seed + int64(v)))
+	table := identifier(v)
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "CREATE TABLE %v (id int, payload text);\n", table)
+	for i := 1; i < o.Statements; i++ {
+		prefix := fmt.Sprintf("INSERT INTO %v (id, payload) VALUES (%v, '", table, i)
+		size := o.StatementSize - len(prefix) - len("');")
+		if size < 1 {
+			size = 1
+		}
+		payload := make([]byte, size)
+		for j := range payload {
+			payload[j] = letters[r.Intn(len(letters))]
+		}
+		fmt.Fprintf(b, "%v%s');\n", prefix, payload)
+	}
+
+	if o.SleepEvery > 0 && v%uint(o.SleepEvery) == 0 {
+		sleep := o.SleepStatement
+		if sleep == nil {
+			sleep = MySQLSleep
+		}
+		b.WriteString(sleep(o.Sleep) + "\n")
+	}
+	return b.Bytes()
+}
+
+// down returns the down migration of version v.
+func (o GenOptions) down(v uint) []byte {
+	return []byte(fmt.Sprintf("DROP TABLE %v;\n", identifier(v)))
+}
+
+// Source serves n generated migrations from memory, see NewSource.
+type Source struct {
+	n    uint
+	opts GenOptions
+}
+
+// NewSource returns a source driver serving the migrations Generate writes
+// for n and opts. Pass it to migrate.NewWithSourceInstance.
+func NewSource(n int, opts GenOptions) source.Driver {
+	return &Source{n: uint(n), opts: opts}
+}
+
+// Open implements source.Driver. The source isn't registered, use NewSource.
+func (s *Source) Open(url string) (source.Driver, error) {
+	return nil, fmt.Errorf("gen: use NewSource")
+}
+
+// Close implements source.Driver.
+func (s *Source) Close() error {
+	return nil
+}
+
+// First implements source.Driver.
+func (s *Source) First() (uint, error) {
+	if s.n == 0 {
+		return 0, &os.PathError{Op: "first", Path: "gen", Err: os.ErrNotExist}
+	}
+	return 1, nil
+}
+
+// Prev implements source.Driver.
+func (s *Source) Prev(version uint) (uint, error) {
+	if version <= 1 || version > s.n {
+		return 0, &os.PathError{Op: fmt.Sprintf("prev for version %v", version), Path: "gen", Err: os.ErrNotExist}
+	}
+	return version - 1, nil
+}
+
+// Next implements source.Driver.
+func (s *Source) Next(version uint) (uint, error) {
+	if version < 1 || version >= s.n {
+		return 0, &os.PathError{Op: fmt.Sprintf("next for version %v", version), Path: "gen", Err: os.ErrNotExist}
+	}
+	return version + 1, nil
+}
+
+// ReadUp implements source.Driver.
+func (s *Source) ReadUp(version uint) (io.ReadCloser, string, error) {
+	if version < 1 || version > s.n {
+		return nil, "", &os.PathError{Op: fmt.Sprintf("read up version %v", version), Path: "gen", Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(s.opts.up(version))), identifier(version), nil
+}
+
+// ReadDown implements source.Driver.
+func (s *Source) ReadDown(version uint) (io.ReadCloser, string, error) {
+	if version < 1 || version > s.n {
+		return nil, "", &os.PathError{Op: fmt.Sprintf("read down version %v", version), Path: "gen", Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(s.opts.down(version))), identifier(version), nil
+}
@@ -0,0 +1,215 @@
+package gen
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate"
+	dStub "github.com/golang-migrate/migrate/database/stub"
+	"github.com/golang-migrate/migrate/source/file"
+)
+
+func readAll(t *testing.T, r io.ReadCloser, err error) string {
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := GenOptions{Seed: 1, Statements: 3, StatementSize: 100, SleepEvery: 2, Sleep: time.Second}
+	if err := Generate(dir, 3, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the files match the migrations served from memory
+	f, err := (&file.File{}).Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := NewSource(3, opts)
+	for v := uint(1); v <= 3; v++ {
+		r, fileID, err := f.ReadUp(v)
+		fileUp := readAll(t, r, err)
+		r, id, err := s.ReadUp(v)
+		up := readAll(t, r, err)
+		if fileUp != up || fileID != id {
+			t.Errorf("expected the file of version %v to match, got %q and %q", v, fileUp, up)
+		}
+
+		r, _, err = f.ReadDown(v)
+		fileDown := readAll(t, r, err)
+		r, _, err = s.ReadDown(v)
+		down := readAll(t, r, err)
+		if fileDown != down {
+			t.Errorf("expected the down file of version %v to match, got %q and %q", v, fileDown, down)
+		}
+	}
+}
+
+func TestGenOptions(t *testing.T) {
+	opts := GenOptions{Seed: 1, Statements: 3, StatementSize: 100, SleepEvery: 2, Sleep: 1500 * time.Millisecond}
+
+	lines := strings.Split(strings.TrimSuffix(string(opts.up(2)), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 3 statements and a sleep, got %q", lines)
+	}
+	if lines[0] != "CREATE TABLE gen_2 (id int, payload text);" {
+		t.Errorf("unexpected CREATE TABLE %q", lines[0])
+	}
+	for _, line := range lines[1:3] {
+		if !strings.HasPrefix(line, "INSERT INTO gen_2 ") || len(line) != 100 {
+			t.Errorf("expected an INSERT of 100 bytes, got %q (%v)", line, len(line))
+		}
+	}
+	if lines[3] != "SELECT SLEEP(1.5);" {
+		t.Errorf("expected a sleep, got %q", lines[3])
+	}
+	if strings.Contains(string(opts.up(1)), "SLEEP") {
+		t.Error("expected only every 2nd migration to sleep")
+	}
+
+	if string(opts.up(2)) != string(opts.up(2)) {
+		t.Error("expected the same seed to generate the same migration")
+	}
+	other := opts
+	other.Seed = 2
+	if string(opts.up(2)) == string(other.up(2)) {
+		t.Error("expected another seed to generate another migration")
+	}
+}
+
+func TestSource(t *testing.T) {
+	s := NewSource(2, GenOptions{})
+
+	if v, err := s.First(); err != nil || v != 1 {
+		t.Errorf("expected first version 1, got %v (%v)", v, err)
+	}
+	if v, err := s.Next(1); err != nil || v != 2 {
+		t.Errorf("expected next version 2, got %v (%v)", v, err)
+	}
+	if _, err := s.Next(2); !os.IsNotExist(err) {
+		t.Errorf("expected no version after 2, got %v", err)
+	}
+	if v, err := s.Prev(2); err != nil || v != 1 {
+		t.Errorf("expected previous version 1, got %v (%v)", v, err)
+	}
+	if _, err := s.Prev(1); !os.IsNotExist(err) {
+		t.Errorf("expected no version before 1, got %v", err)
+	}
+	if _, _, err := s.ReadUp(3); !os.IsNotExist(err) {
+		t.Errorf("expected no version 3, got %v", err)
+	}
+	if _, err := NewSource(0, GenOptions{}).First(); !os.IsNotExist(err) {
+		t.Errorf("expected no first version, got %v", err)
+	}
+}
+
+// soakStub checks that migrations run in order without keeping their
+// bodies, and samples the heap while they run.
+type soakStub struct {
+	*dStub.Stub
+	runs    int
+	maxHeap uint64
+	err     error
+}
+
+func (s *soakStub) Run(migration io.Reader) error {
+	b, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+
+	version, _, _ := s.Version()
+	expected := fmt.Sprintf("CREATE TABLE gen_%v ", version)
+	if strings.HasPrefix(string(b), "DROP") {
+		// the down migration of 1 sets NilVersion
+		if version < 0 {
+			version = 0
+		}
+		expected = fmt.Sprintf("DROP TABLE gen_%v;", version+1)
+	}
+	if s.err == nil && !strings.HasPrefix(string(b), expected) {
+		s.err = fmt.Errorf("expected %q, got %q", expected, strings.SplitN(string(b), "\n", 2)[0])
+	}
+
+	s.runs++
+	if s.runs%100 == 0 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > s.maxHeap {
+			s.maxHeap = stats.HeapAlloc
+		}
+	}
+	return nil
+}
+
+func TestSoakStub(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping soak test in short mode")
+	}
+
+	// 5000 migrations of about 10KB each, 50MB in total
+	n := 5000
+	opts := GenOptions{Seed: 1, Statements: 10, StatementSize: 1000}
+	db, err := (&dStub.Stub{}).Open("stub://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &soakStub{Stub: db.(*dStub.Stub)}
+	m, err := migrate.NewWithInstance("gen", NewSource(n, opts), "stub", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseHeap := stats.HeapAlloc
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if s.err != nil {
+		t.Fatal(s.err)
+	}
+	if version, dirty, err := m.Version(); err != nil || version != uint(n) || dirty {
+		t.Fatalf("expected clean version %v, got %v %v (%v)", n, version, dirty, err)
+	}
+	if s.runs != n {
+		t.Fatalf("expected %v migrations, got %v", n, s.runs)
+	}
+
+	// only the prefetched migrations are held, garbage included
+	if growth := int64(s.maxHeap) - int64(baseHeap); growth > 25<<20 {
+		t.Errorf("expected the heap to grow by less than 25MB, got %vMB", growth>>20)
+	}
+
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if s.err != nil {
+		t.Fatal(s.err)
+	}
+	if s.runs != 2*n {
+		t.Fatalf("expected %v migrations, got %v", 2*n, s.runs)
+	}
+}
@@ -0,0 +1,23 @@
+package source
+
+import (
+	"time"
+)
+
+// Metadata holds operational settings for a single migration version.
+type Metadata struct {
+	// Timeout limits how long running the migration may take.
+	// Zero means no limit.
+	Timeout time.Duration
+
+	// Retries is how often a failed migration is run again
+	// before giving up.
+	Retries int
+}
+
+// MetadataReader is an optional interface a source driver can implement
+// to provide Metadata per migration version. Metadata should return
+// an error satisfying os.IsNotExist if there is none for the version.
+type MetadataReader interface {
+	Metadata(version uint) (Metadata, error)
+}
@@ -0,0 +1,120 @@
+// Package sidecar provides a source driver decorator that reads per-migration
+// metadata from JSON files kept next to the migrations, e.g.
+//
+//	1_init.up.sql
+//	1_init.down.sql
+//	1_init.json
+package sidecar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/golang-migrate/migrate/source"
+)
+
+var ErrNilConfig = fmt.Errorf("no config")
+
+// Regex matches sidecar file names like 123_name.json.
+var Regex = regexp.MustCompile(`^([0-9]+)_(.*)\.json$`)
+
+type Config struct {
+	// Path is the directory holding the sidecar files.
+	Path string
+}
+
+// sidecarFile is the JSON representation of a sidecar file.
+// Timeout uses time.ParseDuration syntax, e.g. "30s". Unknown keys are
+// rejected, so a setting isn't silently ignored.
+type sidecarFile struct {
+	Timeout string `json:"timeout"`
+	Retries int    `json:"retries"`
+}
+
+// Sidecar wraps a source.Driver and implements source.MetadataReader.
+type Sidecar struct {
+	source.Driver
+	metadata map[uint]source.Metadata
+}
+
+// WithInstance reads all sidecar files in config.Path and returns
+// a driver that serves migrations from instance along with their metadata.
+func WithInstance(instance source.Driver, config *Config) (source.Driver, error) {
+	if config == nil {
+		return nil, ErrNilConfig
+	}
+
+	files, err := ioutil.ReadDir(config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sidecar{
+		Driver:   instance,
+		metadata: make(map[uint]source.Metadata),
+	}
+
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		m := Regex.FindStringSubmatch(fi.Name())
+		if len(m) != 3 {
+			continue // ignore files that we can't parse
+		}
+		version, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := s.metadata[uint(version)]; ok {
+			return nil, fmt.Errorf("duplicate sidecar for version %v", version)
+		}
+		md, err := readFile(filepath.Join(config.Path, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s.metadata[uint(version)] = md
+	}
+
+	return s, nil
+}
+
+func readFile(name string) (source.Metadata, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return source.Metadata{}, err
+	}
+
+	var f sidecarFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return source.Metadata{}, fmt.Errorf("%v: %v", name, err)
+	}
+
+	md := source.Metadata{Retries: f.Retries}
+	if md.Retries < 0 {
+		return source.Metadata{}, fmt.Errorf("%v: retries must not be negative", name)
+	}
+	if len(f.Timeout) > 0 {
+		if md.Timeout, err = time.ParseDuration(f.Timeout); err != nil {
+			return source.Metadata{}, fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return md, nil
+}
+
+// Metadata returns the metadata read from the sidecar file for version.
+func (s *Sidecar) Metadata(version uint) (source.Metadata, error) {
+	if md, ok := s.metadata[version]; ok {
+		return md, nil
+	}
+	return source.Metadata{}, &os.PathError{Op: fmt.Sprintf("read metadata for version %v", version), Err: os.ErrNotExist}
+}
@@ -0,0 +1,98 @@
+package sidecar
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate/source"
+	"github.com/golang-migrate/migrate/source/stub"
+)
+
+func TestWithInstance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"0001_init.json":   `{"timeout": "1m30s", "retries": 2}`,
+		"2_users.json":     `{"retries": 1}`,
+		"3_users.up.sql":   `CREATE TABLE users ()`,
+		"notes.json":       `{"timeout": "invalid"}`,
+		"4_empty.json.bak": `{}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sInst, _ := stub.WithInstance(nil, &stub.Config{})
+	d, err := WithInstance(sInst, &Config{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := d.(source.MetadataReader)
+
+	testcases := []struct {
+		version  uint
+		expected source.Metadata
+		notExist bool
+	}{
+		{version: 1, expected: source.Metadata{Timeout: 90 * time.Second, Retries: 2}},
+		{version: 2, expected: source.Metadata{Retries: 1}},
+		{version: 3, notExist: true},
+		{version: 4, notExist: true},
+	}
+
+	for _, tc := range testcases {
+		md, err := mr.Metadata(tc.version)
+		if tc.notExist {
+			if !os.IsNotExist(err) {
+				t.Errorf("expected not exist error for version %v, got %v", tc.version, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md != tc.expected {
+			t.Errorf("expected %+v for version %v, got %+v", tc.expected, tc.version, md)
+		}
+	}
+}
+
+func TestWithInstanceInvalid(t *testing.T) {
+	testcases := []struct {
+		name    string
+		content string
+	}{
+		{name: "invalid json", content: `{"timeout": `},
+		{name: "invalid timeout", content: `{"timeout": "soon"}`},
+		{name: "negative retries", content: `{"retries": -1}`},
+		{name: "unknown key", content: `{"online-ddl": true}`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sidecar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if err := ioutil.WriteFile(filepath.Join(dir, "1_init.json"), []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			sInst, _ := stub.WithInstance(nil, &stub.Config{})
+			if _, err := WithInstance(sInst, &Config{Path: dir}); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
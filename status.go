@@ -0,0 +1,69 @@
+package migrate
+
+import (
+	"os"
+	"sync/atomic"
+
+	"github.com/golang-migrate/migrate/database"
+)
+
+// Status is a snapshot of the migration state, see Migrate.Status.
+type Status struct {
+	// Version is the active migration version, -1 if there is none.
+	Version int
+	Dirty   bool
+
+	// Pending is the number of migrations in the source after Version.
+	Pending int
+
+	// Running is true while Migrate, Steps, Up, Down or Run runs.
+	Running bool
+
+	// LastError is the error of the last run that ended, nil if it
+	// succeeded, found nothing to change or no run ended yet.
+	LastError error
+}
+
+// Status returns the migration state. It doesn't take the lock, so it
+// can be called while migrations run, and reads the version with a single
+// call of the database driver, so it's cheap enough for health checks.
+func (m *Migrate) Status() (Status, error) {
+	s := Status{Running: atomic.LoadInt32(&m.running) > 0}
+
+	m.lastRunMu.Lock()
+	s.LastError = m.lastRunErr
+	m.lastRunMu.Unlock()
+
+	version, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return s, err
+	}
+	s.Version = version
+	s.Dirty = dirty
+
+	if s.Pending, err = m.countPending(version); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// countPending returns the number of migrations in the source after version.
+func (m *Migrate) countPending(version int) (int, error) {
+	var v uint
+	var err error
+	if version == database.NilVersion {
+		v, err = m.sourceDrv.First()
+	} else {
+		v, err = m.sourceDrv.Next(suint(version))
+	}
+
+	count := 0
+	for err == nil {
+		count++
+		v, err = m.sourceDrv.Next(v)
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	return count, nil
+}
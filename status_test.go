@@ -0,0 +1,65 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+
+	dStub "github.com/golang-migrate/migrate/database/stub"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+func TestStatus(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	db := &slowStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = db
+
+	expectStatus := func(expected Status) {
+		t.Helper()
+		s, err := m.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != expected {
+			t.Errorf("expected %+v, got %+v", expected, s)
+		}
+	}
+
+	// version 5 only has a down migration, but is pending too
+	expectStatus(Status{Version: -1, Pending: 5})
+
+	if err := m.Steps(2); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(Status{Version: 3, Pending: 3})
+
+	// a failed run is reported until the next run ends
+	db.failures = 1
+	err := m.Steps(1)
+	if err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	expectStatus(Status{Version: 4, Dirty: true, Pending: 2, LastError: err})
+
+	if err := m.Force(3); err != nil {
+		t.Fatal(err)
+	}
+	db.delay = 50 * time.Millisecond
+	done := make(chan error, 1)
+	go func() { done <- m.Up() }()
+
+	time.Sleep(10 * time.Millisecond)
+	if s, err := m.Status(); err != nil || !s.Running {
+		t.Errorf("expected a running run, got %+v (%v)", s, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(Status{Version: 7})
+
+	// finding nothing to change isn't an error
+	if err := m.Up(); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	expectStatus(Status{Version: 7})
+}
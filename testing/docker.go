@@ -20,6 +20,12 @@ import (
 )
 
 func NewDockerContainer(t testing.TB, image string, env []string, cmd []string) (*DockerContainer, error) {
+	return NewDockerContainerWithBinds(t, image, env, cmd, nil)
+}
+
+// NewDockerContainerWithBinds is like NewDockerContainer, but mounts binds
+// into the container.
+func NewDockerContainerWithBinds(t testing.TB, image string, env []string, cmd []string, binds []string) (*DockerContainer, error) {
 	c, err := dockerclient.NewEnvClient()
 	if err != nil {
 		return nil, err
@@ -35,6 +41,7 @@ func NewDockerContainer(t testing.TB, image string, env []string, cmd []string)
 		ImageName: image,
 		ENV:       env,
 		Cmd:       cmd,
+		Binds:     binds,
 	}
 
 	if err := contr.PullImage(); err != nil {
@@ -55,6 +62,7 @@ type DockerContainer struct {
 	ImageName          string
 	ENV                []string
 	Cmd                []string
+	Binds              []string
 	ContainerId        string
 	ContainerName      string
 	ContainerJSON      dockertypes.ContainerJSON
@@ -104,6 +112,7 @@ func (d *DockerContainer) Start() error {
 		},
 		&dockercontainer.HostConfig{
 			PublishAllPorts: true,
+			Binds:           d.Binds,
 		},
 		&dockernetwork.NetworkingConfig{},
 		containerName)
@@ -18,6 +18,9 @@ type Version struct {
 	Image string
 	ENV   []string
 	Cmd   []string
+
+	// Binds are mounted into the container, e.g. "/host/dir:/container/dir:ro".
+	Binds []string
 }
 
 func ParallelTest(t *testing.T, versions []Version, readyFn IsReadyFunc, testFn TestFunc) {
@@ -39,7 +42,7 @@ func ParallelTest(t *testing.T, versions []Version, readyFn IsReadyFunc, testFn
 				t.Parallel()
 
 				// create new container
-				container, err := NewDockerContainer(t, version.Image, version.ENV, version.Cmd)
+				container, err := NewDockerContainerWithBinds(t, version.Image, version.ENV, version.Cmd, version.Binds)
 				if err != nil {
 					t.Fatalf("%v\n%s", err, containerLogs(t, container))
 				}
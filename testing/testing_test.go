@@ -1,20 +1,71 @@
 package testing
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
-func ExampleParallelTest(t *testing.T) {
+func ExampleParallelTest() {
+	// t is *testing.T coming from parent Test(t *testing.T)
+	var t *testing.T
+
 	var isReady = func(i Instance) bool {
 		// Return true if Instance is ready to run tests.
 		// Don't block here though.
 		return true
 	}
 
-	// t is *testing.T coming from parent Test(t *testing.T)
 	ParallelTest(t, []Version{{Image: "docker_image:9.6"}}, isReady,
 		func(t *testing.T, i Instance) {
 			// Run your test/s ...
 			t.Fatal("...")
 		})
 }
+
+func TestNewCerts(t *testing.T) {
+	certs, err := NewCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certs.Dir)
+
+	caPEM, err := ioutil.ReadFile(certs.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("expected a CA certificate")
+	}
+
+	testcases := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		opts     x509.VerifyOptions
+	}{
+		{name: "server", certFile: certs.ServerCert, keyFile: certs.ServerKey,
+			opts: x509.VerifyOptions{Roots: roots, DNSName: "127.0.0.1"}},
+		{name: "client", certFile: certs.ClientCert, keyFile: certs.ClientKey,
+			opts: x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			pair, err := tls.LoadX509KeyPair(tc.certFile, tc.keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := x509.ParseCertificate(pair.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cert.Verify(tc.opts); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
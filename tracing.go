@@ -0,0 +1,66 @@
+package migrate
+
+import (
+	"sync/atomic"
+
+	"github.com/golang-migrate/migrate/database"
+)
+
+// Tracer receives the start of runs, lock acquisitions and migrations of a
+// Migrate instance, see Migrate.Tracer. A run is a single call of Migrate,
+// Steps, Up, Down or Run. Each method returns a function that is called
+// with the outcome, nil on success, once the operation ended.
+// See the tracing/otel package for an OpenTelemetry implementation.
+type Tracer interface {
+	// StartRun is called before a run acquires the lock. name is the
+	// lower case name of the method, e.g. "up".
+	StartRun(name string) (end func(err error))
+
+	// StartLock is called before acquiring the database lock.
+	StartLock() (end func(err error))
+
+	// StartMigration is called before a migration is applied. statements
+	// is the number of statements in the migration body.
+	StartMigration(migr *Migration, statements int) (end func(err error))
+}
+
+// startRun records the start of a run for Status and starts tracing it if
+// m.Tracer is set. Call the returned function with a pointer to the run's
+// error once the run ended.
+func (m *Migrate) startRun(name string) func(err *error) {
+	atomic.AddInt32(&m.running, 1)
+
+	var end func(err error)
+	if m.Tracer != nil {
+		end = m.Tracer.StartRun(name)
+	}
+
+	return func(err *error) {
+		runErr := *err
+		if runErr == ErrNoChange {
+			runErr = nil
+		}
+		m.lastRunMu.Lock()
+		m.lastRunErr = runErr
+		m.lastRunMu.Unlock()
+		atomic.AddInt32(&m.running, -1)
+
+		if end != nil {
+			end(*err)
+		}
+	}
+}
+
+// countStatements returns the number of statements in body.
+func countStatements(body *bodyBuffer) (int, error) {
+	if body == nil {
+		return 0, nil
+	}
+
+	n := 0
+	scanner := database.NewStatementScanner(body.Reader(), database.GenericOptions)
+	for scanner.Scan() {
+		n++
+	}
+	return n, scanner.Err()
+}
@@ -0,0 +1,106 @@
+// Package otel provides a migrate.Tracer creating OpenTelemetry spans.
+//
+//	m.Tracer = otel.New(ctx, tp)
+//
+// Every run gets a span named after the method, e.g. migrate.up, with child
+// spans for acquiring the lock (migrate.lock) and for each migration
+// (migrate.migration). Migration spans have these attributes:
+//
+//	migrate.version     version of the migration
+//	migrate.identifier  identifier of the migration in the source
+//	migrate.direction   up or down
+//	migrate.statements  number of statements in the migration
+package otel
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang-migrate/migrate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName is the name the tracer is obtained with.
+const InstrumentationName = "github.com/golang-migrate/migrate"
+
+// Tracer implements migrate.Tracer.
+type Tracer struct {
+	tracer trace.Tracer
+	parent context.Context
+
+	mu  sync.Mutex
+	run context.Context
+}
+
+// New returns a Tracer creating spans with a tracer from tp. The spans of
+// runs are children of the span in ctx, if any. Since Migrate doesn't take
+// a context, yet, this is how the caller's trace is continued.
+func New(ctx context.Context, tp trace.TracerProvider) *Tracer {
+	return &Tracer{
+		tracer: tp.Tracer(InstrumentationName),
+		parent: ctx,
+	}
+}
+
+// StartRun implements migrate.Tracer.
+func (t *Tracer) StartRun(name string) func(err error) {
+	ctx, span := t.tracer.Start(t.parent, "migrate."+name)
+
+	t.mu.Lock()
+	t.run = ctx
+	t.mu.Unlock()
+
+	return func(err error) {
+		t.mu.Lock()
+		t.run = nil
+		t.mu.Unlock()
+
+		end(span, err)
+	}
+}
+
+// StartLock implements migrate.Tracer.
+func (t *Tracer) StartLock() func(err error) {
+	_, span := t.tracer.Start(t.context(), "migrate.lock")
+	return func(err error) { end(span, err) }
+}
+
+// StartMigration implements migrate.Tracer.
+func (t *Tracer) StartMigration(migr *migrate.Migration, statements int) func(err error) {
+	direction := "up"
+	if migr.TargetVersion < int(migr.Version) {
+		direction = "down"
+	}
+
+	_, span := t.tracer.Start(t.context(), "migrate.migration", trace.WithAttributes(
+		attribute.Int64("migrate.version", int64(migr.Version)),
+		attribute.String("migrate.identifier", migr.Identifier),
+		attribute.String("migrate.direction", direction),
+		attribute.Int("migrate.statements", statements),
+	))
+	return func(err error) { end(span, err) }
+}
+
+// context returns the context of the current run, or the parent context
+// if there is none, e.g. for a lock taken by Drop.
+func (t *Tracer) context() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.run != nil {
+		return t.run
+	}
+	return t.parent
+}
+
+// end records err on span, unless it's nil or migrate.ErrNoChange,
+// and ends it.
+func end(span trace.Span, err error) {
+	if err != nil && err != migrate.ErrNoChange {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,118 @@
+package otel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang-migrate/migrate"
+	_ "github.com/golang-migrate/migrate/database/stub"
+	"github.com/golang-migrate/migrate/source"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	ctx, deploy := tp.Tracer("deploy").Start(context.Background(), "deploy")
+
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1; CREATE 2"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP 1"})
+
+	sInst, _ := sStub.WithInstance(nil, &sStub.Config{})
+	sInst.(*sStub.Stub).Migrations = migrations
+
+	m, err := migrate.NewWithSourceInstance("stub", sInst, "stub://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Tracer = New(ctx, tp)
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != migrate.ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	deploy.End()
+
+	spans := sr.Ended()
+	expected := []string{
+		"migrate.lock", "migrate.migration", "migrate.up",
+		"migrate.lock", "migrate.up",
+		"migrate.lock", "migrate.migration", "migrate.down",
+		"deploy",
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %v spans, got %v", len(expected), len(spans))
+	}
+	for i, name := range expected {
+		if spans[i].Name() != name {
+			t.Errorf("expected span %v to be %v, got %v", i, name, spans[i].Name())
+		}
+		if spans[i].Status().Code == codes.Error {
+			t.Errorf("expected span %v not to fail", i)
+		}
+	}
+
+	// runs are children of the caller's span, locks and migrations of the run
+	if spans[2].Parent().SpanID() != deploy.SpanContext().SpanID() {
+		t.Error("expected the run to be a child of the caller's span")
+	}
+	for _, i := range []int{0, 1} {
+		if spans[i].Parent().SpanID() != spans[2].SpanContext().SpanID() {
+			t.Errorf("expected span %v to be a child of the run", i)
+		}
+	}
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans[6].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if v := attrs["migrate.version"].AsInt64(); v != 1 {
+		t.Errorf("expected version 1, got %v", v)
+	}
+	if v := attrs["migrate.identifier"].AsString(); v != "1.down.stub" {
+		t.Errorf("expected identifier 1.down.stub, got %v", v)
+	}
+	if v := attrs["migrate.direction"].AsString(); v != "down" {
+		t.Errorf("expected direction down, got %v", v)
+	}
+	for _, kv := range spans[1].Attributes() {
+		if kv.Key == "migrate.statements" && kv.Value.AsInt64() != 2 {
+			t.Errorf("expected 2 statements, got %v", kv.Value.AsInt64())
+		}
+	}
+}
+
+func TestTracerError(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	m, err := migrate.New("stub://", "stub://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Tracer = New(context.Background(), tp)
+
+	if err := m.Migrate(1); err == nil {
+		t.Fatal("expected error migrating to a missing version")
+	}
+
+	spans := sr.Ended()
+	run := spans[len(spans)-1]
+	if run.Name() != "migrate.migrate" {
+		t.Fatalf("expected migrate.migrate span, got %v", run.Name())
+	}
+	if run.Status().Code != codes.Error {
+		t.Error("expected the run span to fail")
+	}
+}
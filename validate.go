@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-migrate/migrate/source"
+)
+
+// VersionGap is a range of missing migration versions. From and To are inclusive.
+type VersionGap struct {
+	From uint
+	To   uint
+}
+
+// String implements string.Stringer.
+func (g VersionGap) String() string {
+	if g.From == g.To {
+		return fmt.Sprintf("%v", g.From)
+	}
+	return fmt.Sprintf("%v-%v", g.From, g.To)
+}
+
+// ErrNotContiguous is returned by ValidateContiguous if the
+// migration versions don't form a contiguous sequence.
+type ErrNotContiguous struct {
+	Gaps []VersionGap
+}
+
+// Error implements the error interface.
+func (e ErrNotContiguous) Error() string {
+	gaps := make([]string, 0, len(e.Gaps))
+	for _, g := range e.Gaps {
+		gaps = append(gaps, g.String())
+	}
+	return fmt.Sprintf("migration versions are not contiguous, missing %v", strings.Join(gaps, ", "))
+}
+
+// ValidateContiguous checks that the versions of the migrations found in
+// sourceDrv form a contiguous sequence, starting at the lowest version.
+// It returns ErrNotContiguous listing the gaps otherwise.
+func ValidateContiguous(sourceDrv source.Driver) error {
+	first, err := sourceDrv.First()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return validateContiguous(sourceDrv, first, first)
+}
+
+// ValidateContiguousFrom is like ValidateContiguous, but the sequence
+// has to start at version start.
+func ValidateContiguousFrom(sourceDrv source.Driver, start uint) error {
+	first, err := sourceDrv.First()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if first < start {
+		return fmt.Errorf("migration version %v is lower than the start version %v", first, start)
+	}
+	return validateContiguous(sourceDrv, start, first)
+}
+
+func validateContiguous(sourceDrv source.Driver, start, first uint) error {
+	gaps := make([]VersionGap, 0)
+	if first > start {
+		gaps = append(gaps, VersionGap{From: start, To: first - 1})
+	}
+
+	for v := first; ; {
+		next, err := sourceDrv.Next(v)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if next > v+1 {
+			gaps = append(gaps, VersionGap{From: v + 1, To: next - 1})
+		}
+		v = next
+	}
+
+	if len(gaps) > 0 {
+		return ErrNotContiguous{Gaps: gaps}
+	}
+	return nil
+}
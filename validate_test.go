@@ -0,0 +1,66 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang-migrate/migrate/source"
+	sStub "github.com/golang-migrate/migrate/source/stub"
+)
+
+func TestValidateContiguous(t *testing.T) {
+	contiguous := source.NewMigrations()
+	contiguous.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	contiguous.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	contiguous.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "DROP 2"})
+	contiguous.Append(&source.Migration{Version: 3, Direction: source.Down, Identifier: "DROP 3"})
+
+	testcases := []struct {
+		name       string
+		migrations *source.Migrations
+		start      uint
+		useStart   bool
+		expected   error
+	}{
+		{name: "empty", migrations: source.NewMigrations()},
+		{name: "contiguous", migrations: contiguous},
+		{name: "contiguous from start", migrations: contiguous, start: 1, useStart: true},
+		{name: "gapped", migrations: sourceStubMigrations,
+			expected: ErrNotContiguous{Gaps: []VersionGap{{From: 2, To: 2}, {From: 6, To: 6}}}},
+		{name: "gap before first", migrations: contiguous, start: 0, useStart: true,
+			expected: ErrNotContiguous{Gaps: []VersionGap{{From: 0, To: 0}}}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := sStub.WithInstance(nil, &sStub.Config{})
+			s.(*sStub.Stub).Migrations = tc.migrations
+
+			var err error
+			if tc.useStart {
+				err = ValidateContiguousFrom(s, tc.start)
+			} else {
+				err = ValidateContiguous(s)
+			}
+			if !reflect.DeepEqual(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestValidateContiguousFromLowerVersion(t *testing.T) {
+	s, _ := sStub.WithInstance(nil, &sStub.Config{})
+	s.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	if err := ValidateContiguousFrom(s, 3); err == nil {
+		t.Error("expected error for version lower than start")
+	}
+}
+
+func TestErrNotContiguous(t *testing.T) {
+	err := ErrNotContiguous{Gaps: []VersionGap{{From: 2, To: 2}, {From: 5, To: 9}}}
+	if expected := "migration versions are not contiguous, missing 2, 5-9"; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}